@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// accessLogFormat is the Apache log format access lines are written in.
+type accessLogFormat string
+
+const (
+	// %h %l %u %t "%r" %>s %b
+	accessCommon accessLogFormat = "common"
+	// common, then "%{Referer}i" "%{User-agent}i"
+	accessCombined accessLogFormat = "combined"
+)
+
+func parseAccessLogFormat(s string) (accessLogFormat, error) {
+	switch f := accessLogFormat(strings.ToLower(s)); f {
+	case "", accessCommon, accessCombined:
+		return f, nil
+	}
+	return "", fmt.Errorf("accessLog: unknown format %q", s)
+}
+
+// accessLogger writes a line per request. With duration set, each line
+// ends with the time taken in microseconds, like Apache's %D.
+type accessLogger struct {
+	out      *log.Logger
+	format   accessLogFormat
+	duration bool
+	proxies  trustedProxies
+}
+
+// withAccessLog logs every request next serves. An empty format turns
+// access logging off.
+func withAccessLog(next http.Handler, l accessLogger) http.Handler {
+	if l.format == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		begin := time.Now()
+		rec := &recordingWriter{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		l.out.Print(l.line(r, rec.status, rec.bytes, begin, time.Since(begin)))
+	})
+}
+
+func newAccessLogger(w io.Writer, format accessLogFormat, duration bool, proxies trustedProxies) accessLogger {
+	return accessLogger{out: log.New(w, "", 0), format: format, duration: duration, proxies: proxies}
+}
+
+func (l accessLogger) line(r *http.Request, status int, bytes int64, begin time.Time, took time.Duration) string {
+	user := "-"
+	if u, _, ok := r.BasicAuth(); ok && u != "" {
+		user = accessEscape(u)
+	}
+	if status == 0 {
+		status = http.StatusOK
+	}
+	size := "-"
+	if bytes > 0 {
+		size = fmt.Sprint(bytes)
+	}
+	line := fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %s",
+		l.proxies.clientIP(r), user, begin.Format("02/Jan/2006:15:04:05 -0700"),
+		accessEscape(r.Method), accessEscape(r.RequestURI), accessEscape(r.Proto), status, size)
+	if l.format == accessCombined {
+		line += fmt.Sprintf(" \"%s\" \"%s\"", accessField(r.Referer()), accessField(r.UserAgent()))
+	}
+	if l.duration {
+		line += fmt.Sprintf(" %d", took.Microseconds())
+	}
+	return line
+}
+
+// accessField is a quoted header value, or "-" when it is absent.
+func accessField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return accessEscape(s)
+}
+
+// accessEscape backslash-escapes quotes, backslashes and control characters
+// the way Apache does, so a client can't forge or split log lines.
+func accessEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// recordingWriter notes the status and size of a response as it is
+// written. Unwrap lets http.ResponseController reach the underlying
+// writer, so streams can still flush.
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *recordingWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *recordingWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
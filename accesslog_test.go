@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestAccessLogFormats(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("short and stout"))
+	})
+	const common = `^192\.0\.2\.1 - alice \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "GET /weather/London\?units=C HTTP/1\.1" 418 15`
+	for _, tt := range []struct {
+		format   accessLogFormat
+		duration bool
+		want     string
+	}{
+		{accessCommon, false, common + `$`},
+		{accessCombined, false, common + ` "http://example\.com/" "curl/8\.0"$`},
+		{accessCommon, true, common + ` \d+$`},
+	} {
+		var buf bytes.Buffer
+		h := withAccessLog(handler, newAccessLogger(&buf, tt.format, tt.duration, nil))
+		req := httptest.NewRequest("GET", "/weather/London?units=C", nil)
+		req.SetBasicAuth("alice", "secret")
+		req.Header.Set("Referer", "http://example.com/")
+		req.Header.Set("User-Agent", "curl/8.0")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+
+		line := strings.TrimSuffix(buf.String(), "\n")
+		if !regexp.MustCompile(tt.want).MatchString(line) {
+			t.Errorf("%s (duration %t): got %q, want %s", tt.format, tt.duration, line, tt.want)
+		}
+	}
+}
+
+func TestAccessLogDefaults(t *testing.T) {
+	var buf bytes.Buffer
+	h := withAccessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		newAccessLogger(&buf, accessCombined, false, nil))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/healthz", nil))
+
+	// No user, no body, no referer or user agent: each is a "-", and the
+	// implicit status is 200.
+	if want := `"GET /healthz HTTP/1.1" 200 - "-" "-"`; !strings.HasSuffix(strings.TrimSpace(buf.String()), want) {
+		t.Errorf("got %q, want it to end %q", buf.String(), want)
+	}
+	if !strings.HasPrefix(buf.String(), "192.0.2.1 - - [") {
+		t.Errorf("got %q, want an anonymous user", buf.String())
+	}
+}
+
+func TestAccessLogEscaping(t *testing.T) {
+	var buf bytes.Buffer
+	h := withAccessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		newAccessLogger(&buf, accessCombined, false, nil))
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("User-Agent", "evil\" \"forged\n127.0.0.1 - - [")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	if strings.Count(buf.String(), "\n") != 1 {
+		t.Errorf("a header split the line: %q", buf.String())
+	}
+	if want := `"evil\" \"forged\x0a127.0.0.1 - - ["`; !strings.Contains(buf.String(), want) {
+		t.Errorf("got %q, want the user agent escaped as %s", buf.String(), want)
+	}
+}
+
+func TestAccessLogProxiedClient(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"192.0.2.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	h := withAccessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		newAccessLogger(&buf, accessCommon, false, proxies))
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Forwarded-For", "203.0.113.9")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	if !strings.HasPrefix(buf.String(), "203.0.113.9 ") {
+		t.Errorf("got %q, want the forwarded client address", buf.String())
+	}
+}
+
+func TestParseAccessLogFormat(t *testing.T) {
+	for in, want := range map[string]accessLogFormat{"": "", "Common": accessCommon, "combined": accessCombined} {
+		if got, err := parseAccessLogFormat(in); err != nil || got != want {
+			t.Errorf("parseAccessLogFormat(%q) = %q, %v, want %q", in, got, err, want)
+		}
+	}
+	if _, err := parseAccessLogFormat("json"); err == nil {
+		t.Error("an unknown format was accepted")
+	}
+}
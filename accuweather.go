@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// accuWeather looks up AccuWeather's location key for a place before it can
+// fetch current conditions. Locations are cached, so the extra hop is only
+// paid once per place.
+type accuWeather struct {
+	apiKey    string
+	locations *locationCache[accuLocation]
+	header    http.Header
+	query     url.Values
+}
+
+// accuLocation is what accuWeather keeps of a location lookup.
+type accuLocation struct {
+	Key           string `json:"Key"`
+	LocalizedName string `json:"LocalizedName"`
+	Country       struct {
+		ID string `json:"ID"` // e.g. "GB"
+	} `json:"Country"`
+	GeoPosition struct {
+		Elevation *struct {
+			Metric struct {
+				Value float64 `json:"Value"` // m
+			} `json:"Metric"`
+		} `json:"Elevation"`
+	} `json:"GeoPosition"`
+}
+
+// place names the location as, for example, "London, GB".
+func (l accuLocation) place() string {
+	if l.LocalizedName == "" || l.Country.ID == "" {
+		return l.LocalizedName
+	}
+	return l.LocalizedName + ", " + l.Country.ID
+}
+
+func newAccuWeather(pc providerConfig, env providerEnv) (weatherProvider, error) {
+	if pc.ApiKey == "" {
+		return nil, errors.New("accuweather: apiKey is required")
+	}
+	return accuWeather{apiKey: pc.ApiKey, locations: newLocationCache[accuLocation](0), header: pc.header(), query: pc.query()}, nil
+}
+
+func (w accuWeather) name() string { return "accuWeather" }
+
+func (w accuWeather) origins() []string { return []string{"http://dataservice.accuweather.com"} }
+
+func (w accuWeather) temperature(ctx context.Context, city string) (reading, error) {
+	begin := time.Now()
+
+	loc, ok := w.locations.get(city)
+	if !ok {
+		var locations []accuLocation
+		if err := getJSONWith(ctx, "http://dataservice.accuweather.com/locations/v1/cities/search?apikey="+w.apiKey+"&q="+url.QueryEscape(city), w.header, w.query, &locations); err != nil {
+			return reading{}, fmt.Errorf("accuWeather: location lookup failed: %w", err)
+		}
+		if len(locations) == 0 {
+			return reading{}, fmt.Errorf("accuWeather: no location for %q", city)
+		}
+		loc = locations[0]
+		w.locations.set(city, loc)
+	}
+
+	r, err := w.current(ctx, loc)
+	if err != nil {
+		return reading{}, err
+	}
+	logReading(ctx, "accuWeather: %s: %.2f; took %s", city, r.celsius, time.Since(begin).String())
+	return r, nil
+}
+
+func (w accuWeather) temperatureAt(ctx context.Context, p point) (reading, error) {
+	loc, ok := w.locations.get(p.String())
+	if !ok {
+		if err := getJSONWith(ctx, "http://dataservice.accuweather.com/locations/v1/cities/geoposition/search?apikey="+w.apiKey+"&q="+p.String(), w.header, w.query, &loc); err != nil {
+			return reading{}, fmt.Errorf("accuWeather: location lookup failed: %w", err)
+		}
+		if loc.Key == "" {
+			return reading{}, fmt.Errorf("accuWeather: no location at %s", p)
+		}
+		w.locations.set(p.String(), loc)
+	}
+	return w.current(ctx, loc)
+}
+
+func (w accuWeather) current(ctx context.Context, loc accuLocation) (reading, error) {
+	type metric struct {
+		Metric struct {
+			Value float64 `json:"Value"`
+		} `json:"Metric"`
+	}
+	var conditions []struct {
+		WeatherText         string   `json:"WeatherText"`
+		WeatherIcon         int      `json:"WeatherIcon"`
+		EpochTime           int64    `json:"EpochTime"`
+		Temperature         metric   `json:"Temperature"`
+		RealFeelTemperature *metric  `json:"RealFeelTemperature"`
+		Pressure            *metric  `json:"Pressure"`
+		UVIndex             *float64 `json:"UVIndex"`
+		CloudCover          *float64 `json:"CloudCover"` // percent
+		Wind                *struct {
+			Direction struct {
+				Degrees float64 `json:"Degrees"`
+			} `json:"Direction"`
+			Speed metric `json:"Speed"` // km/h
+		} `json:"Wind"`
+	}
+	if err := getJSONWith(ctx, "http://dataservice.accuweather.com/currentconditions/v1/"+url.PathEscape(loc.Key)+"?details=true&apikey="+w.apiKey, w.header, w.query, &conditions); err != nil {
+		return reading{}, fmt.Errorf("accuWeather: weather fetch failed: %w", err)
+	}
+	if len(conditions) == 0 {
+		return reading{}, fmt.Errorf("accuWeather: no current conditions for location %s", loc.Key)
+	}
+
+	c := conditions[0]
+	r := reading{place: loc.place(), celsius: c.Temperature.Metric.Value, native: nativeTemp{c.Temperature.Metric.Value, celsius}, condition: c.WeatherText, icon: accuWeatherIcons[c.WeatherIcon], uvIndex: c.UVIndex, cloudCover: c.CloudCover}
+	if c.RealFeelTemperature != nil {
+		feelsLike := c.RealFeelTemperature.Metric.Value
+		r.feelsLike = &feelsLike
+	}
+	if c.Pressure != nil {
+		pressure := c.Pressure.Metric.Value
+		r.pressure = &pressure
+	}
+	if c.Wind != nil {
+		speed, bearing := c.Wind.Speed.Metric.Value/3.6, c.Wind.Direction.Degrees
+		r.windSpeed, r.windBearing = &speed, &bearing
+	}
+	if c.EpochTime > 0 {
+		r.observed = time.Unix(c.EpochTime, 0)
+	}
+	if e := loc.GeoPosition.Elevation; e != nil {
+		elevation := e.Metric.Value
+		r.elevation = &elevation
+	}
+	return r, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestAccuWeather(t *testing.T) {
+	var lookups, fetches atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/locations/v1/cities/search", func(w http.ResponseWriter, r *http.Request) {
+		lookups.Add(1)
+		if r.URL.Query().Get("q") != "London" || r.URL.Query().Get("apikey") != "key" {
+			t.Errorf("location lookup %s", r.URL)
+		}
+		w.Write([]byte(`[{"Key":"328328","LocalizedName":"London","Country":{"ID":"GB"},"GeoPosition":{"Elevation":{"Metric":{"Value":25}}}}]`))
+	})
+	mux.HandleFunc("/currentconditions/v1/328328", func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Write([]byte(`[{"WeatherText":"Cloudy","WeatherIcon":7,"EpochTime":1700000000,
+			"Temperature":{"Metric":{"Value":12.5}},"RealFeelTemperature":{"Metric":{"Value":10}},
+			"Wind":{"Direction":{"Degrees":270},"Speed":{"Metric":{"Value":36}}}}]`))
+	})
+	stubUpstream(t, mux)
+
+	p, err := newAccuWeather(providerConfig{ApiKey: "key"}, providerEnv{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		r, err := p.temperature(context.Background(), "London")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.celsius != 12.5 || r.place != "London, GB" || r.condition != "Cloudy" || *r.feelsLike != 10 || *r.windSpeed != 10 || *r.elevation != 25 {
+			t.Errorf("reading %+v", r)
+		}
+	}
+	if lookups.Load() != 1 || fetches.Load() != 2 {
+		t.Errorf("%d location lookups and %d fetches, want the location cached", lookups.Load(), fetches.Load())
+	}
+}
+
+func TestAccuWeatherErrors(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/locations/v1/cities/search", func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("q") {
+		case "Atlantis":
+			w.Write([]byte(`[]`))
+		case "Broken":
+			http.Error(w, "no", http.StatusServiceUnavailable)
+		default:
+			w.Write([]byte(`[{"Key":"1"}]`))
+		}
+	})
+	mux.HandleFunc("/currentconditions/v1/1", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[]`))
+	})
+	stubUpstream(t, mux)
+
+	p, _ := newAccuWeather(providerConfig{ApiKey: "key"}, providerEnv{})
+	for city, want := range map[string]string{
+		"Atlantis": "no location",
+		"Broken":   "location lookup failed",
+		"Nowhere":  "no current conditions",
+	} {
+		if _, err := p.temperature(context.Background(), city); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: error %v, want %q", city, err, want)
+		}
+	}
+
+	if _, err := newAccuWeather(providerConfig{}, providerEnv{}); err == nil {
+		t.Error("no error without an apiKey")
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// withAdminToken rejects requests that don't carry "Authorization: Bearer
+// <token>".
+func withAdminToken(next http.Handler, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, r, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleProbe runs one provider, named in a POSTed {"provider", "city"}
+// body, and reports its raw result. It bypasses the aggregator and the
+// cache, for debugging a provider in isolation.
+func (s *server) handleProbe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeError(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Provider string `json:"provider"`
+		City     string `json:"city"`
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, s.maxBodyBytes)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, r, fmt.Sprintf("request body exceeds %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.City == "" {
+		writeError(w, r, "city is required", http.StatusBadRequest)
+		return
+	}
+	p, ok := s.mw.provider(req.Provider)
+	if !ok {
+		writeError(w, r, fmt.Sprintf("unknown provider %q", req.Provider), http.StatusNotFound)
+		return
+	}
+
+	ctx, span := s.tracer.start(r.Context(), "POST /admin/probe")
+	defer span.finish()
+	span.setAttr("provider", p.name())
+	span.setAttr("city", req.City)
+
+	begin := time.Now()
+	got, err := p.temperature(ctx, req.City)
+	span.setStatus(err)
+
+	resp := map[string]interface{}{
+		"provider": p.name(),
+		"city":     req.City,
+	}
+	s.tookFormat.set(resp, begin)
+	if err != nil {
+		resp["error"] = err.Error()
+	} else {
+		// In the provider's own unit, as it sent it, where the reading
+		// keeps one.
+		resp["temp"], resp["unit"] = got.celsius, celsius
+		if got.native.unit != "" {
+			resp["temp"], resp["unit"] = got.native.value, got.native.unit
+		}
+	}
+	writeJSON(w, r, resp)
+}
+
+// handleCache lists the cache's entries with when they were stored and,
+// if cache.recordOrigin is set, the request that stored them, for
+// tracking down stale answers.
+func (s *server) handleCache(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		writeError(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	entries := s.cache.all()
+	keys := make([]string, 0, len(entries))
+	for k := range entries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	now := time.Now()
+	list := make([]map[string]interface{}, 0, len(keys))
+	for _, k := range keys {
+		e := entries[k]
+		d := map[string]interface{}{"key": k}
+		if !e.origin.at.IsZero() {
+			// Entries hold Celsius.
+			d["temp"] = e.agg.celsius
+			d["stored"] = e.origin.at.UTC().Format(time.RFC3339)
+			d["expires"] = e.expires.UTC().Format(time.RFC3339)
+			d["expired"] = e.expired(now)
+		}
+		if e.origin.request != "" {
+			d["request"] = e.origin.request
+		}
+		if e.origin.traceID != "" {
+			d["trace_id"] = e.origin.traceID
+		}
+		if err := e.failing(now); err != nil {
+			d["error"] = err.Error()
+		}
+		list = append(list, d)
+	}
+	writeJSON(w, r, map[string]interface{}{"entries": list})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestProbe(t *testing.T) {
+	working, failing := newFake("working", 12.5), newFake("failing", 0)
+	failing.err = errors.New("upstream said no")
+	s := newTestServer(working, failing)
+
+	w := post(s.handleProbe, "/admin/probe", `{"provider": "working", "city": "London"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	body := decode(t, w)
+	if body["provider"] != "working" || body["city"] != "London" || body["temp"] != 12.5 || body["unit"] != "c" || body["took"] == nil {
+		t.Errorf("probe %v", body)
+	}
+
+	body = decode(t, post(s.handleProbe, "/admin/probe", `{"provider": "failing", "city": "London"}`))
+	if body["error"] != "upstream said no" || body["temp"] != nil {
+		t.Errorf("failing probe %v", body)
+	}
+
+	// The probe bypasses the cache both ways.
+	post(s.handleProbe, "/admin/probe", `{"provider": "working", "city": "London"}`)
+	if working.calls.Load() != 2 {
+		t.Errorf("working called %d times, want once per probe", working.calls.Load())
+	}
+	if _, ok := s.cache.get(cacheKey{city: "London", aggregation: s.mw.aggregation}.String()); ok {
+		t.Error("probe result was cached")
+	}
+}
+
+func TestProbeNativeUnit(t *testing.T) {
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"t": 50}`))
+	}))
+	us, err := newHTTPJSONProvider(providerConfig{Name: "us", URL: "http://obs.example/now?q={city}", Field: "t", Unit: "f"}, providerEnv{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A reading that keeps no unit of its own is reported in Celsius.
+	s := newTestServer(us, newFake("plain", 10))
+	if body := decode(t, post(s.handleProbe, "/admin/probe", `{"provider": "us", "city": "Boston"}`)); body["temp"] != 50.0 || body["unit"] != "f" {
+		t.Errorf("probe %v, want 50 in the provider's °F", body)
+	}
+	if body := decode(t, post(s.handleProbe, "/admin/probe", `{"provider": "plain", "city": "Boston"}`)); body["temp"] != 10.0 || body["unit"] != "c" {
+		t.Errorf("probe %v, want Celsius without a native unit", body)
+	}
+}
+
+func TestProbeErrors(t *testing.T) {
+	s := newTestServer(newFake("working", 10))
+	for body, code := range map[string]int{
+		`{"provider": "nonesuch", "city": "London"}`: http.StatusNotFound,
+		`{"provider": "working"}`:                    http.StatusBadRequest,
+		`{"provider":`:                               http.StatusBadRequest,
+	} {
+		if w := post(s.handleProbe, "/admin/probe", body); w.Code != code {
+			t.Errorf("%s: status %d, want %d", body, w.Code, code)
+		}
+	}
+	if w := get(s.handleProbe, "/admin/probe"); w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "POST" {
+		t.Errorf("GET: status %d, Allow %q", w.Code, w.Header().Get("Allow"))
+	}
+}
+
+func TestAdminToken(t *testing.T) {
+	h := withAdminToken(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), "secret")
+	for auth, code := range map[string]int{
+		"":              http.StatusUnauthorized,
+		"secret":        http.StatusUnauthorized,
+		"Bearer wrong":  http.StatusUnauthorized,
+		"Bearer secret": http.StatusOK,
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/admin/probe", strings.NewReader(`{}`))
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		h.ServeHTTP(w, r)
+		if w.Code != code {
+			t.Errorf("%q: status %d, want %d", auth, w.Code, code)
+		}
+	}
+}
+
+func TestAdminCache(t *testing.T) {
+	s := newTestServer(newFake("fake", 12))
+	sr := tracetest.NewSpanRecorder()
+	s.tracer = newSDKTracer(sdktrace.WithSpanProcessor(sr))
+	h := withCacheOrigin(http.HandlerFunc(s.handleWeather), nil)
+
+	before := time.Now().Add(-time.Second)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/weather/London?units=f", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	s.cache.setError("mean:Paris", errors.New("all providers failed"), time.Minute)
+
+	entries := decode(t, get(s.handleCache, "/admin/cache"))["entries"].([]interface{})
+	if len(entries) != 2 {
+		t.Fatalf("entries %v, want London's and Paris's", entries)
+	}
+	london := entries[0].(map[string]interface{})
+	if london["key"] != "mean:London" || london["temp"] != 12.0 || london["expired"] != false {
+		t.Errorf("entry %v, want London's 12°C, unexpired", london)
+	}
+	if london["request"] != "GET /weather/London?units=f from 192.0.2.1" {
+		t.Errorf("request %v, want the one that populated it", london["request"])
+	}
+	if spans := sr.Ended(); len(spans) == 0 || london["trace_id"] != spans[0].SpanContext().TraceID().String() {
+		t.Errorf("trace_id %v, want the lookup's", london["trace_id"])
+	}
+	stored, err := time.Parse(time.RFC3339, london["stored"].(string))
+	if err != nil || stored.Before(before) || london["expires"] == nil {
+		t.Errorf("stored %v, expires %v, want just now", london["stored"], london["expires"])
+	}
+
+	// An entry holding only a failure has no origin.
+	paris := entries[1].(map[string]interface{})
+	if paris["error"] != "all providers failed" || paris["stored"] != nil {
+		t.Errorf("entry %v, want Paris's failure alone", paris)
+	}
+
+	if w := post(s.handleCache, "/admin/cache", ""); w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "GET" {
+		t.Errorf("POST: status %d, Allow %q", w.Code, w.Header().Get("Allow"))
+	}
+}
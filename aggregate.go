@@ -0,0 +1,1042 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// gatedProvider is implemented by providers that may decline to be called,
+// e.g. once their quota is exhausted. A non-nil error from admit skips the
+// provider for this request and is reported as a warning.
+type gatedProvider interface {
+	admit() error
+}
+
+type reading struct {
+	provider  string
+	place     string // the provider's name for where it observed; may be empty
+	celsius   float64
+	condition string    // e.g. "Clear"; empty if the provider has none
+	feelsLike *float64  // apparent temperature, if reported
+	observed  time.Time // when the upstream observed it; zero if unknown
+	// windSpeed is in m/s and windBearing in degrees clockwise from north
+	// that the wind blows from; nil if not reported.
+	windSpeed, windBearing *float64
+	pressure               *float64 // hPa, if reported
+	uvIndex                *float64
+	precipProbability      *float64 // 0 to 1, for now or the next hour
+	cloudCover             *float64 // percent of the sky
+	icon                   string   // normalized; see iconVocabulary
+	// elevation is the station's, in metres, if reported, and
+	// altitudeCorrection what normalizing it to the place's added.
+	elevation, altitudeCorrection *float64
+	// sunrise and sunset are today's, in the location's time zone; zero
+	// if not reported.
+	sunrise, sunset time.Time
+	// stations holds the individual station readings when a provider
+	// averages several stations near the city, named in provider.
+	stations []reading
+	took     time.Duration // how long the provider took to answer
+	cached   bool          // reused from the provider's recent readings
+	// native is the temperature as the provider sent it, before any
+	// conversion or normalization, for auditing.
+	native nativeTemp
+	// upstream and geocoded are what the lookup asked upstream, if
+	// multiWeatherProvider.provenance is set; see provenanceRecorder.
+	upstream []string
+	geocoded *point
+	// share is the fraction of the aggregate's temperature the reading
+	// accounts for; nil if its aggregation doesn't say.
+	share *float64
+}
+
+// nativeTemp is a temperature in a provider's own unit; a zero unit if the
+// provider's reading doesn't keep one, as with averages of stations.
+type nativeTemp struct {
+	value float64
+	unit  unit
+}
+
+type aggregate struct {
+	place     string // see consensusPlace
+	celsius   float64
+	condition string
+	feelsLike *float64
+
+	windSpeed, windBearing *float64
+	pressure               *float64
+	uvIndex                *float64
+	precipProbability      *float64
+	cloudCover             *float64
+	icon                   string
+	sunrise, sunset        time.Time
+	// asOf is the oldest of the readings' observation times, or when
+	// they were fetched if none reports one; see summarize.
+	asOf time.Time
+
+	readings []reading
+	warnings []string
+	// failures are the providers that failed without failing the
+	// aggregate, such as those it stopped waiting for.
+	failures []providerFailure
+}
+
+// multiWeatherProvider averages the readings of several providers.
+type multiWeatherProvider struct {
+	providers []weatherProvider
+	// minCelsius and maxCelsius bound plausible readings; readings
+	// outside them are dropped with a warning.
+	minCelsius, maxCelsius float64
+
+	aggregation aggregation
+	// sequential calls providers one after another, in configuration
+	// order, instead of all at once. Slower, but their logs don't
+	// interleave.
+	sequential bool
+	// requireFresh, if set, fails aggregates that have no reading observed
+	// within it. Readings with no observation time don't count as fresh.
+	requireFresh time.Duration
+	// clockSkew is how far in the future an observation time may be
+	// before it is clamped to now.
+	clockSkew time.Duration
+	// meanUV averages the UV index across providers rather than
+	// reporting the highest, which is the cautious default.
+	meanUV bool
+	// weights, if set, weights the mean by provider; otherwise every
+	// provider counts equally.
+	weights *providerWeights
+	// quotaFallback leaves out providers that failed because the
+	// geocoders are out of quota, averaging those that take city names,
+	// rather than failing the aggregate.
+	quotaFallback bool
+	// altitude, if set, normalizes readings to the elevation of the place
+	// asked about before they are combined.
+	altitude *altitudeNormalizer
+	// retryBudget caps the upstream retries all providers make for one
+	// lookup; 0 leaves each request to upstreamRetry alone.
+	retryBudget int
+	// breaker, if set, skips providers that keep failing without
+	// calling them.
+	breaker *circuitBreaker
+	// rotation, if set, calls only a few of the providers for each
+	// lookup, favouring the healthy ones with quota to spare.
+	rotation *rotation
+	// quota counts requests against providers' daily quotas; nil if none
+	// has one. With quotaOrder, providers called one after another go in
+	// order of the share of their quota left, so usage evens out.
+	quota      *quotaTracker
+	quotaOrder bool
+	// strictTimeouts fails an aggregate if any provider times out, rather
+	// than averaging the providers that answered.
+	strictTimeouts bool
+	// required names providers without whose reading an aggregate is an
+	// error, rather than an average of the rest.
+	required []string
+	// consensusWithin, if set, fails an aggregate unless at least
+	// consensusMin readings, or all of them if consensusMin is 0, lie
+	// within that many degrees Celsius of each other.
+	consensusWithin float64
+	consensusMin    int
+	// overrides are the providers to use instead of all of them for
+	// particular places, keyed by normalized city or country code.
+	overrides map[string][]weatherProvider
+	// tiers are the providers' configured tiers, by name, and tier the
+	// minimum w was narrowed to; see atLeast.
+	tiers map[string]tier
+	tier  tier
+	// With first aggregation, providers named in priority are called in
+	// that order, ahead of the rest, each stagger after the one before
+	// unless it has already failed. The preferred provider usually wins,
+	// but a slow one only holds the others back by stagger.
+	priority []string
+	stagger  time.Duration
+	// hedge, if set, has the other aggregations call only the preferred
+	// provider, as for first, together with any required ones, and the
+	// rest only if it hasn't answered plausibly within hedge.
+	hedge time.Duration
+	// recent keeps each provider's latest readings by location, for
+	// providers configured with a cache TTL. A recent reading is reused
+	// instead of calling the provider again.
+	recent map[string]*locationCache[reading]
+	// With lateWait set, providers that miss the deadline are given that
+	// much longer to answer, and what they return is kept for the next
+	// lookup: in recent if they have a cache of their own, and in late
+	// otherwise.
+	lateWait time.Duration
+	late     map[string]*locationCache[reading]
+	// latency, if set, records how long each provider takes to answer.
+	latency *summaryVec
+	// provenance notes the upstream URLs and coordinates behind each
+	// reading.
+	provenance bool
+}
+
+// aggregation is how readings are combined into one temperature: the name
+// of an Aggregator, or firstAggregation.
+type aggregation string
+
+const (
+	meanAggregation aggregation = "mean"
+	// trimmedAggregation drops the highest and lowest readings before
+	// averaging, if there are at least three.
+	trimmedAggregation aggregation = "trimmed"
+	// freshAggregation weights the mean by how recently each reading was
+	// observed as well, halving a reading's weight for every
+	// freshHalfLife of age.
+	freshAggregation aggregation = "fresh"
+	// firstAggregation takes the first plausible reading to arrive and
+	// cancels the providers still working. It decides when to stop
+	// waiting rather than how to combine, so it is not an Aggregator.
+	firstAggregation aggregation = "first"
+)
+
+// An Aggregator combines the plausible readings for a lookup, at least one
+// and sorted by provider priority, into one. Only the returned reading's
+// celsius is used; the other fields of the answer are summarized from the
+// readings as for every aggregation. weights is nil unless provider
+// weights are configured, and its mean is safe to call either way.
+type Aggregator func(readings []reading, weights *providerWeights) reading
+
+// aggregators are the Aggregators conf.json's aggregation and ?agg= can
+// name.
+var aggregators = map[aggregation]Aggregator{
+	meanAggregation: func(readings []reading, weights *providerWeights) reading {
+		return reading{celsius: weights.mean(readings, false)}
+	},
+	trimmedAggregation: func(readings []reading, weights *providerWeights) reading {
+		return reading{celsius: weights.mean(readings, true)}
+	},
+	freshAggregation: func(readings []reading, weights *providerWeights) reading {
+		var c float64
+		for i, share := range weights.freshShares(readings, freshHalfLife, time.Now()) {
+			c += share * readings[i].celsius
+		}
+		return reading{celsius: c}
+	},
+}
+
+// RegisterAggregator makes a selectable by name, for builds that add their
+// own. It must be called before the configuration is loaded, from an init
+// function, and panics if name is empty or already taken.
+func RegisterAggregator(name string, a Aggregator) {
+	n := aggregation(strings.ToLower(name))
+	if _, ok := aggregators[n]; ok || n == "" || n == firstAggregation {
+		panic(fmt.Sprintf("RegisterAggregator: aggregation %q already registered or invalid", name))
+	}
+	aggregators[n] = a
+}
+
+func parseAggregation(s string) (aggregation, error) {
+	a := aggregation(strings.ToLower(s))
+	if _, ok := aggregators[a]; ok || a == firstAggregation {
+		return a, nil
+	}
+	names := []string{string(firstAggregation)}
+	for name := range aggregators {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+	return "", fmt.Errorf("unknown aggregation %q, want one of %s", s, strings.Join(names, ", "))
+}
+
+func (w multiWeatherProvider) name() string { return "multiWeatherProvider" }
+
+func (w multiWeatherProvider) temperature(ctx context.Context, city string) (reading, error) {
+	agg, err := w.aggregate(ctx, city)
+	return reading{provider: w.name(), celsius: agg.celsius, condition: agg.condition}, err
+}
+
+func (w multiWeatherProvider) aggregate(ctx context.Context, city string) (aggregate, error) {
+	return w.forCity(city).fanOut(ctx, city, func(ctx context.Context, p weatherProvider) (reading, error) {
+		r, err := p.temperature(ctx, city)
+		if err == nil {
+			r = w.altitude.forCity(ctx, city, r)
+		}
+		return r, err
+	})
+}
+
+// normalizeCity lowercases city and trims the spaces around its
+// comma-separated parts, so "Boston, US" and "boston,us" are one place.
+func normalizeCity(city string) string {
+	parts := strings.Split(strings.ToLower(city), ",")
+	for i, p := range parts {
+		parts[i] = strings.TrimSpace(p)
+	}
+	return strings.Join(parts, ",")
+}
+
+// forCity narrows w to the providers overridden for city: those for the
+// city itself, or failing that for its trailing country code, as in
+// "Boston,US". Cities without an override keep every provider.
+func (w multiWeatherProvider) forCity(city string) multiWeatherProvider {
+	if len(w.overrides) == 0 {
+		return w
+	}
+	city = normalizeCity(city)
+	providers, ok := w.overrides[city]
+	if i := strings.LastIndex(city, ","); !ok && i >= 0 {
+		providers, ok = w.overrides[city[i+1:]]
+	}
+	if ok {
+		w.providers = providers
+	}
+	return w
+}
+
+// selection parses a ?providers= list into the canonical form cache keys
+// hold: configured names, deduplicated and sorted. Unknown names are an
+// error, as is leaving out a required provider.
+func (w multiWeatherProvider) selection(list string) (string, error) {
+	chosen := make(map[string]bool)
+	var names []string
+	for _, name := range strings.Split(list, ",") {
+		p, ok := w.provider(strings.TrimSpace(name))
+		if !ok {
+			return "", fmt.Errorf("unknown provider %q", strings.TrimSpace(name))
+		}
+		if !chosen[p.name()] {
+			chosen[p.name()] = true
+			names = append(names, p.name())
+		}
+	}
+	for _, name := range w.required {
+		if !chosen[name] {
+			return "", fmt.Errorf("required provider %s must be selected", name)
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, ","), nil
+}
+
+// forKey configures w for k: its aggregation and, if k selects some, only
+// those providers, whatever the city overrides say, of k's minimum tier or
+// better.
+func (w multiWeatherProvider) forKey(k cacheKey) multiWeatherProvider {
+	w.aggregation = k.aggregation
+	if k.minTier != noTier {
+		w = w.atLeast(k.minTier)
+	}
+	if k.providers == "" {
+		return w
+	}
+	chosen := make(map[string]bool)
+	for _, name := range strings.Split(k.providers, ",") {
+		chosen[name] = true
+	}
+	all := w.providers
+	w.providers, w.overrides = nil, nil
+	for _, p := range all {
+		if chosen[p.name()] {
+			w.providers = append(w.providers, p)
+		}
+	}
+	return w
+}
+
+// aggregateAt averages the providers that can look up a point.
+func (w multiWeatherProvider) aggregateAt(ctx context.Context, pt point) (aggregate, error) {
+	located := w
+	located.providers = nil
+	for _, p := range w.providers {
+		if _, ok := capability[coordinateProvider](p); ok {
+			located.providers = append(located.providers, p)
+		}
+	}
+	return located.fanOut(ctx, pt.String(), func(ctx context.Context, p weatherProvider) (reading, error) {
+		c, _ := capability[coordinateProvider](p)
+		r, err := c.temperatureAt(ctx, pt)
+		if err == nil {
+			r = w.altitude.at(ctx, pt, r)
+		}
+		return r, err
+	})
+}
+
+// outcome is one provider's reading, or the error it failed with.
+type outcome struct {
+	provider string
+	reading  reading
+	err      error
+}
+
+// dispatch calls fetch for every admitted provider concurrently, sending
+// each outcome on the returned channel. Providers that decline to be called
+// or whose circuit is open are reported in warnings and never called, and
+// those with a recent reading for location answer with it at once. With a
+// rotation, providers out of it are left out silently. location also
+// labels spans and logs.
+func (w multiWeatherProvider) dispatch(ctx context.Context, location string, fetch func(ctx context.Context, p weatherProvider) (reading, error)) (outcomes <-chan outcome, dispatched []weatherProvider, warnings []string) {
+	ctx = withRetryBudget(ctx, w.retryBudget)
+	dispatched = make([]weatherProvider, 0, len(w.providers))
+	var hits []reading
+	calls := make([]weatherProvider, 0, len(w.providers))
+	for _, p := range w.rotation.choose(w.providers, w.standing, w.required) {
+		r, ok := w.recent[p.name()].lookup(location)
+		if !ok {
+			r, ok = w.late[p.name()].lookup(location)
+		}
+		if ok {
+			r.cached = true
+			hits = append(hits, r)
+			dispatched = append(dispatched, p)
+			continue
+		}
+		// The breaker goes first so an open circuit doesn't use up quota.
+		if err := w.breaker.admit(p.name()); err != nil {
+			warnings = append(warnings, p.name()+" skipped: "+err.Error())
+			continue
+		}
+		if g, ok := p.(gatedProvider); ok {
+			if err := g.admit(); err != nil {
+				w.breaker.abandon(p.name())
+				warnings = append(warnings, p.name()+" skipped: "+err.Error())
+				continue
+			}
+		}
+		dispatched = append(dispatched, p)
+		calls = append(calls, p)
+	}
+
+	results := make(chan outcome, len(dispatched))
+	for _, r := range hits {
+		results <- outcome{provider: r.provider, reading: r}
+	}
+	failed := make(chan struct{}, len(dispatched))
+	call := func(p weatherProvider) outcome {
+		begin := time.Now()
+		ctx, span := startSpan(ctx, p.name())
+		span.setAttr("city", location)
+		span.setAttr("provider", p.name())
+		var rec *provenanceRecorder
+		if w.provenance {
+			ctx, rec = withProvenance(ctx)
+		}
+		r, err := fetch(ctx, p)
+		if rec != nil {
+			rec.fill(&r)
+		}
+		if err == nil && (math.IsNaN(r.celsius) || math.IsInf(r.celsius, 0)) {
+			err = fmt.Errorf("%s: non-finite temperature %v", p.name(), r.celsius)
+		}
+		span.setStatus(err)
+		span.finish()
+		if ctx.Err() == nil {
+			w.weights.record(p.name(), err)
+			w.breaker.record(p.name(), err)
+			w.latency.observe(time.Since(begin).Seconds(), p.name())
+		} else {
+			w.breaker.abandon(p.name())
+		}
+		r.provider = p.name()
+		r.took = time.Since(begin)
+		if now := time.Now(); r.observed.After(now.Add(w.clockSkew)) {
+			log.Printf("%s: %s: observed %s is %s in the future; clamped to now", location, p.name(), r.observed.Format(time.RFC3339), r.observed.Sub(now).Round(time.Second))
+			r.observed = now
+		}
+		if err != nil {
+			failed <- struct{}{}
+		} else if c := w.recent[p.name()]; c != nil {
+			c.set(location, r)
+		}
+		o := outcome{provider: p.name(), reading: r, err: err}
+		results <- o
+		return o
+	}
+	// skip gives back the breaker's admission of calls never made.
+	skip := func(rest []weatherProvider) {
+		for _, p := range rest {
+			w.breaker.abandon(p.name())
+		}
+	}
+
+	if w.quotaOrder {
+		calls = w.byQuota(calls)
+	}
+	if w.sequential {
+		go func() {
+			for i, p := range calls {
+				if ctx.Err() != nil {
+					skip(calls[i:])
+					return
+				}
+				call(p)
+			}
+		}()
+		return results, dispatched, warnings
+	}
+	if w.aggregation == firstAggregation && w.stagger > 0 {
+		ordered := w.prioritized(calls)
+		go func() {
+			for i, p := range ordered {
+				if i > 0 {
+					select {
+					case <-ctx.Done():
+						skip(ordered[i:])
+						return
+					case <-failed:
+					case <-time.After(w.stagger):
+					}
+				}
+				go call(p)
+			}
+		}()
+		return results, dispatched, warnings
+	}
+	if w.hedge > 0 && w.aggregation != firstAggregation && len(calls) > 1 {
+		now, backups := w.hedged(calls)
+		preferred := make(chan outcome, 1)
+		go func() { preferred <- call(now[0]) }()
+		for _, p := range now[1:] {
+			go call(p)
+		}
+		unneeded := func() {
+			skip(backups)
+			for _, p := range backups {
+				results <- outcome{provider: p.name(), err: errNotHedged}
+			}
+		}
+		go func() {
+			hedge := time.NewTimer(w.hedge)
+			defer hedge.Stop()
+			select {
+			case o := <-preferred:
+				if c := o.reading.celsius; o.err == nil && c >= w.minCelsius && c <= w.maxCelsius {
+					unneeded()
+					return
+				}
+			case <-ctx.Done():
+				unneeded()
+				return
+			case <-hedge.C:
+			}
+			for _, p := range backups {
+				go call(p)
+			}
+		}()
+		return results, dispatched, warnings
+	}
+	for _, p := range calls {
+		go call(p)
+	}
+	return results, dispatched, warnings
+}
+
+// errNotHedged is the outcome of a backup provider that a hedged lookup
+// didn't need to call.
+var errNotHedged = errors.New("not called; the preferred provider answered in time")
+
+// hedged splits providers into those a hedged lookup calls at once, the
+// preferred one first and then any required, and the backups.
+func (w multiWeatherProvider) hedged(providers []weatherProvider) (now, backups []weatherProvider) {
+	ordered := w.prioritized(providers)
+	now = ordered[:1:1]
+	for _, p := range ordered[1:] {
+		if slices.Contains(w.required, p.name()) {
+			now = append(now, p)
+		} else {
+			backups = append(backups, p)
+		}
+	}
+	return now, backups
+}
+
+// prioritized orders providers as w.priority lists them, followed by the
+// rest in the order given.
+func (w multiWeatherProvider) prioritized(providers []weatherProvider) []weatherProvider {
+	ordered := make([]weatherProvider, 0, len(providers))
+	listed := make(map[string]bool, len(w.priority))
+	for _, name := range w.priority {
+		for _, p := range providers {
+			if p.name() == name {
+				ordered = append(ordered, p)
+				listed[name] = true
+			}
+		}
+	}
+	for _, p := range providers {
+		if !listed[p.name()] {
+			ordered = append(ordered, p)
+		}
+	}
+	return ordered
+}
+
+// fanOut averages the readings of all providers, failing if any of them
+// does.
+func (w multiWeatherProvider) fanOut(ctx context.Context, location string, fetch func(ctx context.Context, p weatherProvider) (reading, error)) (aggregate, error) {
+	if w.aggregation == firstAggregation {
+		return w.first(ctx, location, fetch)
+	}
+	var agg aggregate
+
+	deadline := time.Millisecond * 1500
+	// Calls outlive the request by up to lateWait if late readings are
+	// kept, and are otherwise cancelled with it.
+	cancel := context.CancelFunc(func() {})
+	if w.lateWait > 0 {
+		ctx, cancel = context.WithTimeout(context.WithoutCancel(ctx), deadline+w.lateWait)
+	}
+	draining := false
+	defer func() {
+		if !draining {
+			cancel()
+		}
+	}()
+
+	outcomes, dispatched, warnings := w.dispatch(ctx, location, fetch)
+	agg.warnings = warnings
+	if len(dispatched) == 0 {
+		return agg, errors.New("no providers available")
+	}
+
+	counted := len(dispatched)
+	answered := make(map[string]bool, len(dispatched))
+	timeout := time.After(deadline)
+
+wait:
+	for i := 0; i < len(dispatched); i++ {
+		select {
+		case o := <-outcomes:
+			answered[o.provider] = true
+			if errors.Is(o.err, errNotHedged) {
+				counted--
+				continue
+			}
+			if o.err != nil {
+				if w.quotaFallback && geocodeQuotaExhausted(o.err) {
+					warning := o.provider + " excluded: geocoder quota exhausted"
+					agg.warnings = append(agg.warnings, warning)
+					agg.failures = append(agg.failures, newProviderFailure(o.provider, o.err, warning))
+					counted--
+					continue
+				}
+				return agg, o.err
+			}
+			if c := o.reading.celsius; c < w.minCelsius || c > w.maxCelsius {
+				agg.warnings = append(agg.warnings, fmt.Sprintf("%s excluded: implausible temperature %.2f°C", o.provider, c))
+				counted--
+				continue
+			}
+			agg.readings = append(agg.readings, o.reading)
+		case <-timeout:
+			var late []string
+			for _, p := range dispatched {
+				if !answered[p.name()] {
+					late = append(late, p.name())
+				}
+			}
+			log.Printf("%s: timed out waiting for %s", location, strings.Join(late, ", "))
+			if w.lateWait > 0 {
+				draining = true
+				go w.drain(ctx, location, outcomes, len(late), cancel)
+			}
+			if w.strictTimeouts {
+				return agg, fmt.Errorf("timed out waiting for %s", strings.Join(late, ", "))
+			}
+			for _, name := range late {
+				warning := name + " timed out; excluded from the average"
+				agg.warnings = append(agg.warnings, warning)
+				agg.failures = append(agg.failures, newProviderFailure(name, errTimedOut, warning))
+			}
+			counted -= len(late)
+			break wait
+		}
+	}
+
+	if counted == 0 {
+		return agg, errors.New("no plausible readings")
+	}
+	if err := requirePresent(agg.readings, w.required); err != nil {
+		return agg, err
+	}
+	if w.requireFresh > 0 && !anyFresh(agg.readings, time.Now().Add(-w.requireFresh)) {
+		return agg, fmt.Errorf("no reading observed within the last %s", w.requireFresh)
+	}
+	if w.consensusWithin > 0 {
+		if err := consensus(agg.readings, w.consensusWithin, w.consensusMin); err != nil {
+			return agg, err
+		}
+	}
+	w.sortReadings(agg.readings)
+	agg.celsius = aggregators[w.aggregation](agg.readings, w.weights).celsius
+	var shares []float64
+	switch w.aggregation {
+	case meanAggregation, trimmedAggregation:
+		shares = w.weights.shares(agg.readings, w.aggregation == trimmedAggregation)
+	case freshAggregation:
+		shares = w.weights.freshShares(agg.readings, freshHalfLife, time.Now())
+	}
+	for i := range shares {
+		agg.readings[i].share = &shares[i]
+	}
+	w.summarize(&agg)
+	return agg, nil
+}
+
+// drain waits for the pending providers that missed fanOut's deadline,
+// logging how late each was and keeping its reading for the next lookup of
+// location. It calls done when they have all answered or ctx ends.
+func (w multiWeatherProvider) drain(ctx context.Context, location string, outcomes <-chan outcome, pending int, done context.CancelFunc) {
+	defer done()
+	for ; pending > 0; pending-- {
+		select {
+		case o := <-outcomes:
+			if o.err != nil {
+				log.Printf("%s: %s failed after the deadline: %s", location, o.provider, o.err)
+				continue
+			}
+			log.Printf("%s: %s answered late, after %s", location, o.provider, o.reading.took)
+			if c := w.late[o.provider]; c != nil {
+				c.set(location, o.reading)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// first returns the first plausible reading, cancelling the providers yet
+// to answer. It only fails if none of them succeed.
+func (w multiWeatherProvider) first(ctx context.Context, location string, fetch func(ctx context.Context, p weatherProvider) (reading, error)) (aggregate, error) {
+	var agg aggregate
+	if len(w.required) > 0 {
+		return agg, errors.New("first aggregation cannot honour requiredProviders")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	outcomes, dispatched, warnings := w.dispatch(ctx, location, fetch)
+	agg.warnings = warnings
+	if len(dispatched) == 0 {
+		return agg, errors.New("no providers available")
+	}
+
+	var errs []error
+	timeout := time.After(time.Millisecond * 1500)
+	for i := 0; i < len(dispatched); i++ {
+		select {
+		case o := <-outcomes:
+			switch c := o.reading.celsius; {
+			case o.err != nil:
+				errs = append(errs, o.err)
+				agg.failures = append(agg.failures, newProviderFailure(o.provider, o.err, ""))
+			case c < w.minCelsius || c > w.maxCelsius:
+				agg.warnings = append(agg.warnings, fmt.Sprintf("%s excluded: implausible temperature %.2f°C", o.provider, c))
+			case w.requireFresh > 0 && !anyFresh([]reading{o.reading}, time.Now().Add(-w.requireFresh)):
+				agg.warnings = append(agg.warnings, fmt.Sprintf("%s excluded: not observed within the last %s", o.provider, w.requireFresh))
+			default:
+				agg.celsius = c
+				agg.readings = []reading{o.reading}
+				share := 1.0
+				agg.readings[0].share = &share
+				w.summarize(&agg)
+				return agg, nil
+			}
+		case <-timeout:
+			return agg, errors.New("no provider answered in time")
+		}
+	}
+	if len(errs) > 0 {
+		return agg, errors.Join(errs...)
+	}
+	return agg, errors.New("no plausible readings")
+}
+
+// summarize fills in everything but the temperature from agg's readings.
+func (w multiWeatherProvider) summarize(agg *aggregate) {
+	agg.place = consensusPlace(agg.readings)
+	agg.condition = majorityCondition(agg.readings)
+	agg.icon = majorityOf(agg.readings, func(r reading) string { return r.icon })
+	agg.feelsLike = meanOf(agg.readings, func(r reading) *float64 { return r.feelsLike })
+	agg.windSpeed = meanOf(agg.readings, func(r reading) *float64 { return r.windSpeed })
+	agg.windBearing = circularMeanOf(agg.readings, func(r reading) *float64 { return r.windBearing })
+	agg.pressure = meanOf(agg.readings, func(r reading) *float64 { return r.pressure })
+	agg.precipProbability = meanOf(agg.readings, func(r reading) *float64 { return r.precipProbability })
+	agg.cloudCover = meanOf(agg.readings, func(r reading) *float64 { return r.cloudCover })
+	agg.asOf = time.Now()
+	observed := false
+	for _, r := range agg.readings {
+		if !r.observed.IsZero() && (!observed || r.observed.Before(agg.asOf)) {
+			agg.asOf, observed = r.observed, true
+		}
+	}
+	for _, r := range agg.readings {
+		if !r.sunrise.IsZero() && !r.sunset.IsZero() {
+			agg.sunrise, agg.sunset = r.sunrise, r.sunset
+			break
+		}
+	}
+	uv := func(r reading) *float64 { return r.uvIndex }
+	if w.meanUV {
+		agg.uvIndex = meanOf(agg.readings, uv)
+	} else {
+		agg.uvIndex = maxOf(agg.readings, uv)
+	}
+}
+
+// errTimedOut is the outcome of a provider that collect gave up waiting
+// for.
+var errTimedOut = errors.New("timed out")
+
+// collect returns every provider's outcome for city without aggregating
+// them. Providers that have not answered by the timeout are reported as
+// timed out.
+func (w multiWeatherProvider) collect(ctx context.Context, city string) ([]outcome, []string) {
+	w.hedge = 0 // every provider, to report on
+	results, dispatched, warnings := w.dispatch(ctx, city, func(ctx context.Context, p weatherProvider) (reading, error) {
+		return p.temperature(ctx, city)
+	})
+
+	outcomes := make([]outcome, 0, len(dispatched))
+	answered := make(map[string]bool)
+	timeout := time.After(time.Millisecond * 1500)
+	for len(outcomes) < len(dispatched) {
+		select {
+		case o := <-results:
+			outcomes = append(outcomes, o)
+			answered[o.provider] = true
+		case <-timeout:
+			for _, p := range dispatched {
+				if !answered[p.name()] {
+					outcomes = append(outcomes, outcome{provider: p.name(), err: errTimedOut})
+				}
+			}
+		}
+	}
+	rank := w.rank()
+	sort.SliceStable(outcomes, func(i, j int) bool {
+		return rank[outcomes[i].provider] < rank[outcomes[j].provider]
+	})
+	return outcomes, warnings
+}
+
+// provider finds a provider by name, ignoring case.
+func (w multiWeatherProvider) provider(name string) (weatherProvider, bool) {
+	for _, p := range w.providers {
+		if strings.EqualFold(p.name(), name) {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// rank maps provider names to their position in the configuration.
+func (w multiWeatherProvider) rank() map[string]int {
+	rank := make(map[string]int, len(w.providers))
+	for i := len(w.providers) - 1; i >= 0; i-- {
+		rank[w.providers[i].name()] = i
+	}
+	return rank
+}
+
+// sortReadings puts readings in configuration order, since they arrive in
+// whatever order the providers answer.
+func (w multiWeatherProvider) sortReadings(readings []reading) {
+	rank := w.rank()
+	sort.SliceStable(readings, func(i, j int) bool {
+		return rank[readings[i].provider] < rank[readings[j].provider]
+	})
+}
+
+// capability finds an optional provider interface on p or, if p wraps
+// another provider (e.g. to enforce a quota), on the provider it wraps.
+func capability[T any](p weatherProvider) (T, bool) {
+	for {
+		if c, ok := p.(T); ok {
+			return c, true
+		}
+		w, ok := p.(interface{ unwrap() weatherProvider })
+		if !ok {
+			var zero T
+			return zero, false
+		}
+		p = w.unwrap()
+	}
+}
+
+// stddev is the sample standard deviation of the readings' temperatures in
+// Celsius, or nil for fewer than two readings.
+func stddev(readings []reading) *float64 {
+	if len(readings) < 2 {
+		return nil
+	}
+	mean := 0.0
+	for _, r := range readings {
+		mean += r.celsius
+	}
+	mean /= float64(len(readings))
+	sum := 0.0
+	for _, r := range readings {
+		sum += (r.celsius - mean) * (r.celsius - mean)
+	}
+	sd := math.Sqrt(sum / float64(len(readings)-1))
+	return &sd
+}
+
+// meanOf averages an optional field over the readings that report it, or
+// returns nil if none do.
+func meanOf(readings []reading, field func(reading) *float64) *float64 {
+	sum, n := 0.0, 0
+	for _, r := range readings {
+		if v := field(r); v != nil {
+			sum += *v
+			n++
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+	mean := sum / float64(n)
+	return &mean
+}
+
+// maxOf is the highest of an optional field over the readings that report
+// it, or nil if none do.
+func maxOf(readings []reading, field func(reading) *float64) *float64 {
+	var max *float64
+	for _, r := range readings {
+		if v := field(r); v != nil && (max == nil || *v > *max) {
+			max = v
+		}
+	}
+	return max
+}
+
+// requirePresent fails unless every required provider has a reading.
+func requirePresent(readings []reading, required []string) error {
+	for _, name := range required {
+		found := false
+		for _, r := range readings {
+			if r.provider == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("required provider %s has no reading", name)
+		}
+	}
+	return nil
+}
+
+// consensusError reports readings that don't agree closely enough to be
+// trusted.
+type consensusError struct {
+	within   float64
+	readings []reading
+}
+
+func (e consensusError) Error() string {
+	parts := make([]string, len(e.readings))
+	for i, r := range e.readings {
+		parts[i] = fmt.Sprintf("%s %.2f°C", r.provider, r.celsius)
+	}
+	return fmt.Sprintf("no consensus within %g°C: %s", e.within, strings.Join(parts, ", "))
+}
+
+// consensus fails unless agreeing readings, or all of them if agreeing is
+// 0, lie within degrees of each other.
+func consensus(readings []reading, within float64, agreeing int) error {
+	if agreeing <= 0 {
+		agreeing = len(readings)
+	}
+	sorted := append([]reading(nil), readings...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].celsius < sorted[j].celsius })
+	// The largest agreeing group is a run of the sorted readings.
+	best := 0
+	for i, j := 0, 0; j < len(sorted); j++ {
+		for sorted[j].celsius-sorted[i].celsius > within {
+			i++
+		}
+		if n := j - i + 1; n > best {
+			best = n
+		}
+	}
+	if best < agreeing {
+		return consensusError{within, sorted}
+	}
+	return nil
+}
+
+// anyFresh reports whether any reading was observed after since.
+func anyFresh(readings []reading, since time.Time) bool {
+	for _, r := range readings {
+		if !r.observed.IsZero() && r.observed.After(since) {
+			return true
+		}
+	}
+	return false
+}
+
+// circularMeanOf averages an optional bearing in degrees over the readings
+// that report it. Bearings wrap at 360, so they are averaged as unit
+// vectors: 350° and 10° average to 0°, not 180°. It returns nil if no
+// reading has a bearing or they cancel out, e.g. 90° and 270°.
+func circularMeanOf(readings []reading, field func(reading) *float64) *float64 {
+	var x, y float64
+	n := 0
+	for _, r := range readings {
+		if v := field(r); v != nil {
+			rad := *v * math.Pi / 180
+			x += math.Cos(rad)
+			y += math.Sin(rad)
+			n++
+		}
+	}
+	if n == 0 || math.Hypot(x, y)/float64(n) < 1e-9 {
+		return nil
+	}
+	mean := math.Mod(math.Atan2(y, x)*180/math.Pi+360, 360)
+	return &mean
+}
+
+// majorityCondition picks the condition reported by the most providers,
+// compared case-insensitively. Ties go to the alphabetically first
+// condition so the result does not depend on which provider answered first.
+func majorityCondition(readings []reading) string {
+	return majorityOf(readings, func(r reading) string { return strings.ToLower(strings.TrimSpace(r.condition)) })
+}
+
+// consensusPlace is the place most readings say they were observed at.
+// Places are compared by their first part, since providers qualify them
+// differently: "London, GB" and "London, England, United Kingdom" agree.
+// The winner is named as the first reading to give it does.
+func consensusPlace(readings []reading) string {
+	locality := func(r reading) string {
+		first, _, _ := strings.Cut(r.place, ",")
+		return strings.ToLower(strings.TrimSpace(first))
+	}
+	best := majorityOf(readings, locality)
+	for _, r := range readings {
+		if best != "" && locality(r) == best {
+			return r.place
+		}
+	}
+	return ""
+}
+
+// majorityOf returns the most common non-empty value of field among
+// readings, breaking ties alphabetically.
+func majorityOf(readings []reading, field func(reading) string) string {
+	votes := make(map[string]int)
+	for _, r := range readings {
+		if c := field(r); c != "" {
+			votes[c]++
+		}
+	}
+	best := ""
+	for c, n := range votes {
+		if best == "" || n > votes[best] || n == votes[best] && c < best {
+			best = c
+		}
+	}
+	return best
+}
@@ -0,0 +1,1304 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func conditions(cs ...string) []reading {
+	readings := make([]reading, len(cs))
+	for i, c := range cs {
+		readings[i] = reading{condition: c}
+	}
+	return readings
+}
+
+func TestMajorityCondition(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		conditions []string
+		want       string
+	}{
+		{"clear majority", []string{"Rain", "Clear", "rain "}, "rain"},
+		{"tie", []string{"rain", "clouds", "clouds", "rain"}, "clouds"},
+		{"all distinct", []string{"snow", "rain", "fog"}, "fog"},
+		{"empty ignored", []string{"", "", "fog"}, "fog"},
+		{"none", []string{"", ""}, ""},
+	} {
+		if got := majorityCondition(conditions(tt.conditions...)); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAggregateCondition(t *testing.T) {
+	providers := make([]weatherProvider, 0, 3)
+	for _, c := range []string{"Clouds", "Rain", "clouds"} {
+		p := newFake("p"+c, 10)
+		p.reading.condition = c
+		providers = append(providers, p)
+	}
+
+	agg, err := newTestMW(providers...).aggregate(context.Background(), "London")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agg.condition != "clouds" {
+		t.Errorf("condition %q, want clouds", agg.condition)
+	}
+}
+
+func TestAggregateFeelsLike(t *testing.T) {
+	a, b, c := newFake("a", 10), newFake("b", 12), newFake("c", 14)
+	a.reading.feelsLike, b.reading.feelsLike = ptr(6.0), ptr(9.0)
+
+	agg, err := newTestMW(a, b, c).aggregate(context.Background(), "London")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agg.feelsLike == nil || *agg.feelsLike != 7.5 {
+		t.Errorf("feels like %v, want 7.5 from the two providers reporting it", agg.feelsLike)
+	}
+
+	agg, err = newTestMW(c).aggregate(context.Background(), "London")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agg.feelsLike != nil {
+		t.Errorf("feels like %v, want none", *agg.feelsLike)
+	}
+}
+
+func TestNonFiniteTemperatures(t *testing.T) {
+	for _, bad := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+		_, err := newTestMW(newFake("bad", bad), newFake("good", 10)).aggregate(context.Background(), "London")
+		if err == nil || !strings.Contains(err.Error(), "bad: non-finite temperature") {
+			t.Errorf("%v: error %v, want bad's non-finite temperature", bad, err)
+		}
+	}
+}
+
+func TestNonFiniteFromUpstream(t *testing.T) {
+	// Finite as sent, but infinite once converted from Fahrenheit.
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"temp": 1.7e308}`))
+	}))
+	bad, err := newHTTPJSONProvider(providerConfig{Name: "bad", URL: "http://stub.example/{city}", Field: "temp", Unit: "f"}, providerEnv{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(bad, newFake("good", 10))
+
+	w := get(s.handleWeather, "/weather/London")
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("status %d, want 500: %s", w.Code, w.Body)
+	}
+	if !strings.Contains(w.Body.String(), "bad: non-finite temperature +Inf") {
+		t.Errorf("got %q, want bad's non-finite temperature", w.Body)
+	}
+}
+
+func TestReadingsInConfigurationOrder(t *testing.T) {
+	// Each answers sooner than the one configured before it.
+	var providers []weatherProvider
+	for i, name := range []string{"zulu", "alpha", "mike", "bravo"} {
+		p := newFake(name, float64(i))
+		p.delay = time.Duration(4-i) * 5 * time.Millisecond
+		providers = append(providers, p)
+	}
+	s := newTestServer(providers...)
+
+	var first string
+	for i := 0; i < 5; i++ {
+		w := get(s.handleWeather, fmt.Sprintf("/weather/City%d?detail=true&fields=providers", i))
+		var names []string
+		for _, p := range decode(t, w)["providers"].([]interface{}) {
+			names = append(names, p.(map[string]interface{})["provider"].(string))
+		}
+		if got := strings.Join(names, ","); got != "zulu,alpha,mike,bravo" {
+			t.Errorf("request %d: providers in order %s, want configuration order", i+1, got)
+		}
+		if i == 0 {
+			first = w.Body.String()
+		} else if w.Body.String() != first {
+			t.Errorf("request %d: output %s differs from %s", i+1, w.Body, first)
+		}
+	}
+}
+
+func TestPlausibleBounds(t *testing.T) {
+	mw := newTestMW(newFake("a", 20), newFake("b", 22), newFake("broken", 400), newFake("frozen", -120))
+	agg, err := mw.aggregate(context.Background(), "London")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agg.celsius != 21 || len(agg.readings) != 2 {
+		t.Errorf("celsius %v from %d readings, want 21 from the two in range", agg.celsius, len(agg.readings))
+	}
+	if len(agg.warnings) != 2 || !strings.Contains(agg.warnings[0]+agg.warnings[1], "broken excluded: implausible temperature 400.00°C") {
+		t.Errorf("warnings %q", agg.warnings)
+	}
+
+	// The bounds are inclusive.
+	if _, err := newTestMW(newFake("a", 60), newFake("b", -90)).aggregate(context.Background(), "London"); err != nil {
+		t.Errorf("readings on the bounds: %s", err)
+	}
+
+	if _, err := newTestMW(newFake("broken", 400)).aggregate(context.Background(), "London"); err == nil || !strings.Contains(err.Error(), "no plausible readings") {
+		t.Errorf("no plausible readings: error %v", err)
+	}
+}
+
+func TestPlausibleBoundsConfig(t *testing.T) {
+	var conf config
+	conf.Providers = []providerConfig{{Type: "openweathermap"}}
+	mw, err := getMultiWeatherProvider(conf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mw.minCelsius != -273.15 || !math.IsInf(mw.maxCelsius, 1) {
+		t.Errorf("default bounds %v, %v, want absolute zero and none", mw.minCelsius, mw.maxCelsius)
+	}
+
+	conf.Plausible.MinCelsius, conf.Plausible.MaxCelsius = ptr(-90.0), ptr(60.0)
+	if mw, err = getMultiWeatherProvider(conf, nil); err != nil {
+		t.Fatal(err)
+	}
+	if mw.minCelsius != -90 || mw.maxCelsius != 60 {
+		t.Errorf("bounds %v, %v, want -90, 60", mw.minCelsius, mw.maxCelsius)
+	}
+
+	// Absolute zero holds whatever the configured minimum.
+	conf.Plausible.MinCelsius = ptr(-500.0)
+	if mw, err = getMultiWeatherProvider(conf, nil); err != nil {
+		t.Fatal(err)
+	}
+	if mw.minCelsius != -273.15 {
+		t.Errorf("minimum %v, want absolute zero", mw.minCelsius)
+	}
+}
+
+func bearings(bs ...float64) []reading {
+	readings := make([]reading, len(bs))
+	for i := range bs {
+		readings[i] = reading{windBearing: &bs[i]}
+	}
+	return readings
+}
+
+func TestCircularMean(t *testing.T) {
+	bearing := func(r reading) *float64 { return r.windBearing }
+	for _, tt := range []struct {
+		bearings []float64
+		want     float64
+	}{
+		{[]float64{350, 10}, 0},
+		{[]float64{10, 350}, 0},
+		{[]float64{340, 0, 20}, 0},
+		{[]float64{355, 15}, 5},
+		{[]float64{170, 190}, 180},
+		{[]float64{90}, 90},
+		{[]float64{0, 90}, 45},
+		{[]float64{270, 360}, 315},
+	} {
+		got := circularMeanOf(bearings(tt.bearings...), bearing)
+		if got == nil || !near(math.Mod(*got+360-tt.want+180, 360)-180, 0) {
+			t.Errorf("circular mean of %v = %v, want %v", tt.bearings, got, tt.want)
+		}
+	}
+
+	for _, bs := range [][]float64{nil, {90, 270}, {0, 120, 240}} {
+		if got := circularMeanOf(bearings(bs...), bearing); got != nil {
+			t.Errorf("circular mean of %v = %v, want none", bs, *got)
+		}
+	}
+}
+
+func TestAggregateWind(t *testing.T) {
+	a, b, c := newFake("a", 10), newFake("b", 10), newFake("c", 10)
+	a.reading.windSpeed, a.reading.windBearing = ptr(4.0), ptr(350.0)
+	b.reading.windSpeed, b.reading.windBearing = ptr(6.0), ptr(10.0)
+	// c reports no wind, so it only counts towards the temperature.
+	s := newTestServer(a, b, c)
+
+	wind, _ := decode(t, get(s.handleWeather, "/weather/London"))["wind"].(map[string]interface{})
+	if wind == nil || !near(wind["speed"].(float64), 5) || !near(math.Mod(wind["bearing"].(float64)+180, 360)-180, 0) {
+		t.Errorf("wind %v, want speed 5 from bearing 0", wind)
+	}
+
+	s = newTestServer(newFake("a", 10))
+	if _, ok := decode(t, get(s.handleWeather, "/weather/London"))["wind"]; ok {
+		t.Error("wind reported without any wind data")
+	}
+}
+
+func TestCardinal(t *testing.T) {
+	for bearing, want := range map[float64]string{
+		0:        "N",
+		348.75:   "N",
+		11.2499:  "N",
+		11.25:    "NNE",
+		22.5:     "NNE",
+		33.75:    "NE",
+		90:       "E",
+		191.25:   "SSW",
+		348.7499: "NNW",
+		359.99:   "N",
+		360:      "N",
+		370:      "N",
+		-11.25:   "N",
+		-11.2501: "NNW",
+		-90:      "W",
+		720 + 45: "NE",
+	} {
+		if got := cardinal(bearing); got != want {
+			t.Errorf("cardinal(%v) = %s, want %s", bearing, got, want)
+		}
+	}
+}
+
+func TestCardinalWind(t *testing.T) {
+	a := newFake("a", 10)
+	a.reading.windSpeed, a.reading.windBearing = ptr(4.0), ptr(200.0)
+	s := newTestServer(a)
+	if _, ok := decode(t, get(s.handleWeather, "/weather/London"))["wind"].(map[string]interface{})["cardinal"]; ok {
+		t.Error("cardinal reported with cardinalWind off")
+	}
+	s.cardinal = true
+	if wind := decode(t, get(s.handleWeather, "/weather/London"))["wind"].(map[string]interface{}); wind["cardinal"] != "SSW" {
+		t.Errorf("wind %v, want from the SSW", wind)
+	}
+}
+
+func TestTrimmedMean(t *testing.T) {
+	trimmed := aggregators[trimmedAggregation]
+	for _, tt := range []struct {
+		temps []float64
+		want  float64
+	}{
+		{[]float64{10, 20}, 15},
+		{[]float64{10, 20, 90}, 20},
+		{[]float64{-40, 10, 11, 12, 50}, 11},
+		// Only one of several equal extremes is dropped.
+		{[]float64{10, 10, 10, 20, 20}, 40.0 / 3},
+	} {
+		readings := make([]reading, len(tt.temps))
+		for i, c := range tt.temps {
+			readings[i] = reading{provider: fmt.Sprint(i), celsius: c}
+		}
+		if got := trimmed(readings, nil).celsius; !near(got, tt.want) {
+			t.Errorf("trimmed mean of %v = %v, want %v", tt.temps, got, tt.want)
+		}
+	}
+}
+
+func TestTrimmedAggregationQuery(t *testing.T) {
+	s := newTestServer(newFake("a", 10), newFake("b", 11), newFake("c", 12), newFake("d", 13), newFake("e", 44))
+	if temp := number(t, decode(t, get(s.handleWeather, "/weather/London?units=c&agg=trimmed")), "temp"); !near(temp, 12) {
+		t.Errorf("?agg=trimmed: temp %v, want 12", temp)
+	}
+	if temp := number(t, decode(t, get(s.handleWeather, "/weather/London?units=c")), "temp"); !near(temp, 18) {
+		t.Errorf("mean: temp %v, want 18", temp)
+	}
+	if w := get(s.handleWeather, "/weather/London?agg=median-ish"); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown aggregation: status %d, want 400", w.Code)
+	}
+}
+
+func TestFreshAggregation(t *testing.T) {
+	now := time.Now()
+	observed := func(label string, celsius float64, age time.Duration) *fakeProvider {
+		p := newFake(label, celsius)
+		p.reading.observed = now.Add(-age)
+		return p
+	}
+	s := newTestServer(observed("a", 10, 0), observed("b", 20, 10*time.Minute), observed("c", 30, time.Hour))
+	// Weighted 1, 1/2 and 1/64 by age.
+	want := (10 + 20.0/2 + 30.0/64) / (1 + 1.0/2 + 1.0/64)
+	if temp := number(t, decode(t, get(s.handleWeather, "/weather/London?units=c&agg=fresh")), "temp"); math.Abs(temp-want) > 0.01 {
+		t.Errorf("?agg=fresh: temp %v, want %.2f", temp, want)
+	}
+	if temp := number(t, decode(t, get(s.handleWeather, "/weather/London?units=c")), "temp"); !near(temp, 20) {
+		t.Errorf("mean: temp %v, want 20", temp)
+	}
+
+	mw := s.mw
+	mw.aggregation = freshAggregation
+	agg, err := mw.aggregate(context.Background(), "Paris")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sum, weighted float64
+	for _, r := range agg.readings {
+		sum += *r.share
+		weighted += *r.share * r.celsius
+	}
+	if !near(sum, 1) || !near(weighted, agg.celsius) {
+		t.Errorf("shares sum to %v and weigh to %v, want 1 and the temperature %v", sum, weighted, agg.celsius)
+	}
+}
+
+func TestRegisterAggregator(t *testing.T) {
+	var given []reading
+	RegisterAggregator("Median", func(readings []reading, weights *providerWeights) reading {
+		given = readings
+		cs := make([]float64, len(readings))
+		for i, r := range readings {
+			cs[i] = r.celsius
+		}
+		sort.Float64s(cs)
+		return reading{celsius: cs[len(cs)/2]}
+	})
+	t.Cleanup(func() { delete(aggregators, "median") })
+
+	a, err := parseAggregation("MEDIAN")
+	if err != nil || a != "median" {
+		t.Fatalf("parseAggregation = %q, %v", a, err)
+	}
+	s := newTestServer(newFake("a", 10), newFake("b", 11), newFake("c", 44))
+	if temp := number(t, decode(t, get(s.handleWeather, "/weather/London?agg=median")), "temp"); temp != 11 {
+		t.Errorf("?agg=median: temp %v, want 11", temp)
+	}
+	if len(given) != 3 {
+		t.Errorf("aggregator given %d readings, want all 3", len(given))
+	}
+	// The rest of the answer is summarized as for any aggregation.
+	s.mw.aggregation = a
+	s.cache = newMemoryCache(0)
+	if body := decode(t, get(s.handleWeather, "/weather/London?detail=true")); number(t, body, "temp") != 11 || len(body["providers"].([]interface{})) != 3 {
+		t.Errorf("configured median: %v", body)
+	}
+
+	if _, err := parseAggregation("mode"); err == nil || !strings.Contains(err.Error(), "median") {
+		t.Errorf("unknown aggregation: %v, want the registered names", err)
+	}
+}
+
+func TestRegisterAggregatorTaken(t *testing.T) {
+	for _, name := range []string{"mean", "First", ""} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("registering %q didn't panic", name)
+				}
+			}()
+			RegisterAggregator(name, aggregators[meanAggregation])
+		}()
+	}
+}
+
+func TestAggregatePressure(t *testing.T) {
+	a, b, c := newFake("a", 10), newFake("b", 20), newFake("c", 30)
+	a.reading.pressure, b.reading.pressure = ptr(1000.0), ptr(1020.0)
+	// c reports no pressure; it counts towards the temperature only.
+	agg, err := newTestMW(a, b, c).aggregate(context.Background(), "London")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agg.celsius != 20 || agg.pressure == nil || *agg.pressure != 1010 {
+		t.Errorf("celsius %v, pressure %v; want 20 from all three and 1010 from a and b", agg.celsius, agg.pressure)
+	}
+
+	s := newTestServer(a, b, c)
+	if got := number(t, decode(t, get(s.handleWeather, "/weather/London")), "pressure"); got != 1010 {
+		t.Errorf("/weather/ pressure %v, want 1010", got)
+	}
+
+	agg, _ = newTestMW(newFake("a", 10)).aggregate(context.Background(), "London")
+	if agg.pressure != nil {
+		t.Errorf("no provider reports pressure, but got %v", *agg.pressure)
+	}
+}
+
+// orderedProvider records the order providers are called in.
+type orderedProvider struct {
+	*fakeProvider
+	mu      *sync.Mutex
+	order   *[]string
+	running *maxCounter
+}
+
+func (p orderedProvider) temperature(ctx context.Context, city string) (reading, error) {
+	p.running.enter()
+	defer p.running.leave()
+	p.mu.Lock()
+	*p.order = append(*p.order, p.label)
+	p.mu.Unlock()
+	return p.fakeProvider.temperature(ctx, city)
+}
+
+func TestSequentialProviders(t *testing.T) {
+	for _, sequential := range []bool{true, false} {
+		var (
+			mu      sync.Mutex
+			order   []string
+			running maxCounter
+		)
+		var providers []weatherProvider
+		for i, label := range []string{"a", "b", "c", "d"} {
+			p := newFake(label, float64(i))
+			// Later providers answer faster, so they would finish first
+			// if called at once.
+			p.delay = time.Duration(4-i) * 10 * time.Millisecond
+			providers = append(providers, orderedProvider{p, &mu, &order, &running})
+		}
+		mw := newTestMW(providers...)
+		mw.sequential = sequential
+		agg, err := mw.aggregate(context.Background(), "London")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if agg.celsius != 1.5 {
+			t.Errorf("sequential %v: celsius %v, want 1.5", sequential, agg.celsius)
+		}
+		if sequential {
+			if strings.Join(order, ",") != "a,b,c,d" || running.max.Load() != 1 {
+				t.Errorf("called %v with up to %d at once, want a,b,c,d one at a time", order, running.max.Load())
+			}
+		} else if running.max.Load() < 2 {
+			t.Errorf("parallel: at most %d called at once", running.max.Load())
+		}
+	}
+}
+
+func TestRequireFresh(t *testing.T) {
+	observed := func(label string, celsius float64, age time.Duration) *fakeProvider {
+		p := newFake(label, celsius)
+		if age > 0 {
+			p.reading.observed = time.Now().Add(-age)
+		}
+		return p
+	}
+	for _, tt := range []struct {
+		name      string
+		providers []weatherProvider
+		want      float64 // 0 if the aggregate should fail
+	}{
+		{"only stale", []weatherProvider{observed("a", 10, 2*time.Hour), observed("b", 20, 3*time.Hour)}, 0},
+		{"no observation times", []weatherProvider{observed("a", 10, 0)}, 0},
+		{"only fresh", []weatherProvider{observed("a", 10, time.Minute), observed("b", 20, 5*time.Minute)}, 15},
+		// One fresh source is enough, and the stale ones still count.
+		{"mixed", []weatherProvider{observed("a", 10, 2*time.Hour), observed("b", 20, time.Minute)}, 15},
+	} {
+		mw := newTestMW(tt.providers...)
+		mw.requireFresh = 30 * time.Minute
+		agg, err := mw.aggregate(context.Background(), "London")
+		switch {
+		case tt.want == 0 && (err == nil || !strings.Contains(err.Error(), "no reading observed within the last 30m0s")):
+			t.Errorf("%s: error %v, want no fresh reading", tt.name, err)
+		case tt.want != 0 && err != nil:
+			t.Errorf("%s: %s", tt.name, err)
+		case tt.want != 0 && agg.celsius != tt.want:
+			t.Errorf("%s: celsius %v, want %v", tt.name, agg.celsius, tt.want)
+		}
+	}
+}
+
+func TestRequireFreshConfig(t *testing.T) {
+	var conf config
+	if err := json.Unmarshal([]byte(`{"requireFresh": "30m", "providers": [{"type": "openweathermap"}]}`), &conf); err != nil {
+		t.Fatal(err)
+	}
+	mw, err := getMultiWeatherProvider(conf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mw.requireFresh != 30*time.Minute {
+		t.Errorf("requireFresh %s, want 30m", mw.requireFresh)
+	}
+}
+
+func TestAggregateUVIndex(t *testing.T) {
+	a, b, c := newFake("a", 10), newFake("b", 10), newFake("c", 10)
+	a.reading.uvIndex, b.reading.uvIndex = ptr(2.0), ptr(6.0)
+	// c reports no UV index, so it doesn't drag the mean down.
+	for _, tt := range []struct {
+		meanUV bool
+		want   float64
+	}{
+		{false, 6},
+		{true, 4},
+	} {
+		mw := newTestMW(a, b, c)
+		mw.meanUV = tt.meanUV
+		agg, err := mw.aggregate(context.Background(), "London")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if agg.uvIndex == nil || *agg.uvIndex != tt.want {
+			t.Errorf("meanUV %v: UV index %v, want %v", tt.meanUV, agg.uvIndex, tt.want)
+		}
+	}
+
+	agg, _ := newTestMW(newFake("a", 10)).aggregate(context.Background(), "London")
+	if agg.uvIndex != nil {
+		t.Errorf("no provider reports UV, but got %v", *agg.uvIndex)
+	}
+
+	for uv, c := range map[string]bool{"": false, "max": false, "mean": true} {
+		conf := config{UVIndex: uv, Providers: []providerConfig{{Type: "openweathermap"}}}
+		if mw, err := getMultiWeatherProvider(conf, nil); err != nil || mw.meanUV != c {
+			t.Errorf("uvIndex %q: meanUV %v, %v", uv, mw.meanUV, err)
+		}
+	}
+	if _, err := getMultiWeatherProvider(config{UVIndex: "median"}, nil); err == nil {
+		t.Error("no error for an unknown uvIndex aggregation")
+	}
+}
+
+func TestRequiredProviders(t *testing.T) {
+	nws, other := newFake("nws", 10), newFake("other", 12)
+	mw := newTestMW(nws, other)
+	mw.required = []string{"nws"}
+	agg, err := mw.aggregate(context.Background(), "Boston")
+	if err != nil || agg.celsius != 11 {
+		t.Errorf("required present: celsius %v, %v; want 11", agg.celsius, err)
+	}
+
+	// Excluded readings don't satisfy the requirement, even though the
+	// others alone would make an average.
+	nws.reading.celsius = 400
+	if _, err := mw.aggregate(context.Background(), "Boston"); err == nil || !strings.Contains(err.Error(), "required provider nws has no reading") {
+		t.Errorf("required implausible: error %v", err)
+	}
+	nws.reading.celsius, nws.err = 10, errors.New("nws down")
+	if _, err := mw.aggregate(context.Background(), "Boston"); err == nil || !strings.Contains(err.Error(), "nws down") {
+		t.Errorf("required failing: error %v", err)
+	}
+}
+
+func TestRequiredProvidersConfig(t *testing.T) {
+	conf := config{RequiredProviders: []string{"openWeatherMap"}, Providers: []providerConfig{{Type: "openweathermap"}, {Type: "weatherunderground"}}}
+	mw, err := getMultiWeatherProvider(conf, nil)
+	if err != nil || len(mw.required) != 1 || mw.required[0] != "openWeatherMap" {
+		t.Errorf("required %v, %v", mw.required, err)
+	}
+	conf.RequiredProviders = []string{"nws"}
+	if _, err := getMultiWeatherProvider(conf, nil); err == nil || !strings.Contains(err.Error(), `required provider "nws" is not configured`) {
+		t.Errorf("unconfigured required provider: error %v", err)
+	}
+}
+
+// cancelWatcher reports on cancelled when its call is cancelled.
+type cancelWatcher struct {
+	*fakeProvider
+	cancelled chan string
+}
+
+func (p cancelWatcher) temperature(ctx context.Context, city string) (reading, error) {
+	r, err := p.fakeProvider.temperature(ctx, city)
+	if ctx.Err() != nil {
+		p.cancelled <- p.label
+	}
+	return r, err
+}
+
+func TestFirstAggregation(t *testing.T) {
+	cancelled := make(chan string, 2)
+	fast, failing, implausible := newFake("fast", 10), newFake("failing", 0), newFake("implausible", 400)
+	failing.err = errors.New("down")
+	slow1, slow2 := newFake("slow1", 20), newFake("slow2", 30)
+	slow1.delay, slow2.delay = time.Second, time.Second
+	fast.delay = 10 * time.Millisecond
+	mw := newTestMW(cancelWatcher{slow1, cancelled}, failing, implausible, fast, cancelWatcher{slow2, cancelled})
+	mw.aggregation = firstAggregation
+
+	begin := time.Now()
+	agg, err := mw.aggregate(context.Background(), "London")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agg.celsius != 10 || len(agg.readings) != 1 || agg.readings[0].provider != "fast" {
+		t.Errorf("got %v from %v, want fast's 10", agg.celsius, agg.readings)
+	}
+	if took := time.Since(begin); took > 500*time.Millisecond {
+		t.Errorf("took %s, want to return with the fastest", took)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-cancelled:
+		case <-time.After(500 * time.Millisecond):
+			t.Fatalf("only %d of the slow providers were cancelled", i)
+		}
+	}
+}
+
+func TestFirstAggregationAllFail(t *testing.T) {
+	a, b := newFake("a", 0), newFake("b", 400)
+	a.err = errors.New("a down")
+	mw := newTestMW(a, b)
+	mw.aggregation = firstAggregation
+	if _, err := mw.aggregate(context.Background(), "London"); err == nil || !strings.Contains(err.Error(), "a down") {
+		t.Errorf("error %v, want a's failure", err)
+	}
+}
+
+func TestTimeoutModes(t *testing.T) {
+	// The fan-out waits 1500ms, so the modes run side by side.
+	for _, strict := range []bool{false, true} {
+		t.Run(fmt.Sprintf("strict=%v", strict), func(t *testing.T) {
+			t.Parallel()
+			slow := newFake("slow", 30)
+			slow.delay = 3 * time.Second
+			mw := newTestMW(newFake("a", 10), slow, newFake("b", 12))
+			mw.strictTimeouts = strict
+			agg, err := mw.aggregate(context.Background(), "London")
+			if strict {
+				if err == nil || !strings.Contains(err.Error(), "timed out waiting for slow") {
+					t.Errorf("error %v, want slow's timeout", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if agg.celsius != 11 {
+				t.Errorf("celsius %v, want 11 from the providers that answered", agg.celsius)
+			}
+			if len(agg.warnings) != 1 || agg.warnings[0] != "slow timed out; excluded from the average" {
+				t.Errorf("warnings %q", agg.warnings)
+			}
+		})
+	}
+}
+
+func TestTimeoutsConfig(t *testing.T) {
+	for timeouts, strict := range map[string]bool{"": false, "lenient": false, "strict": true} {
+		mw, err := getMultiWeatherProvider(config{Timeouts: timeouts, Providers: []providerConfig{{Type: "openweathermap"}}}, nil)
+		if err != nil || mw.strictTimeouts != strict {
+			t.Errorf("timeouts %q: strict %v, %v", timeouts, mw.strictTimeouts, err)
+		}
+	}
+	if _, err := getMultiWeatherProvider(config{Timeouts: "patient"}, nil); err == nil {
+		t.Error("no error for an unknown timeouts mode")
+	}
+}
+
+func TestConsensusGate(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		temps    []float64
+		within   float64
+		agreeing int
+		ok       bool
+	}{
+		{"all agree", []float64{10, 11, 12}, 2, 0, true},
+		{"one strays", []float64{10, 11, 15}, 2, 0, false},
+		{"enough agree", []float64{10, 11, 15}, 2, 2, true},
+		{"too few agree", []float64{10, 13, 16}, 2, 2, false},
+		{"a run in the middle", []float64{0, 9, 10, 11, 25}, 2, 3, true},
+		{"exactly at the limit", []float64{10, 12}, 2, 0, true},
+	} {
+		var readings []reading
+		for i, c := range tt.temps {
+			readings = append(readings, reading{provider: string(rune('a' + i)), celsius: c})
+		}
+		err := consensus(readings, tt.within, tt.agreeing)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: consensus = %v, want ok %t", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestConsensusResponses(t *testing.T) {
+	// Reached: the answer is still the mean of every reading.
+	s := newTestServer(newFake("a", 10), newFake("b", 11), newFake("c", 12))
+	s.mw.consensusWithin = 2
+	w := get(s.handleWeather, "/weather/London")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200: %s", w.Code, w.Body)
+	}
+	if got := number(t, decode(t, w), "temp"); !near(got, 11) {
+		t.Errorf("temp %v, want 11", got)
+	}
+
+	// Failed: a 409 listing the readings, lowest first.
+	s = newTestServer(newFake("a", 18), newFake("b", 10), newFake("c", 11))
+	s.mw.consensusWithin, s.mw.consensusMin = 2, 3
+	w = get(s.handleWeather, "/weather/London")
+	if w.Code != http.StatusConflict {
+		t.Fatalf("status %d, want 409: %s", w.Code, w.Body)
+	}
+	body := w.Body.String()
+	for _, want := range []string{"no consensus within 2°C", "b 10.00°C, c 11.00°C, a 18.00°C"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("body %q, want it to contain %q", body, want)
+		}
+	}
+}
+
+func TestCityProviderOverrides(t *testing.T) {
+	us, eu, other := newFake("us", 10), newFake("eu", 20), newFake("other", 40)
+	s := newTestServer(us, eu, other)
+	s.mw.overrides = map[string][]weatherProvider{
+		"us":        {us},
+		"paris,fr":  {eu},
+		"boston,us": {us, other},
+	}
+	for _, tt := range []struct {
+		city string
+		want float64
+	}{
+		{"Denver,US", 10},     // by country code
+		{"Boston,%20US", 25},  // the city's own entry wins over its country's
+		{"paris,%20FR", 20},   // normalized before lookup
+		{"London", 70.0 / 3},  // no override: every provider
+		{"Paris", 70.0 / 3},   // only "paris,fr" is overridden
+		{"Lyon,FR", 70.0 / 3}, // no entry for FR
+	} {
+		if got := number(t, decode(t, get(s.handleWeather, "/weather/"+tt.city)), "temp"); !near(got, tt.want) {
+			t.Errorf("%s: temp %v, want %v", tt.city, got, tt.want)
+		}
+	}
+}
+
+func TestCityProvidersConfig(t *testing.T) {
+	parse := func(body string) (multiWeatherProvider, error) {
+		var conf config
+		if err := json.Unmarshal([]byte(body), &conf); err != nil {
+			t.Fatal(err)
+		}
+		return getMultiWeatherProvider(conf, nil)
+	}
+	providers := `"providers": [{"type": "openweathermap"}, {"type": "forecastio", "apiKey": "k"}]`
+
+	mw, err := parse(`{` + providers + `, "cityProviders": {"Boston, US": ["openWeatherMap"]}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := mw.forCity("boston,us").providers; len(got) != 1 || got[0].name() != "openWeatherMap" {
+		t.Errorf("Boston uses %v, want openWeatherMap alone", got)
+	}
+	if got := mw.forCity("London").providers; len(got) != 2 {
+		t.Errorf("London uses %v, want every provider", got)
+	}
+
+	if _, err := parse(`{` + providers + `, "cityProviders": {"boston": ["nws"]}}`); err == nil {
+		t.Error("an override naming an unconfigured provider was accepted")
+	}
+	if _, err := parse(`{` + providers + `, "requiredProviders": ["forecastIo"],
+		"cityProviders": {"boston": ["openWeatherMap"]}}`); err == nil {
+		t.Error("an override leaving out a required provider was accepted")
+	}
+}
+
+func TestFirstPriorityStagger(t *testing.T) {
+	const stagger = 200 * time.Millisecond
+	race := func(preferredDelay time.Duration, preferredErr error) (aggregate, time.Duration, *fakeProvider, *fakeProvider) {
+		t.Helper()
+		fast, preferred, last := newFake("fast", 10), newFake("preferred", 20), newFake("last", 30)
+		preferred.delay, preferred.err = preferredDelay, preferredErr
+		mw := newTestMW(fast, last, preferred)
+		mw.aggregation, mw.priority, mw.stagger = firstAggregation, []string{"preferred"}, stagger
+		begin := time.Now()
+		agg, err := mw.aggregate(context.Background(), "London")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return agg, time.Since(begin), fast, last
+	}
+
+	// Within its window, the preferred provider wins though the others
+	// would have answered at once, and the rest are never called.
+	agg, took, fast, last := race(50*time.Millisecond, nil)
+	if agg.readings[0].provider != "preferred" || took >= stagger {
+		t.Errorf("within the stagger %s won in %s, want preferred", agg.readings[0].provider, took)
+	}
+	if n := fast.calls.Load() + last.calls.Load(); n != 0 {
+		t.Errorf("%d other providers called, want none", n)
+	}
+
+	// Too slow, and the next in configuration order starts after the
+	// stagger and wins.
+	agg, took, _, last = race(time.Second, nil)
+	if agg.readings[0].provider != "fast" {
+		t.Errorf("past the stagger %s won, want fast", agg.readings[0].provider)
+	}
+	if took < stagger || took > stagger+300*time.Millisecond {
+		t.Errorf("took %s, want about the %s stagger", took, stagger)
+	}
+	if last.calls.Load() != 0 {
+		t.Error("the last provider was called after fast had won")
+	}
+
+	// A failure starts the next provider straight away.
+	agg, took, _, _ = race(0, errors.New("down"))
+	if agg.readings[0].provider != "fast" || took >= stagger {
+		t.Errorf("after a failure %s won in %s, want fast before the stagger", agg.readings[0].provider, took)
+	}
+}
+
+func TestFirstPriorityConfig(t *testing.T) {
+	providers := []providerConfig{{Type: "openweathermap"}, {Type: "forecastio"}}
+	conf := config{Providers: providers}
+	conf.First.Priority = []string{"forecastio"}
+	mw, err := getMultiWeatherProvider(conf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mw.priority) != 1 || mw.priority[0] != "forecastIo" || mw.stagger != 250*time.Millisecond {
+		t.Errorf("priority %v, stagger %s, want forecastIo and the 250ms default", mw.priority, mw.stagger)
+	}
+	if got := mw.prioritized(mw.providers); got[0].name() != "forecastIo" || got[1].name() != "openWeatherMap" {
+		t.Errorf("prioritized order %v, want forecastIo first", got)
+	}
+
+	conf.First.Priority = []string{"nws"}
+	if _, err := getMultiWeatherProvider(conf, nil); err == nil {
+		t.Error("an unconfigured priority provider was accepted")
+	}
+	if mw, _ := getMultiWeatherProvider(config{Providers: providers}, nil); mw.stagger != 0 {
+		t.Errorf("stagger %s without a priority, want a plain race", mw.stagger)
+	}
+}
+
+func TestProviderCache(t *testing.T) {
+	var upstream atomic.Int32
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream.Add(1)
+		w.Write([]byte(`{"name":"London","main":{"temp":10}}`))
+	}))
+	var conf config
+	if err := json.Unmarshal([]byte(`{"providers": [{"type": "openweathermap", "cacheTTL": "1h"}]}`), &conf); err != nil {
+		t.Fatal(err)
+	}
+	mw, err := getMultiWeatherProvider(conf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, cached := range []bool{false, true, true} {
+		agg, err := mw.aggregate(context.Background(), "London")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if agg.celsius != 10 || agg.readings[0].cached != cached {
+			t.Errorf("aggregate %d: %v, cached %t, want 10, cached %t", i, agg.celsius, agg.readings[0].cached, cached)
+		}
+	}
+	if n := upstream.Load(); n != 1 {
+		t.Errorf("%d upstream calls, want the cached reading reused", n)
+	}
+	mw.aggregate(context.Background(), "Paris")
+	if n := upstream.Load(); n != 2 {
+		t.Errorf("%d upstream calls, want readings cached per location", n)
+	}
+}
+
+func TestProviderCacheSlowProvider(t *testing.T) {
+	slow, fast, failing := newFake("slow", 10), newFake("fast", 20), newFake("failing", 0)
+	slow.delay = 300 * time.Millisecond
+	failing.err = errors.New("down")
+	mw := newTestMW(slow, fast)
+	mw.recent = map[string]*locationCache[reading]{
+		"slow":    newLocationCache[reading](100 * time.Millisecond),
+		"failing": newLocationCache[reading](time.Hour),
+	}
+	run := func() (aggregate, time.Duration) {
+		t.Helper()
+		begin := time.Now()
+		agg, err := mw.aggregate(context.Background(), "London")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return agg, time.Since(begin)
+	}
+
+	run()
+	// The slow provider's recent reading answers at once; the fast one is
+	// still asked fresh.
+	agg, took := run()
+	if took >= slow.delay || agg.celsius != 15 {
+		t.Errorf("with slow's reading cached took %s for %v, want 15 at once", took, agg.celsius)
+	}
+	if slow.calls.Load() != 1 || fast.calls.Load() != 2 {
+		t.Errorf("slow called %d times and fast %d, want 1 and 2", slow.calls.Load(), fast.calls.Load())
+	}
+
+	// Each provider's readings expire on their own TTL.
+	time.Sleep(100 * time.Millisecond)
+	run()
+	if slow.calls.Load() != 2 {
+		t.Errorf("slow called %d times, want again after its TTL", slow.calls.Load())
+	}
+
+	// Failures aren't remembered.
+	mw.providers = []weatherProvider{failing}
+	mw.aggregate(context.Background(), "London")
+	mw.aggregate(context.Background(), "London")
+	if failing.calls.Load() != 2 {
+		t.Errorf("failing called %d times, want every failure retried", failing.calls.Load())
+	}
+}
+
+func TestProviderCacheDetail(t *testing.T) {
+	p := newFake("fake", 10)
+	s := newTestServer(p)
+	s.mw.recent = map[string]*locationCache[reading]{"fake": newLocationCache[reading](time.Hour)}
+	s.mw.recent["fake"].set("London", reading{provider: "fake", celsius: 12})
+
+	body := decode(t, get(s.handleWeather, "/weather/London?detail=true"))
+	detail := body["providers"].([]interface{})[0].(map[string]interface{})
+	if detail["cached"] != true || number(t, body, "temp") != 12 || p.calls.Load() != 0 {
+		t.Errorf("got %v, want the cached 12 marked cached without a call", body)
+	}
+}
+
+func TestProviderSelection(t *testing.T) {
+	a, b, c := newFake("openWeatherMap", 10), newFake("nws", 20), newFake("forecastIo", 40)
+	s := newTestServer(a, b, c)
+	s.mw.overrides = map[string][]weatherProvider{"paris": {c}}
+
+	for _, tt := range []struct {
+		target string
+		want   float64
+	}{
+		{"/weather/London?providers=openweathermap,NWS", 15},
+		{"/weather/London?providers=nws,%20nws", 20},
+		{"/weather/London", 70.0 / 3},
+		// A selection replaces the city's override.
+		{"/weather/Paris?providers=openWeatherMap", 10},
+		{"/weather/Paris", 40},
+	} {
+		w := get(s.handleWeather, tt.target)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", tt.target, w.Code, w.Body)
+		}
+		if got := number(t, decode(t, w), "temp"); !near(got, tt.want) {
+			t.Errorf("%s: temp %v, want %v", tt.target, got, tt.want)
+		}
+	}
+	// Each selection is cached apart: the second round asks no one.
+	calls := a.calls.Load() + b.calls.Load() + c.calls.Load()
+	get(s.handleWeather, "/weather/London?providers=NWS,openWeatherMap")
+	if n := a.calls.Load() + b.calls.Load() + c.calls.Load(); n != calls {
+		t.Errorf("%d provider calls for a cached selection, want none", n-calls)
+	}
+
+	for _, target := range []string{
+		"/weather/London?providers=openweathermap,accuweather",
+		"/weather/London?providers=,",
+	} {
+		if w := get(s.handleWeather, target); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "unknown provider") {
+			t.Errorf("%s: status %d %q, want a 400 naming the provider", target, w.Code, w.Body)
+		}
+	}
+	s.mw.required = []string{"nws"}
+	if w := get(s.handleWeather, "/weather/London?providers=openWeatherMap"); w.Code != http.StatusBadRequest {
+		t.Errorf("leaving out a required provider: status %d, want 400", w.Code)
+	}
+}
+
+func TestSelectionCanonical(t *testing.T) {
+	mw := newTestMW(newFake("openWeatherMap", 10), newFake("nws", 20))
+	got, err := mw.selection(" OpenWeatherMap,nws,NWS")
+	if err != nil || got != "nws,openWeatherMap" {
+		t.Errorf("selection = %q, %v, want nws,openWeatherMap", got, err)
+	}
+	if k := (cacheKey{city: "London", aggregation: meanAggregation, providers: got}).String(); k != "mean[nws,openWeatherMap]:London" {
+		t.Errorf("cache key %q", k)
+	}
+}
+
+func TestStddev(t *testing.T) {
+	temps := func(cs ...float64) []reading {
+		readings := make([]reading, len(cs))
+		for i, c := range cs {
+			readings[i] = reading{celsius: c}
+		}
+		return readings
+	}
+	for _, tt := range []struct {
+		readings []reading
+		want     float64
+	}{
+		{temps(2, 4, 4, 4, 5, 5, 7, 9), math.Sqrt(32.0 / 7)},
+		{temps(10, 20), math.Sqrt(50)},
+		{temps(-3, -3, -3), 0},
+	} {
+		if got := stddev(tt.readings); got == nil || !near(*got, tt.want) {
+			t.Errorf("stddev(%v) = %v, want %v", tt.readings, got, tt.want)
+		}
+	}
+	for _, readings := range [][]reading{nil, temps(10)} {
+		if got := stddev(readings); got != nil {
+			t.Errorf("stddev of %d readings = %v, want none", len(readings), *got)
+		}
+	}
+}
+
+func TestStddevResponse(t *testing.T) {
+	s := newTestServer(newFake("a", 10), newFake("b", 20))
+	for units, want := range map[string]float64{"c": math.Sqrt(50), "f": 1.8 * math.Sqrt(50), "k": math.Sqrt(50)} {
+		body := decode(t, get(s.handleWeather, "/weather/London?detail=true&units="+units))
+		if got := number(t, body, "stddev"); !near(got, want) {
+			t.Errorf("units=%s: stddev %v, want %v", units, got, want)
+		}
+	}
+	if _, ok := decode(t, get(s.handleWeather, "/weather/London"))["stddev"]; ok {
+		t.Error("stddev reported without detail")
+	}
+	s = newTestServer(newFake("a", 10))
+	if _, ok := decode(t, get(s.handleWeather, "/weather/London?detail=true"))["stddev"]; ok {
+		t.Error("stddev reported for a single reading")
+	}
+}
+
+func TestGeocodedReadingCache(t *testing.T) {
+	var mu sync.Mutex
+	hits := make(map[string]int)
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits[r.Host]++
+		mu.Unlock()
+		switch r.Host {
+		case "maps.googleapis.com":
+			w.Write([]byte(`{"status":"OK","results":[{"geometry":{"location":{"lat":51.5,"lng":-0.12}}}]}`))
+		case "api.forecast.io":
+			w.Write([]byte(`{"currently":{"temperature":10}}`))
+		default:
+			w.Write([]byte(`{"name":"London","main":{"temp":12}}`))
+		}
+	}))
+	took := func() map[string]int {
+		mu.Lock()
+		defer mu.Unlock()
+		h := hits
+		hits = make(map[string]int)
+		return h
+	}
+	var conf config
+	if err := json.Unmarshal([]byte(`{"geocoder": {"readingTTL": "50ms"},
+		"providers": [{"type": "forecastio", "apiKey": "k"}, {"type": "openweathermap"}]}`), &conf); err != nil {
+		t.Fatal(err)
+	}
+	geo, err := newGeocoder(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mw, err := getMultiWeatherProvider(conf, geo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mw.recent["openWeatherMap"] != nil {
+		t.Error("a provider that doesn't geocode got a reading cache")
+	}
+	aggregate := func() {
+		t.Helper()
+		if agg, err := mw.aggregate(context.Background(), "London"); err != nil || agg.celsius != 11 {
+			t.Fatalf("aggregate = %v, %v", agg.celsius, err)
+		}
+	}
+
+	aggregate()
+	if h := took(); h["maps.googleapis.com"] != 1 || h["api.forecast.io"] != 1 {
+		t.Fatalf("first lookup: %v, want a geocode and a weather call", h)
+	}
+	// A hit skips both hops; other providers are still asked.
+	aggregate()
+	if h := took(); h["maps.googleapis.com"] != 0 || h["api.forecast.io"] != 0 || h["api.openweathermap.org"] != 1 {
+		t.Errorf("cache hit: %v, want only OpenWeatherMap called", h)
+	}
+	// Once the reading expires the weather is fetched again, but the
+	// coordinates are still in the geocode cache.
+	time.Sleep(60 * time.Millisecond)
+	aggregate()
+	if h := took(); h["maps.googleapis.com"] != 0 || h["api.forecast.io"] != 1 {
+		t.Errorf("after the reading expired: %v, want a weather call alone", h)
+	}
+
+	// The providers share the server's geocoder: a city it placed isn't
+	// geocoded again for them.
+	if _, err := geo.geocode(context.Background(), "Paris"); err != nil {
+		t.Fatal(err)
+	}
+	took()
+	if agg, err := mw.aggregate(context.Background(), "Paris"); err != nil || agg.celsius != 11 {
+		t.Fatalf("Paris: %v, %v", agg.celsius, err)
+	}
+	if h := took(); h["maps.googleapis.com"] != 0 || h["api.forecast.io"] != 1 {
+		t.Errorf("Paris: %v, want the server's geocode reused", h)
+	}
+}
+
+func TestGeocodedReadingCacheConfig(t *testing.T) {
+	var conf config
+	if err := json.Unmarshal([]byte(`{"geocoder": {"readingTTL": "5m"},
+		"providers": [{"type": "forecastio", "apiKey": "k", "cacheTTL": "1h"}]}`), &conf); err != nil {
+		t.Fatal(err)
+	}
+	mw, err := getMultiWeatherProvider(conf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl := mw.recent["forecastIo"].ttl; ttl != time.Hour {
+		t.Errorf("TTL %s, want the provider's own 1h", ttl)
+	}
+}
+
+func TestLateReadingsKept(t *testing.T) {
+	// The fan-out deadline is 1500ms; these answer just after it.
+	fast, slow, failing := newFake("fast", 10), newFake("slow", 20), newFake("failing", 0)
+	slow.delay, failing.delay = 1600*time.Millisecond, 1600*time.Millisecond
+	failing.err = errors.New("down")
+	mw := newTestMW(fast, slow, failing)
+	mw.lateWait = time.Second
+	mw.late = map[string]*locationCache[reading]{
+		"fast": newLocationCache[reading](time.Minute), "slow": newLocationCache[reading](time.Minute), "failing": newLocationCache[reading](time.Minute),
+	}
+	logs := captureLog(t)
+
+	// The request going away doesn't cut the stragglers short.
+	ctx, cancel := context.WithCancel(context.Background())
+	agg, err := mw.aggregate(ctx, "London")
+	cancel()
+	if err != nil || agg.celsius != 10 {
+		t.Fatalf("first lookup: %v, %v, want fast's 10 alone", agg.celsius, err)
+	}
+	time.Sleep(300 * time.Millisecond)
+
+	if !strings.Contains(logs.String(), "slow answered late") || !strings.Contains(logs.String(), "failing failed after the deadline") {
+		t.Errorf("drain log %q, want both stragglers", logs)
+	}
+	if _, ok := mw.late["failing"].lookup("London"); ok {
+		t.Error("a late failure was kept")
+	}
+
+	// The next lookup uses the late reading without waiting on it again.
+	mw.providers = []weatherProvider{fast, slow}
+	begin := time.Now()
+	if agg, err = mw.aggregate(context.Background(), "London"); err != nil || agg.celsius != 15 {
+		t.Errorf("second lookup: %v, %v, want the mean with slow's late 20", agg.celsius, err)
+	}
+	if took := time.Since(begin); took > 500*time.Millisecond || slow.calls.Load() != 1 {
+		t.Errorf("second lookup took %s and called slow %d times, want its kept reading at once", took, slow.calls.Load())
+	}
+}
+
+func TestLateReadingsConfig(t *testing.T) {
+	var conf config
+	if err := json.Unmarshal([]byte(`{"lateReadings": {"ttl": "1m"},
+		"providers": [{"type": "openweathermap"}, {"type": "forecastio", "cacheTTL": "1h"}]}`), &conf); err != nil {
+		t.Fatal(err)
+	}
+	mw, err := getMultiWeatherProvider(conf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mw.lateWait != 5*time.Second || mw.late["openWeatherMap"] == nil {
+		t.Errorf("lateWait %s, late caches %v, want 5s and one for openWeatherMap", mw.lateWait, mw.late)
+	}
+	// A provider with its own cache keeps late readings there.
+	if mw.late["forecastIo"] != nil {
+		t.Error("forecastIo got a late cache beside its own")
+	}
+}
+
+func TestConsensusPlace(t *testing.T) {
+	at := func(places ...string) []reading {
+		readings := make([]reading, len(places))
+		for i, p := range places {
+			readings[i] = reading{place: p}
+		}
+		return readings
+	}
+	for _, tt := range []struct {
+		name     string
+		readings []reading
+		want     string
+	}{
+		{"qualified differently", at("London, GB", "London, England, United Kingdom"), "London, GB"},
+		{"majority", at("London, GB", "Paris, FR", "paris, Texas"), "Paris, FR"},
+		{"unnamed readings get no vote", at("", "", "London, Ontario"), "London, Ontario"},
+		{"none named", at("", ""), ""},
+	} {
+		if got := consensusPlace(tt.readings); got != tt.want {
+			t.Errorf("%s: %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPlaceResponse(t *testing.T) {
+	a, b, c := newFake("a", 10), newFake("b", 10), newFake("c", 10)
+	a.reading.place, b.reading.place = "London, CA", "London, Ontario, Canada"
+	s := newTestServer(a, b, c)
+
+	body := decode(t, get(s.handleWeather, "/weather/London?detail=true"))
+	if body["place"] != "London, CA" {
+		t.Errorf("place %v, want London, CA", body["place"])
+	}
+	places := map[interface{}]interface{}{}
+	for _, d := range body["providers"].([]interface{}) {
+		d := d.(map[string]interface{})
+		places[d["provider"]] = d["place"]
+	}
+	if places["b"] != "London, Ontario, Canada" || places["c"] != nil {
+		t.Errorf("provider places %v, want each provider's own", places)
+	}
+
+	c.reading.place = ""
+	if _, ok := decode(t, get(newTestServer(c).handleWeather, "/weather/London"))["place"]; ok {
+		t.Error("place reported without any provider's")
+	}
+}
+
+func TestClockSkewClamped(t *testing.T) {
+	skewed, slight := newFake("skewed", 10), newFake("slight", 12)
+	skewed.reading.observed = time.Now().Add(time.Hour)
+	slight.reading.observed = time.Now().Add(30 * time.Second)
+	mw := newTestMW(skewed, slight)
+	mw.clockSkew = time.Minute
+	logs := captureLog(t)
+
+	before := time.Now()
+	agg, err := mw.aggregate(context.Background(), "London")
+	if err != nil {
+		t.Fatal(err)
+	}
+	observed := map[string]time.Time{}
+	for _, r := range agg.readings {
+		observed[r.provider] = r.observed
+	}
+	if o := observed["skewed"]; o.Before(before) || o.After(time.Now()) {
+		t.Errorf("skewed observed %s, want clamped to now", o)
+	}
+	if o := observed["slight"]; !o.Equal(slight.reading.observed) {
+		t.Errorf("slight observed %s, want its own %s within the tolerance", o, slight.reading.observed)
+	}
+	// as_of isn't put in the future either.
+	if agg.asOf.After(time.Now()) {
+		t.Errorf("as_of %s in the future", agg.asOf)
+	}
+	if out := logs.String(); !strings.Contains(out, "London: skewed: observed") || !strings.Contains(out, "1h0m0s in the future; clamped to now") || strings.Contains(out, "slight: observed") {
+		t.Errorf("log %s, want skewed's clamp alone", out)
+	}
+}
+
+func TestClockSkewConfig(t *testing.T) {
+	for body, want := range map[string]time.Duration{
+		`{"providers": [{"type": "openweathermap"}]}`:                    time.Minute,
+		`{"clockSkew": "5m", "providers": [{"type": "openweathermap"}]}`: 5 * time.Minute,
+	} {
+		var conf config
+		if err := json.Unmarshal([]byte(body), &conf); err != nil {
+			t.Fatal(err)
+		}
+		mw, err := getMultiWeatherProvider(conf, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mw.clockSkew != want {
+			t.Errorf("%s: clockSkew %s, want %s", body, mw.clockSkew, want)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// airQualityProvider is implemented by providers that can report a city's
+// air quality index.
+type airQualityProvider interface {
+	airQuality(ctx context.Context, city string) (float64, error)
+}
+
+// handleAir serves /air/<city>: the mean air quality index of the providers
+// that report one. Providers without air quality data are skipped; if none
+// has any, it answers 501.
+func (s *server) handleAir(w http.ResponseWriter, r *http.Request) {
+	begin := time.Now()
+	city := strings.SplitN(r.URL.Path, "/", 3)[2]
+
+	ctx, span := s.tracer.start(r.Context(), "GET /air/")
+	defer span.finish()
+	span.setAttr("city", city)
+
+	aqi, sources, err := s.mw.airQuality(ctx, city)
+	span.setStatus(err)
+	if errors.Is(err, errNoAirQuality) {
+		writeError(w, r, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp := map[string]interface{}{
+		"city":    city,
+		"aqi":     aqi,
+		"sources": sources,
+	}
+	s.tookFormat.set(resp, begin)
+	writeJSON(w, r, resp)
+}
+
+var errNoAirQuality = errors.New("no configured provider reports air quality")
+
+// airQuality averages the air quality index of the providers that report
+// one, failing if any of them does.
+func (w multiWeatherProvider) airQuality(ctx context.Context, city string) (aqi float64, sources []string, err error) {
+	located := w
+	located.providers = nil
+	for _, p := range w.providers {
+		if _, ok := capability[airQualityProvider](p); ok {
+			located.providers = append(located.providers, p)
+		}
+	}
+	if len(located.providers) == 0 {
+		return 0, nil, errNoAirQuality
+	}
+
+	outcomes, dispatched, _ := located.dispatch(ctx, city, func(ctx context.Context, p weatherProvider) (reading, error) {
+		a, _ := capability[airQualityProvider](p)
+		v, err := a.airQuality(ctx, city)
+		// dispatch carries readings, so the index rides in celsius.
+		return reading{celsius: v}, err
+	})
+	timeout := time.After(time.Millisecond * 1500)
+	sum := 0.0
+	for range dispatched {
+		select {
+		case o := <-outcomes:
+			if o.err != nil {
+				return 0, nil, o.err
+			}
+			sum += o.reading.celsius
+			sources = append(sources, o.provider)
+		case <-timeout:
+			return 0, nil, errors.New("air quality: timed out")
+		}
+	}
+	if len(sources) == 0 {
+		return 0, nil, errors.New("no providers available")
+	}
+	return sum / float64(len(sources)), sources, nil
+}
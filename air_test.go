@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// airFake is a fakeProvider that also reports air quality.
+type airFake struct {
+	*fakeProvider
+	aqi float64
+	err error
+}
+
+func (p airFake) airQuality(ctx context.Context, city string) (float64, error) {
+	return p.aqi, p.err
+}
+
+func TestHandleAir(t *testing.T) {
+	s := newTestServer(airFake{fakeProvider: newFake("a", 10), aqi: 2}, newFake("noAir", 10), airFake{fakeProvider: newFake("b", 10), aqi: 4})
+	w := get(s.handleAir, "/air/London")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	body := decode(t, w)
+	sources, _ := body["sources"].([]interface{})
+	if body["aqi"] != 3.0 || body["city"] != "London" || len(sources) != 2 {
+		t.Errorf("got %v, want the mean of a and b only", body)
+	}
+}
+
+func TestHandleAirErrors(t *testing.T) {
+	s := newTestServer(newFake("noAir", 10))
+	if w := get(s.handleAir, "/air/London"); w.Code != http.StatusNotImplemented {
+		t.Errorf("no air quality providers: status %d, want 501", w.Code)
+	}
+
+	s = newTestServer(airFake{fakeProvider: newFake("a", 10), err: errors.New("a down")})
+	if w := get(s.handleAir, "/air/London"); w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), "a down") {
+		t.Errorf("failing provider: status %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestOpenWeatherMapAirQuality(t *testing.T) {
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/geo/1.0/direct":
+			if r.URL.Query().Get("q") == "London" {
+				w.Write([]byte(`[{"lat": 51.5, "lon": -0.12}]`))
+				return
+			}
+			w.Write([]byte(`[]`))
+		case "/data/2.5/air_pollution":
+			if r.URL.Query().Get("lat") != "51.5" || r.URL.Query().Get("lon") != "-0.12" {
+				t.Errorf("air pollution at %s", r.URL.RawQuery)
+			}
+			w.Write([]byte(`{"list": [{"main": {"aqi": 2}}]}`))
+		}
+	}))
+	if aqi, err := (openWeatherMap{}).airQuality(context.Background(), "London"); err != nil || aqi != 2 {
+		t.Errorf("got %v, %v", aqi, err)
+	}
+	if _, err := (openWeatherMap{}).airQuality(context.Background(), "Atlantis"); err == nil || !strings.Contains(err.Error(), "cannot locate") {
+		t.Errorf("unknown city: error %v", err)
+	}
+}
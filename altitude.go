@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// standardLapseRate is how much colder the air gets with height, in °C per
+// kilometre, in the International Standard Atmosphere.
+const standardLapseRate = 6.5
+
+// altitudeNormalizer corrects readings taken by stations above or below
+// the place asked about to that place's elevation, assuming the
+// temperature falls by lapseRate per kilometre. In the mountains, a
+// station on the ridge and one in the valley otherwise pull the average
+// apart. Readings that don't report an elevation are left alone.
+type altitudeNormalizer struct {
+	lapseRate  float64 // °C per km
+	geocoder   geocoder
+	elevations *locationCache[float64] // metres, by point
+}
+
+func newAltitudeNormalizer(lapseRate float64, geo geocoder) *altitudeNormalizer {
+	if lapseRate == 0 {
+		lapseRate = standardLapseRate
+	}
+	return &altitudeNormalizer{lapseRate: lapseRate, geocoder: geo, elevations: newLocationCache[float64](0)}
+}
+
+// forCity normalizes r to the elevation of city.
+func (a *altitudeNormalizer) forCity(ctx context.Context, city string, r reading) reading {
+	if a == nil || r.elevation == nil {
+		return r
+	}
+	p, err := a.geocoder.geocode(ctx, city)
+	if err != nil {
+		log.Printf("altitude: %s: %s; %s left at its station's elevation", city, err, r.provider)
+		return r
+	}
+	return a.at(ctx, p, r)
+}
+
+// at normalizes r to the elevation of p.
+func (a *altitudeNormalizer) at(ctx context.Context, p point, r reading) reading {
+	if a == nil || r.elevation == nil {
+		return r
+	}
+	target, err := a.elevation(ctx, p)
+	if err != nil {
+		log.Printf("altitude: %s: %s; %s left at its station's elevation", p, err, r.provider)
+		return r
+	}
+	correction := (*r.elevation - target) / 1000 * a.lapseRate
+	r.celsius += correction
+	if r.feelsLike != nil {
+		feelsLike := *r.feelsLike + correction
+		r.feelsLike = &feelsLike
+	}
+	r.altitudeCorrection = &correction
+	return r
+}
+
+// elevation looks up the ground elevation at p from Open-Meteo, once.
+func (a *altitudeNormalizer) elevation(ctx context.Context, p point) (float64, error) {
+	if e, ok := a.elevations.get(p.String()); ok {
+		return e, nil
+	}
+	var d struct {
+		Elevation []float64 `json:"elevation"`
+	}
+	if err := getJSON(ctx, "https://api.open-meteo.com/v1/elevation?latitude="+strconv.FormatFloat(p.lat, 'f', -1, 64)+"&longitude="+strconv.FormatFloat(p.lon, 'f', -1, 64), &d); err != nil {
+		return 0, fmt.Errorf("elevation lookup failed: %w", err)
+	}
+	if len(d.Elevation) == 0 {
+		return 0, fmt.Errorf("no elevation for %s", p)
+	}
+	a.elevations.set(p.String(), d.Elevation[0])
+	return d.Elevation[0], nil
+}
+
+// parseElevation reads an elevation such as "280 ft" or "85 m" as metres,
+// or returns nil if it can't. A bare number is taken to be metres.
+func parseElevation(s string) *float64 {
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields) > 2 {
+		return nil
+	}
+	v, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return nil
+	}
+	if len(fields) == 2 {
+		switch strings.ToLower(fields[1]) {
+		case "ft":
+			v *= 0.3048
+		case "m":
+		default:
+			return nil
+		}
+	}
+	return &v
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+// atElevation is a provider whose station is at metres, if given.
+func atElevation(label string, celsius float64, metres *float64) *fakeProvider {
+	p := newFake(label, celsius)
+	p.reading.elevation = metres
+	return p
+}
+
+func TestAltitudeNormalization(t *testing.T) {
+	var lookups atomic.Int32
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lookups.Add(1)
+		if r.Host != "api.open-meteo.com" || r.URL.Query().Get("latitude") != "46.02" || r.URL.Query().Get("longitude") != "7.75" {
+			t.Errorf("elevation lookup %s", r.URL)
+		}
+		w.Write([]byte(`{"elevation": [1000]}`))
+	}))
+	geo := &stubGeocoder{points: map[string]point{"Zermatt": {46.02, 7.75}}}
+
+	ridge := atElevation("ridge", 0, ptr(2000.0))
+	ridge.reading.feelsLike = ptr(-3.0)
+	valley := atElevation("valley", 10, ptr(500.0))
+	unknown := atElevation("unknown", 7, nil)
+	s := newTestServer(ridge, valley, unknown)
+	s.mw.altitude = newAltitudeNormalizer(0, geo)
+
+	body := decode(t, get(s.handleWeather, "/weather/Zermatt?detail=true"))
+	// The ridge is a km up, so 6.5°C warmer at the place; the valley half
+	// a km down, 3.25°C colder; the unknown station is left alone.
+	if temp := number(t, body, "temp"); !near(temp, (6.5+6.75+7)/3) {
+		t.Errorf("mean %v, want the normalized readings'", temp)
+	}
+	details := map[interface{}]map[string]interface{}{}
+	for _, d := range body["providers"].([]interface{}) {
+		d := d.(map[string]interface{})
+		details[d["provider"]] = d
+	}
+	if d := details["ridge"]; d["elevation"] != 2000.0 || d["altitude_correction"] != 6.5 || d["temp"] != 6.5 || d["feels_like"] != 3.5 {
+		t.Errorf("ridge %v, want corrected by 6.5", d)
+	}
+	if d := details["valley"]; d["altitude_correction"] != -3.25 || d["temp"] != 6.75 {
+		t.Errorf("valley %v, want corrected by -3.25", d)
+	}
+	if _, ok := details["unknown"]["altitude_correction"]; ok {
+		t.Errorf("unknown %v corrected without an elevation", details["unknown"])
+	}
+
+	// The place's elevation is cached for later lookups.
+	before := lookups.Load()
+	s.cache = newMemoryCache(0)
+	get(s.handleWeather, "/weather/Zermatt")
+	if n := lookups.Load() - before; n != 0 {
+		t.Errorf("%d more elevation lookups, want it cached", n)
+	}
+}
+
+func TestAltitudeLapseRate(t *testing.T) {
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"elevation": [0]}`))
+	}))
+	a := newAltitudeNormalizer(10, nil)
+	r := a.at(context.Background(), point{0, 0}, reading{celsius: 0, elevation: ptr(500.0)})
+	if r.celsius != 5 {
+		t.Errorf("%v at 10°C/km, want 5", r.celsius)
+	}
+	if a := newAltitudeNormalizer(0, nil); a.lapseRate != standardLapseRate {
+		t.Errorf("lapse rate %v, want the standard atmosphere's", a.lapseRate)
+	}
+}
+
+func TestAltitudeLookupFails(t *testing.T) {
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"elevation": []}`))
+	}))
+	captureLog(t)
+	in := reading{provider: "ridge", celsius: 0, elevation: ptr(2000.0)}
+
+	a := newAltitudeNormalizer(0, &stubGeocoder{err: errors.New("geocoder down")})
+	if r := a.forCity(context.Background(), "Zermatt", in); r.celsius != 0 || r.altitudeCorrection != nil {
+		t.Errorf("geocode failure: %+v, want the reading unchanged", r)
+	}
+	a = newAltitudeNormalizer(0, &stubGeocoder{points: map[string]point{"Zermatt": {46.02, 7.75}}})
+	if r := a.forCity(context.Background(), "Zermatt", in); r.celsius != 0 || r.altitudeCorrection != nil {
+		t.Errorf("no elevation: %+v, want the reading unchanged", r)
+	}
+
+	var off *altitudeNormalizer
+	if r := off.forCity(context.Background(), "Zermatt", in); r.celsius != 0 {
+		t.Errorf("a nil normalizer changed %v", r.celsius)
+	}
+}
+
+func TestParseElevation(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want *float64
+	}{
+		{"280 ft", ptr(280 * 0.3048)},
+		{"85 m", ptr(85.0)},
+		{"85", ptr(85.0)},
+		{"", nil},
+		{"85 furlongs", nil},
+		{"high", nil},
+	} {
+		got := parseElevation(tt.in)
+		if (got == nil) != (tt.want == nil) || got != nil && !near(*got, *tt.want) {
+			t.Errorf("parseElevation(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// batchLogging is how much a batch logs of its lookups.
+type batchLogging string
+
+const (
+	// batchLogSummary logs one line per batch, with how many cities
+	// succeeded, failed and timed out, the slowest and the total time,
+	// instead of each provider's reading for every city.
+	batchLogSummary batchLogging = "summary"
+	// batchLogVerbose logs the summary as well as every reading.
+	batchLogVerbose batchLogging = "verbose"
+	// batchLogNone logs neither, leaving only warnings and errors.
+	batchLogNone batchLogging = "none"
+)
+
+func parseBatchLogging(s string) (batchLogging, error) {
+	switch l := batchLogging(strings.ToLower(s)); l {
+	case "":
+		return batchLogSummary, nil
+	case batchLogSummary, batchLogVerbose, batchLogNone:
+		return l, nil
+	}
+	return "", fmt.Errorf("unknown batch logging %q, want summary, verbose or none", s)
+}
+
+type quietReadingsKey struct{}
+
+// logReading logs a provider's reading, unless it was made for a batch that
+// doesn't log them.
+func logReading(ctx context.Context, format string, args ...interface{}) {
+	if quiet, _ := ctx.Value(quietReadingsKey{}).(bool); quiet {
+		return
+	}
+	log.Printf(format, args...)
+}
+
+type batchResult struct {
+	City     string   `json:"city"`
+	Temp     *float64 `json:"temp,omitempty"`
+	Error    string   `json:"error,omitempty"`
+	TimedOut bool     `json:"timed_out,omitempty"`
+}
+
+// handleBatch looks up every city in a POSTed {"cities": [...]} body. Large
+// batches are answered a page at a time; the client re-sends the same body
+// with ?cursor= set to the previous response's "next" to get the rest.
+func (s *server) handleBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeError(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cities, ok := s.readCities(w, r)
+	if !ok {
+		return
+	}
+	u, err := s.requestUnit(r)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	offset, err := decodeCursor(r.URL.Query().Get("cursor"))
+	if err != nil || offset > len(cities) {
+		writeError(w, r, "invalid cursor", http.StatusBadRequest)
+		return
+	}
+
+	page := cities[offset:]
+	next := ""
+	if s.batchPageSize > 0 && len(page) > s.batchPageSize {
+		page = page[:s.batchPageSize]
+		next = encodeCursor(offset + s.batchPageSize)
+	}
+
+	ctx, span := s.tracer.start(r.Context(), "POST /weather/batch")
+	defer span.finish()
+	span.setAttr("cities", len(page))
+
+	results := s.lookupAll(ctx, s.trustedProxies.clientIP(r), page, u)
+
+	resp := map[string]interface{}{"results": results}
+	if next != "" {
+		resp["next"] = next
+	}
+	writeJSON(w, r, resp)
+}
+
+// readCities decodes a {"cities": [...]} body within the batch limits. On
+// failure it has already responded.
+func (s *server) readCities(w http.ResponseWriter, r *http.Request) ([]string, bool) {
+	var req struct {
+		Cities []string `json:"cities"`
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, s.maxBodyBytes)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, r, fmt.Sprintf("request body exceeds %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+			return nil, false
+		}
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	if s.batchMaxSize > 0 && len(req.Cities) > s.batchMaxSize {
+		writeError(w, r, fmt.Sprintf("batch of %d cities exceeds the maximum of %d", len(req.Cities), s.batchMaxSize), http.StatusBadRequest)
+		return nil, false
+	}
+	return req.Cities, true
+}
+
+// handleExtremes answers a POSTed {"cities": [...]} body with just the
+// warmest and coldest of them. Cities that failed or timed out are listed
+// separately.
+func (s *server) handleExtremes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeError(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cities, ok := s.readCities(w, r)
+	if !ok {
+		return
+	}
+	u, err := s.requestUnit(r)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, span := s.tracer.start(r.Context(), "POST /weather/extremes")
+	defer span.finish()
+	span.setAttr("cities", len(cities))
+
+	var warmest, coldest *batchResult
+	failed := []batchResult{}
+	for _, res := range s.lookupAll(ctx, s.trustedProxies.clientIP(r), cities, u) {
+		res := res
+		switch {
+		case res.Temp == nil:
+			failed = append(failed, res)
+		case warmest == nil:
+			warmest, coldest = &res, &res
+		case *res.Temp > *warmest.Temp:
+			warmest = &res
+		case *res.Temp < *coldest.Temp:
+			coldest = &res
+		}
+	}
+	writeJSON(w, r, map[string]interface{}{
+		"warmest": warmest,
+		"coldest": coldest,
+		"failed":  failed,
+	})
+}
+
+// lookupAll looks up cities concurrently through the worker pool. If the
+// batch timeout passes first, it returns what has completed and marks the
+// rest as timed out.
+func (s *server) lookupAll(ctx context.Context, client string, cities []string, u unit) []batchResult {
+	if s.batchTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.batchTimeout)
+		defer cancel()
+	}
+
+	type indexed struct {
+		i    int
+		res  batchResult
+		took time.Duration
+	}
+	begin := time.Now()
+	if s.batchLogging != batchLogVerbose {
+		ctx = context.WithValue(ctx, quietReadingsKey{}, true)
+	}
+	done := make(chan indexed, len(cities))
+	go func() {
+		for i, city := range cities {
+			release, err := s.pool.acquire(ctx, client)
+			if err != nil {
+				return
+			}
+			go func(i int, city string) {
+				defer release()
+				lookupBegin := time.Now()
+				res := batchResult{City: city}
+				agg, _, err := s.aggregate(ctx, cacheKey{city: city, aggregation: s.mw.aggregation})
+				if err != nil {
+					res.Error = err.Error()
+				} else {
+					temp := u.fromCelsius(agg.celsius)
+					res.Temp = &temp
+				}
+				done <- indexed{i, res, time.Since(lookupBegin)}
+			}(i, city)
+		}
+	}()
+
+	results := make([]batchResult, len(cities))
+	finished := make([]bool, len(cities))
+	var slowest indexed
+	defer func() { s.logBatch(client, results, slowest.res.City, slowest.took, time.Since(begin)) }()
+	for n := 0; n < len(cities); n++ {
+		select {
+		case d := <-done:
+			results[d.i], finished[d.i] = d.res, true
+			if d.took > slowest.took {
+				slowest = d
+			}
+		case <-ctx.Done():
+			for i, city := range cities {
+				if !finished[i] {
+					results[i] = batchResult{City: city, TimedOut: true}
+				}
+			}
+			return results
+		}
+	}
+	return results
+}
+
+// logBatch logs the summary of a batch's results, unless batches log
+// nothing.
+func (s *server) logBatch(client string, results []batchResult, slowest string, slowestTook, took time.Duration) {
+	if s.batchLogging == batchLogNone || len(results) == 0 {
+		return
+	}
+	var succeeded, failed, timedOut int
+	for _, res := range results {
+		switch {
+		case res.TimedOut:
+			timedOut++
+		case res.Error != "":
+			failed++
+		default:
+			succeeded++
+		}
+	}
+	slog.Info("batch done", "client", client, "cities", len(results), "succeeded", succeeded, "failed", failed,
+		"timed_out", timedOut, "slowest", slowest, "slowest_took", slowestTook, "took", took)
+}
+
+func encodeCursor(offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(offset)))
+}
+
+func decodeCursor(cursor string) (int, error) {
+	if cursor == "" {
+		return 0, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, err
+	}
+	offset, err := strconv.Atoi(string(b))
+	if err == nil && offset < 0 {
+		err = errors.New("negative offset")
+	}
+	return offset, err
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type batchPage struct {
+	Results []batchResult `json:"results"`
+	Next    string        `json:"next"`
+}
+
+func TestBatchTooLarge(t *testing.T) {
+	s := newTestServer(newFake("fake", 10))
+	s.batchMaxSize = 2
+
+	w := post(s.handleBatch, "/weather/batch", `{"cities":["a","b","c"]}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status %d, want 400: %s", w.Code, w.Body)
+	}
+	if w := post(s.handleBatch, "/weather/batch", `{"cities":["a","b"]}`); w.Code != http.StatusOK {
+		t.Errorf("batch at the maximum: status %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestBatchPages(t *testing.T) {
+	s := newTestServer(newFake("fake", 10))
+	s.batchPageSize = 2
+	body := `{"cities":["a","b","c","d","e"]}`
+
+	var cities []string
+	pages := 0
+	for cursor := ""; ; pages++ {
+		w := post(s.handleBatch, "/weather/batch?cursor="+url.QueryEscape(cursor), body)
+		if w.Code != http.StatusOK {
+			t.Fatalf("page %d: status %d: %s", pages+1, w.Code, w.Body)
+		}
+		var page batchPage
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Results) > 2 {
+			t.Errorf("page %d has %d results, more than the page size", pages+1, len(page.Results))
+		}
+		for _, res := range page.Results {
+			if res.Temp == nil || *res.Temp != 10 {
+				t.Errorf("%s: %+v", res.City, res)
+			}
+			cities = append(cities, res.City)
+		}
+		if page.Next == "" {
+			break
+		}
+		cursor = page.Next
+	}
+	if pages+1 != 3 {
+		t.Errorf("got %d pages, want 3", pages+1)
+	}
+	if want := []string{"a", "b", "c", "d", "e"}; !reflect.DeepEqual(cities, want) {
+		t.Errorf("cities %v, want %v", cities, want)
+	}
+}
+
+func TestBatchInvalidCursor(t *testing.T) {
+	s := newTestServer(newFake("fake", 10))
+	for _, cursor := range []string{"!!", encodeCursor(4), encodeCursor(-1)} {
+		w := post(s.handleBatch, "/weather/batch?cursor="+url.QueryEscape(cursor), `{"cities":["a","b"]}`)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("cursor %q: status %d, want 400", cursor, w.Code)
+		}
+	}
+}
+
+func TestBatchBodyTooLarge(t *testing.T) {
+	s := newTestServer(newFake("fake", 10))
+	s.maxBodyBytes = 64
+	big := `{"cities":["` + strings.Repeat("a", 100) + `"]}`
+
+	for name, h := range map[string]http.HandlerFunc{"batch": s.handleBatch, "extremes": s.handleExtremes} {
+		if w := post(h, "/weather/"+name, big); w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("%s: status %d, want 413: %s", name, w.Code, w.Body)
+		}
+		if w := post(h, "/weather/"+name, `{"cities":["a"]}`); w.Code != http.StatusOK {
+			t.Errorf("%s: small body: status %d: %s", name, w.Code, w.Body)
+		}
+	}
+}
+
+// byCity answers each city with its own temperature after its own delay.
+type byCity struct {
+	temps  map[string]float64
+	delays map[string]time.Duration
+}
+
+func (p byCity) name() string { return "byCity" }
+
+func (p byCity) temperature(ctx context.Context, city string) (reading, error) {
+	select {
+	case <-time.After(p.delays[city]):
+	case <-ctx.Done():
+		return reading{}, ctx.Err()
+	}
+	c, ok := p.temps[city]
+	if !ok {
+		return reading{}, fmt.Errorf("no weather for %s", city)
+	}
+	return reading{provider: "byCity", celsius: c}, nil
+}
+
+func TestBatchTimeout(t *testing.T) {
+	s := newTestServer(byCity{
+		temps:  map[string]float64{"fast": 10, "slow": 20, "also fast": 15},
+		delays: map[string]time.Duration{"slow": time.Second},
+	})
+	s.batchTimeout = 50 * time.Millisecond
+
+	begin := time.Now()
+	w := post(s.handleBatch, "/weather/batch", `{"cities":["fast","slow","also fast"]}`)
+	if took := time.Since(begin); took > 500*time.Millisecond {
+		t.Errorf("batch took %s despite its 50ms timeout", took)
+	}
+	var page batchPage
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Results) != 3 {
+		t.Fatalf("results %+v", page.Results)
+	}
+	for i, want := range []float64{10, 0, 15} {
+		res := page.Results[i]
+		if want == 0 {
+			if !res.TimedOut || res.Temp != nil {
+				t.Errorf("%s: %+v, want timed out", res.City, res)
+			}
+			continue
+		}
+		if res.TimedOut || res.Temp == nil || *res.Temp != want {
+			t.Errorf("%s: %+v, want %v", res.City, res, want)
+		}
+	}
+}
+
+// slowProvider counts how many of its lookups run at once.
+type slowProvider struct{ running *maxCounter }
+
+func (p slowProvider) name() string { return "slow" }
+
+func (p slowProvider) temperature(ctx context.Context, city string) (reading, error) {
+	p.running.enter()
+	defer p.running.leave()
+	time.Sleep(50 * time.Millisecond)
+	return reading{celsius: 10}, nil
+}
+
+func TestBatchPerClientBehindProxy(t *testing.T) {
+	// Clients behind a trusted proxy each have their own budget, rather
+	// than sharing the proxy's.
+	var running maxCounter
+	s := newTestServer(slowProvider{&running})
+	s.pool = newWorkerPool(0, 1)
+	var err error
+	if s.trustedProxies, err = parseTrustedProxies([]string{"192.0.2.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i, client := range []string{"198.51.100.1", "198.51.100.2"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := httptest.NewRequest("POST", "/weather/batch", strings.NewReader(fmt.Sprintf(`{"cities":["London%d"]}`, i)))
+			r.Header.Set("X-Forwarded-For", client)
+			s.handleBatch(httptest.NewRecorder(), r)
+		}()
+	}
+	wg.Wait()
+	if m := running.max.Load(); m != 2 {
+		t.Errorf("%d lookups ran at once, want each client's own", m)
+	}
+}
+
+func TestExtremes(t *testing.T) {
+	s := newTestServer(byCity{temps: map[string]float64{"London": 10, "Cairo": 35, "Oslo": -5, "Paris": 15}})
+	w := post(s.handleExtremes, "/weather/extremes?units=f", `{"cities": ["London", "Cairo", "Atlantis", "Oslo", "Paris"]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var body struct {
+		Warmest, Coldest *batchResult
+		Failed           []batchResult
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Warmest == nil || body.Warmest.City != "Cairo" || *body.Warmest.Temp != 95 {
+		t.Errorf("warmest %+v, want Cairo at 95°F", body.Warmest)
+	}
+	if body.Coldest == nil || body.Coldest.City != "Oslo" || *body.Coldest.Temp != 23 {
+		t.Errorf("coldest %+v, want Oslo at 23°F", body.Coldest)
+	}
+	if len(body.Failed) != 1 || body.Failed[0].City != "Atlantis" || !strings.Contains(body.Failed[0].Error, "no weather for Atlantis") {
+		t.Errorf("failed %+v, want Atlantis", body.Failed)
+	}
+}
+
+func TestExtremesAllFailed(t *testing.T) {
+	s := newTestServer(byCity{})
+	body := decode(t, post(s.handleExtremes, "/weather/extremes", `{"cities": ["Atlantis", "Lemuria"]}`))
+	if body["warmest"] != nil || body["coldest"] != nil || len(body["failed"].([]interface{})) != 2 {
+		t.Errorf("got %v", body)
+	}
+	if w := get(s.handleExtremes, "/weather/extremes"); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: status %d", w.Code)
+	}
+}
+
+func TestBatchLogging(t *testing.T) {
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("q") == "Atlantis" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"t": 10}`))
+	}))
+	p, err := newHTTPJSONProvider(providerConfig{Name: "obs", URL: "http://obs.example/now?q={city}", Field: "t"}, providerEnv{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		logging  batchLogging
+		readings int
+		summary  bool
+	}{
+		{batchLogSummary, 0, true},
+		{batchLogVerbose, 2, true},
+		{batchLogNone, 0, false},
+	} {
+		logs := captureLog(t)
+		s := newTestServer(p)
+		s.batchLogging = tt.logging
+		post(s.handleBatch, "/weather/batch", `{"cities":["London","Paris","Atlantis"]}`)
+
+		var readings int
+		var summary map[string]interface{}
+		for _, l := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+			var line map[string]interface{}
+			json.Unmarshal([]byte(l), &line)
+			switch msg, _ := line["msg"].(string); {
+			case msg == "batch done":
+				summary = line
+			case strings.HasPrefix(msg, "obs: "):
+				readings++
+			}
+		}
+		if readings != tt.readings {
+			t.Errorf("%s: %d reading lines, want %d", tt.logging, readings, tt.readings)
+		}
+		if (summary != nil) != tt.summary {
+			t.Errorf("%s: summary %v, want one %v", tt.logging, summary, tt.summary)
+		}
+		if summary != nil && (summary["cities"] != 3.0 || summary["succeeded"] != 2.0 || summary["failed"] != 1.0 || summary["timed_out"] != 0.0) {
+			t.Errorf("%s: summary %v, want 2 of 3 succeeded and 1 failed", tt.logging, summary)
+		}
+	}
+
+	// Single lookups still log their readings.
+	logs := captureLog(t)
+	get(newTestServer(p).handleWeather, "/weather/London")
+	if !strings.Contains(logs.String(), "obs: London: 10.00") {
+		t.Errorf("no reading logged for a single lookup: %s", logs)
+	}
+}
+
+func TestParseBatchLogging(t *testing.T) {
+	for s, want := range map[string]batchLogging{"": batchLogSummary, "Summary": batchLogSummary, "verbose": batchLogVerbose, "none": batchLogNone} {
+		if got, err := parseBatchLogging(s); err != nil || got != want {
+			t.Errorf("parseBatchLogging(%q) = %q, %v; want %q", s, got, err, want)
+		}
+	}
+	if _, err := parseBatchLogging("loud"); err == nil {
+		t.Error("unknown batch logging accepted")
+	}
+}
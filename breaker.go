@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// circuitBreaker stops calling providers that keep failing. Once a provider
+// fails threshold times in a row its circuit opens and it is skipped for
+// cooldown. Then a single call is let through: success closes the circuit,
+// and failure opens it for another cooldown.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	circuits map[string]*circuit
+}
+
+type circuit struct {
+	failures  int
+	openUntil time.Time
+	probing   bool // the trial call after a cooldown is in flight
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown, circuits: make(map[string]*circuit)}
+}
+
+// admit returns why provider mustn't be called now, or nil if it may be.
+// A nil breaker admits everything.
+func (b *circuitBreaker) admit(provider string) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.circuits[provider]
+	if c == nil || c.failures < b.threshold {
+		return nil
+	}
+	if c.probing || time.Now().Before(c.openUntil) {
+		return fmt.Errorf("circuit open after %d failures in a row", c.failures)
+	}
+	c.probing = true
+	return nil
+}
+
+// record notes the outcome of a call admit let through.
+func (b *circuitBreaker) record(provider string, err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.circuits[provider]
+	if c == nil {
+		c = &circuit{}
+		b.circuits[provider] = c
+	}
+	c.probing = false
+	if err == nil {
+		c.failures = 0
+		return
+	}
+	c.failures++
+	if c.failures >= b.threshold {
+		c.openUntil = time.Now().Add(b.cooldown)
+	}
+}
+
+// abandon forgets a call admit let through that ended without an outcome
+// worth counting, such as one cancelled with its request.
+func (b *circuitBreaker) abandon(provider string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c := b.circuits[provider]; c != nil {
+		c.probing = false
+	}
+}
+
+// health is 0 while provider's circuit is open, and otherwise falls from 1
+// with each failure in a row, staying above 0 once the cooldown is over so
+// the provider can still be tried.
+func (b *circuitBreaker) health(provider string) float64 {
+	if b == nil {
+		return 1
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.circuits[provider]
+	if c == nil {
+		return 1
+	}
+	if c.failures >= b.threshold && (c.probing || time.Now().Before(c.openUntil)) {
+		return 0
+	}
+	return 1 - math.Min(float64(c.failures), float64(b.threshold))/float64(b.threshold+1)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBreakerSkipsOpenCircuit(t *testing.T) {
+	up, down := newFake("up", 10), newFake("down", 30)
+	down.err = errors.New("unavailable")
+	mw := newTestMW(up, down)
+	mw.breaker = newCircuitBreaker(2, time.Hour)
+
+	// Failures fail the lookup, but they open the circuit.
+	for i := 0; i < 2; i++ {
+		mw.aggregate(context.Background(), "London")
+	}
+	agg, err := mw.aggregate(context.Background(), "London")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if down.calls.Load() != 2 {
+		t.Errorf("down called %d times, want none once its circuit opened", down.calls.Load())
+	}
+	// Skipped rather than failed, it doesn't count towards the divisor.
+	if agg.celsius != 10 || len(agg.readings) != 1 {
+		t.Errorf("mean %v over %d readings, want up's 10 alone", agg.celsius, len(agg.readings))
+	}
+	if len(agg.warnings) != 1 || !strings.Contains(agg.warnings[0], "down skipped: circuit open after 2 failures") {
+		t.Errorf("warnings %q, want down's skip", agg.warnings)
+	}
+}
+
+func TestBreakerRecovers(t *testing.T) {
+	b := newCircuitBreaker(1, 10*time.Millisecond)
+	b.record("p", errors.New("down"))
+	if b.admit("p") == nil {
+		t.Fatal("admitted with the circuit open")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if err := b.admit("p"); err != nil {
+		t.Fatalf("no trial call after the cooldown: %v", err)
+	}
+	if b.admit("p") == nil {
+		t.Error("a second call admitted beside the trial one")
+	}
+	b.record("p", errors.New("still down"))
+	if b.admit("p") == nil {
+		t.Error("a failed trial didn't reopen the circuit")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	b.admit("p")
+	b.record("p", nil)
+	for i := 0; i < 2; i++ {
+		if err := b.admit("p"); err != nil {
+			t.Errorf("call %d after a good trial: %v", i, err)
+		}
+	}
+}
+
+func TestBreakerAbandonedTrial(t *testing.T) {
+	// A trial call cancelled with its request leaves the circuit to try again.
+	b := newCircuitBreaker(1, 10*time.Millisecond)
+	b.record("p", errors.New("down"))
+	time.Sleep(20 * time.Millisecond)
+	b.admit("p")
+	b.abandon("p")
+	if err := b.admit("p"); err != nil {
+		t.Errorf("abandoned trial blocked the next: %v", err)
+	}
+
+	var nilBreaker *circuitBreaker
+	if nilBreaker.admit("p") != nil {
+		t.Error("a nil breaker refused a call")
+	}
+}
+
+func TestBreakerConfig(t *testing.T) {
+	var conf config
+	if err := json.Unmarshal([]byte(`{"breaker": {"failures": 3}, "providers": [{"type": "openweathermap"}]}`), &conf); err != nil {
+		t.Fatal(err)
+	}
+	mw, err := getMultiWeatherProvider(conf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mw.breaker == nil || mw.breaker.threshold != 3 || mw.breaker.cooldown != 30*time.Second {
+		t.Errorf("breaker %+v, want 3 failures and the 30s default cooldown", mw.breaker)
+	}
+
+	conf.Breaker.Failures = 0
+	if mw, _ = getMultiWeatherProvider(conf, nil); mw.breaker != nil {
+		t.Error("breaker set without failures")
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// cacheKey identifies a cached aggregate by every request variant that
+// changes it. Units and ?detail= are left out on purpose: entries hold
+// Celsius, converted per response, and keep each provider's readings for
+// detail mode, so one entry serves them all.
+type cacheKey struct {
+	city        string
+	aggregation aggregation
+	providers   string // ?providers=, canonical; empty for the default set
+	minTier     tier   // ?min_tier=; noTier for every provider
+}
+
+func (k cacheKey) String() string {
+	s := string(k.aggregation)
+	if k.minTier != noTier {
+		s += "@" + k.minTier.String()
+	}
+	if k.providers != "" {
+		s += "[" + k.providers + "]"
+	}
+	return s + ":" + k.city
+}
+
+type cacheEntry struct {
+	agg     aggregate
+	expires time.Time
+	origin  cacheOrigin
+	// err is the last failure to refresh agg, remembered until
+	// errExpires. It leaves agg in place for serving stale.
+	err        error
+	errExpires time.Time
+}
+
+func (e cacheEntry) expired(now time.Time) bool {
+	return !now.Before(e.expires)
+}
+
+// failing returns the remembered failure while it is current.
+func (e cacheEntry) failing(now time.Time) error {
+	if e.err != nil && now.Before(e.errExpires) {
+		return e.err
+	}
+	return nil
+}
+
+// cacheOrigin records what put an aggregate in the cache, for
+// /admin/cache.
+type cacheOrigin struct {
+	at      time.Time
+	request string // e.g. "GET /weather/London from 203.0.113.7", if noted
+	traceID string // hex; empty if the request wasn't traced
+}
+
+type originKey struct{}
+
+// withCacheOrigin notes each request in its context, so the cache entries
+// it populates can name it.
+func withCacheOrigin(next http.Handler, proxies trustedProxies) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request := r.Method + " " + r.RequestURI + " from " + proxies.clientIP(r)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), originKey{}, request)))
+	})
+}
+
+// originOf is the origin of an aggregate looked up for ctx now. Lookups
+// not made for a noted request, such as warming, have no request.
+func originOf(ctx context.Context) cacheOrigin {
+	o := cacheOrigin{at: time.Now()}
+	o.request, _ = ctx.Value(originKey{}).(string)
+	if s, _ := ctx.Value(spanKey{}).(*span); s != nil {
+		o.traceID = s.traceID()
+	}
+	return o
+}
+
+// errNotCached answers cache-only lookups that the cache has no fresh
+// entry for.
+var errNotCached = errors.New("not in the cache, and lookups are cache-only")
+
+type cacheOnlyKey struct{}
+
+// withCacheOnly marks ctx's lookups as answered from the cache alone, for
+// ?cache_only=true.
+func withCacheOnly(ctx context.Context) context.Context {
+	return context.WithValue(ctx, cacheOnlyKey{}, true)
+}
+
+// cacheOnly reports whether lookups for ctx may not call the providers,
+// because the server or the request says so.
+func (s *server) cacheOnly(ctx context.Context) bool {
+	only, _ := ctx.Value(cacheOnlyKey{}).(bool)
+	return s.cacheOnlyAll || only
+}
+
+// cache stores aggregates by cacheKey. get returns entries even
+// after they expire so callers can decide whether a stale value is usable.
+type cache interface {
+	get(key string) (cacheEntry, bool)
+	set(key string, agg aggregate, ttl time.Duration, origin cacheOrigin)
+	// setError remembers a failure for key for ttl, usually shorter than
+	// a success's, without discarding its last aggregate.
+	setError(key string, err error, ttl time.Duration)
+	// all returns a copy of every entry, by key.
+	all() map[string]cacheEntry
+}
+
+// memoryCache holds entries in memory. With maxEntries set, storing one
+// past the limit evicts the least recently used, whether or not it has
+// expired; otherwise it grows with every key stored.
+type memoryCache struct {
+	maxEntries int // 0 means no limit
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+	// recency orders keys from most to least recently used, and uses
+	// finds each key's place in it; both are nil without maxEntries.
+	recency *list.List
+	uses    map[string]*list.Element
+}
+
+func newMemoryCache(maxEntries int) *memoryCache {
+	c := &memoryCache{maxEntries: maxEntries, entries: make(map[string]cacheEntry)}
+	if maxEntries > 0 {
+		c.recency, c.uses = list.New(), make(map[string]*list.Element)
+	}
+	return c
+}
+
+func (c *memoryCache) get(key string) (cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if ok {
+		c.touch(key)
+	}
+	return e, ok
+}
+
+func (c *memoryCache) set(key string, agg aggregate, ttl time.Duration, origin cacheOrigin) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.put(key, cacheEntry{agg: agg, expires: time.Now().Add(ttl), origin: origin})
+}
+
+func (c *memoryCache) setError(key string, err error, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.entries[key]
+	e.err, e.errExpires = err, time.Now().Add(ttl)
+	c.put(key, e)
+}
+
+// put stores e as key's entry, as its most recently used, and evicts the
+// least recently used beyond maxEntries. c.mu must be held.
+func (c *memoryCache) put(key string, e cacheEntry) {
+	c.entries[key] = e
+	if c.recency == nil {
+		return
+	}
+	c.touch(key)
+	for len(c.entries) > c.maxEntries {
+		oldest := c.recency.Back()
+		k := c.recency.Remove(oldest).(string)
+		delete(c.uses, k)
+		delete(c.entries, k)
+	}
+}
+
+// touch makes key the most recently used. c.mu must be held.
+func (c *memoryCache) touch(key string) {
+	if c.recency == nil {
+		return
+	}
+	if el, ok := c.uses[key]; ok {
+		c.recency.MoveToFront(el)
+		return
+	}
+	c.uses[key] = c.recency.PushFront(key)
+}
+
+func (c *memoryCache) all() map[string]cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entries := make(map[string]cacheEntry, len(c.entries))
+	for k, e := range c.entries {
+		entries[k] = e
+	}
+	return entries
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCacheKeyVariants(t *testing.T) {
+	for _, tt := range []struct {
+		key  cacheKey
+		want string
+	}{
+		{cacheKey{city: "London", aggregation: meanAggregation}, "mean:London"},
+		{cacheKey{city: "London", aggregation: trimmedAggregation}, "trimmed:London"},
+		{cacheKey{city: "London", aggregation: meanAggregation, providers: "a,b"}, "mean[a,b]:London"},
+		{cacheKey{city: "London", aggregation: meanAggregation, minTier: authoritativeTier}, "mean@authoritative:London"},
+		{cacheKey{city: "London", aggregation: meanAggregation, providers: "a,b", minTier: standardTier}, "mean@standard[a,b]:London"},
+	} {
+		if got := tt.key.String(); got != tt.want {
+			t.Errorf("%+v: key %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestCacheVariantsDoNotInterfere(t *testing.T) {
+	a, b, c := newFake("a", 10), newFake("b", 11), newFake("c", 30)
+	s := newTestServer(a, b, c)
+	temp := func(query string) float64 {
+		t.Helper()
+		return number(t, decode(t, get(s.handleWeather, "/weather/London?units=c"+query)), "temp")
+	}
+
+	if got := temp(""); !near(got, 17) {
+		t.Fatalf("mean: temp %v, want 17", got)
+	}
+	if got := temp("&agg=trimmed"); !near(got, 11) {
+		t.Errorf("trimmed after mean: temp %v, want 11, not the cached mean", got)
+	}
+	if got := temp("&providers=a,b"); !near(got, 10.5) {
+		t.Errorf("a and b only: temp %v, want 10.5", got)
+	}
+	if got := temp(""); !near(got, 17) {
+		t.Errorf("mean again: temp %v, want the cached 17", got)
+	}
+	if c.calls.Load() != 2 {
+		t.Errorf("c called %d times, want once for each variant it is in", c.calls.Load())
+	}
+
+	// Units and detail only change how a cached aggregate is rendered, so
+	// they share its entry.
+	body := decode(t, get(s.handleWeather, "/weather/London?units=f&detail=true"))
+	if body["cache"] != "hit" || !near(number(t, body, "temp"), 62.6) {
+		t.Errorf("detail in Fahrenheit: %v", body)
+	}
+	if providers, _ := body["providers"].([]interface{}); len(providers) != 3 {
+		t.Errorf("detail of the cached aggregate: providers %v, want all three", body["providers"])
+	}
+	if a.calls.Load() != 3 {
+		t.Errorf("a called %d times, want 3", a.calls.Load())
+	}
+}
+
+func TestErrorTTLShorterThanSuccess(t *testing.T) {
+	p := newFake("a", 10)
+	p.err = errors.New("down")
+	s := newTestServer(p)
+	s.cacheTTL, s.errorTTL = time.Minute, 50*time.Millisecond
+	key := cacheKey{city: "London", aggregation: s.mw.aggregation}
+
+	for i := 0; i < 3; i++ {
+		if _, _, err := s.aggregate(context.Background(), key); err == nil {
+			t.Fatal("no error from a failing provider")
+		}
+	}
+	if p.calls.Load() != 1 {
+		t.Errorf("provider called %d times within the error TTL, want once", p.calls.Load())
+	}
+
+	// The error expires, and the provider has recovered.
+	time.Sleep(60 * time.Millisecond)
+	p.err = nil
+	if _, hit, err := s.aggregate(context.Background(), key); err != nil || hit {
+		t.Fatalf("after the error TTL: hit %v, %v; want a fresh lookup", hit, err)
+	}
+	// The success outlives the error TTL.
+	time.Sleep(60 * time.Millisecond)
+	if _, hit, err := s.aggregate(context.Background(), key); err != nil || !hit {
+		t.Errorf("after the error TTL again: hit %v, %v; want the cached success", hit, err)
+	}
+	if p.calls.Load() != 2 {
+		t.Errorf("provider called %d times, want twice", p.calls.Load())
+	}
+}
+
+func TestErrorTTLKeepsLastAggregate(t *testing.T) {
+	c := newMemoryCache(0)
+	c.set("k", aggregate{celsius: 10}, -time.Second, cacheOrigin{})
+	c.setError("k", errors.New("down"), time.Minute)
+	e, ok := c.get("k")
+	if !ok || e.agg.celsius != 10 || e.failing(time.Now()) == nil {
+		t.Errorf("entry %+v, want the last aggregate kept alongside the error", e)
+	}
+	if e.failing(time.Now().Add(2*time.Minute)) != nil {
+		t.Error("error still current after its TTL")
+	}
+}
+
+func TestErrorTTLOff(t *testing.T) {
+	p := newFake("a", 10)
+	p.err = errors.New("down")
+	s := newTestServer(p)
+	key := cacheKey{city: "London", aggregation: s.mw.aggregation}
+	s.aggregate(context.Background(), key)
+	s.aggregate(context.Background(), key)
+	if p.calls.Load() != 2 {
+		t.Errorf("provider called %d times without an error TTL, want every time", p.calls.Load())
+	}
+}
+
+func TestCacheOriginWithoutRequest(t *testing.T) {
+	// Lookups made outside a request, such as warming, record only when.
+	s := newTestServer(newFake("fake", 12))
+	k := cacheKey{city: "London", aggregation: s.mw.aggregation}
+	if _, err := s.refresh(context.Background(), k); err != nil {
+		t.Fatal(err)
+	}
+	e, ok := s.cache.get(k.String())
+	if !ok || e.origin.at.IsZero() || e.origin.request != "" || e.origin.traceID != "" {
+		t.Errorf("origin %+v, want a time alone", e.origin)
+	}
+}
+
+func TestMemoryCacheMaxEntries(t *testing.T) {
+	c := newMemoryCache(3)
+	for _, k := range []string{"a", "b", "c"} {
+		c.set(k, aggregate{}, time.Hour, cacheOrigin{})
+	}
+	// Read, a is used more recently than b, and a failure counts as a use
+	// of c.
+	c.get("a")
+	c.setError("c", errors.New("down"), time.Hour)
+	c.set("d", aggregate{}, time.Hour, cacheOrigin{})
+	if _, ok := c.get("b"); ok {
+		t.Error("b, the least recently used, wasn't evicted")
+	}
+	for _, k := range []string{"a", "c", "d"} {
+		if _, ok := c.get(k); !ok {
+			t.Errorf("%s evicted", k)
+		}
+	}
+	if n := len(c.all()); n != 3 {
+		t.Errorf("%d entries, want the cap of 3", n)
+	}
+	if c.recency.Len() != 3 || len(c.uses) != 3 {
+		t.Errorf("recency holds %d keys and uses %d, want 3", c.recency.Len(), len(c.uses))
+	}
+
+	// Storing an entry again doesn't evict anything.
+	c.set("a", aggregate{celsius: 1}, time.Hour, cacheOrigin{})
+	if n := len(c.all()); n != 3 {
+		t.Errorf("%d entries after replacing one, want 3", n)
+	}
+}
+
+func TestMemoryCacheMaxEntriesConcurrent(t *testing.T) {
+	c := newMemoryCache(5)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				k := fmt.Sprintf("%d:%d", g, i%7)
+				c.set(k, aggregate{}, time.Hour, cacheOrigin{})
+				c.get(k)
+				c.setError(k, errors.New("down"), time.Hour)
+			}
+		}(g)
+	}
+	wg.Wait()
+	if len(c.entries) != 5 || c.recency.Len() != 5 || len(c.uses) != 5 {
+		t.Errorf("%d entries, %d in recency and %d uses; want 5 of each", len(c.entries), c.recency.Len(), len(c.uses))
+	}
+}
+
+func TestMemoryCacheEvictsExpired(t *testing.T) {
+	// Expired entries are evicted by recency too, not first.
+	c := newMemoryCache(2)
+	c.set("fresh", aggregate{}, time.Hour, cacheOrigin{})
+	c.set("expired", aggregate{}, -time.Minute, cacheOrigin{})
+	c.set("new", aggregate{}, time.Hour, cacheOrigin{})
+	if _, ok := c.get("expired"); !ok {
+		t.Error("the more recently used expired entry was evicted")
+	}
+	if _, ok := c.get("fresh"); ok {
+		t.Error("the least recently used entry survived")
+	}
+}
+
+func TestMemoryCacheUnbounded(t *testing.T) {
+	c := newMemoryCache(0)
+	for i := 0; i < 100; i++ {
+		c.set(string(rune('a'+i)), aggregate{}, time.Hour, cacheOrigin{})
+	}
+	if n := len(c.all()); n != 100 || c.recency != nil {
+		t.Errorf("%d entries, recency %v; want all 100 and no list", n, c.recency)
+	}
+}
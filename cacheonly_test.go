@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCacheOnly(t *testing.T) {
+	p := newFake("a", 10)
+	s := newTestServer(p)
+
+	if w := get(s.handleWeather, "/weather/London?cache_only=true"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("miss: status %d, want 503", w.Code)
+	}
+	if p.calls.Load() != 0 {
+		t.Fatalf("provider called %d times for a cache-only miss", p.calls.Load())
+	}
+
+	get(s.handleWeather, "/weather/London")
+	w := get(s.handleWeather, "/weather/London?cache_only=true")
+	if w.Code != http.StatusOK || number(t, decode(t, w), "temp") != 10 {
+		t.Errorf("hit: status %d: %s", w.Code, w.Body)
+	}
+	if p.calls.Load() != 1 {
+		t.Errorf("provider called %d times, want once for the normal lookup", p.calls.Load())
+	}
+
+	if w := get(s.handleWeather, "/weather/London?cache_only=maybe"); w.Code != http.StatusBadRequest {
+		t.Errorf("bad value: status %d, want 400", w.Code)
+	}
+}
+
+func TestCacheOnlyStale(t *testing.T) {
+	p := newFake("a", 10)
+	s := newTestServer(p)
+	s.cache.set("mean:London", aggregate{celsius: 8, readings: []reading{{provider: "a", celsius: 8}}}, -time.Minute, cacheOrigin{})
+
+	body := decode(t, get(s.handleWeather, "/weather/London?cache_only=true"))
+	if body["stale"] != true || number(t, body, "temp") != 8 {
+		t.Errorf("expired entry served as %v, want the cached 8 flagged stale", body)
+	}
+	if p.calls.Load() != 0 {
+		t.Errorf("provider called %d times to refresh a cache-only lookup", p.calls.Load())
+	}
+}
+
+func TestCacheOnlyServer(t *testing.T) {
+	p := newFake("a", 10)
+	s := newTestServer(p)
+	s.cacheOnlyAll = true
+
+	// A request can't turn it off.
+	if w := get(s.handleWeather, "/weather/London?cache_only=false"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("?cache_only=false: status %d, want 503", w.Code)
+	}
+	if w := get(s.handlePoint, "/point/51.5,-0.12"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("/point/: status %d, want 503 as points aren't cached", w.Code)
+	}
+	if p.calls.Load() != 0 {
+		t.Fatalf("provider called %d times under cacheOnly", p.calls.Load())
+	}
+
+	// /readings/ asks the providers directly, whatever the cache.
+	if w := get(s.handleReadings, "/readings/London"); w.Code != http.StatusOK || p.calls.Load() != 1 {
+		t.Errorf("/readings/: status %d after %d calls, want the provider asked", w.Code, p.calls.Load())
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// defaultClimate is the bundled dataset: mean monthly temperatures in
+// Celsius, January first, for a few large cities.
+//
+//go:embed climate.json
+var defaultClimate []byte
+
+// climate holds long-term monthly means by lowercase city name, the last
+// resort when neither the providers nor the cache can answer.
+type climate map[string][12]float64
+
+// loadClimate reads a dataset shaped like climate.json from path, or the
+// bundled one if path is empty.
+func loadClimate(path string) (climate, error) {
+	data := defaultClimate
+	if path != "" {
+		var err error
+		if data, err = os.ReadFile(path); err != nil {
+			return nil, fmt.Errorf("fallback: %s", err)
+		}
+	}
+	var raw map[string][12]float64
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("fallback: climate dataset: %s", err)
+	}
+	c := make(climate, len(raw))
+	for city, means := range raw {
+		c[strings.ToLower(city)] = means
+	}
+	return c, nil
+}
+
+// average is city's mean temperature for the month of now.
+func (c climate) average(city string, now time.Time) (aggregate, bool) {
+	means, ok := c[strings.ToLower(strings.TrimSpace(city))]
+	if !ok {
+		return aggregate{}, false
+	}
+	month := now.Month()
+	return aggregate{
+		celsius:  means[month-1],
+		warnings: []string{"providers unavailable; climatological average for " + month.String()},
+	}, true
+}
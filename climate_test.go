@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadClimate(t *testing.T) {
+	c, err := loadClimate("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if avg, ok := c.average(" London ", time.Date(2026, time.July, 1, 0, 0, 0, 0, time.UTC)); !ok || avg.celsius != 18.7 {
+		t.Errorf("bundled London in July = %v, %t, want 18.7", avg.celsius, ok)
+	}
+
+	path := filepath.Join(t.TempDir(), "climate.json")
+	if err := os.WriteFile(path, []byte(`{"Reykjavik": [-0.5, 0, 0.5, 3, 6.5, 9.5, 11, 10.5, 8, 4.5, 1.5, 0]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if c, err = loadClimate(path); err != nil {
+		t.Fatal(err)
+	}
+	if avg, ok := c.average("reykjavik", time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)); !ok || avg.celsius != -0.5 {
+		t.Errorf("Reykjavik in January = %v, %t, want -0.5", avg.celsius, ok)
+	}
+	if _, ok := c.average("London", time.Now()); ok {
+		t.Error("a replacement dataset kept the bundled cities")
+	}
+
+	os.WriteFile(path, []byte(`{"Oslo": "cold"}`), 0o600)
+	for _, p := range []string{path, filepath.Join(t.TempDir(), "none.json")} {
+		if _, err := loadClimate(p); err == nil {
+			t.Errorf("%s: loaded", p)
+		}
+	}
+}
+
+func TestClimateFallback(t *testing.T) {
+	clim, err := loadClimate("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := clim["london"][time.Now().Month()-1]
+	p := newFake("fake", 10)
+	p.err = errors.New("upstream down")
+	s := newTestServer(p)
+	s.climate = clim
+
+	// Everything failed: the month's average, flagged.
+	w := get(s.handleWeather, "/weather/London")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	body := decode(t, w)
+	if body["fallback"] != true || number(t, body, "temp") != want || body["warnings"] == nil {
+		t.Errorf("got %v, want the climatological %v flagged fallback", body, want)
+	}
+
+	// A city the dataset doesn't know still fails.
+	if w := get(s.handleWeather, "/weather/Atlantis"); w.Code != http.StatusInternalServerError {
+		t.Errorf("unknown city: status %d, want 500", w.Code)
+	}
+
+	// A stale cached value comes first.
+	s.staleOnError = true
+	s.cache.set("mean:London", aggregate{celsius: 12, readings: []reading{{provider: "fake", celsius: 12}}}, -time.Minute, cacheOrigin{})
+	body = decode(t, get(s.handleWeather, "/weather/London"))
+	if _, ok := body["fallback"]; ok || number(t, body, "temp") != 12 {
+		t.Errorf("with a stale entry got %v, want the cached 12", body)
+	}
+
+	// So do the providers, when they answer.
+	p.err = nil
+	s = newTestServer(p)
+	s.climate = clim
+	body = decode(t, get(s.handleWeather, "/weather/London"))
+	if _, ok := body["fallback"]; ok || number(t, body, "temp") != 10 {
+		t.Errorf("with providers up got %v, want their 10", body)
+	}
+
+	// Refusals aren't papered over.
+	s = newTestServer(newFake("a", 10), newFake("b", 20))
+	s.climate = clim
+	s.mw.consensusWithin = 2
+	if w := get(s.handleWeather, "/weather/London"); w.Code != http.StatusConflict {
+		t.Errorf("without consensus: status %d, want 409", w.Code)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// climatologyProvider answers with a city's long-term normal for the
+// current month, to blend into the average where live coverage is poor.
+// Normals are read once at startup from a CSV of city, month (1 to 12)
+// and temperature in Celsius, every month given for every city:
+//
+//	city,month,normal
+//	Reykjavik,1,-0.5
+//	Reykjavik,2,-0.2
+//
+// The header row is optional. Readings carry no observation time, so they
+// never count as fresh.
+type climatologyProvider struct {
+	normals climate
+}
+
+func newClimatologyProvider(pc providerConfig, env providerEnv) (weatherProvider, error) {
+	if pc.Path == "" {
+		return nil, errors.New("climatology: path is required")
+	}
+	f, err := os.Open(pc.Path)
+	if err != nil {
+		return nil, fmt.Errorf("climatology: %s", err)
+	}
+	defer f.Close()
+	normals, err := readClimateCSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("climatology: %s: %s", pc.Path, err)
+	}
+	return climatologyProvider{normals: normals}, nil
+}
+
+// readClimateCSV reads city, month, normal rows into a climate, failing on
+// malformed rows and on cities missing any month.
+func readClimateCSV(r io.Reader) (climate, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = 3
+	cr.TrimLeadingSpace = true
+	c := make(climate)
+	seen := make(map[string]int) // months given, as bits
+	for line := 1; ; line++ {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		month, err := strconv.Atoi(strings.TrimSpace(row[1]))
+		if err != nil && line == 1 {
+			continue // the header
+		}
+		if err != nil || month < 1 || month > 12 {
+			return nil, fmt.Errorf("line %d: month %q is not 1 to 12", line, row[1])
+		}
+		normal, err := strconv.ParseFloat(strings.TrimSpace(row[2]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: normal %q is not a number", line, row[2])
+		}
+		city := strings.ToLower(strings.TrimSpace(row[0]))
+		means := c[city]
+		means[month-1] = normal
+		c[city] = means
+		seen[city] |= 1 << (month - 1)
+	}
+	var incomplete []string
+	for city, months := range seen {
+		if months != 1<<12-1 {
+			incomplete = append(incomplete, city)
+		}
+	}
+	if len(incomplete) > 0 {
+		sort.Strings(incomplete)
+		return nil, fmt.Errorf("missing months for %s", strings.Join(incomplete, ", "))
+	}
+	return c, nil
+}
+
+func (w climatologyProvider) name() string { return "climatology" }
+
+func (w climatologyProvider) temperature(ctx context.Context, city string) (reading, error) {
+	means, ok := w.normals[strings.ToLower(strings.TrimSpace(city))]
+	if !ok {
+		return reading{}, fmt.Errorf("climatology: no normals for %q", city)
+	}
+	normal := means[time.Now().UTC().Month()-1]
+	return reading{celsius: normal, native: nativeTemp{normal, celsius}}, nil
+}
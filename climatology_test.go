@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// normalsCSV lists cities with each month's normal as the month number
+// plus offset, after a header row.
+func normalsCSV(offsets map[string]float64) string {
+	var b strings.Builder
+	b.WriteString("city,month,normal\n")
+	for city, offset := range offsets {
+		for m := 1; m <= 12; m++ {
+			fmt.Fprintf(&b, "%s, %d, %g\n", city, m, float64(m)+offset)
+		}
+	}
+	return b.String()
+}
+
+func TestClimatologyProvider(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "normals.csv")
+	if err := os.WriteFile(path, []byte(normalsCSV(map[string]float64{"Reykjavik": -5, "Nuuk": -10.5})), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := newClimatologyProvider(providerConfig{Path: path}, providerEnv{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := float64(time.Now().UTC().Month()) - 5
+	r, err := p.temperature(context.Background(), " reykjavik ")
+	if err != nil || r.celsius != want {
+		t.Errorf("Reykjavik = %v, %v, want this month's %v", r.celsius, err, want)
+	}
+	if !r.observed.IsZero() {
+		t.Errorf("observed %s, want none for a normal", r.observed)
+	}
+	if _, err := p.temperature(context.Background(), "London"); err == nil || !strings.Contains(err.Error(), `no normals for "London"`) {
+		t.Errorf("unknown city: %v", err)
+	}
+}
+
+func TestReadClimateCSV(t *testing.T) {
+	// The header is optional.
+	c, err := readClimateCSV(strings.NewReader(strings.TrimPrefix(normalsCSV(map[string]float64{"Oslo": 0}), "city,month,normal\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c["oslo"][6] != 7 {
+		t.Errorf("Oslo in July = %v, want 7", c["oslo"][6])
+	}
+
+	for _, tt := range []struct{ name, csv, want string }{
+		{"missing months", "city,month,normal\nOslo,1,-4\nOslo,2,-4\n", "missing months for oslo"},
+		{"bad month", "Oslo,13,-4\n", `line 1: month "13" is not 1 to 12`},
+		{"bad normal", "city,month,normal\nOslo,1,cold\n", `line 2: normal "cold" is not a number`},
+		{"short row", "Oslo,1\n", "wrong number of fields"},
+	} {
+		if _, err := readClimateCSV(strings.NewReader(tt.csv)); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestClimatologyProviderConfig(t *testing.T) {
+	if _, err := newClimatologyProvider(providerConfig{}, providerEnv{}); err == nil {
+		t.Error("created without a path")
+	}
+	if _, err := newClimatologyProvider(providerConfig{Path: filepath.Join(t.TempDir(), "none.csv")}, providerEnv{}); err == nil {
+		t.Error("created from a missing file")
+	}
+	if _, ok := providerTypes["climatology"]; !ok {
+		t.Error("climatology isn't a provider type")
+	}
+}
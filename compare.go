@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// handleCompare serves /compare/<city>/<city>: both temperatures, the
+// first minus the second, and which is warmer, all in the requested units.
+func (s *server) handleCompare(w http.ResponseWriter, r *http.Request) {
+	begin := time.Now()
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/compare/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		writeError(w, r, "want /compare/<city>/<city>", http.StatusBadRequest)
+		return
+	}
+	u, err := s.requestUnit(r)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, span := s.tracer.start(r.Context(), "GET /compare/")
+	defer span.finish()
+	span.setAttr("cities", strings.Join(parts, ","))
+
+	type lookup struct {
+		agg aggregate
+		err error
+	}
+	var lookups [2]lookup
+	done := make(chan struct{})
+	go func() {
+		lookups[1].agg, _, lookups[1].err = s.aggregate(ctx, cacheKey{city: parts[1], aggregation: s.mw.aggregation})
+		close(done)
+	}()
+	lookups[0].agg, _, lookups[0].err = s.aggregate(ctx, cacheKey{city: parts[0], aggregation: s.mw.aggregation})
+	<-done
+
+	for i, l := range lookups {
+		if l.err != nil {
+			span.setStatus(l.err)
+			writeError(w, r, parts[i]+": "+l.err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	span.setStatus(nil)
+
+	a, b := u.fromCelsius(lookups[0].agg.celsius), u.fromCelsius(lookups[1].agg.celsius)
+	resp := map[string]interface{}{
+		"cities": []map[string]interface{}{
+			{"city": parts[0], "temp": a},
+			{"city": parts[1], "temp": b},
+		},
+		"difference": a - b,
+		"warmer":     nil,
+	}
+	s.tookFormat.set(resp, begin)
+	switch {
+	case a > b:
+		resp["warmer"] = parts[0]
+	case b > a:
+		resp["warmer"] = parts[1]
+	}
+	writeJSON(w, r, resp)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestHandleCompare(t *testing.T) {
+	s := newTestServer(byCity{temps: map[string]float64{"London": 10, "Madrid": 25, "Lisbon": 25}})
+	s.defaultUnit = fahrenheit
+
+	for _, tt := range []struct {
+		path          string
+		first, second float64
+		difference    float64
+		warmer        interface{}
+	}{
+		{"/compare/London/Madrid", 50, 77, -27, "Madrid"},
+		{"/compare/Madrid/London?units=c", 25, 10, 15, "Madrid"},
+		{"/compare/Madrid/Lisbon", 77, 77, 0, nil},
+	} {
+		w := get(s.handleCompare, tt.path)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", tt.path, w.Code, w.Body)
+		}
+		body := decode(t, w)
+		cities := body["cities"].([]interface{})
+		a := cities[0].(map[string]interface{})["temp"].(float64)
+		b := cities[1].(map[string]interface{})["temp"].(float64)
+		if !near(a, tt.first) || !near(b, tt.second) || !near(number(t, body, "difference"), tt.difference) || body["warmer"] != tt.warmer {
+			t.Errorf("%s: got %v", tt.path, body)
+		}
+	}
+}
+
+func TestHandleCompareErrors(t *testing.T) {
+	s := newTestServer(byCity{temps: map[string]float64{"London": 10}})
+	for path, code := range map[string]int{
+		"/compare/London":            http.StatusBadRequest,
+		"/compare/London/":           http.StatusBadRequest,
+		"/compare/London/Paris/Rome": http.StatusBadRequest,
+		"/compare/London/Atlantis":   http.StatusInternalServerError,
+	} {
+		if w := get(s.handleCompare, path); w.Code != code {
+			t.Errorf("%s: status %d, want %d", path, w.Code, code)
+		}
+	}
+}
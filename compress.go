@@ -0,0 +1,177 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// compressors build the writers for the content codings responses can be
+// compressed with.
+var compressors = map[string]func(w io.Writer) io.WriteCloser{
+	"br":   func(w io.Writer) io.WriteCloser { return brotli.NewWriter(w) },
+	"gzip": func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+	"deflate": func(w io.Writer) io.WriteCloser {
+		fw, _ := flate.NewWriter(w, flate.DefaultCompression) // only fails for a bad level
+		return fw
+	},
+}
+
+// compressionHandler compresses responses of at least minBytes with the
+// best of encodings, in order of preference, that the request's
+// Accept-Encoding allows. Smaller responses, and those the client accepts
+// no encoding for, are sent as they are.
+type compressionHandler struct {
+	next      http.Handler
+	encodings []string
+	minBytes  int
+}
+
+func withCompression(next http.Handler, encodings []string, minBytes int) (http.Handler, error) {
+	if len(encodings) == 0 {
+		return next, nil
+	}
+	for i, e := range encodings {
+		e = strings.ToLower(e)
+		if compressors[e] == nil {
+			return nil, fmt.Errorf("compression: unknown encoding %q, want br, gzip or deflate", e)
+		}
+		encodings[i] = e
+	}
+	return compressionHandler{next: next, encodings: encodings, minBytes: minBytes}, nil
+}
+
+func (h compressionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Vary", "Accept-Encoding")
+	encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"), h.encodings)
+	if encoding == "" {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	cw := &compressingWriter{ResponseWriter: w, encoding: encoding, minBytes: h.minBytes}
+	defer cw.close()
+	h.next.ServeHTTP(cw, r)
+}
+
+// negotiateEncoding picks the encoding in offered, in order of preference,
+// that header gives the highest quality, or "" if it accepts none of them.
+func negotiateEncoding(header string, offered []string) string {
+	if header == "" {
+		return ""
+	}
+	quality := make(map[string]float64)
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		quality[strings.ToLower(strings.TrimSpace(coding))] = q
+	}
+	best, bestQ := "", 0.0
+	for _, e := range offered {
+		q, ok := quality[e]
+		if !ok {
+			q = quality["*"]
+		}
+		if q > bestQ {
+			best, bestQ = e, q
+		}
+	}
+	return best
+}
+
+// compressingWriter holds back a response until it has minBytes of it, and
+// then compresses it, or sends it as it is if the handler finishes first.
+// Flushing, as streams do, decides early.
+type compressingWriter struct {
+	http.ResponseWriter
+	encoding string
+	minBytes int
+
+	status  int
+	buf     []byte
+	decided bool
+	enc     io.WriteCloser // nil if not compressing
+}
+
+func (w *compressingWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+}
+
+func (w *compressingWriter) Write(b []byte) (int, error) {
+	if !w.decided {
+		w.buf = append(w.buf, b...)
+		if len(w.buf) < w.minBytes {
+			return len(b), nil
+		}
+		if err := w.decide(); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if w.enc != nil {
+		return w.enc.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// decide sends the header, compressing if there is enough body held back
+// and nothing else has encoded it, and then what was held back.
+func (w *compressingWriter) decide() error {
+	w.decided = true
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	h := w.Header()
+	if len(w.buf) > 0 && len(w.buf) >= w.minBytes && h.Get("Content-Encoding") == "" {
+		h.Set("Content-Encoding", w.encoding)
+		h.Del("Content-Length")
+		w.enc = compressors[w.encoding](w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if w.enc != nil {
+		_, err = w.enc.Write(buf)
+	} else {
+		_, err = w.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+func (w *compressingWriter) Flush() {
+	if !w.decided && w.decide() != nil {
+		return
+	}
+	if f, ok := w.enc.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *compressingWriter) close() {
+	if !w.decided {
+		w.decide()
+	}
+	if w.enc != nil {
+		w.enc.Close()
+	}
+}
+
+func (w *compressingWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+// compressed serves body through withCompression and returns the response
+// to a request accepting acceptEncoding.
+func compressed(t *testing.T, body string, minBytes int, acceptEncoding string) *httptest.ResponseRecorder {
+	t.Helper()
+	h, err := withCompression(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}), []string{"br", "gzip", "deflate"}, minBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/weather/London", nil)
+	if acceptEncoding != "" {
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// decompress reads the body of w as its Content-Encoding says.
+func decompress(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	var r io.Reader = w.Body
+	switch w.Header().Get("Content-Encoding") {
+	case "br":
+		r = brotli.NewReader(w.Body)
+	case "gzip":
+		gr, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = gr
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestCompressionNegotiation(t *testing.T) {
+	body := strings.Repeat(`{"city": "London", "temp": 11.5}`, 64)
+	for _, tt := range []struct {
+		name, accept, want string
+	}{
+		{"gzip only", "gzip", "gzip"},
+		{"brotli preferred", "gzip, deflate, br", "br"},
+		{"brotli refused", "br;q=0, gzip", "gzip"},
+		{"quality decides", "br;q=0.5, gzip;q=0.8", "gzip"},
+		{"anything", "*", "br"},
+		{"none", "", ""},
+		{"unsupported", "zstd", ""},
+	} {
+		w := compressed(t, body, 1024, tt.accept)
+		if got := w.Header().Get("Content-Encoding"); got != tt.want {
+			t.Errorf("%s: Content-Encoding %q, want %q", tt.name, got, tt.want)
+			continue
+		}
+		if got := decompress(t, w); got != body {
+			t.Errorf("%s: body %.40q..., want the handler's", tt.name, got)
+		}
+		if w.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("%s: Vary %q", tt.name, w.Header().Get("Vary"))
+		}
+	}
+}
+
+func TestCompressionThreshold(t *testing.T) {
+	small := `{"city": "London", "temp": 11.5}`
+	for _, accept := range []string{"br", "gzip"} {
+		w := compressed(t, small, 1024, accept)
+		if enc := w.Header().Get("Content-Encoding"); enc != "" || w.Body.String() != small {
+			t.Errorf("%s: %d bytes sent with Content-Encoding %q, want them as they are", accept, len(small), enc)
+		}
+		if w := compressed(t, small, len(small), accept); w.Header().Get("Content-Encoding") != accept {
+			t.Errorf("%s: a body of exactly minBytes wasn't compressed", accept)
+		}
+	}
+}
+
+func TestCompressionConfig(t *testing.T) {
+	next := http.NotFoundHandler()
+	if h, err := withCompression(next, nil, 0); err != nil || h == nil {
+		t.Errorf("no encodings: %v, %v", h, err)
+	}
+	if _, err := withCompression(next, []string{"BR", "gzip"}, 0); err != nil {
+		t.Errorf("br: %v", err)
+	}
+	if _, err := withCompression(next, []string{"zstd"}, 0); err == nil || !strings.Contains(err.Error(), "want br, gzip or deflate") {
+		t.Errorf("unknown encoding: %v", err)
+	}
+}
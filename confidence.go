@@ -0,0 +1,67 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// confidenceScorer rates how far an aggregate can be trusted, from 0 to 1,
+// as a weighted mean of three factors, each also from 0 to 1:
+//
+//   - sources: 1 - 2^-n for n readings, so each provider that answers
+//     halves the remaining doubt;
+//   - agreement: 2^-(stddev/spread), halving with every spread degrees
+//     Celsius of disagreement;
+//   - freshness: the mean of 2^-(age/halfLife) over the readings that
+//     report when they were observed.
+//
+// A factor that can't be judged, such as agreement with a single reading,
+// is left out rather than guessed at.
+type confidenceScorer struct {
+	sources, agreement, freshness float64 // weights; all 1 if all zero
+
+	spread   float64       // degrees Celsius; 2 if unset
+	halfLife time.Duration // 1h if unset
+}
+
+// score rates readings as of now. No readings, as with a climatological
+// fallback, score 0.
+func (c confidenceScorer) score(readings []reading, now time.Time) float64 {
+	if len(readings) == 0 {
+		return 0
+	}
+	ws, wa, wf := c.sources, c.agreement, c.freshness
+	if ws == 0 && wa == 0 && wf == 0 {
+		ws, wa, wf = 1, 1, 1
+	}
+	spread, halfLife := c.spread, c.halfLife
+	if spread <= 0 {
+		spread = 2
+	}
+	if halfLife <= 0 {
+		halfLife = time.Hour
+	}
+
+	sum, total := ws*(1-math.Exp2(-float64(len(readings)))), ws
+	if sd := stddev(readings); sd != nil {
+		sum += wa * math.Exp2(-*sd/spread)
+		total += wa
+	}
+	fresh, n := 0.0, 0
+	for _, r := range readings {
+		if r.observed.IsZero() {
+			continue
+		}
+		age := math.Max(now.Sub(r.observed).Seconds(), 0)
+		fresh += math.Exp2(-age / halfLife.Seconds())
+		n++
+	}
+	if n > 0 {
+		sum += wf * fresh / float64(n)
+		total += wf
+	}
+	if total == 0 {
+		return 0
+	}
+	return math.Round(sum/total*100) / 100
+}
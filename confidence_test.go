@@ -0,0 +1,90 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestConfidenceScenarios(t *testing.T) {
+	now := time.Date(2026, 1, 15, 12, 0, 0, 0, time.UTC)
+	readings := func(age time.Duration, cs ...float64) []reading {
+		rs := make([]reading, len(cs))
+		for i, c := range cs {
+			rs[i] = reading{celsius: c}
+			if age >= 0 {
+				rs[i].observed = now.Add(-age)
+			}
+		}
+		return rs
+	}
+	const unknown = -1 // no observation times
+	var c confidenceScorer
+
+	for _, tt := range []struct {
+		name     string
+		readings []reading
+		min, max float64
+	}{
+		{"many agreeing fresh sources", readings(0, 10, 10.2, 9.9, 10.1, 10), 0.95, 1},
+		{"two agreeing fresh sources", readings(0, 10, 10.5), 0.8, 0.95},
+		{"many sources far apart", readings(0, 0, 10, 20, 30), 0.6, 0.7},
+		{"agreeing but stale", readings(6*time.Hour, 10, 10, 10), 0.55, 0.65},
+		{"one fresh source", readings(0, 10), 0.7, 0.8},
+		{"one source, no times", readings(unknown, 10), 0.5, 0.5},
+		{"nothing to go on", nil, 0, 0},
+	} {
+		if got := c.score(tt.readings, now); got < tt.min || got > tt.max {
+			t.Errorf("%s: confidence %v, want %v to %v", tt.name, got, tt.min, tt.max)
+		}
+	}
+
+	// Each factor moves the score the right way on its own.
+	more := c.score(readings(0, 10, 10, 10, 10), now)
+	fewer := c.score(readings(0, 10, 10), now)
+	closer := c.score(readings(0, 10, 11), now)
+	apart := c.score(readings(0, 10, 15), now)
+	fresher := c.score(readings(time.Minute, 10, 11), now)
+	older := c.score(readings(3*time.Hour, 10, 11), now)
+	if !(more > fewer && closer > apart && fresher > older) {
+		t.Errorf("more %v fewer %v, closer %v apart %v, fresher %v older %v", more, fewer, closer, apart, fresher, older)
+	}
+}
+
+func TestConfidenceWeights(t *testing.T) {
+	now := time.Now()
+	rs := []reading{{celsius: 0, observed: now}, {celsius: 10, observed: now}}
+	sd := *stddev(rs)
+
+	// Only agreement counts: 2^-(sd/spread).
+	c := confidenceScorer{agreement: 1, spread: 4}
+	if got, want := c.score(rs, now), math.Round(math.Exp2(-sd/4)*100)/100; got != want {
+		t.Errorf("agreement alone: %v, want %v", got, want)
+	}
+	// Only sources count: 1 - 2^-2.
+	c = confidenceScorer{sources: 1}
+	if got := c.score(rs, now); got != 0.75 {
+		t.Errorf("sources alone: %v, want 0.75", got)
+	}
+	// Freshness halves every halfLife.
+	rs = []reading{{celsius: 10, observed: now.Add(-2 * time.Hour)}}
+	c = confidenceScorer{freshness: 1, halfLife: 2 * time.Hour}
+	if got := c.score(rs, now); got != 0.5 {
+		t.Errorf("freshness alone after one half-life: %v, want 0.5", got)
+	}
+}
+
+func TestConfidenceResponse(t *testing.T) {
+	s := newTestServer(newFake("a", 10), newFake("b", 10))
+	body := decode(t, get(s.handleWeather, "/weather/London"))
+	// Two agreeing sources without observation times: (0.75 + 1) / 2.
+	if got := number(t, body, "confidence"); got != 0.88 {
+		t.Errorf("confidence %v, want 0.88", got)
+	}
+
+	var conf config
+	conf.Confidence.Sources = -1
+	if _, err := newConfidenceScorer(conf); err == nil {
+		t.Error("a negative weight was accepted")
+	}
+}
@@ -0,0 +1,1051 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+type config struct {
+	// Providers lists the providers to aggregate. When empty, the
+	// built-in providers are used with the keys below.
+	Providers []providerConfig
+
+	WeatherUnderground struct {
+		ApiKey string
+	}
+	ForecastIo struct {
+		ApiKey string
+	}
+
+	Geocoder struct {
+		Timeout duration // per lookup; 2s if unset
+		// Chain lists the geocoders to try in order: "google" or
+		// "nominatim". Only Google is used if unset.
+		Chain []string
+		// Ambiguous is what to do with names that match several places
+		// equally well: "first", the default, takes the geocoder's first
+		// answer, and "reject" fails the request with a 300 listing
+		// them.
+		Ambiguous string
+		// RequireQualifier rejects cities given without a region or
+		// country, as in "Springfield,IL".
+		RequireQualifier bool
+		// ReadingTTL, if set, caches the readings of providers that
+		// geocode city names themselves, such as forecast.io, by the
+		// city asked for, so repeat lookups skip both the geocode and
+		// the weather call. A provider's own cacheTTL takes precedence.
+		ReadingTTL duration
+		// CacheTTL is how long a city's coordinates are trusted before
+		// it is geocoded again; 720h if unset.
+		CacheTTL duration
+		// QuotaFallback, when the geocoders are out of quota, answers
+		// from the providers that take city names rather than failing,
+		// leaving out those that geocode first with a warning.
+		QuotaFallback bool
+		// MaxConcurrent bounds the live geocoder lookups running at
+		// once, separately from the weather providers; 0 is no limit.
+		MaxConcurrent int
+		// Static maps city names to coordinates to use when every
+		// geocoder in the chain fails.
+		Static map[string]struct {
+			Lat, Lon float64
+		}
+	}
+
+	// IPGeo locates clients for /weather/here.
+	IPGeo struct {
+		Provider string // "ip-api" or "ipinfo"; /weather/here is off if unset
+		Token    string // for ipinfo
+	}
+
+	// TrustedProxies lists the addresses or CIDR ranges of proxies whose
+	// X-Forwarded-For headers are believed.
+	TrustedProxies []string
+
+	Upstream struct {
+		// Proxy is the URL of a proxy for upstream requests. It overrides
+		// HTTP_PROXY, HTTPS_PROXY and NO_PROXY.
+		Proxy string
+
+		DNS struct {
+			// Server is a resolver to query instead of the system's,
+			// e.g. "1.1.1.1:53".
+			Server string
+			// Timeout bounds each name resolution; 0 leaves it to the
+			// request's own deadline.
+			Timeout duration
+		}
+
+		// MaxIdleConns and MaxIdleConnsPerHost cap the idle connections
+		// kept for reuse, in all and to each upstream; IdleConnTimeout
+		// closes those idle for longer. Unset values keep net/http's
+		// defaults, except that MaxIdleConnsPerHost defaults to 16
+		// rather than 2, since every provider is called for every city.
+		MaxIdleConns        int
+		MaxIdleConnsPerHost int
+		IdleConnTimeout     duration
+		// HTTP2 negotiates HTTP/2 with upstreams that offer it; true if
+		// unset.
+		HTTP2 *bool
+
+		// MaxRedirects is how many redirects a request follows before
+		// failing; 3 if unset. 0 follows none.
+		MaxRedirects *int
+
+		// Retries, if Attempts is set, retries a request that fails
+		// transiently, with a 5xx, a 429 or a network failure, up to
+		// that many times, Backoff apart to begin with (100ms if unset)
+		// and doubling. Budget caps the retries of all providers for one
+		// lookup together; 0 leaves only Attempts.
+		Retries struct {
+			Attempts int
+			Backoff  duration
+			Budget   int
+		}
+
+		// ErrorSnippet logs up to this many bytes of the body of each
+		// upstream response outside the 2xx range, with anything that
+		// looks like an API key redacted; 0 logs none.
+		ErrorSnippet int
+
+		TLS struct {
+			MinVersion string // "1.2", the default, or "1.3"
+			// CAFile is a PEM bundle to trust instead of the system's
+			// roots, to pin upstreams to known CAs.
+			CAFile string
+			// Insecure skips certificate verification, for local mocks
+			// served over HTTPS with self-signed certificates.
+			Insecure bool
+		}
+
+		// Preconnect, if Enabled, connects to every provider's upstream
+		// at startup, waiting up to Timeout (5s if unset) before
+		// serving, so first requests skip the DNS, TCP and TLS setup.
+		// With Interval, it connects again that often, keeping
+		// connections alive that IdleConnTimeout would close.
+		Preconnect struct {
+			Enabled  bool
+			Interval duration
+			Timeout  duration
+		}
+	}
+
+	Tracing struct {
+		Exporter string // "", "log" or "otlp"
+		Endpoint string // OTLP/HTTP traces URL
+	}
+
+	Cache struct {
+		TTL duration
+		// Jitter adds up to this much, at random, to each entry's TTL.
+		Jitter duration
+		// CoalesceWindow, e.g. "50ms", lets lookups of a city that start
+		// within it of another's finishing share that lookup's result,
+		// not just those that overlap it.
+		CoalesceWindow duration
+		// ErrorTTL is how long a failed lookup is remembered and
+		// returned without asking the providers again; 0 disables it.
+		ErrorTTL duration
+		// StaleOnError serves the last cached value, even if expired, when
+		// the providers fail.
+		StaleOnError bool
+		// RecordOrigin notes the request that stored each entry, for
+		// /admin/cache to show alongside when it was stored.
+		RecordOrigin bool
+		// PersistPath, if set, is a file the cache is saved to on a
+		// graceful shutdown and reloaded from on startup, less any
+		// entries that have expired in between.
+		PersistPath string
+		// MaxEntries caps how many entries the cache holds, evicting the
+		// least recently used beyond it; 0 means no limit.
+		MaxEntries int
+	}
+
+	// Fallback, if Climate is set, answers /weather/ with a city's
+	// climatological average for the month, flagged "fallback", when the
+	// providers fail and there's no cached value to serve instead.
+	// ClimatePath replaces the bundled dataset with one shaped like
+	// climate.json.
+	Fallback struct {
+		Climate     bool
+		ClimatePath string
+	}
+
+	// Warm keeps Cities in the cache by refreshing them every Interval,
+	// half the cache TTL if unset.
+	Warm struct {
+		Cities   []string
+		Interval duration
+	}
+
+	// Plausible bounds the readings to trust, e.g. -90 to 60. Anything
+	// below absolute zero is always rejected.
+	Plausible struct {
+		MinCelsius, MaxCelsius *float64
+	}
+
+	// RequireFresh fails requests unless at least one provider's reading
+	// was observed within it, e.g. "30m". Providers that don't report
+	// observation times never count as fresh. 0 disables the check.
+	RequireFresh duration
+	// ClockSkew is how far in the future a provider's observation time
+	// may be before it is taken for a clock or time zone bug, clamped to
+	// now and logged; 1m if unset.
+	ClockSkew duration
+
+	// Timeouts is what happens when a provider doesn't answer in time:
+	// "lenient", the default, averages the rest with a warning, and
+	// "strict" fails the request.
+	Timeouts string
+
+	// LateReadings, if TTL is set, gives providers that miss the
+	// deadline up to Wait longer, 5s if unset, and keeps what they
+	// return for TTL, so the next lookup of the place uses it rather
+	// than waiting on them again. Providers with their own cacheTTL
+	// keep late readings for that long instead.
+	LateReadings struct {
+		TTL, Wait duration
+	}
+
+	// RequiredProviders names providers, e.g. "forecastIo", that must
+	// contribute to every aggregate. If one fails, is skipped or is
+	// excluded, the request fails.
+	RequiredProviders []string
+
+	// CityProviders names the providers to use for particular cities,
+	// instead of all of them, e.g. {"boston": ["nws", "openWeatherMap"]}.
+	// A key can also be a country code, matching cities given as
+	// "Boston,US". Cities without an entry use every provider.
+	CityProviders map[string][]string
+
+	// Consensus, if Within is set, fails requests with a 409 unless at
+	// least MinAgreeing providers, or all of them if that is unset, read
+	// within Within degrees Celsius of each other.
+	Consensus struct {
+		Within      float64
+		MinAgreeing int
+	}
+
+	// Confidence weights the factors of each response's confidence
+	// score: how many providers answered, how closely they agree and
+	// how recently they observed. Leaving all three at 0 weights them
+	// equally. Spread, in degrees Celsius, and HalfLife, e.g. "1h", are
+	// how much disagreement and age halve their factors.
+	Confidence struct {
+		Sources, Agreement, Freshness float64
+		Spread                        float64
+		HalfLife                      duration
+	}
+
+	// Weighting adapts provider weights to their health: each failure
+	// multiplies a provider's weight by Decay, e.g. 0.5, and each success
+	// adds Recovery, e.g. 0.1, back up to its configured weight. Weights
+	// never fall below Floor times the configured weight. A zero Decay
+	// keeps weights fixed. MinWeight and MaxWeight bound every provider's
+	// weight; a zero MaxWeight means no ceiling.
+	Weighting struct {
+		Decay, Recovery, Floor float64
+		MinWeight, MaxWeight   float64
+	}
+
+	// Altitude, if Normalize is set, corrects readings from stations
+	// that report their elevation to the ground elevation of the place
+	// asked about, at LapseRate °C per km (6.5 if unset), before they
+	// are averaged.
+	Altitude struct {
+		Normalize bool
+		LapseRate float64
+	}
+
+	// Breaker, if Failures is set, stops calling a provider once it has
+	// failed that many times in a row. It is skipped with a warning for
+	// Cooldown, 30s if unset, and then given one call to recover.
+	Breaker struct {
+		Failures int
+		Cooldown duration
+	}
+
+	// Rotation, if Primaries is set, calls only that many providers for
+	// each lookup: those in the best health, as the breaker and weighting
+	// judge it, with the largest share of their daily quota left. Equals
+	// take turns, changing every Interval, 1m if unset. Required
+	// providers are called as well.
+	Rotation struct {
+		Primaries int
+		Interval  duration
+	}
+
+	// Outage, if Failures is set, detects outages of every provider at
+	// once: after that many lookups in a row have had no provider
+	// answer, lookups that would call providers fail at once with a 503
+	// and Retry-After for Cooldown, 30s if unset. Then one is let through
+	// to see if they have recovered. Cached and climatological answers
+	// are still served.
+	Outage struct {
+		Failures int
+		Cooldown duration
+	}
+
+	// Aggregation combines the providers' readings: "mean", the default,
+	// "trimmed", "fresh" to weight the mean towards the most recently
+	// observed, "first" to take the fastest provider's, or the name of
+	// an Aggregator a build registers. Requests can override it with ?agg=.
+	Aggregation string
+	// FreshHalfLife is the age at which "fresh" counts an observation
+	// half as much as one made now; 10m if unset.
+	FreshHalfLife duration
+
+	// First tunes the first aggregation. Providers named in Priority are
+	// called in that order, ahead of the rest, each Stagger after the one
+	// before (250ms if unset) unless it has already failed, so preferred
+	// providers usually win without a slow one holding up the answer.
+	First struct {
+		Priority []string
+		Stagger  duration
+	}
+
+	// Hedge, if Delay is set, has the mean, trimmed and registered
+	// aggregations call the preferred provider, the first in
+	// first.priority or else in providers, and any required ones, and the
+	// others only if it hasn't answered plausibly within Delay. Most
+	// lookups then cost one call, and a slow or failing preferred
+	// provider costs at most Delay more than calling everyone.
+	Hedge struct {
+		Delay duration
+	}
+
+	// Sequential calls providers one at a time rather than concurrently,
+	// so their logs come out in order when debugging.
+	Sequential bool
+
+	// UVIndex combines the providers' UV indexes: "max", the default, or
+	// "mean".
+	UVIndex string
+
+	// Units is the default for responses when a request has no ?units=;
+	// Kelvin if unset.
+	Units string
+	// Kelvin adds the temperature in Kelvin to every /weather/ response
+	// as "kelvin", alongside temp in the requested unit. Requests can
+	// override it with ?kelvin=.
+	Kelvin bool
+	// AsOf adds "as_of" to /weather/ responses: the oldest contributing
+	// observation time, or when the readings were fetched if none
+	// reports one, so caching clients know how old the answer is.
+	AsOf bool
+	// CardinalWind adds the wind's direction as the nearest of the 16
+	// compass points, e.g. "NNE", to /weather/ responses' wind.
+	CardinalWind bool
+	// ErrorCategories adds a "category" to each provider failure /readings/
+	// and /diagnose/ report, one of timeout, rate_limited, not_found, auth,
+	// network, decode or upstream_error. /weather/ and /point/ warnings
+	// become objects with a "message", and the "provider" and "category"
+	// of the failure they report if any. ?detail=true lists the providers
+	// that failed without failing the lookup beside those that answered.
+	ErrorCategories bool
+	// Method adds a "method" to ?detail=true responses: the aggregation,
+	// outlier filter and weighting that computed the temperature, as
+	// configured or overridden by ?agg=.
+	Method bool
+	// CacheOnly answers /weather/ and the other cached lookups from the
+	// cache alone, never calling the providers: a 503, or a stale
+	// entry flagged as such, where it has nothing fresh. It suits a
+	// read-only replica fed by cache.persistPath. Warming is skipped.
+	// Requests can ask for the same with ?cache_only=true.
+	CacheOnly bool
+	// LocalTime adds the city's time zone, looked up from its
+	// coordinates, and local time to /weather/ responses. ?when=, now or
+	// an offset such as +10m, gives the time to report instead of now;
+	// providers only report current conditions, so offsets of more than
+	// 15 minutes are refused whether or not this is set.
+	LocalTime bool
+	// DegradedHeader names any degraded state a /weather/ response is
+	// answered in, comma-separated, in an X-Gollo-Degraded header:
+	// load_shedding when only the degraded provider was asked,
+	// providers_skipped when circuits were open or quotas spent, stale,
+	// or climatology. Refusals are flagged overloaded, at the in-flight
+	// limit, or outage, while the outage breaker is open.
+	DegradedHeader bool
+	// Provenance adds a "provenance" to ?detail=true /weather/ responses:
+	// for each reading, the city as requested and as normalized, the
+	// coordinates it was geocoded to if the provider needed them, the
+	// upstream URLs with credentials redacted, the temperature as sent
+	// and in Kelvin, and its weight in the aggregate.
+	Provenance bool
+
+	// LogConfig logs the configuration at startup, after every override
+	// is merged, with API keys, tokens and other credentials redacted.
+	// Options left unset are shown as zero values, meaning their
+	// documented defaults.
+	LogConfig bool
+
+	// Quotas caps the requests made to each provider, by name, per UTC day.
+	Quotas map[string]int
+	// QuotaOrder calls providers with the largest share of their quota
+	// left first, where order matters: with sequential, and after the
+	// providers first.priority lists. Rotation always favours them.
+	QuotaOrder bool
+
+	Batch struct {
+		MaxSize  int // cities per request; 0 means unlimited
+		PageSize int // results per response; 0 means a single page
+		// MaxConcurrency bounds the lookups running for all batches at
+		// once, and MaxConcurrencyPerClient those for any one client.
+		// 0 means unbounded.
+		MaxConcurrency          int
+		MaxConcurrencyPerClient int
+		// Timeout bounds a whole batch; cities not done by then are
+		// returned as timed out. 0 means no limit.
+		Timeout duration
+		// Logging is "summary", the default, to log one line per batch
+		// instead of every provider's reading for every city,
+		// "verbose" to log both, or "none" to log neither.
+		Logging string
+	}
+
+	// Envelope wraps JSON responses as {"status": "ok", "data": ...} and
+	// errors as {"status": "error", "error": {"code", "message"}}. v1 and
+	// the Dark Sky compatibility API keep their shapes.
+	Envelope bool
+	// Always200 sends every error with a 200, as the envelope's error
+	// object carrying the status it would have had, for client
+	// frameworks that choke on other statuses. Requests can ask for
+	// either with ?always200=.
+	Always200 bool
+
+	// Took is how responses report the time they took: "string", the
+	// default, as in "1.234567ms"; "ms" for an integer took_ms; or "both".
+	Took string
+
+	// PartialContent answers /weather/ with 206 Partial Content rather
+	// than 200 when the result leaves providers out, so clients can tell
+	// without reading the warnings.
+	PartialContent bool
+
+	// SlowThreshold logs /weather/ requests slower than it; 0 disables.
+	SlowThreshold duration
+	// SampleRate logs that fraction of /weather/ requests, e.g. 0.01, in
+	// full, with every provider's reading and timing. Requests are
+	// picked by a hash of their X-Request-Id, so the same ID is always
+	// picked or not.
+	SampleRate float64
+
+	// Debug holds settings for testing gollo itself, which take effect
+	// only with Enabled set. MinResponseTime pads every /weather/
+	// response, failures included, to take at least that long, for
+	// exercising client and proxy timeouts deterministically.
+	Debug struct {
+		Enabled         bool
+		MinResponseTime duration
+	}
+
+	Limits struct {
+		MaxBodyBytes   int64 // request bodies; 1 MiB if unset
+		MaxHeaderBytes int   // request headers; net/http's default if unset
+		// MaxInFlight caps the requests served at once; more get a 503.
+		// 0 means no limit.
+		MaxInFlight int
+		// DegradeAt is the number of requests in flight from which
+		// /weather/ cache misses are answered by DegradedProvider alone,
+		// flagged "degraded"; 0 never degrades. DegradedProvider is the
+		// first configured provider if unset.
+		DegradeAt        int
+		DegradedProvider string
+	}
+
+	// Server bounds how long a client may take over each part of a
+	// connection, so slow clients can't hold connections open. Unset
+	// values get the defaults in loadConfig.
+	Server struct {
+		// PathPrefix is where the service is mounted behind a reverse
+		// proxy that passes the full path on, e.g. "/api/gollo". It is
+		// stripped before routing; paths outside it are not found.
+		PathPrefix string
+
+		ReadHeaderTimeout duration
+		ReadTimeout       duration
+		WriteTimeout      duration
+		IdleTimeout       duration
+		// ShutdownTimeout is how long in-flight requests get to finish
+		// on SIGINT or SIGTERM.
+		ShutdownTimeout duration
+	}
+
+	Stream struct {
+		Interval duration // between /stream/ events; 10s if unset
+	}
+
+	Health struct {
+		// ReadyCity is looked up by /readyz to check that at least one
+		// provider is reachable; London if unset.
+		ReadyCity string
+		// StartupProviders, if set, holds off listening until that many
+		// providers answer for ReadyCity, probing every 5s.
+		// StartupTimeout bounds the wait, after which the server exits;
+		// it waits indefinitely if unset.
+		StartupProviders int
+		StartupTimeout   duration
+	}
+
+	Metrics struct {
+		// SpreadBuckets are the upper bounds, in °C, of the provider
+		// spread histogram.
+		SpreadBuckets []float64
+	}
+
+	AccessLog struct {
+		// Format is "common" or "combined", Apache's log formats. Access
+		// logging is off if it is unset.
+		Format string
+		Path   string // appended to; standard output if unset
+		// Duration ends each line with the microseconds the request took.
+		Duration bool
+	}
+
+	CORS struct {
+		AllowedOrigins []string // e.g. "https://dashboard.example.com", or "*"
+	}
+
+	// Compression compresses responses of at least MinBytes with the
+	// first of Encodings, "br", "gzip" or "deflate", that the client
+	// accepts with the highest quality. No Encodings leaves responses as
+	// they are.
+	Compression struct {
+		Encodings []string
+		MinBytes  int
+	}
+
+	Compat struct {
+		DarkSky bool // serve /compat/darksky/
+	}
+
+	// Deprecated maps the path prefixes of routes on their way out to
+	// what replaces them, e.g. {"/weather/": "/v2/weather/"}, or "" if
+	// nothing does. Responses on them carry a Warning header and each
+	// request is logged with its client.
+	Deprecated map[string]string
+
+	// Overrides, if Allow is set, even to [], restricts the query
+	// parameters that override the configuration per request, any of
+	// agg, units, providers, min_tier, kelvin and cache_only, to those
+	// it lists.
+	// Others are ignored or, with Reject, answered with a 400.
+	Overrides struct {
+		Allow  []string
+		Reject bool
+	}
+
+	Admin struct {
+		// Token is the bearer token /admin/ endpoints require. They are
+		// not served if it is unset.
+		Token string
+		// Diagnose serves /diagnose/, behind Token, with every reading
+		// for a city and what each aggregation makes of them.
+		Diagnose bool
+	}
+}
+
+// duration decodes a time.Duration from a JSON string such as "5m".
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.Duration.String())
+}
+
+// secretFields are the fields, by lowercased name, whose values String
+// leaves out, wherever they appear.
+var secretFields = map[string]bool{"apikey": true, "token": true}
+
+// String renders c as JSON for the startup log. API keys and tokens are
+// redacted, as are the values of providers' upstream headers and query
+// parameters, credentials in URLs, and anything else that looks like a
+// key.
+func (c config) String() string {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Sprintf("<unprintable configuration: %s>", err)
+	}
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return fmt.Sprintf("<unprintable configuration: %s>", err)
+	}
+	b, _ = json.Marshal(redactConfig(v))
+	return string(b)
+}
+
+// minResponseTime is debug.minResponseTime if debug mode is on, and 0
+// otherwise.
+func (c config) minResponseTime() time.Duration {
+	if !c.Debug.Enabled {
+		return 0
+	}
+	return c.Debug.MinResponseTime.Duration
+}
+
+func redactConfig(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, x := range v {
+			switch lk := strings.ToLower(k); {
+			case secretFields[lk]:
+				if s, _ := x.(string); s != "" {
+					v[k] = "REDACTED"
+				}
+			case lk == "headers" || lk == "query":
+				if m, ok := x.(map[string]interface{}); ok {
+					for name := range m {
+						m[name] = "REDACTED"
+					}
+				}
+			default:
+				v[k] = redactConfig(x)
+			}
+		}
+	case []interface{}:
+		for i, x := range v {
+			v[i] = redactConfig(x)
+		}
+	case string:
+		if u, err := url.Parse(v); err == nil && u.User != nil {
+			v = u.Redacted()
+		}
+		return redact(v)
+	}
+	return v
+}
+
+// loadConfig reads the base config file, then layers each override over
+// it in order, and then each of layers, the configuration given by the
+// environment and flags. An override may be a directory, whose *.json
+// files are applied in name order. Overrides that don't exist are
+// skipped, and so is the base, as long as what the rest give sets up
+// providers or their API keys.
+func loadConfig(base string, overrides []string, layers ...map[string]interface{}) (conf config, err error) {
+	merged, err := readConfigFile(base)
+	baseRead := err == nil
+	read := baseRead
+	if errors.Is(err, fs.ErrNotExist) {
+		merged = make(map[string]interface{})
+	} else if err != nil {
+		return conf, err
+	}
+	for _, path := range overrides {
+		files := []string{path}
+		if info, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return conf, err
+		} else if info.IsDir() {
+			if files, err = filepath.Glob(filepath.Join(path, "*.json")); err != nil {
+				return conf, err
+			}
+			sort.Strings(files)
+		}
+		for _, file := range files {
+			layer, err := readConfigFile(file)
+			if err != nil {
+				return conf, err
+			}
+			mergeConfig(merged, layer)
+			read = true
+		}
+	}
+	for _, layer := range layers {
+		if len(layer) > 0 {
+			mergeConfig(merged, layer)
+			read = true
+		}
+	}
+	if !read {
+		return conf, fmt.Errorf("no configuration: %s does not exist and no override was found", base)
+	}
+	b, err := json.Marshal(merged)
+	if err != nil {
+		return conf, err
+	}
+	if err = json.Unmarshal(b, &conf); err != nil {
+		return conf, err
+	}
+	// Without the base, the built-in providers' defaults are no reason
+	// to start: something has to say which providers to use.
+	if !baseRead && len(conf.Providers) == 0 && conf.ForecastIo.ApiKey == "" && conf.WeatherUnderground.ApiKey == "" {
+		return conf, fmt.Errorf("no usable provider set: %s does not exist, and no override, flag or environment variable configures providers or API keys", base)
+	}
+	if conf.Geocoder.Timeout.Duration == 0 {
+		conf.Geocoder.Timeout.Duration = 2 * time.Second
+	}
+	if conf.Health.ReadyCity == "" {
+		conf.Health.ReadyCity = "London"
+	}
+	defaults := []struct {
+		d *duration
+		v time.Duration
+	}{
+		{&conf.Server.ReadHeaderTimeout, 5 * time.Second},
+		{&conf.Server.ReadTimeout, 10 * time.Second},
+		{&conf.Server.WriteTimeout, 30 * time.Second},
+		{&conf.Server.IdleTimeout, 2 * time.Minute},
+		{&conf.Server.ShutdownTimeout, 10 * time.Second},
+		{&conf.Stream.Interval, 10 * time.Second},
+	}
+	for _, def := range defaults {
+		if def.d.Duration == 0 {
+			def.d.Duration = def.v
+		}
+	}
+	return
+}
+
+// envConfig is the configuration getenv gives: GOLLO_CONFIG, a JSON
+// document, with the built-in providers' keys in GOLLO_FORECASTIO_API_KEY
+// and GOLLO_WEATHERUNDERGROUND_API_KEY over it.
+func envConfig(getenv func(string) string) (map[string]interface{}, error) {
+	return configLayer("GOLLO_CONFIG", getenv("GOLLO_CONFIG"), getenv("GOLLO_FORECASTIO_API_KEY"), getenv("GOLLO_WEATHERUNDERGROUND_API_KEY"))
+}
+
+// parseArgs splits the command line into the override files it names and
+// the configuration its flags give: -config, a JSON document, with the
+// built-in providers' keys in -forecastio-key and -wunderground-key over
+// it.
+func parseArgs(args []string) (files []string, layer map[string]interface{}, err error) {
+	fl := flag.NewFlagSet("gollo", flag.ContinueOnError)
+	doc := fl.String("config", "", "a JSON configuration, layered over the files")
+	forecastIo := fl.String("forecastio-key", "", "forecast.io's API key")
+	wunderground := fl.String("wunderground-key", "", "Weather Underground's API key")
+	if err := fl.Parse(args); err != nil {
+		return nil, nil, err
+	}
+	layer, err = configLayer("-config", *doc, *forecastIo, *wunderground)
+	return fl.Args(), layer, err
+}
+
+// configLayer is the configuration doc describes, named source in errors,
+// with any keys for the built-in providers set over it.
+func configLayer(source, doc, forecastIo, wunderground string) (map[string]interface{}, error) {
+	layer := make(map[string]interface{})
+	if doc != "" {
+		if err := json.Unmarshal([]byte(doc), &layer); err != nil {
+			return nil, fmt.Errorf("%s: %s", source, err)
+		}
+	}
+	if forecastIo != "" {
+		mergeConfig(layer, map[string]interface{}{"forecastIo": map[string]interface{}{"apiKey": forecastIo}})
+	}
+	if wunderground != "" {
+		mergeConfig(layer, map[string]interface{}{"weatherUnderground": map[string]interface{}{"apiKey": wunderground}})
+	}
+	return layer, nil
+}
+
+func readConfigFile(path string) (map[string]interface{}, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var m map[string]interface{}
+	if err := json.NewDecoder(file).Decode(&m); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return m, nil
+}
+
+// mergeConfig deep-merges src into dst. Objects are merged key by key,
+// matching keys case-insensitively as config decoding does; anything else,
+// lists included, is replaced whole.
+func mergeConfig(dst, src map[string]interface{}) {
+	for k, v := range src {
+		key := k
+		for existing := range dst {
+			if strings.EqualFold(existing, k) {
+				key = existing
+				break
+			}
+		}
+		sub, isMap := v.(map[string]interface{})
+		if cur, ok := dst[key].(map[string]interface{}); ok && isMap {
+			mergeConfig(cur, sub)
+			continue
+		}
+		dst[key] = v
+	}
+}
+
+func newGeocoder(conf config) (geocoder, error) {
+	names := conf.Geocoder.Chain
+	if len(names) == 0 {
+		names = []string{"google"}
+	}
+	var reject bool
+	switch conf.Geocoder.Ambiguous {
+	case "", "first":
+	case "reject":
+		reject = true
+	default:
+		return nil, fmt.Errorf("geocoder: unknown ambiguous %q, want first or reject", conf.Geocoder.Ambiguous)
+	}
+	var live chainGeocoder
+	for _, name := range names {
+		switch name {
+		case "google":
+			live = append(live, googleGeocoder{timeout: conf.Geocoder.Timeout.Duration, rejectAmbiguous: reject})
+		case "nominatim":
+			live = append(live, nominatimGeocoder{timeout: conf.Geocoder.Timeout.Duration, rejectAmbiguous: reject})
+		default:
+			return nil, fmt.Errorf("unknown geocoder %q", name)
+		}
+	}
+	// Only live answers are cached; the static table is cheap, and a
+	// fallback shouldn't outlive the outage that called for it.
+	ttl := conf.Geocoder.CacheTTL.Duration
+	if ttl == 0 {
+		ttl = 720 * time.Hour
+	}
+	var next geocoder = live
+	if len(live) == 1 {
+		next = live[0]
+	}
+	if n := conf.Geocoder.MaxConcurrent; n > 0 {
+		next = limitedGeocoder{next: next, slots: make(chan struct{}, n)}
+	}
+	chain := chainGeocoder{cachingGeocoder{next: next, points: newLocationCache[point](ttl)}}
+	if len(conf.Geocoder.Static) > 0 {
+		static := make(staticGeocoder, len(conf.Geocoder.Static))
+		for city, c := range conf.Geocoder.Static {
+			static[strings.ToLower(city)] = point{c.Lat, c.Lon}
+		}
+		chain = append(chain, static)
+	}
+	if len(chain) == 1 {
+		return chain[0], nil
+	}
+	return chain, nil
+}
+
+func newConfidenceScorer(conf config) (confidenceScorer, error) {
+	c := conf.Confidence
+	if c.Sources < 0 || c.Agreement < 0 || c.Freshness < 0 {
+		return confidenceScorer{}, errors.New("confidence: weights must not be negative")
+	}
+	return confidenceScorer{
+		sources:   c.Sources,
+		agreement: c.Agreement,
+		freshness: c.Freshness,
+		spread:    c.Spread,
+		halfLife:  c.HalfLife.Duration,
+	}, nil
+}
+
+// getMultiWeatherProvider builds the provider set conf describes. Providers
+// that geocode cities use geo.
+func getMultiWeatherProvider(conf config, geo geocoder) (mw multiWeatherProvider, err error) {
+	env := providerEnv{geocoder: geo}
+	if len(conf.Providers) == 0 {
+		mw.providers = []weatherProvider{
+			openWeatherMap{},
+			weatherUnderground{apiKey: conf.WeatherUnderground.ApiKey},
+			forecastIo{apiKey: conf.ForecastIo.ApiKey, geocoder: env.geocoder},
+		}
+	}
+	var configured []weatherProvider
+	for _, pc := range conf.Providers {
+		p, err := newProvider(pc, env)
+		if err != nil {
+			return mw, err
+		}
+		configured = append(configured, p)
+	}
+	if len(configured) > 0 {
+		if mw.providers, err = labelProviders(configured, conf.Providers); err != nil {
+			return mw, err
+		}
+	}
+	for i, pc := range conf.Providers {
+		if pc.CacheTTL.Duration > 0 {
+			if mw.recent == nil {
+				mw.recent = make(map[string]*locationCache[reading])
+			}
+			mw.recent[mw.providers[i].name()] = newLocationCache[reading](pc.CacheTTL.Duration)
+		}
+	}
+	if ttl := conf.Geocoder.ReadingTTL.Duration; ttl > 0 {
+		for _, p := range mw.providers {
+			if _, ok := capability[geocodingProvider](p); !ok || mw.recent[p.name()] != nil {
+				continue
+			}
+			if mw.recent == nil {
+				mw.recent = make(map[string]*locationCache[reading])
+			}
+			mw.recent[p.name()] = newLocationCache[reading](ttl)
+		}
+	}
+	if len(conf.Quotas) > 0 {
+		mw.quota = newQuotaTracker(conf.Quotas)
+		for i, p := range mw.providers {
+			if _, ok := conf.Quotas[p.name()]; ok {
+				mw.providers[i] = quotaProvider{p, mw.quota}
+			}
+		}
+		mw.quotaOrder = conf.QuotaOrder
+	}
+
+	mw.aggregation = meanAggregation
+	if conf.Aggregation != "" {
+		if mw.aggregation, err = parseAggregation(conf.Aggregation); err != nil {
+			return mw, err
+		}
+	}
+
+	mw.sequential = conf.Sequential
+	mw.hedge = conf.Hedge.Delay.Duration
+	mw.provenance = conf.Provenance
+	if ttl := conf.LateReadings.TTL.Duration; ttl > 0 {
+		mw.lateWait = conf.LateReadings.Wait.Duration
+		if mw.lateWait == 0 {
+			mw.lateWait = 5 * time.Second
+		}
+		mw.late = make(map[string]*locationCache[reading])
+		for _, p := range mw.providers {
+			if mw.recent[p.name()] == nil {
+				mw.late[p.name()] = newLocationCache[reading](ttl)
+			}
+		}
+	}
+	switch conf.Timeouts {
+	case "", "lenient":
+	case "strict":
+		mw.strictTimeouts = true
+	default:
+		return mw, fmt.Errorf("unknown timeouts %q, want lenient or strict", conf.Timeouts)
+	}
+	for _, name := range conf.RequiredProviders {
+		p, ok := mw.provider(name)
+		if !ok {
+			return mw, fmt.Errorf("required provider %q is not configured", name)
+		}
+		mw.required = append(mw.required, p.name())
+	}
+	for i, pc := range conf.Providers {
+		if pc.Tier == "" {
+			continue
+		}
+		t, err := parseTier(pc.Tier)
+		if err != nil {
+			return mw, fmt.Errorf("provider %s: %s", mw.providers[i].name(), err)
+		}
+		if mw.tiers == nil {
+			mw.tiers = make(map[string]tier)
+		}
+		mw.tiers[mw.providers[i].name()] = t
+	}
+	base := make(map[string]float64)
+	for i, pc := range conf.Providers {
+		if pc.Weight != nil {
+			base[mw.providers[i].name()] = *pc.Weight
+		}
+	}
+	if wt := conf.Weighting; len(base) > 0 || wt.Decay > 0 || wt.MinWeight > 0 || wt.MaxWeight > 0 {
+		if wt.MaxWeight > 0 && wt.MinWeight > wt.MaxWeight {
+			return mw, fmt.Errorf("weighting: minWeight %g exceeds maxWeight %g", wt.MinWeight, wt.MaxWeight)
+		}
+		mw.weights = newProviderWeights(base, wt.Decay, wt.Recovery, wt.Floor, wt.MinWeight, wt.MaxWeight)
+	}
+	if n := conf.Breaker.Failures; n > 0 {
+		cooldown := conf.Breaker.Cooldown.Duration
+		if cooldown == 0 {
+			cooldown = 30 * time.Second
+		}
+		mw.breaker = newCircuitBreaker(n, cooldown)
+	}
+	if n := conf.Rotation.Primaries; n > 0 {
+		interval := conf.Rotation.Interval.Duration
+		if interval <= 0 {
+			interval = time.Minute
+		}
+		mw.rotation = &rotation{primaries: n, interval: interval}
+	}
+	for place, names := range conf.CityProviders {
+		var providers []weatherProvider
+		for _, name := range names {
+			p, ok := mw.provider(name)
+			if !ok {
+				return mw, fmt.Errorf("cityProviders: %s: provider %q is not configured", place, name)
+			}
+			providers = append(providers, p)
+		}
+		for _, name := range mw.required {
+			if _, ok := (multiWeatherProvider{providers: providers}).provider(name); !ok {
+				return mw, fmt.Errorf("cityProviders: %s: leaves out required provider %s", place, name)
+			}
+		}
+		if mw.overrides == nil {
+			mw.overrides = make(map[string][]weatherProvider)
+		}
+		mw.overrides[normalizeCity(place)] = providers
+	}
+	for _, name := range conf.First.Priority {
+		p, ok := mw.provider(name)
+		if !ok {
+			return mw, fmt.Errorf("first: priority provider %q is not configured", name)
+		}
+		mw.priority = append(mw.priority, p.name())
+	}
+	if len(mw.priority) > 0 {
+		mw.stagger = conf.First.Stagger.Duration
+		if mw.stagger == 0 {
+			mw.stagger = 250 * time.Millisecond
+		}
+	}
+	mw.requireFresh = conf.RequireFresh.Duration
+	mw.clockSkew = conf.ClockSkew.Duration
+	if mw.clockSkew <= 0 {
+		mw.clockSkew = time.Minute
+	}
+	mw.quotaFallback = conf.Geocoder.QuotaFallback
+	mw.retryBudget = conf.Upstream.Retries.Budget
+	if conf.Altitude.Normalize {
+		mw.altitude = newAltitudeNormalizer(conf.Altitude.LapseRate, geo)
+	}
+	mw.consensusWithin, mw.consensusMin = conf.Consensus.Within, conf.Consensus.MinAgreeing
+	switch conf.UVIndex {
+	case "", "max":
+	case "mean":
+		mw.meanUV = true
+	default:
+		return mw, fmt.Errorf("unknown uvIndex aggregation %q, want max or mean", conf.UVIndex)
+	}
+
+	mw.minCelsius, mw.maxCelsius = -273.15, math.Inf(1)
+	if conf.Plausible.MinCelsius != nil {
+		mw.minCelsius = math.Max(mw.minCelsius, *conf.Plausible.MinCelsius)
+	}
+	if conf.Plausible.MaxCelsius != nil {
+		mw.maxCelsius = *conf.Plausible.MaxCelsius
+	}
+	return
+}
@@ -0,0 +1,49 @@
+package main
+
+import "net/http"
+
+// corsHandler adds CORS headers for requests from allowed origins and
+// answers OPTIONS preflight requests itself, allowing whichever request
+// headers the browser asks for. An origin of "*" allows any.
+type corsHandler struct {
+	next    http.Handler
+	origins map[string]bool
+}
+
+func withCORS(next http.Handler, allowedOrigins []string) http.Handler {
+	if len(allowedOrigins) == 0 {
+		return next
+	}
+	h := corsHandler{next: next, origins: make(map[string]bool)}
+	for _, o := range allowedOrigins {
+		h.origins[o] = true
+	}
+	return h
+}
+
+func (h corsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	allowed := origin != "" && (h.origins["*"] || h.origins[origin])
+	// Every response depends on the origin, including those without CORS
+	// headers, so caches mustn't serve one origin's to another.
+	w.Header().Add("Vary", "Origin")
+	if allowed {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+
+	if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+		if !allowed {
+			writeError(w, r, "origin not allowed", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+			w.Header().Set("Access-Control-Allow-Headers", headers)
+		}
+		w.Header().Set("Access-Control-Max-Age", "600")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	h.next.ServeHTTP(w, r)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func corsRequest(h http.Handler, method, origin string, header map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/weather/London", nil)
+	if origin != "" {
+		r.Header.Set("Origin", origin)
+	}
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("{}")) })
+
+func TestCORSAllowedOrigin(t *testing.T) {
+	h := withCORS(okHandler, []string{"https://app.example"})
+
+	w := corsRequest(h, "GET", "https://app.example", nil)
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://app.example" {
+		t.Errorf("Access-Control-Allow-Origin %q, want the origin", got)
+	}
+	if got := w.Header().Get("Vary"); got != "Origin" {
+		t.Errorf("Vary %q, want Origin", got)
+	}
+}
+
+func TestCORSDisallowedOrigin(t *testing.T) {
+	h := withCORS(okHandler, []string{"https://app.example"})
+
+	for _, origin := range []string{"https://evil.example", ""} {
+		w := corsRequest(h, "GET", origin, nil)
+		if w.Code != http.StatusOK {
+			t.Errorf("%q: status %d; simple requests are still served", origin, w.Code)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != "" {
+			t.Errorf("%q: Access-Control-Allow-Origin %q, want none", origin, got)
+		}
+		// A cache must not hand this response to an allowed origin.
+		if got := w.Header().Get("Vary"); got != "Origin" {
+			t.Errorf("%q: Vary %q, want Origin", origin, got)
+		}
+	}
+}
+
+func TestCORSWildcard(t *testing.T) {
+	h := withCORS(okHandler, []string{"*"})
+	w := corsRequest(h, "GET", "https://any.example", nil)
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://any.example" {
+		t.Errorf("Access-Control-Allow-Origin %q, want the origin", got)
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	h := withCORS(okHandler, []string{"https://app.example"})
+	preflight := map[string]string{
+		"Access-Control-Request-Method":  "GET",
+		"Access-Control-Request-Headers": "X-Request-Id",
+	}
+
+	w := corsRequest(h, "OPTIONS", "https://app.example", preflight)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("status %d, want 204", w.Code)
+	}
+	for k, want := range map[string]string{
+		"Access-Control-Allow-Origin":  "https://app.example",
+		"Access-Control-Allow-Methods": "GET, POST, OPTIONS",
+		"Access-Control-Allow-Headers": "X-Request-Id",
+		"Access-Control-Max-Age":       "600",
+		"Vary":                         "Origin",
+	} {
+		if got := w.Header().Get(k); got != want {
+			t.Errorf("%s %q, want %q", k, got, want)
+		}
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("preflight reached the handler: %q", w.Body)
+	}
+
+	w = corsRequest(h, "OPTIONS", "https://evil.example", preflight)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("disallowed preflight: status %d, want 403", w.Code)
+	}
+}
+
+func TestCORSUnconfigured(t *testing.T) {
+	w := corsRequest(withCORS(okHandler, nil), "GET", "https://app.example", nil)
+	if len(w.Header().Values("Vary")) != 0 || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("CORS headers without CORS configured: %v", w.Header())
+	}
+}
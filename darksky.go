@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// darkSkyUnits maps Dark Sky's units parameter onto ours. Dark Sky defaulted
+// to "us" when none was given.
+var darkSkyUnits = map[string]unit{
+	"us":  fahrenheit,
+	"si":  celsius,
+	"ca":  celsius,
+	"uk2": celsius,
+}
+
+// handleDarkSky serves /compat/darksky/<city> in the shape of Dark Sky's
+// forecast response, for clients written against that API.
+func (s *server) handleDarkSky(w http.ResponseWriter, r *http.Request) {
+	city := strings.SplitN(r.URL.Path, "/", 4)[3]
+
+	units := r.URL.Query().Get("units")
+	if units == "" || units == "auto" {
+		units = "us"
+	}
+	u, ok := darkSkyUnits[units]
+	if !ok {
+		writeError(w, r, "unknown units "+units, http.StatusBadRequest)
+		return
+	}
+
+	ctx, span := s.tracer.start(r.Context(), "GET /compat/darksky/")
+	defer span.finish()
+	span.setAttr("city", city)
+
+	agg, _, err := s.aggregate(ctx, cacheKey{city: city, aggregation: s.mw.aggregation})
+	span.setStatus(err)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, r, darkSkyResponse(agg.celsius, units, u, time.Now(), s.mw))
+}
+
+type darkSkyForecast struct {
+	Currently struct {
+		Time        int64   `json:"time"`
+		Temperature float64 `json:"temperature"`
+	} `json:"currently"`
+	Flags struct {
+		Sources []string `json:"sources"`
+		Units   string   `json:"units"`
+	} `json:"flags"`
+}
+
+func darkSkyResponse(celsius float64, units string, u unit, now time.Time, mw multiWeatherProvider) darkSkyForecast {
+	var f darkSkyForecast
+	f.Currently.Time = now.Unix()
+	f.Currently.Temperature = u.fromCelsius(celsius)
+	f.Flags.Units = units
+	f.Flags.Sources = make([]string, 0, len(mw.providers))
+	for _, p := range mw.providers {
+		f.Flags.Sources = append(f.Flags.Sources, p.name())
+	}
+	return f
+}
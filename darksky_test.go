@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDarkSkyResponseShape(t *testing.T) {
+	mw := multiWeatherProvider{providers: []weatherProvider{newFake("openWeatherMap", 0), newFake("forecastIo", 0)}}
+	f := darkSkyResponse(10, "us", fahrenheit, time.Unix(1700000000, 0), mw)
+
+	got, err := json.Marshal(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"currently":{"time":1700000000,"temperature":50},"flags":{"sources":["openWeatherMap","forecastIo"],"units":"us"}}`
+	if string(got) != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+}
+
+func TestHandleDarkSky(t *testing.T) {
+	s := newTestServer(newFake("fake", 10))
+
+	for _, tt := range []struct {
+		query string
+		temp  float64
+	}{
+		{"", 50},
+		{"?units=auto", 50},
+		{"?units=si", 10},
+		{"?units=uk2", 10},
+	} {
+		w := get(s.handleDarkSky, "/compat/darksky/London"+tt.query)
+		if w.Code != http.StatusOK {
+			t.Errorf("%q: status %d: %s", tt.query, w.Code, w.Body)
+			continue
+		}
+		var f darkSkyForecast
+		if err := json.Unmarshal(w.Body.Bytes(), &f); err != nil {
+			t.Fatal(err)
+		}
+		if f.Currently.Temperature != tt.temp {
+			t.Errorf("%q: temperature %v, want %v", tt.query, f.Currently.Temperature, tt.temp)
+		}
+	}
+
+	if w := get(s.handleDarkSky, "/compat/darksky/London?units=kelvin"); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown units: status %d, want 400", w.Code)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// degradedHeader names the ways a response is degraded, comma-separated,
+// so clients and monitors can tell without parsing its body.
+const degradedHeader = "X-Gollo-Degraded"
+
+// The conditions degradedHeader names.
+const (
+	degradedLoadShedding     = "load_shedding"     // answered by the degraded provider alone
+	degradedOverloaded       = "overloaded"        // refused at the in-flight limit
+	degradedOutage           = "outage"            // refused while the outage breaker is open
+	degradedProvidersSkipped = "providers_skipped" // some providers' circuits open or quotas spent
+	degradedStale            = "stale"             // an expired cache entry
+	degradedClimatology      = "climatology"       // a climatological average
+)
+
+// setDegraded sets degradedHeader to conditions, if there are any.
+func setDegraded(h http.Header, conditions ...string) {
+	if len(conditions) > 0 {
+		h.Set(degradedHeader, strings.Join(conditions, ","))
+	}
+}
+
+// degradations are the conditions res was answered under.
+func (res weatherResult) degradations() []string {
+	var conds []string
+	if res.degraded {
+		conds = append(conds, degradedLoadShedding)
+	}
+	for _, w := range res.agg.warnings {
+		if strings.Contains(w, " skipped: ") {
+			conds = append(conds, degradedProvidersSkipped)
+			break
+		}
+	}
+	if res.stale {
+		conds = append(conds, degradedStale)
+	}
+	if res.fallback {
+		conds = append(conds, degradedClimatology)
+	}
+	return conds
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDegradedHeaderStale(t *testing.T) {
+	p := &fakeProvider{label: "fake", err: errors.New("upstream down")}
+	s := newTestServer(p)
+	s.staleOnError, s.signalDegraded = true, true
+	s.cache.set("mean:London", aggregate{celsius: 10, readings: []reading{{provider: "fake", celsius: 10}}}, -time.Minute, cacheOrigin{})
+
+	w := get(s.handleWeather, "/weather/London")
+	if w.Code != http.StatusOK || w.Header().Get(degradedHeader) != degradedStale {
+		t.Errorf("status %d, %s %q; want 200 flagged stale", w.Code, degradedHeader, w.Header().Get(degradedHeader))
+	}
+
+	// Off, the same response says nothing.
+	s.signalDegraded = false
+	if w := get(s.handleWeather, "/weather/London"); w.Header().Get(degradedHeader) != "" {
+		t.Errorf("%s %q without degradedHeader", degradedHeader, w.Header().Get(degradedHeader))
+	}
+}
+
+func TestDegradedHeaderLoadShedding(t *testing.T) {
+	cheap, other := newFake("cheap", 10), newFake("other", 20)
+	s := newTestServer(cheap, other)
+	s.degradedProvider, s.signalDegraded = cheap, true
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/weather/London", nil)
+	s.handleWeather(w, r.WithContext(context.WithValue(r.Context(), degradedKey{}, true)))
+	if got := w.Header().Get(degradedHeader); got != degradedLoadShedding {
+		t.Errorf("%s %q, want %s", degradedHeader, got, degradedLoadShedding)
+	}
+	// Answered in full, it isn't flagged.
+	if got := get(s.handleWeather, "/weather/Paris").Header().Get(degradedHeader); got != "" {
+		t.Errorf("%s %q on a full answer", degradedHeader, got)
+	}
+}
+
+func TestDegradedHeaderProvidersSkipped(t *testing.T) {
+	up, down := newFake("up", 10), newFake("down", 30)
+	down.err = errors.New("unavailable")
+	s := newTestServer(up, down)
+	s.mw.breaker = newCircuitBreaker(2, time.Hour)
+	s.signalDegraded = true
+	for _, city := range []string{"London", "Paris"} {
+		get(s.handleWeather, "/weather/"+city)
+	}
+
+	w := get(s.handleWeather, "/weather/Berlin")
+	if got := w.Header().Get(degradedHeader); got != degradedProvidersSkipped {
+		t.Errorf("status %d, %s %q; want %s", w.Code, degradedHeader, got, degradedProvidersSkipped)
+	}
+}
+
+func TestDegradedHeaderClimatology(t *testing.T) {
+	clim, err := loadClimate("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newFake("fake", 10)
+	p.err = errors.New("upstream down")
+	s := newTestServer(p)
+	s.climate, s.signalDegraded = clim, true
+
+	if got := get(s.handleWeather, "/weather/London").Header().Get(degradedHeader); got != degradedClimatology {
+		t.Errorf("%s %q, want %s", degradedHeader, got, degradedClimatology)
+	}
+	// A failure isn't a degraded answer.
+	w := get(s.handleWeather, "/weather/Atlantis")
+	if w.Code != http.StatusInternalServerError || w.Header().Get(degradedHeader) != "" {
+		t.Errorf("status %d, %s %q; want a plain 500", w.Code, degradedHeader, w.Header().Get(degradedHeader))
+	}
+}
+
+func TestDegradedHeaderOutage(t *testing.T) {
+	p := newFake("a", 20)
+	p.err = errors.New("unavailable")
+	s := newTestServer(p)
+	s.outage = newCircuitBreaker(1, time.Hour)
+	s.signalDegraded = true
+	get(s.handleWeather, "/weather/London")
+
+	w := get(s.handleWeather, "/weather/London")
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get(degradedHeader) != degradedOutage {
+		t.Errorf("status %d, %s %q; want 503 flagged %s", w.Code, degradedHeader, w.Header().Get(degradedHeader), degradedOutage)
+	}
+}
+
+func TestDegradations(t *testing.T) {
+	res := weatherResult{
+		degraded: true,
+		stale:    true,
+		fallback: true,
+		agg:      aggregate{warnings: []string{"x skipped: circuit open after 2 failures", "y skipped: daily quota of 2 spent"}},
+	}
+	want := []string{degradedLoadShedding, degradedProvidersSkipped, degradedStale, degradedClimatology}
+	if got := res.degradations(); !reflect.DeepEqual(got, want) {
+		t.Errorf("degradations %q, want %q, skips named once", got, want)
+	}
+	if got := (weatherResult{}).degradations(); got != nil {
+		t.Errorf("degradations %q, want none", got)
+	}
+
+	h := http.Header{}
+	setDegraded(h)
+	if _, ok := h[degradedHeader]; ok {
+		t.Error("header set with no conditions")
+	}
+	setDegraded(h, degradedStale, degradedClimatology)
+	if got := h.Get(degradedHeader); got != "stale,climatology" {
+		t.Errorf("%s %q, want stale,climatology", degradedHeader, got)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// withDeprecation marks responses on deprecated routes with a Warning
+// header and logs each request to one, with who made it, so the clients
+// still on it can be found before it goes. routes maps path prefixes to
+// what replaces them, or "" if nothing does. The longest matching prefix
+// wins.
+func withDeprecation(next http.Handler, routes map[string]string, proxies trustedProxies) http.Handler {
+	if len(routes) == 0 {
+		return next
+	}
+	prefixes := make([]string, 0, len(routes))
+	for p := range routes {
+		prefixes = append(prefixes, p)
+	}
+	sort.Slice(prefixes, func(i, j int) bool { return len(prefixes[i]) > len(prefixes[j]) })
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, p := range prefixes {
+			if !strings.HasPrefix(r.URL.Path, p) {
+				continue
+			}
+			text := p + " is deprecated"
+			if use := routes[p]; use != "" {
+				text += "; use " + use
+			}
+			w.Header().Add("Warning", "299 - "+strconv.Quote(text))
+			slog.Warn("deprecated route", "route", p, "path", r.URL.Path, "client", proxies.clientIP(r), "user_agent", r.UserAgent())
+			break
+		}
+		next.ServeHTTP(w, r)
+	})
+}
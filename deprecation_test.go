@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDeprecationWarning(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := withDeprecation(ok, map[string]string{"/weather/": "/v2/weather/", "/compat/": ""}, nil)
+	logs := captureLog(t)
+
+	for _, tt := range []struct{ path, want string }{
+		{"/weather/London", `299 - "/weather/ is deprecated; use /v2/weather/"`},
+		{"/compat/darksky/forecast/51.5,-0.12", `299 - "/compat/ is deprecated"`},
+		// The versioned route isn't caught by the legacy one's prefix.
+		{"/v2/weather/London", ""},
+		{"/healthz", ""},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", tt.path, nil)
+		r.Header.Set("User-Agent", "legacy-client/1.0")
+		h.ServeHTTP(w, r)
+		if got := w.Header().Get("Warning"); got != tt.want {
+			t.Errorf("%s: Warning %q, want %q", tt.path, got, tt.want)
+		}
+	}
+
+	out := logs.String()
+	if n := strings.Count(out, `"msg":"deprecated route"`); n != 2 {
+		t.Errorf("%d deprecation log lines, want one per legacy request: %s", n, out)
+	}
+	if !strings.Contains(out, `"route":"/weather/","path":"/weather/London","client":"192.0.2.1","user_agent":"legacy-client/1.0"`) {
+		t.Errorf("log %s, want the route, path, client and user agent", out)
+	}
+}
+
+func TestDeprecationOff(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	w := httptest.NewRecorder()
+	withDeprecation(ok, nil, nil).ServeHTTP(w, httptest.NewRequest("GET", "/weather/London", nil))
+	if got := w.Header().Get("Warning"); got != "" {
+		t.Errorf("Warning %q with no routes deprecated", got)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// handleDiagnose serves /diagnose/<city>: every provider's reading or
+// error, what each aggregation would make of the plausible ones, how far
+// they disagree, and which readings would be left out and why. Like
+// /readings/, it bypasses the cache.
+func (s *server) handleDiagnose(w http.ResponseWriter, r *http.Request) {
+	begin := time.Now()
+	city := strings.SplitN(r.URL.Path, "/", 3)[2]
+
+	u, err := s.requestUnit(r)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, span := s.tracer.start(r.Context(), "GET /diagnose/")
+	defer span.finish()
+	span.setAttr("city", city)
+
+	// Every provider, whatever the rotation.
+	mw := s.mw
+	mw.rotation = nil
+	outcomes, warnings := mw.collect(ctx, city)
+
+	readings := make([]map[string]interface{}, 0, len(outcomes))
+	var plausible []reading
+	rejected := []map[string]interface{}{}
+	for _, o := range outcomes {
+		if o.err != nil {
+			readings = append(readings, s.providerError(o))
+			continue
+		}
+		readings = append(readings, providerDetails([]reading{o.reading}, u, nil, true)[0])
+		if c := o.reading.celsius; c < mw.minCelsius || c > mw.maxCelsius {
+			rejected = append(rejected, map[string]interface{}{"provider": o.provider, "reason": "implausible"})
+			continue
+		}
+		plausible = append(plausible, o.reading)
+	}
+
+	resp := map[string]interface{}{
+		"city":     city,
+		"readings": readings,
+		"rejected": rejected,
+	}
+	s.tookFormat.set(resp, begin)
+	if len(warnings) > 0 {
+		resp["warnings"] = warnings
+	}
+	if len(plausible) == 0 {
+		writeJSON(w, r, resp)
+		return
+	}
+
+	aggregates := make(map[string]interface{}, len(aggregators)+1)
+	for name, a := range aggregators {
+		aggregates[string(name)] = u.fromCelsius(a(plausible, mw.weights).celsius)
+	}
+	fastest := plausible[0]
+	for _, r := range plausible[1:] {
+		if r.took < fastest.took {
+			fastest = r
+		}
+	}
+	aggregates[string(firstAggregation)] = u.fromCelsius(fastest.celsius)
+	resp["aggregates"] = aggregates
+
+	// Spreads scale with the unit but don't shift with it.
+	low, high := math.Inf(1), math.Inf(-1)
+	for _, r := range plausible {
+		low, high = math.Min(low, r.celsius), math.Max(high, r.celsius)
+	}
+	resp["spread"] = u.fromCelsius(high-low) - u.fromCelsius(0)
+	if sd := stddev(plausible); sd != nil {
+		resp["stddev"] = u.fromCelsius(*sd) - u.fromCelsius(0)
+	}
+	if len(plausible) >= 3 {
+		sorted := append([]reading(nil), plausible...)
+		sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].celsius < sorted[j].celsius })
+		for _, r := range []reading{sorted[0], sorted[len(sorted)-1]} {
+			rejected = append(rejected, map[string]interface{}{"provider": r.provider, "reason": "trimmed"})
+		}
+		resp["rejected"] = rejected
+	}
+	if mw.consensusWithin > 0 {
+		resp["consensus"] = "ok"
+		if err := consensus(plausible, mw.consensusWithin, mw.consensusMin); err != nil {
+			resp["consensus"] = err.Error()
+		}
+	}
+	writeJSON(w, r, resp)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestDiagnose(t *testing.T) {
+	failing := newFake("failing", 0)
+	failing.err = errors.New("upstream said no")
+	s := newTestServer(newFake("a", 10), newFake("b", 12), newFake("c", 14), newFake("hot", 500), failing)
+	s.mw.rotation = &rotation{primaries: 1}
+	s.mw.consensusWithin = 1
+
+	w := get(s.handleDiagnose, "/diagnose/London")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	body := decode(t, w)
+	for _, section := range []string{"city", "readings", "aggregates", "spread", "stddev", "rejected", "consensus"} {
+		if _, ok := body[section]; !ok {
+			t.Errorf("no %s in %v", section, body)
+		}
+	}
+
+	// Every provider is called, whatever the rotation.
+	errs := map[interface{}]interface{}{}
+	for _, r := range body["readings"].([]interface{}) {
+		r := r.(map[string]interface{})
+		errs[r["provider"]] = r["error"]
+	}
+	if len(errs) != 5 || errs["failing"] != "upstream said no" || errs["a"] != nil {
+		t.Errorf("readings %v, want all five with failing's error", body["readings"])
+	}
+
+	aggregates := body["aggregates"].(map[string]interface{})
+	if aggregates["mean"] != 12.0 || aggregates["trimmed"] != 12.0 {
+		t.Errorf("aggregates %v, want the mean and trimmed mean of 10, 12 and 14", aggregates)
+	}
+	if first, ok := aggregates["first"].(float64); !ok || first != 10 && first != 12 && first != 14 {
+		t.Errorf("first %v, want one of the plausible readings", aggregates["first"])
+	}
+	if number(t, body, "spread") != 4 || !near(number(t, body, "stddev"), 2) {
+		t.Errorf("spread %v, stddev %v, want 4 and 2", body["spread"], body["stddev"])
+	}
+	if body["consensus"] == "ok" {
+		t.Error("consensus ok for readings 4° apart within 1°")
+	}
+
+	rejected := map[interface{}]interface{}{}
+	for _, r := range body["rejected"].([]interface{}) {
+		r := r.(map[string]interface{})
+		rejected[r["provider"]] = r["reason"]
+	}
+	if len(rejected) != 3 || rejected["hot"] != "implausible" || rejected["a"] != "trimmed" || rejected["c"] != "trimmed" {
+		t.Errorf("rejected %v, want hot implausible and a and c trimmed", rejected)
+	}
+
+	// Spreads scale with the unit.
+	body = decode(t, get(s.handleDiagnose, "/diagnose/London?units=f"))
+	if !near(number(t, body, "spread"), 7.2) || !near(body["aggregates"].(map[string]interface{})["mean"].(float64), 53.6) {
+		t.Errorf("units=f: spread %v, aggregates %v", body["spread"], body["aggregates"])
+	}
+}
+
+func TestDiagnoseNothingPlausible(t *testing.T) {
+	failing := newFake("failing", 0)
+	failing.err = errors.New("upstream said no")
+	body := decode(t, get(newTestServer(failing).handleDiagnose, "/diagnose/London"))
+	if _, ok := body["aggregates"]; ok || len(body["readings"].([]interface{})) != 1 {
+		t.Errorf("got %v, want the failure without aggregates", body)
+	}
+}
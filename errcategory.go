@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+)
+
+// errorCategory is a coarse kind of provider failure, for clients and
+// dashboards to count failures by without parsing messages.
+type errorCategory string
+
+const (
+	categoryTimeout     errorCategory = "timeout"
+	categoryRateLimited errorCategory = "rate_limited"
+	categoryNotFound    errorCategory = "not_found"
+	categoryAuth        errorCategory = "auth"
+	categoryNetwork     errorCategory = "network"
+	categoryDecode      errorCategory = "decode"
+	categoryUpstream    errorCategory = "upstream_error"
+)
+
+// categorize sorts err into a category. Anything it can't place more
+// precisely, such as a provider's own complaint in a 200 response, is an
+// upstream error.
+func categorize(err error) errorCategory {
+	var se statusError
+	var gs googleStatusError
+	var ne net.Error
+	var syntax *json.SyntaxError
+	var mistyped *json.UnmarshalTypeError
+	switch {
+	case errors.Is(err, errTimedOut), errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &ne) && ne.Timeout():
+		return categoryTimeout
+	case geocodeQuotaExhausted(err):
+		return categoryRateLimited
+	case errors.As(err, &se):
+		switch {
+		case se.status == http.StatusTooManyRequests:
+			return categoryRateLimited
+		case se.status == http.StatusNotFound:
+			return categoryNotFound
+		case se.status == http.StatusUnauthorized || se.status == http.StatusForbidden:
+			return categoryAuth
+		}
+	case errors.As(err, &gs) && gs.status == "REQUEST_DENIED":
+		return categoryAuth
+	case errors.Is(err, errNoResults):
+		return categoryNotFound
+	case errors.As(err, &syntax), errors.As(err, &mistyped), errors.Is(err, io.ErrUnexpectedEOF):
+		return categoryDecode
+	case errors.As(err, new(*tls.CertificateVerificationError)), errors.As(err, &ne):
+		return categoryNetwork
+	}
+	return categoryUpstream
+}
+
+// providerError describes o's failure for /readings/ and /diagnose/, with
+// its category if the server is configured to add them.
+func (s *server) providerError(o outcome) map[string]interface{} {
+	e := map[string]interface{}{
+		"provider": o.provider,
+		"error":    o.err.Error(),
+	}
+	if s.errorCategories {
+		e["category"] = categorize(o.err)
+	}
+	return e
+}
+
+// providerFailure is a provider's failure that an aggregate was computed
+// without, kept to report with its category.
+type providerFailure struct {
+	provider string
+	err      string
+	category errorCategory
+	// warning is the entry of the aggregate's warnings that reports the
+	// failure, if any does.
+	warning string
+}
+
+func newProviderFailure(provider string, err error, warning string) providerFailure {
+	return providerFailure{provider: provider, err: err.Error(), category: categorize(err), warning: warning}
+}
+
+// detail describes f among a ?detail=true response's providers, as
+// providerError does for /readings/.
+func (f providerFailure) detail() map[string]interface{} {
+	return map[string]interface{}{
+		"provider": f.provider,
+		"error":    f.err,
+		"category": f.category,
+	}
+}
+
+// warningList is agg's warnings for a response. With categories, each is
+// an object with its message, and the provider and category of the failure
+// it reports if it reports one.
+func (agg aggregate) warningList(categories bool) interface{} {
+	if !categories {
+		return agg.warnings
+	}
+	warnings := make([]map[string]interface{}, 0, len(agg.warnings))
+	for _, w := range agg.warnings {
+		entry := map[string]interface{}{"message": w}
+		for _, f := range agg.failures {
+			if f.warning == w {
+				entry["provider"], entry["category"] = f.provider, f.category
+				break
+			}
+		}
+		warnings = append(warnings, entry)
+	}
+	return warnings
+}
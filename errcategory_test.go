@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestCategorize(t *testing.T) {
+	var syntax, mistyped error
+	var v struct{ Temp float64 }
+	syntax = json.Unmarshal([]byte(`{"temp": `), &v)
+	mistyped = json.Unmarshal([]byte(`{"temp": "warm"}`), &v)
+	quota := geocodeError{"London", googleStatusError{status: "OVER_QUERY_LIMIT"}}
+
+	for _, tt := range []struct {
+		err  error
+		want errorCategory
+	}{
+		{errTimedOut, categoryTimeout},
+		{context.DeadlineExceeded, categoryTimeout},
+		{&url.Error{Op: "Get", URL: "http://a.example", Err: &net.DNSError{Err: "i/o timeout", IsTimeout: true}}, categoryTimeout},
+		{statusError{"a.example", http.StatusTooManyRequests}, categoryRateLimited},
+		{quota, categoryRateLimited},
+		{statusError{"a.example", http.StatusNotFound}, categoryNotFound},
+		{geocodeError{"Atlantis", errNoResults}, categoryNotFound},
+		{statusError{"a.example", http.StatusUnauthorized}, categoryAuth},
+		{statusError{"a.example", http.StatusForbidden}, categoryAuth},
+		{geocodeError{"London", googleStatusError{status: "REQUEST_DENIED"}}, categoryAuth},
+		{&url.Error{Op: "Get", URL: "http://a.example", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}, categoryNetwork},
+		{&net.DNSError{Err: "no such host", IsNotFound: true}, categoryNetwork},
+		{syntax, categoryDecode},
+		{mistyped, categoryDecode},
+		{io.ErrUnexpectedEOF, categoryDecode},
+		{statusError{"a.example", http.StatusInternalServerError}, categoryUpstream},
+		{errors.New("wunderground: no current observation"), categoryUpstream},
+		// Wrapping keeps the category.
+		{fmt.Errorf("darksky: %w", statusError{"a.example", http.StatusTooManyRequests}), categoryRateLimited},
+	} {
+		if got := categorize(tt.err); got != tt.want {
+			t.Errorf("categorize(%v) = %s, want %s", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestProviderErrorCategory(t *testing.T) {
+	failing := newFake("failing", 0)
+	failing.err = statusError{"a.example", http.StatusTooManyRequests}
+	s := newTestServer(newFake("a", 10), failing)
+	category := func() interface{} {
+		t.Helper()
+		for _, r := range decode(t, get(s.handleReadings, "/readings/London"))["readings"].([]interface{}) {
+			if r := r.(map[string]interface{}); r["provider"] == "failing" {
+				return r["category"]
+			}
+		}
+		t.Fatal("no reading for failing")
+		return nil
+	}
+
+	if c := category(); c != nil {
+		t.Errorf("category %v without errorCategories", c)
+	}
+	s.errorCategories = true
+	if c := category(); c != string(categoryRateLimited) {
+		t.Errorf("category %v, want rate_limited", c)
+	}
+}
+
+func TestWeatherErrorCategories(t *testing.T) {
+	exhausted := newFake("exhausted", 0)
+	exhausted.err = geocodeError{"London", googleStatusError{status: "OVER_QUERY_LIMIT"}}
+	s := newTestServer(newFake("a", 10), exhausted)
+	s.mw.quotaFallback = true
+
+	// Without errorCategories, warnings stay strings and detail lists
+	// only the providers that answered.
+	body := decode(t, get(s.handleWeather, "/weather/London?detail=true"))
+	if w, _ := body["warnings"].([]interface{}); len(w) != 1 || w[0] != "exhausted excluded: geocoder quota exhausted" {
+		t.Errorf("warnings %v, want exhausted's as a string", body["warnings"])
+	}
+	if p, _ := body["providers"].([]interface{}); len(p) != 1 {
+		t.Errorf("providers %v, want a's alone", body["providers"])
+	}
+
+	s.errorCategories = true
+	body = decode(t, get(s.handleWeather, "/weather/London?detail=true&detail_fields=temp"))
+	warnings, _ := body["warnings"].([]interface{})
+	if len(warnings) != 1 {
+		t.Fatalf("warnings %v, want exhausted's", body["warnings"])
+	}
+	w := warnings[0].(map[string]interface{})
+	if w["message"] != "exhausted excluded: geocoder quota exhausted" || w["provider"] != "exhausted" || w["category"] != "rate_limited" {
+		t.Errorf("warning %v, want exhausted's message, name and rate_limited", w)
+	}
+	providers, _ := body["providers"].([]interface{})
+	if len(providers) != 2 {
+		t.Fatalf("providers %v, want a's reading and exhausted's failure", body["providers"])
+	}
+	// ?detail_fields= doesn't strip a failure's error.
+	f := providers[1].(map[string]interface{})
+	if f["provider"] != "exhausted" || f["category"] != "rate_limited" || f["error"] == nil {
+		t.Errorf("failure %v, want exhausted's error and category", f)
+	}
+}
+
+func TestWeatherErrorCategoriesFirst(t *testing.T) {
+	// With first aggregation, providers that failed before one answered
+	// are listed, though no warning mentions them.
+	denied := newFake("denied", 0)
+	denied.err = statusError{"a.example", http.StatusUnauthorized}
+	slow := newFake("slow", 10)
+	slow.delay = 50 * time.Millisecond
+	s := newTestServer(denied, slow)
+	s.mw.aggregation = firstAggregation
+	s.errorCategories = true
+
+	body := decode(t, get(s.handleWeather, "/weather/London?detail=true"))
+	if _, ok := body["warnings"]; ok {
+		t.Errorf("warnings %v, want none", body["warnings"])
+	}
+	providers := body["providers"].([]interface{})
+	if len(providers) != 2 {
+		t.Fatalf("providers %v, want slow's reading and denied's failure", providers)
+	}
+	if f := providers[1].(map[string]interface{}); f["provider"] != "denied" || f["category"] != "auth" {
+		t.Errorf("failure %v, want denied's auth", f)
+	}
+}
+
+func TestWarningList(t *testing.T) {
+	agg := aggregate{
+		warnings: []string{"a skipped: circuit open after 2 failures", "b timed out; excluded from the average"},
+		failures: []providerFailure{newProviderFailure("b", errTimedOut, "b timed out; excluded from the average")},
+	}
+	if got, ok := agg.warningList(false).([]string); !ok || len(got) != 2 {
+		t.Errorf("warnings %v, want the strings as they are", agg.warningList(false))
+	}
+	got := agg.warningList(true).([]map[string]interface{})
+	if len(got) != 2 || got[0]["category"] != nil || got[0]["message"] != agg.warnings[0] {
+		t.Errorf("warning %v, want just a's message", got[0])
+	}
+	if got[1]["provider"] != "b" || got[1]["category"] != categoryTimeout {
+		t.Errorf("warning %v, want b's timeout", got[1])
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// weatherFields are the top-level /weather/ response fields ?fields= can
+// select.
+var weatherFields = map[string]bool{
+	"city":               true,
+	"place":              true,
+	"temp":               true,
+	"temps":              true,
+	"kelvin":             true,
+	"as_of":              true,
+	"local_time":         true,
+	"time_zone":          true,
+	"took":               true,
+	"took_ms":            true,
+	"condition":          true,
+	"icon":               true,
+	"feels_like":         true,
+	"wind":               true,
+	"pressure":           true,
+	"uv_index":           true,
+	"precip_probability": true,
+	"cloud_cover":        true,
+	"sunrise":            true,
+	"sunset":             true,
+	"confidence":         true,
+	"trend":              true,
+	"stale":              true,
+	"degraded":           true,
+	"fallback":           true,
+	"warnings":           true,
+	"providers":          true,
+	"stddev":             true,
+	"cache":              true,
+	"provenance":         true,
+	"sources":            true,
+}
+
+// detailFields are the per-provider fields of ?detail=true responses
+// ?detail_fields= can select. The provider's name is always kept.
+var detailFields = map[string]bool{
+	"temp":                true,
+	"attribution":         true,
+	"native":              true,
+	"place":               true,
+	"condition":           true,
+	"icon":                true,
+	"cached":              true,
+	"observed":            true,
+	"feels_like":          true,
+	"wind":                true,
+	"pressure":            true,
+	"uv_index":            true,
+	"precip_probability":  true,
+	"cloud_cover":         true,
+	"elevation":           true,
+	"altitude_correction": true,
+	"stations":            true,
+}
+
+// fieldAliases accepts a few natural misspellings of field names.
+var fieldAliases = map[string]string{
+	"conditions":  "condition",
+	"temperature": "temp",
+	"feelslike":   "feels_like",
+}
+
+// parseFields parses a comma-separated field list, checking each against
+// known. An empty list selects everything and returns nil.
+func parseFields(list string, known map[string]bool) (map[string]bool, error) {
+	if list == "" {
+		return nil, nil
+	}
+	fields := make(map[string]bool)
+	for _, f := range strings.Split(list, ",") {
+		f = strings.ToLower(strings.TrimSpace(f))
+		if alias, ok := fieldAliases[f]; ok {
+			f = alias
+		}
+		if !known[f] {
+			return nil, fmt.Errorf("unknown field %q", f)
+		}
+		fields[f] = true
+	}
+	return fields, nil
+}
+
+// selectDetailFields drops the fields of each provider's details, and of
+// their stations', not in fields; nil fields keeps all.
+func selectDetailFields(details []map[string]interface{}, fields map[string]bool) []map[string]interface{} {
+	if fields == nil {
+		return details
+	}
+	for _, d := range details {
+		for k, v := range d {
+			if k == "provider" {
+				continue
+			}
+			if !fields[k] {
+				delete(d, k)
+			} else if stations, ok := v.([]map[string]interface{}); ok {
+				selectDetailFields(stations, fields)
+			}
+		}
+	}
+	return details
+}
+
+// selectFields drops the keys of resp not in fields; nil fields keeps all.
+func selectFields(resp interface{}, fields map[string]bool) interface{} {
+	m, ok := resp.(map[string]interface{})
+	if !ok || fields == nil {
+		return resp
+	}
+	for k := range m {
+		if !fields[k] {
+			delete(m, k)
+		}
+	}
+	return m
+}
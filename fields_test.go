@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestWeatherFields(t *testing.T) {
+	s := newTestServer(newFake("a", 20))
+	for query, want := range map[string][]string{
+		"temp":                  {"temp"},
+		"temp,city,conditions":  {"city", "condition", "temp"},
+		"TEMP,%20city":          {"city", "temp"},
+		"temperature,feelslike": {"feels_like", "temp"},
+	} {
+		w := get(s.handleWeather, "/weather/London?fields="+query)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%q: status %d: %s", query, w.Code, w.Body)
+		}
+		body := decode(t, w)
+		var got []string
+		for k := range body {
+			got = append(got, k)
+		}
+		sort.Strings(got)
+		// Fields a reading lacks are simply absent, so only check that
+		// nothing unrequested came back and temp did.
+		for _, k := range got {
+			if !contains(want, k) {
+				t.Errorf("%q: unrequested field %q in %v", query, k, got)
+			}
+		}
+		if contains(want, "temp") && body["temp"] == nil {
+			t.Errorf("%q: no temp in %v", query, body)
+		}
+	}
+}
+
+func TestWeatherFieldsInvalid(t *testing.T) {
+	s := newTestServer(newFake("a", 20))
+	for _, query := range []string{"temp,humidity", "banana", "temp,,city"} {
+		if w := get(s.handleWeather, "/weather/London?fields="+query); w.Code != http.StatusBadRequest {
+			t.Errorf("%q: status %d, want 400", query, w.Code)
+		}
+	}
+}
+
+func TestParseFieldsEmpty(t *testing.T) {
+	fields, err := parseFields("", weatherFields)
+	if fields != nil || err != nil {
+		t.Errorf("parseFields(\"\") = %v, %v, want nil, nil", fields, err)
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestDetailFields(t *testing.T) {
+	s := newTestServer(newFake("a", 20), newFake("b", 22))
+	w := get(s.handleWeather, "/weather/London?detail=true&detail_fields=temperature,cached")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	body := decode(t, w)
+	providers := body["providers"].([]interface{})
+	if len(providers) != 2 {
+		t.Fatalf("providers %v, want 2", providers)
+	}
+	for _, p := range providers {
+		d := p.(map[string]interface{})
+		if d["provider"] == nil || d["temp"] == nil {
+			t.Errorf("detail %v lacks provider or temp", d)
+		}
+		for k := range d {
+			if !contains([]string{"provider", "temp", "cached"}, k) {
+				t.Errorf("unrequested field %q in %v", k, d)
+			}
+		}
+	}
+	// The rest of the response is untouched.
+	if body["city"] == nil {
+		t.Errorf("no city in %v", body)
+	}
+}
+
+func TestDetailFieldsInvalid(t *testing.T) {
+	s := newTestServer(newFake("a", 20))
+	w := get(s.handleWeather, "/weather/London?detail=true&detail_fields=temp,banana")
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status %d, want 400", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "banana") {
+		t.Errorf("error %q doesn't name the field", w.Body)
+	}
+}
+
+func TestSelectDetailFieldsStations(t *testing.T) {
+	details := []map[string]interface{}{{
+		"provider": "owm",
+		"temp":     11.0,
+		"icon":     "rain",
+		"stations": []map[string]interface{}{
+			{"provider": "Camden", "temp": 11.0, "icon": "rain"},
+		},
+	}}
+	selectDetailFields(details, map[string]bool{"temp": true, "stations": true})
+	if _, ok := details[0]["icon"]; ok {
+		t.Errorf("icon kept in %v", details[0])
+	}
+	st := details[0]["stations"].([]map[string]interface{})[0]
+	if _, ok := st["icon"]; ok || st["provider"] != "Camden" || st["temp"] != 11.0 {
+		t.Errorf("station %v, want just its provider and temp", st)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// flightGroup coalesces concurrent lookups of the same key into one call,
+// like golang.org/x/sync/singleflight. With a window, a finished call's
+// result is also shared with lookups that arrive up to window after it,
+// so bursts that are merely close together share one call too.
+type flightGroup struct {
+	window time.Duration
+
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+type flight struct {
+	wg  sync.WaitGroup
+	agg aggregate
+	err error
+}
+
+// do calls fn unless a call for key is already in flight, in which case it
+// waits for that call and returns its result. shared reports the latter.
+// If fn panics, the waiters get an error and the panic carries on in the
+// caller that made the call.
+func (g *flightGroup) do(key string, fn func() (aggregate, error)) (agg aggregate, err error, shared bool) {
+	g.mu.Lock()
+	if g.flights == nil {
+		g.flights = make(map[string]*flight)
+	}
+	if f, ok := g.flights[key]; ok {
+		g.mu.Unlock()
+		f.wg.Wait()
+		return f.agg, f.err, true
+	}
+	f := &flight{}
+	f.wg.Add(1)
+	g.flights[key] = f
+	g.mu.Unlock()
+
+	returned := false
+	defer func() {
+		if !returned {
+			f.agg, f.err = aggregate{}, fmt.Errorf("lookup of %s panicked", key)
+		}
+		f.wg.Done()
+		forget := func() {
+			g.mu.Lock()
+			defer g.mu.Unlock()
+			if g.flights[key] == f {
+				delete(g.flights, key)
+			}
+		}
+		// A panic isn't a result worth sharing with later lookups.
+		if g.window > 0 && returned {
+			time.AfterFunc(g.window, forget)
+		} else {
+			forget()
+		}
+	}()
+	f.agg, f.err = fn()
+	returned = true
+	return f.agg, f.err, false
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFlightGroupCoalesces(t *testing.T) {
+	var g flightGroup
+	var calls atomic.Int32
+	release := make(chan struct{})
+
+	var wg sync.WaitGroup
+	var shared atomic.Int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			agg, err, wasShared := g.do("London", func() (aggregate, error) {
+				calls.Add(1)
+				<-release
+				return aggregate{celsius: 10}, nil
+			})
+			if err != nil || agg.celsius != 10 {
+				t.Errorf("got %v, %v", agg.celsius, err)
+			}
+			if wasShared {
+				shared.Add(1)
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls.Load() != 1 || shared.Load() != 9 {
+		t.Errorf("%d calls, %d shared; want 1 and 9", calls.Load(), shared.Load())
+	}
+
+	// Once it has finished, the next lookup calls again.
+	g.do("London", func() (aggregate, error) { calls.Add(1); return aggregate{}, nil })
+	if calls.Load() != 2 {
+		t.Errorf("%d calls after the flight landed, want 2", calls.Load())
+	}
+}
+
+func TestConcurrentMissesShareLookup(t *testing.T) {
+	p := newFake("fake", 10)
+	p.delay = 20 * time.Millisecond
+	s := newTestServer(p)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			get(s.handleWeather, "/weather/London")
+		}()
+	}
+	wg.Wait()
+	if n := p.calls.Load(); n != 1 {
+		t.Errorf("provider called %d times for 10 concurrent misses, want 1", n)
+	}
+}
+
+func TestFlightGroupPanic(t *testing.T) {
+	g := flightGroup{window: time.Minute}
+	entered := make(chan struct{})
+	waited := make(chan error, 1)
+	go func() {
+		<-entered
+		_, err, _ := g.do("London", func() (aggregate, error) {
+			t.Error("a waiter made its own call")
+			return aggregate{}, nil
+		})
+		waited <- err
+	}()
+
+	func() {
+		defer func() {
+			if r := recover(); r != "boom" {
+				t.Errorf("recovered %v, want the panic to reach the caller", r)
+			}
+		}()
+		g.do("London", func() (aggregate, error) {
+			close(entered)
+			// Give the waiter time to join the flight.
+			time.Sleep(20 * time.Millisecond)
+			panic("boom")
+		})
+	}()
+
+	select {
+	case err := <-waited:
+		if err == nil || !strings.Contains(err.Error(), "panicked") {
+			t.Errorf("waiter got %v, want the panic reported", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waiter still hanging after the call panicked")
+	}
+
+	// The panic isn't shared through the window: the next lookup calls.
+	agg, err, shared := g.do("London", func() (aggregate, error) { return aggregate{celsius: 10}, nil })
+	if err != nil || shared || agg.celsius != 10 {
+		t.Errorf("after a panic got %v, %v, shared %t, want a fresh call", agg.celsius, err, shared)
+	}
+}
+
+func TestFlightGroupWindow(t *testing.T) {
+	g := flightGroup{window: 100 * time.Millisecond}
+	var calls atomic.Int32
+	call := func() {
+		g.do("London", func() (aggregate, error) {
+			calls.Add(1)
+			return aggregate{celsius: 10}, nil
+		})
+	}
+
+	// Staggered lookups within the window after a call share it.
+	call()
+	for i := 0; i < 3; i++ {
+		time.Sleep(20 * time.Millisecond)
+		call()
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("%d calls for lookups within the window, want 1", n)
+	}
+	// One past it calls again.
+	time.Sleep(150 * time.Millisecond)
+	call()
+	if n := calls.Load(); n != 2 {
+		t.Errorf("%d calls after the window, want 2", n)
+	}
+	// Other keys never share.
+	g.do("Paris", func() (aggregate, error) { calls.Add(1); return aggregate{}, nil })
+	if n := calls.Load(); n != 3 {
+		t.Errorf("%d calls after another city's lookup, want 3", n)
+	}
+}
+
+func TestCoalesceWindowUpstreamCalls(t *testing.T) {
+	p := newFake("fake", 10)
+	s := newTestServer(p)
+	s.cacheTTL = 0 // every request misses, so only the window coalesces
+	s.flights.window = 100 * time.Millisecond
+
+	for i := 0; i < 4; i++ {
+		get(s.handleWeather, "/weather/London")
+		time.Sleep(20 * time.Millisecond)
+	}
+	if n := p.calls.Load(); n != 1 {
+		t.Errorf("provider called %d times within the window, want 1", n)
+	}
+	time.Sleep(150 * time.Millisecond)
+	get(s.handleWeather, "/weather/London")
+	if n := p.calls.Load(); n != 2 {
+		t.Errorf("provider called %d times after the window, want 2", n)
+	}
+}
+
+func TestSharedRefreshOutlivesItsRequest(t *testing.T) {
+	p := newFake("fake", 10)
+	p.delay = 50 * time.Millisecond
+	s := newTestServer(p)
+
+	// The request that starts the lookup goes away; a second one waiting
+	// on the same lookup still gets its answer.
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := s.refresh(ctx, cacheKey{city: "London", aggregation: meanAggregation})
+		first <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	second := make(chan error, 1)
+	go func() {
+		_, err := s.refresh(context.Background(), cacheKey{city: "London", aggregation: meanAggregation})
+		second <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	if err := <-second; err != nil {
+		t.Errorf("the waiting request failed with %v after the first went away", err)
+	}
+	<-first
+	if p.calls.Load() != 1 {
+		t.Errorf("provider called %d times, want the lookup shared", p.calls.Load())
+	}
+	if _, ok := s.cache.get("mean:London"); !ok {
+		t.Error("the shared lookup's answer wasn't cached")
+	}
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type point struct {
+	lat, lon float64
+}
+
+func (p point) String() string {
+	return strconv.FormatFloat(p.lat, 'f', -1, 64) + "," + strconv.FormatFloat(p.lon, 'f', -1, 64)
+}
+
+// parsePoint parses "lat,lon".
+func parsePoint(s string) (point, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return point{}, fmt.Errorf("invalid coordinates %q, want lat,lon", s)
+	}
+	lat, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil || lat < -90 || lat > 90 {
+		return point{}, fmt.Errorf("invalid latitude %q", parts[0])
+	}
+	lon, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err != nil || lon < -180 || lon > 180 {
+		return point{}, fmt.Errorf("invalid longitude %q", parts[1])
+	}
+	return point{lat, lon}, nil
+}
+
+// geocoder resolves place names to coordinates and back.
+type geocoder interface {
+	geocode(ctx context.Context, city string) (point, error)
+	reverseGeocode(ctx context.Context, p point) (string, error)
+}
+
+// geocodeError distinguishes a failure to locate a city from a failure to
+// fetch its weather.
+type geocodeError struct {
+	city string
+	err  error
+}
+
+func (e geocodeError) Error() string {
+	return fmt.Sprintf("geocode failed for %q: %s", e.city, e.err)
+}
+
+func (e geocodeError) Unwrap() error { return e.err }
+
+// geocodeQuotaExhausted reports whether err is a geocoder refusing a lookup
+// because its quota is used up: Google's OVER_QUERY_LIMIT or
+// OVER_DAILY_LIMIT, or a 429 from any of them.
+func geocodeQuotaExhausted(err error) bool {
+	if !errors.As(err, new(geocodeError)) {
+		return false
+	}
+	var gs googleStatusError
+	if errors.As(err, &gs) && (gs.status == "OVER_QUERY_LIMIT" || gs.status == "OVER_DAILY_LIMIT") {
+		return true
+	}
+	var se statusError
+	return errors.As(err, &se) && se.status == http.StatusTooManyRequests
+}
+
+// errNoResults is a geocoder finding nothing by the name asked for.
+var errNoResults = errors.New("no results")
+
+// candidate is one of the places an ambiguous name could mean.
+type candidate struct {
+	name string
+	p    point
+}
+
+// ambiguousError reports a city name that matches several places equally
+// well, when geocoders are told not to guess between them.
+type ambiguousError struct {
+	city       string
+	candidates []candidate
+}
+
+func (e ambiguousError) Error() string {
+	names := make([]string, len(e.candidates))
+	for i, c := range e.candidates {
+		names[i] = fmt.Sprintf("%s (%s)", c.name, c.p)
+	}
+	return fmt.Sprintf("%q is ambiguous; qualify it with a region or country, e.g. one of: %s", e.city, strings.Join(names, "; "))
+}
+
+// googleStatusError reports a non-OK status in a Google API response body,
+// e.g. OVER_QUERY_LIMIT or REQUEST_DENIED.
+type googleStatusError struct {
+	status, message string
+}
+
+func (e googleStatusError) Error() string {
+	if e.message == "" {
+		return "google: " + e.status
+	}
+	return "google: " + e.status + ": " + e.message
+}
+
+type googleGeocoder struct {
+	timeout time.Duration // per lookup; no limit if zero
+	// rejectAmbiguous fails names with more than one exact match rather
+	// than taking the first.
+	rejectAmbiguous bool
+}
+
+func (g googleGeocoder) geocode(ctx context.Context, city string) (point, error) {
+	ctx, span := startSpan(ctx, "geocode")
+	defer span.finish()
+	span.setAttr("city", city)
+	if g.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, g.timeout)
+		defer cancel()
+	}
+
+	var location struct {
+		Status       string `json:"status"`
+		ErrorMessage string `json:"error_message"`
+		Results      []struct {
+			FormattedAddress string `json:"formatted_address"`
+			PartialMatch     bool   `json:"partial_match"`
+			Geometry         struct {
+				Location struct {
+					Latitude  float64 `json:"lat"`
+					Longitude float64 `json:"lng"`
+				} `json:"location"`
+			} `json:"geometry"`
+		} `json:"results"`
+	}
+
+	err := getJSON(ctx, "https://maps.googleapis.com/maps/api/geocode/json?address="+city, &location)
+	if err == nil && location.Status != "" && location.Status != "OK" {
+		err = googleStatusError{location.Status, location.ErrorMessage}
+	}
+	if err == nil && len(location.Results) == 0 {
+		err = errNoResults
+	}
+	span.setStatus(err)
+	if err != nil {
+		return point{}, geocodeError{city, err}
+	}
+	if g.rejectAmbiguous {
+		var exact []candidate
+		for _, r := range location.Results {
+			if !r.PartialMatch {
+				exact = append(exact, candidate{r.FormattedAddress, point{r.Geometry.Location.Latitude, r.Geometry.Location.Longitude}})
+			}
+		}
+		if len(exact) > 1 {
+			return point{}, ambiguousError{city, exact}
+		}
+	}
+	l := location.Results[0].Geometry.Location
+	return point{l.Latitude, l.Longitude}, nil
+}
+
+// reverseGeocode names the locality containing p, or failing that the
+// closest address Google knows.
+func (g googleGeocoder) reverseGeocode(ctx context.Context, p point) (string, error) {
+	ctx, span := startSpan(ctx, "reverseGeocode")
+	defer span.finish()
+	span.setAttr("point", p.String())
+	if g.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, g.timeout)
+		defer cancel()
+	}
+
+	var location struct {
+		Status       string `json:"status"`
+		ErrorMessage string `json:"error_message"`
+		Results      []struct {
+			FormattedAddress  string `json:"formatted_address"`
+			AddressComponents []struct {
+				LongName string   `json:"long_name"`
+				Types    []string `json:"types"`
+			} `json:"address_components"`
+		} `json:"results"`
+	}
+
+	err := getJSON(ctx, "https://maps.googleapis.com/maps/api/geocode/json?latlng="+p.String(), &location)
+	if err == nil && location.Status != "" && location.Status != "OK" {
+		err = googleStatusError{location.Status, location.ErrorMessage}
+	}
+	if err == nil && len(location.Results) == 0 {
+		err = fmt.Errorf("reverse geocode: no results for %s", p)
+	}
+	span.setStatus(err)
+	if err != nil {
+		return "", err
+	}
+	for _, r := range location.Results {
+		for _, c := range r.AddressComponents {
+			for _, t := range c.Types {
+				if t == "locality" {
+					return c.LongName, nil
+				}
+			}
+		}
+	}
+	return location.Results[0].FormattedAddress, nil
+}
+
+// nominatimGeocoder uses OpenStreetMap's Nominatim service.
+type nominatimGeocoder struct {
+	timeout time.Duration // per lookup; no limit if zero
+	// rejectAmbiguous fails names whose runner-up matches are nearly as
+	// important as the best one rather than taking the best.
+	rejectAmbiguous bool
+}
+
+// nominatimRivalImportance is how close, as a fraction of the best match's
+// importance, another match must come to make a name ambiguous.
+const nominatimRivalImportance = 0.8
+
+func (g nominatimGeocoder) geocode(ctx context.Context, city string) (point, error) {
+	ctx, span := startSpan(ctx, "geocode")
+	defer span.finish()
+	span.setAttr("city", city)
+	span.setAttr("geocoder", "nominatim")
+	if g.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, g.timeout)
+		defer cancel()
+	}
+
+	var places []struct {
+		Lat         string  `json:"lat"`
+		Lon         string  `json:"lon"`
+		DisplayName string  `json:"display_name"`
+		Importance  float64 `json:"importance"`
+	}
+	limit := "1"
+	if g.rejectAmbiguous {
+		limit = "5"
+	}
+	err := getJSON(ctx, "https://nominatim.openstreetmap.org/search?format=json&limit="+limit+"&q="+url.QueryEscape(city), &places)
+	if err == nil && len(places) == 0 {
+		err = errNoResults
+	}
+	if err == nil && g.rejectAmbiguous && len(places) > 1 {
+		// Results come best first.
+		var rivals []candidate
+		for _, pl := range places {
+			if pl.Importance < places[0].Importance*nominatimRivalImportance {
+				continue
+			}
+			if p, err := parsePoint(pl.Lat + "," + pl.Lon); err == nil {
+				rivals = append(rivals, candidate{pl.DisplayName, p})
+			}
+		}
+		if len(rivals) > 1 {
+			err = ambiguousError{city, rivals}
+		}
+	}
+	var p point
+	if err == nil {
+		p, err = parsePoint(places[0].Lat + "," + places[0].Lon)
+	}
+	span.setStatus(err)
+	if errors.As(err, new(ambiguousError)) {
+		return point{}, err
+	}
+	if err != nil {
+		return point{}, geocodeError{city, err}
+	}
+	return p, nil
+}
+
+func (g nominatimGeocoder) reverseGeocode(ctx context.Context, p point) (string, error) {
+	ctx, span := startSpan(ctx, "reverseGeocode")
+	defer span.finish()
+	span.setAttr("point", p.String())
+	span.setAttr("geocoder", "nominatim")
+	if g.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, g.timeout)
+		defer cancel()
+	}
+
+	var place struct {
+		Error       string `json:"error"`
+		DisplayName string `json:"display_name"`
+		Address     struct {
+			City    string `json:"city"`
+			Town    string `json:"town"`
+			Village string `json:"village"`
+		} `json:"address"`
+	}
+	err := getJSON(ctx, "https://nominatim.openstreetmap.org/reverse?format=json&lat="+strconv.FormatFloat(p.lat, 'f', -1, 64)+"&lon="+strconv.FormatFloat(p.lon, 'f', -1, 64), &place)
+	if err == nil && place.Error != "" {
+		err = errors.New("nominatim: " + place.Error)
+	}
+	span.setStatus(err)
+	if err != nil {
+		return "", err
+	}
+	for _, name := range []string{place.Address.City, place.Address.Town, place.Address.Village} {
+		if name != "" {
+			return name, nil
+		}
+	}
+	return place.DisplayName, nil
+}
+
+// chainGeocoder tries each geocoder in turn until one succeeds.
+type chainGeocoder []geocoder
+
+func (c chainGeocoder) geocode(ctx context.Context, city string) (point, error) {
+	var errs []error
+	for _, g := range c {
+		p, err := g.geocode(ctx, city)
+		if err == nil {
+			noteGeocoded(ctx, p)
+			return p, nil
+		}
+		// Another geocoder guessing would defeat the point.
+		if errors.As(err, new(ambiguousError)) {
+			return point{}, err
+		}
+		errs = append(errs, err)
+	}
+	return point{}, errors.Join(errs...)
+}
+
+func (c chainGeocoder) reverseGeocode(ctx context.Context, p point) (string, error) {
+	var errs []error
+	for _, g := range c {
+		name, err := g.reverseGeocode(ctx, p)
+		if err == nil {
+			return name, nil
+		}
+		errs = append(errs, err)
+	}
+	return "", errors.Join(errs...)
+}
+
+// cachingGeocoder remembers the coordinates next finds for each city.
+// Reverse lookups are passed straight through.
+type cachingGeocoder struct {
+	next   geocoder
+	points *locationCache[point]
+}
+
+func (g cachingGeocoder) geocode(ctx context.Context, city string) (point, error) {
+	key := strings.TrimSpace(city)
+	if p, ok := g.points.get(key); ok {
+		return p, nil
+	}
+	p, err := g.next.geocode(ctx, city)
+	if err != nil {
+		return point{}, err
+	}
+	g.points.set(key, p)
+	return p, nil
+}
+
+func (g cachingGeocoder) reverseGeocode(ctx context.Context, p point) (string, error) {
+	return g.next.reverseGeocode(ctx, p)
+}
+
+// limitedGeocoder lets at most cap(slots) lookups through to next at once,
+// so a burst of uncached cities queues here rather than running into the
+// geocoder's own rate limits. It sits behind the cache, so hits never wait.
+type limitedGeocoder struct {
+	next  geocoder
+	slots chan struct{}
+}
+
+func (g limitedGeocoder) acquire(ctx context.Context) error {
+	select {
+	case g.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("geocode: waiting for a slot: %w", ctx.Err())
+	}
+}
+
+func (g limitedGeocoder) geocode(ctx context.Context, city string) (point, error) {
+	if err := g.acquire(ctx); err != nil {
+		return point{}, err
+	}
+	defer func() { <-g.slots }()
+	return g.next.geocode(ctx, city)
+}
+
+func (g limitedGeocoder) reverseGeocode(ctx context.Context, p point) (string, error) {
+	if err := g.acquire(ctx); err != nil {
+		return "", err
+	}
+	defer func() { <-g.slots }()
+	return g.next.reverseGeocode(ctx, p)
+}
+
+// staticGeocoder looks cities up in a fixed table, keyed by lowercase name.
+// It ends the chain so common cities still resolve when the live geocoders
+// are down.
+type staticGeocoder map[string]point
+
+func (g staticGeocoder) geocode(ctx context.Context, city string) (point, error) {
+	p, ok := g[strings.ToLower(strings.TrimSpace(city))]
+	if !ok {
+		return point{}, geocodeError{city, errors.New("not in static table")}
+	}
+	return p, nil
+}
+
+func (g staticGeocoder) reverseGeocode(ctx context.Context, p point) (string, error) {
+	return "", fmt.Errorf("reverse geocode: static table cannot name %s", p)
+}
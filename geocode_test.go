@@ -0,0 +1,501 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReverseGeocode(t *testing.T) {
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Host {
+		case "maps.googleapis.com":
+			if r.URL.Query().Get("latlng") != "51.5,-0.12" {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write([]byte(`{"status":"OK","results":[{"formatted_address":"Whitehall, London SW1A, UK",
+				"address_components":[{"long_name":"Whitehall","types":["route"]},{"long_name":"London","types":["locality","political"]}]}]}`))
+		case "nominatim.openstreetmap.org":
+			w.Write([]byte(`{"display_name":"Whitehall, London","address":{"town":"Westminster"}}`))
+		}
+	}))
+	for _, tt := range []struct {
+		g    geocoder
+		want string
+	}{
+		{googleGeocoder{}, "London"},
+		{nominatimGeocoder{}, "Westminster"},
+	} {
+		got, err := tt.g.reverseGeocode(context.Background(), point{51.5, -0.12})
+		if err != nil || got != tt.want {
+			t.Errorf("%T: got %q, %v; want %q", tt.g, got, err, tt.want)
+		}
+	}
+}
+
+func TestParsePoint(t *testing.T) {
+	if p, err := parsePoint(" 51.5, -0.12"); err != nil || p != (point{51.5, -0.12}) {
+		t.Errorf("got %v, %v", p, err)
+	}
+	if got := (point{51.5, -0.12}).String(); got != "51.5,-0.12" {
+		t.Errorf("String() = %q", got)
+	}
+}
+
+func TestGoogleGeocodeFailures(t *testing.T) {
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("address") {
+		case "Slow":
+			time.Sleep(100 * time.Millisecond)
+			w.Write([]byte(`{"status":"OK","results":[{"geometry":{"location":{"lat":1,"lng":2}}}]}`))
+		case "Quota":
+			w.Write([]byte(`{"status":"OVER_QUERY_LIMIT","error_message":"You have exceeded your daily request quota"}`))
+		case "Nowhere":
+			w.Write([]byte(`{"status":"ZERO_RESULTS","results":[]}`))
+		case "Empty":
+			w.Write([]byte(`{"results":[]}`))
+		case "Broken":
+			http.Error(w, "oops", http.StatusBadGateway)
+		default:
+			w.Write([]byte(`{"status":"OK","results":[{"geometry":{"location":{"lat":1,"lng":2}}}]}`))
+		}
+	}))
+	g := googleGeocoder{timeout: 30 * time.Millisecond}
+
+	if p, err := g.geocode(context.Background(), "London"); err != nil || p != (point{1, 2}) {
+		t.Fatalf("got %v, %v", p, err)
+	}
+	for city, check := range map[string]func(error) bool{
+		"Slow": func(err error) bool { return errors.Is(err, context.DeadlineExceeded) },
+		"Quota": func(err error) bool {
+			var gs googleStatusError
+			return errors.As(err, &gs) && gs.status == "OVER_QUERY_LIMIT" && geocodeQuotaExhausted(err)
+		},
+		"Nowhere": func(err error) bool {
+			var gs googleStatusError
+			return errors.As(err, &gs) && gs.status == "ZERO_RESULTS" && !geocodeQuotaExhausted(err)
+		},
+		"Empty": func(err error) bool { return errors.Is(err, errNoResults) },
+		"Broken": func(err error) bool {
+			var se statusError
+			return errors.As(err, &se) && se.status == http.StatusBadGateway
+		},
+	} {
+		_, err := g.geocode(context.Background(), city)
+		if !errors.As(err, new(geocodeError)) || !check(err) {
+			t.Errorf("%s: unexpected error %v", city, err)
+		}
+		if err != nil && !strings.HasPrefix(err.Error(), `geocode failed for "`+city+`"`) {
+			t.Errorf("%s: error %q doesn't say the geocode failed", city, err)
+		}
+	}
+}
+
+func TestForecastIoErrorClasses(t *testing.T) {
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "oops", http.StatusInternalServerError)
+	}))
+	p := forecastIo{apiKey: "k", geocoder: &stubGeocoder{points: map[string]point{"London": {51.5, -0.12}}}}
+
+	if _, err := p.temperature(context.Background(), "Nowhere"); !errors.As(err, new(geocodeError)) {
+		t.Errorf("unplaceable city: error %v, want a geocodeError", err)
+	}
+	_, err := p.temperature(context.Background(), "London")
+	if err == nil || errors.As(err, new(geocodeError)) || !strings.Contains(err.Error(), "forecastIo: weather fetch failed") {
+		t.Errorf("failed weather fetch: error %v", err)
+	}
+}
+
+func TestChainGeocoder(t *testing.T) {
+	failing := &stubGeocoder{err: errors.New("first down")}
+	working := &stubGeocoder{points: map[string]point{"London": {51.5, -0.12}}, name: "London"}
+
+	p, err := chainGeocoder{failing, working}.geocode(context.Background(), "London")
+	if err != nil || p != (point{51.5, -0.12}) {
+		t.Errorf("got %v, %v; want the second geocoder's point", p, err)
+	}
+	if failing.calls.Load() != 1 || working.calls.Load() != 1 {
+		t.Errorf("calls %d, %d; want one each", failing.calls.Load(), working.calls.Load())
+	}
+
+	if name, err := (chainGeocoder{failing, working}).reverseGeocode(context.Background(), p); err != nil || name != "London" {
+		t.Errorf("reverse: got %q, %v", name, err)
+	}
+
+	// The first to succeed answers alone.
+	second := &stubGeocoder{points: map[string]point{"London": {0, 0}}}
+	if p, _ := (chainGeocoder{working, second}).geocode(context.Background(), "London"); p != (point{51.5, -0.12}) || second.calls.Load() != 0 {
+		t.Errorf("got %v with %d later calls", p, second.calls.Load())
+	}
+
+	_, err = chainGeocoder{failing, &stubGeocoder{err: errors.New("second down")}}.geocode(context.Background(), "London")
+	if err == nil || !strings.Contains(err.Error(), "first down") || !strings.Contains(err.Error(), "second down") {
+		t.Errorf("both failing: error %v, want both errors", err)
+	}
+}
+
+func TestNominatimGeocode(t *testing.T) {
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("q") == "London" {
+			w.Write([]byte(`[{"lat":"51.5","lon":"-0.12","display_name":"London"}]`))
+			return
+		}
+		w.Write([]byte(`[]`))
+	}))
+	if p, err := (nominatimGeocoder{}).geocode(context.Background(), "London"); err != nil || p != (point{51.5, -0.12}) {
+		t.Errorf("got %v, %v", p, err)
+	}
+	if _, err := (nominatimGeocoder{}).geocode(context.Background(), "Nowhere"); !errors.Is(err, errNoResults) {
+		t.Errorf("error %v, want no results", err)
+	}
+}
+
+func TestStaticGeocoderFallback(t *testing.T) {
+	var lookups atomic.Int32
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lookups.Add(1)
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	var conf config
+	conf.Geocoder.Chain = []string{"nominatim"}
+	conf.Geocoder.Static = map[string]struct{ Lat, Lon float64 }{"London": {51.5, -0.12}}
+	geo, err := newGeocoder(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, city := range []string{"London", " london "} {
+		if p, err := geo.geocode(context.Background(), city); err != nil || p != (point{51.5, -0.12}) {
+			t.Errorf("%q: got %v, %v; want the static table's point", city, p, err)
+		}
+	}
+	if lookups.Load() == 0 {
+		t.Error("the static table answered before the live geocoder was tried")
+	}
+
+	_, err = geo.geocode(context.Background(), "Paris")
+	if err == nil || !strings.Contains(err.Error(), "not in static table") {
+		t.Errorf("Paris: error %v, want both geocoders' errors", err)
+	}
+	var ge geocodeError
+	if !errors.As(err, &ge) {
+		t.Errorf("Paris: error %v is not a geocodeError", err)
+	}
+}
+
+func TestGeocodeCacheTTL(t *testing.T) {
+	live := &stubGeocoder{points: map[string]point{"London": {51.5, -0.12}}}
+	g := cachingGeocoder{next: live, points: newLocationCache[point](50 * time.Millisecond)}
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if p, err := g.geocode(ctx, "London"); err != nil || p != (point{51.5, -0.12}) {
+			t.Fatalf("geocode = %v, %v", p, err)
+		}
+	}
+	if n := live.calls.Load(); n != 1 {
+		t.Errorf("geocoded %d times within the TTL, want once", n)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	live.points["London"] = point{51.51, -0.13}
+	if p, _ := g.geocode(ctx, "London"); p != (point{51.51, -0.13}) {
+		t.Errorf("after expiry got %v, want the new coordinates", p)
+	}
+	if n := live.calls.Load(); n != 2 {
+		t.Errorf("geocoded %d times, want again after expiry", n)
+	}
+
+	// Failures aren't cached.
+	live.err = errors.New("down")
+	g.geocode(ctx, "Paris")
+	g.geocode(ctx, "Paris")
+	if n := live.calls.Load(); n != 4 {
+		t.Errorf("geocoded %d times, want every failure retried", n)
+	}
+}
+
+func TestGeocodeCacheDefaultTTL(t *testing.T) {
+	for _, tt := range []struct {
+		conf string
+		want time.Duration
+	}{
+		{`{}`, 720 * time.Hour},
+		{`{"cacheTTL": "24h"}`, 24 * time.Hour},
+	} {
+		var conf config
+		if err := json.Unmarshal([]byte(`{"geocoder": `+tt.conf+`}`), &conf); err != nil {
+			t.Fatal(err)
+		}
+		g, err := newGeocoder(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, ok := g.(cachingGeocoder)
+		if !ok {
+			t.Fatalf("%s: got a %T, want the cache", tt.conf, g)
+		}
+		if c.points.ttl != tt.want {
+			t.Errorf("%s: TTL %s, want %s", tt.conf, c.points.ttl, tt.want)
+		}
+	}
+}
+
+func TestLocationCacheForever(t *testing.T) {
+	c := newLocationCache[string](0)
+	c.set("London", "328328")
+	if v, ok := c.get("LONDON"); !ok || v != "328328" {
+		t.Errorf("get = %q, %t, want the key case-insensitively", v, ok)
+	}
+	if e := c.entries["london"]; !e.expires.IsZero() {
+		t.Errorf("entry expires at %s, want never", e.expires)
+	}
+}
+
+func TestGoogleGeocodeAmbiguity(t *testing.T) {
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("address") {
+		case "Springfield":
+			w.Write([]byte(`{"status":"OK","results":[
+				{"formatted_address":"Springfield, IL, USA","geometry":{"location":{"lat":39.8,"lng":-89.65}}},
+				{"formatted_address":"Springfield, MA, USA","geometry":{"location":{"lat":42.1,"lng":-72.59}}},
+				{"formatted_address":"Springfield Rd, UK","partial_match":true,"geometry":{"location":{"lat":51,"lng":0}}}]}`))
+		default:
+			// One exact match, and a partial one that doesn't count.
+			w.Write([]byte(`{"status":"OK","results":[
+				{"formatted_address":"Paris, France","geometry":{"location":{"lat":48.86,"lng":2.35}}},
+				{"formatted_address":"Paris, TX, USA","partial_match":true,"geometry":{"location":{"lat":33.66,"lng":-95.56}}}]}`))
+		}
+	}))
+	ctx := context.Background()
+	reject := googleGeocoder{rejectAmbiguous: true}
+
+	if p, err := reject.geocode(ctx, "Paris"); err != nil || p != (point{48.86, 2.35}) {
+		t.Errorf("single candidate: got %v, %v", p, err)
+	}
+	_, err := reject.geocode(ctx, "Springfield")
+	var amb ambiguousError
+	if !errors.As(err, &amb) || len(amb.candidates) != 2 {
+		t.Fatalf("multiple candidates: error %v, want the two exact matches", err)
+	}
+	if amb.candidates[0].name != "Springfield, IL, USA" || amb.candidates[1].p != (point{42.1, -72.59}) {
+		t.Errorf("candidates %v", amb.candidates)
+	}
+	if !strings.Contains(err.Error(), "Springfield, MA, USA") {
+		t.Errorf("error %q doesn't list the candidates", err)
+	}
+
+	// By default the first answer is taken.
+	if p, err := (googleGeocoder{}).geocode(ctx, "Springfield"); err != nil || p != (point{39.8, -89.65}) {
+		t.Errorf("first: got %v, %v", p, err)
+	}
+}
+
+func TestNominatimGeocodeAmbiguity(t *testing.T) {
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("limit") != "5" {
+			w.Write([]byte(`[{"lat":"39.8","lon":"-89.65","display_name":"Springfield, IL","importance":0.7}]`))
+			return
+		}
+		switch r.URL.Query().Get("q") {
+		case "Springfield":
+			w.Write([]byte(`[
+				{"lat":"39.8","lon":"-89.65","display_name":"Springfield, IL","importance":0.7},
+				{"lat":"37.2","lon":"-93.29","display_name":"Springfield, MO","importance":0.65},
+				{"lat":"42.1","lon":"-72.59","display_name":"Springfield, MA","importance":0.3}]`))
+		default:
+			// The runner-up is well under 80% of the best's importance.
+			w.Write([]byte(`[
+				{"lat":"51.5","lon":"-0.12","display_name":"London, UK","importance":0.9},
+				{"lat":"42.98","lon":"-81.25","display_name":"London, ON","importance":0.5}]`))
+		}
+	}))
+	ctx := context.Background()
+	reject := nominatimGeocoder{rejectAmbiguous: true}
+
+	if p, err := reject.geocode(ctx, "London"); err != nil || p != (point{51.5, -0.12}) {
+		t.Errorf("single strong candidate: got %v, %v", p, err)
+	}
+	_, err := reject.geocode(ctx, "Springfield")
+	var amb ambiguousError
+	if !errors.As(err, &amb) || len(amb.candidates) != 2 || amb.candidates[1].name != "Springfield, MO" {
+		t.Errorf("multiple candidates: error %v, want IL and MO", err)
+	}
+	if p, err := (nominatimGeocoder{}).geocode(ctx, "Springfield"); err != nil || p != (point{39.8, -89.65}) {
+		t.Errorf("first: got %v, %v", p, err)
+	}
+}
+
+func TestChainGeocoderStopsAtAmbiguity(t *testing.T) {
+	amb := ambiguousError{"Springfield", []candidate{{"Springfield, IL", point{39.8, -89.65}}, {"Springfield, MA", point{42.1, -72.59}}}}
+	first := &stubGeocoder{err: amb}
+	next := &stubGeocoder{points: map[string]point{"Springfield": {1, 2}}}
+	_, err := chainGeocoder{first, next}.geocode(context.Background(), "Springfield")
+	if !errors.As(err, new(ambiguousError)) || next.calls.Load() != 0 {
+		t.Errorf("error %v after %d further lookups, want the ambiguity and none", err, next.calls.Load())
+	}
+}
+
+func TestAmbiguousResponses(t *testing.T) {
+	p := newFake("fake", 10)
+	p.err = ambiguousError{"Springfield", []candidate{{"Springfield, IL", point{39.8, -89.65}}, {"Springfield, MA", point{42.1, -72.59}}}}
+	s := newTestServer(p)
+	w := get(s.handleWeather, "/weather/Springfield")
+	if w.Code != http.StatusMultipleChoices || !strings.Contains(w.Body.String(), "Springfield, MA") {
+		t.Errorf("status %d %q, want a 300 listing the candidates", w.Code, w.Body)
+	}
+
+	p.err = nil
+	s = newTestServer(p)
+	s.requireQualifier = true
+	if w := get(s.handleWeather, "/weather/Springfield"); w.Code != http.StatusBadRequest {
+		t.Errorf("unqualified city: status %d, want 400", w.Code)
+	}
+	if w := get(s.handleWeather, "/weather/Springfield,IL"); w.Code != http.StatusOK {
+		t.Errorf("qualified city: status %d, want 200", w.Code)
+	}
+}
+
+func TestAmbiguousConfig(t *testing.T) {
+	var conf config
+	conf.Geocoder.Ambiguous = "reject"
+	g, err := newGeocoder(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := g.(cachingGeocoder); !c.next.(googleGeocoder).rejectAmbiguous {
+		t.Error("reject didn't reach the geocoder")
+	}
+	conf.Geocoder.Ambiguous = "guess"
+	if _, err := newGeocoder(conf); err == nil {
+		t.Error("an unknown ambiguous mode was accepted")
+	}
+}
+
+// countingGeocoder takes delay over each lookup, counting how many run at
+// once.
+type countingGeocoder struct {
+	delay   time.Duration
+	running maxCounter
+}
+
+func (g *countingGeocoder) geocode(ctx context.Context, city string) (point, error) {
+	g.running.enter()
+	defer g.running.leave()
+	time.Sleep(g.delay)
+	return point{1, 2}, nil
+}
+
+func (g *countingGeocoder) reverseGeocode(ctx context.Context, p point) (string, error) {
+	g.running.enter()
+	defer g.running.leave()
+	time.Sleep(g.delay)
+	return "London", nil
+}
+
+func TestGeocodeConcurrencyLimit(t *testing.T) {
+	live := &countingGeocoder{delay: 20 * time.Millisecond}
+	g := limitedGeocoder{next: live, slots: make(chan struct{}, 3)}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			if i%4 == 0 {
+				_, err = g.reverseGeocode(context.Background(), point{1, 2})
+			} else {
+				_, err = g.geocode(context.Background(), fmt.Sprint("City", i))
+			}
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if m := live.running.max.Load(); m != 3 {
+		t.Errorf("at most %d lookups ran at once, want the limit of 3", m)
+	}
+
+	// Waiting for a slot gives up with the request.
+	g.slots <- struct{}{}
+	g.slots <- struct{}{}
+	g.slots <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := g.geocode(ctx, "London"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error %v, want the wait to end with the request", err)
+	}
+}
+
+func TestGeocodeConcurrencyConfig(t *testing.T) {
+	var conf config
+	conf.Geocoder.MaxConcurrent = 4
+	g, err := newGeocoder(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The limit sits behind the cache, so hits never wait.
+	l, ok := g.(cachingGeocoder).next.(limitedGeocoder)
+	if !ok || cap(l.slots) != 4 {
+		t.Errorf("cache's next is %T, want a limit of 4", g.(cachingGeocoder).next)
+	}
+	if g, _ = newGeocoder(config{}); g.(cachingGeocoder).next != (googleGeocoder{}) {
+		t.Errorf("without maxConcurrent got %T, want no limit", g.(cachingGeocoder).next)
+	}
+}
+
+func TestGeocodeQuotaExhausted(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"google over query limit", geocodeError{"London", googleStatusError{status: "OVER_QUERY_LIMIT"}}, true},
+		{"google over daily limit", fmt.Errorf("forecastIo: %w", geocodeError{"London", googleStatusError{status: "OVER_DAILY_LIMIT"}}), true},
+		{"rate limited", geocodeError{"London", statusError{host: "nominatim.openstreetmap.org", status: http.StatusTooManyRequests}}, true},
+		{"denied", geocodeError{"London", googleStatusError{status: "REQUEST_DENIED"}}, false},
+		{"no results", geocodeError{"Atlantis", errNoResults}, false},
+		// A weather provider's own 429 isn't the geocoder's.
+		{"provider rate limited", statusError{host: "api.darksky.net", status: http.StatusTooManyRequests}, false},
+	} {
+		if got := geocodeQuotaExhausted(tt.err); got != tt.want {
+			t.Errorf("%s: %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGeocodeQuotaFallback(t *testing.T) {
+	cityName := newFake("openWeatherMap", 10)
+	geocoding := forecastIo{apiKey: "k", geocoder: &stubGeocoder{err: googleStatusError{status: "OVER_QUERY_LIMIT"}}}
+	mw := newTestMW(cityName, geocoding)
+
+	if _, err := mw.aggregate(context.Background(), "London"); err == nil {
+		t.Fatal("an exhausted geocoder passed without quotaFallback")
+	}
+
+	mw.quotaFallback = true
+	agg, err := mw.aggregate(context.Background(), "London")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agg.celsius != 10 || len(agg.warnings) != 1 || agg.warnings[0] != "forecastIo excluded: geocoder quota exhausted" {
+		t.Errorf("got %v with warnings %q, want openWeatherMap's 10 and forecastIo left out", agg.celsius, agg.warnings)
+	}
+
+	// Any other failure still fails the lookup.
+	geocoding.geocoder = &stubGeocoder{err: errors.New("geocoder down")}
+	mw.providers = []weatherProvider{cityName, geocoding}
+	if _, err := mw.aggregate(context.Background(), "London"); err == nil {
+		t.Error("a geocoder failure other than quota passed")
+	}
+}
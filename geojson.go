@@ -0,0 +1,43 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// geoJSONType is the media type of GeoJSON, RFC 7946.
+const geoJSONType = "application/geo+json"
+
+// wantsGeoJSON reports whether r asks for its answer as a GeoJSON Feature,
+// with ?format=geojson or by accepting application/geo+json.
+func wantsGeoJSON(r *http.Request) bool {
+	if f := r.URL.Query().Get("format"); f != "" {
+		return strings.EqualFold(f, "geojson")
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if t, _, err := mime.ParseMediaType(strings.TrimSpace(accept)); err == nil && t == geoJSONType {
+			return true
+		}
+	}
+	return false
+}
+
+// geoJSONFeature places properties at p, as a GeoJSON Feature with a Point
+// geometry. GeoJSON puts longitude first.
+func geoJSONFeature(p point, properties interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"type": "Feature",
+		"geometry": map[string]interface{}{
+			"type":        "Point",
+			"coordinates": []float64{p.lon, p.lat},
+		},
+		"properties": properties,
+	}
+}
+
+// writeGeoJSON writes v, never enveloped, as GeoJSON.
+func writeGeoJSON(w http.ResponseWriter, r *http.Request, code int, v interface{}) {
+	w.Header().Set("Content-Type", geoJSONType)
+	encodeJSON(w, r, code, v)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWantsGeoJSON(t *testing.T) {
+	for _, tt := range []struct {
+		target, accept string
+		want           bool
+	}{
+		{"/weather/London?format=geojson", "", true},
+		{"/weather/London?format=GeoJSON", "", true},
+		{"/weather/London", "application/geo+json", true},
+		{"/weather/London", "text/html, application/geo+json;q=0.9", true},
+		{"/weather/London", "application/json", false},
+		{"/weather/London", "", false},
+		// ?format= decides over the Accept header.
+		{"/weather/London?format=json", "application/geo+json", false},
+	} {
+		r := httptest.NewRequest("GET", tt.target, nil)
+		if tt.accept != "" {
+			r.Header.Set("Accept", tt.accept)
+		}
+		if got := wantsGeoJSON(r); got != tt.want {
+			t.Errorf("%s with Accept %q: %v, want %v", tt.target, tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestGeoJSONFeature(t *testing.T) {
+	s := newTestServer(newFake("a", 10))
+	s.geocoder = &stubGeocoder{points: map[string]point{"London": {lat: 51.5, lon: -0.12}}}
+
+	w := get(s.handleWeather, "/weather/London?format=geojson&fields=temp")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != geoJSONType {
+		t.Errorf("Content-Type %q, want %s", ct, geoJSONType)
+	}
+	if !strings.Contains(w.Header().Get("Vary"), "Accept") {
+		t.Errorf("Vary %q, want Accept", w.Header().Get("Vary"))
+	}
+	body := decode(t, w)
+	geometry, _ := body["geometry"].(map[string]interface{})
+	coords, _ := geometry["coordinates"].([]interface{})
+	if body["type"] != "Feature" || geometry["type"] != "Point" || len(coords) != 2 || coords[0] != -0.12 || coords[1] != 51.5 {
+		t.Errorf("feature %v, want a Point at longitude -0.12, latitude 51.5", body)
+	}
+	properties, _ := body["properties"].(map[string]interface{})
+	if len(properties) != 1 || properties["temp"] != 10.0 {
+		t.Errorf("properties %v, want just the selected temp", properties)
+	}
+
+	r := httptest.NewRequest("GET", "/weather/London", nil)
+	r.Header.Set("Accept", geoJSONType)
+	w = httptest.NewRecorder()
+	s.handleWeather(w, r)
+	if w.Header().Get("Content-Type") != geoJSONType || decode(t, w)["type"] != "Feature" {
+		t.Errorf("Accept: %s answered %s", geoJSONType, w.Header().Get("Content-Type"))
+	}
+}
+
+func TestGeoJSONUnplaced(t *testing.T) {
+	s := newTestServer(newFake("a", 10))
+	s.geocoder = &stubGeocoder{err: errors.New("geocoder down")}
+	w := get(s.handleWeather, "/weather/London?format=geojson")
+	if w.Code != http.StatusBadGateway || !strings.Contains(w.Body.String(), "can't place London") {
+		t.Errorf("status %d: %s, want a 502 for the unplaced city", w.Code, w.Body)
+	}
+	// Plain JSON needs no point.
+	if w := get(s.handleWeather, "/weather/London"); w.Code != http.StatusOK {
+		t.Errorf("plain JSON: status %d", w.Code)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// golloProvider reads the weather from another gollo server, so that edge
+// instances can aggregate from a regional one. Its URL is the other
+// server's base, including any path prefix, e.g.
+//
+//	{"type": "gollo", "name": "regional", "url": "https://gollo.eu.internal"}
+//
+// Temperatures are asked for in Kelvin, whatever the other server's
+// default unit, and the rest of its answer is kept where it maps onto a
+// reading. Its response may be enveloped or not.
+type golloProvider struct {
+	providerName string
+	base         string
+	header       http.Header
+	query        url.Values
+}
+
+func newGolloProvider(pc providerConfig, env providerEnv) (weatherProvider, error) {
+	if pc.URL == "" {
+		return nil, errors.New("gollo: url is required")
+	}
+	u, err := url.Parse(pc.URL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("gollo: url %q is not absolute", pc.URL)
+	}
+	name := pc.Name
+	if name == "" {
+		name = "gollo"
+	}
+	return golloProvider{providerName: name, base: strings.TrimSuffix(pc.URL, "/"), header: pc.header(), query: pc.query()}, nil
+}
+
+func (w golloProvider) name() string { return w.providerName }
+
+func (w golloProvider) origins() []string {
+	u, _ := url.Parse(w.base) // checked by newGolloProvider
+	return []string{u.Scheme + "://" + u.Host}
+}
+
+func (w golloProvider) temperature(ctx context.Context, city string) (reading, error) {
+	begin := time.Now()
+	r, err := w.fetch(ctx, "/weather/"+url.PathEscape(city))
+	if err != nil {
+		return reading{}, err
+	}
+	logReading(ctx, "%s: %s: %.2f; took %s", w.providerName, city, r.celsius, time.Since(begin).String())
+	return r, nil
+}
+
+// temperatureAt asks the other server's /point/, which only reports the
+// temperature.
+func (w golloProvider) temperatureAt(ctx context.Context, p point) (reading, error) {
+	return w.fetch(ctx, "/point/"+p.String())
+}
+
+func (w golloProvider) fetch(ctx context.Context, path string) (reading, error) {
+	var raw json.RawMessage
+	if err := getJSONWith(ctx, w.base+path+"?units=k", w.header, w.query, &raw); err != nil {
+		return reading{}, err
+	}
+	var env struct {
+		Status string          `json:"status"`
+		Data   json.RawMessage `json:"data"`
+		Error  *struct {
+			Code int `json:"code"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(raw, &env) == nil {
+		switch {
+		case env.Status == "ok" && env.Data != nil:
+			raw = env.Data
+		case env.Status == "error" && env.Error != nil:
+			// An error sent with a 200, as always200 does.
+			u, _ := url.Parse(w.base)
+			return reading{}, statusError{host: u.Host, status: env.Error.Code}
+		}
+	}
+	var d struct {
+		Temp      *float64 `json:"temp"` // K
+		Place     string   `json:"place"`
+		Condition string   `json:"condition"`
+		Icon      string   `json:"icon"`
+		FeelsLike *float64 `json:"feels_like"` // K
+		Wind      *struct {
+			Speed   *float64 `json:"speed"` // m/s
+			Bearing *float64 `json:"bearing"`
+		} `json:"wind"`
+		Pressure          *float64 `json:"pressure"`
+		UVIndex           *float64 `json:"uv_index"`
+		PrecipProbability *float64 `json:"precip_probability"`
+		CloudCover        *float64 `json:"cloud_cover"`
+		Sunrise           string   `json:"sunrise"`
+		Sunset            string   `json:"sunset"`
+		AsOf              string   `json:"as_of"`
+	}
+	if err := json.Unmarshal(raw, &d); err != nil {
+		return reading{}, err
+	}
+	if d.Temp == nil {
+		return reading{}, fmt.Errorf("%s: no temperature for %s", w.providerName, path)
+	}
+
+	r := reading{
+		place:             d.Place,
+		celsius:           kelvin.toCelsius(*d.Temp),
+		native:            nativeTemp{*d.Temp, kelvin},
+		condition:         d.Condition,
+		icon:              d.Icon,
+		pressure:          d.Pressure,
+		uvIndex:           d.UVIndex,
+		precipProbability: d.PrecipProbability,
+		cloudCover:        d.CloudCover,
+	}
+	if d.FeelsLike != nil {
+		feelsLike := kelvin.toCelsius(*d.FeelsLike)
+		r.feelsLike = &feelsLike
+	}
+	if d.Wind != nil {
+		r.windSpeed, r.windBearing = d.Wind.Speed, d.Wind.Bearing
+	}
+	// Times it can't parse are left out rather than failing the reading.
+	r.sunrise, _ = time.Parse(time.RFC3339, d.Sunrise)
+	r.sunset, _ = time.Parse(time.RFC3339, d.Sunset)
+	r.observed, _ = time.Parse(time.RFC3339, d.AsOf)
+	return r, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// stubGollo serves another gollo server, with s's /weather/ and /point/
+// behind the path prefix /eu, as the upstream of every request.
+func stubGollo(t *testing.T, s *server) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/weather/", s.handleWeather)
+	mux.HandleFunc("/point/", s.handlePoint)
+	stubUpstream(t, http.StripPrefix("/eu", mux))
+}
+
+func newTestGollo(t *testing.T) weatherProvider {
+	p, err := newGolloProvider(providerConfig{Type: "gollo", Name: "regional", URL: "https://gollo.eu.internal/eu/"}, providerEnv{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestGolloProvider(t *testing.T) {
+	observed := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	fake := newFake("a", 11.5)
+	fake.reading.place, fake.reading.condition, fake.reading.observed = "São Paulo, BR", "clear", observed
+	fake.reading.feelsLike, fake.reading.windSpeed, fake.reading.windBearing = ptr(10.0), ptr(4.0), ptr(90.0)
+	regional := newTestServer(fake)
+	regional.defaultUnit, regional.asOf = fahrenheit, true
+	stubGollo(t, regional)
+
+	p := newTestGollo(t)
+	if p.name() != "regional" {
+		t.Errorf("name %q, want regional", p.name())
+	}
+	r, err := p.temperature(context.Background(), "São Paulo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Asked for in Kelvin, whatever the other server's default.
+	if !near(r.celsius, 11.5) || r.native.unit != kelvin || !near(r.native.value, 284.65) {
+		t.Errorf("%v°C, native %v; want 11.5°C read as 284.65K", r.celsius, r.native)
+	}
+	if r.place != "São Paulo, BR" || r.condition != "clear" || !r.observed.Equal(observed) {
+		t.Errorf("reading %+v, want the place, condition and observation time kept", r)
+	}
+	if r.feelsLike == nil || !near(*r.feelsLike, 10) || r.windSpeed == nil || *r.windSpeed != 4 || *r.windBearing != 90 {
+		t.Errorf("feels like %v, wind %v from %v; want 10°C and 4 m/s from 90°", r.feelsLike, r.windSpeed, r.windBearing)
+	}
+}
+
+func TestGolloProviderPoint(t *testing.T) {
+	regional := newTestServer(&pointProvider{fakeProvider: newFake("a", 11.5)})
+	stubGollo(t, regional)
+	r, err := newTestGollo(t).(coordinateProvider).temperatureAt(context.Background(), point{lat: 51.5, lon: -0.12})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !near(r.celsius, 11.5) {
+		t.Errorf("%v°C at the point, want 11.5", r.celsius)
+	}
+}
+
+func TestGolloProviderEnveloped(t *testing.T) {
+	setEnvelope(t, true)
+	stubGollo(t, newTestServer(newFake("a", 11.5)))
+	r, err := newTestGollo(t).temperature(context.Background(), "London")
+	if err != nil || !near(r.celsius, 11.5) {
+		t.Errorf("enveloped: %v°C, %v; want 11.5", r.celsius, err)
+	}
+}
+
+func TestGolloProviderErrors(t *testing.T) {
+	failing := newFake("a", 0)
+	failing.err = errors.New("down")
+	stubGollo(t, newTestServer(failing))
+	if _, err := newTestGollo(t).temperature(context.Background(), "London"); err == nil {
+		t.Error("the other server's failure was a reading")
+	}
+	// An error answered with a 200 is still the other server's error.
+	old := always200
+	always200 = true
+	t.Cleanup(func() { always200 = old })
+	stubGollo(t, newTestServer(failing))
+	_, err := newTestGollo(t).temperature(context.Background(), "London")
+	var se statusError
+	if !errors.As(err, &se) || se.host != "gollo.eu.internal" || se.status != http.StatusInternalServerError {
+		t.Errorf("always200 error read as %v, want the statusError it names", err)
+	}
+
+	for _, u := range []string{"", "/eu", "gollo.eu.internal"} {
+		if _, err := newGolloProvider(providerConfig{Type: "gollo", URL: u}, providerEnv{}); err == nil {
+			t.Errorf("url %q accepted", u)
+		}
+	}
+	p, _ := newGolloProvider(providerConfig{Type: "gollo", URL: "https://gollo.eu.internal:8443/eu"}, providerEnv{})
+	if p.name() != "gollo" || p.(hostedProvider).origins()[0] != "https://gollo.eu.internal:8443" {
+		t.Errorf("name %q, origins %v", p.name(), p.(hostedProvider).origins())
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// graphQLProvider POSTs a GraphQL query from conf.json, with the city as
+// its $city variable, and reads the temperature from a path under the
+// response's data. For example:
+//
+//	{"type": "graphql", "name": "internalWeather",
+//	 "url": "https://weather.internal/graphql",
+//	 "document": "query($city: String!) { current(city: $city) { temp sky } }",
+//	 "field": "current.temp", "unit": "f", "conditionField": "current.sky"}
+//
+// Paths and auth work as for httpjson, whose URL handling it shares.
+type graphQLProvider struct {
+	httpJSONProvider
+	document string
+}
+
+func newGraphQLProvider(pc providerConfig, env providerEnv) (weatherProvider, error) {
+	if pc.Name == "" || pc.URL == "" || pc.Document == "" || pc.Field == "" {
+		return nil, errors.New("graphql: name, url, document and field are required")
+	}
+	u := celsius
+	if pc.Unit != "" {
+		var err error
+		if u, err = parseUnit(pc.Unit); err != nil {
+			return nil, fmt.Errorf("graphql: %s", err)
+		}
+	}
+	w := graphQLProvider{
+		httpJSONProvider: httpJSONProvider{
+			providerName:   pc.Name,
+			url:            pc.URL,
+			field:          pc.Field,
+			conditionField: pc.ConditionField,
+			unit:           u,
+			header:         pc.header(),
+			query:          pc.query(),
+		},
+		document: pc.Document,
+	}
+	if err := w.setAuth(pc.Auth.Scheme, pc.Auth.Name, pc.Auth.Token); err != nil {
+		return nil, fmt.Errorf("graphql %s: %s", pc.Name, err)
+	}
+	return w, nil
+}
+
+func (w graphQLProvider) temperature(ctx context.Context, city string) (reading, error) {
+	begin := time.Now()
+	u, shown, err := w.requestURL(city)
+	if err != nil {
+		return reading{}, fmt.Errorf("%s: %w", w.providerName, err)
+	}
+	body := map[string]interface{}{
+		"query":     w.document,
+		"variables": map[string]string{"city": city},
+	}
+	var d struct {
+		Data   interface{} `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := postJSON(ctx, u, w.header, w.query, body, &d); err != nil {
+		// Keep the token out of logs and responses.
+		var ue *url.Error
+		if errors.As(err, &ue) {
+			ue.URL = shown
+		}
+		return reading{}, fmt.Errorf("%s: %w", w.providerName, err)
+	}
+	if len(d.Errors) > 0 {
+		return reading{}, fmt.Errorf("%s: %s", w.providerName, d.Errors[0].Message)
+	}
+
+	v, err := jsonPath(d.Data, w.field)
+	if err != nil {
+		return reading{}, fmt.Errorf("%s: %s", w.providerName, err)
+	}
+	temp, ok := v.(float64)
+	if !ok {
+		return reading{}, fmt.Errorf("%s: %s is %T, not a number", w.providerName, w.field, v)
+	}
+	r := reading{celsius: w.unit.toCelsius(temp), native: nativeTemp{temp, w.unit}}
+	if w.conditionField != "" {
+		if v, err := jsonPath(d.Data, w.conditionField); err == nil {
+			r.condition, _ = v.(string)
+		}
+	}
+	logReading(ctx, "%s: %s: %.2f; took %s", w.providerName, city, r.celsius, time.Since(begin).String())
+	return r, nil
+}
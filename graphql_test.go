@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+const graphQLDocument = "query($city: String!) { current(city: $city) { temp sky } }"
+
+// graphQLStub answers GraphQL POSTs for weather.internal, checking each
+// carries the document and a city, with what answer returns for it.
+func graphQLStub(t *testing.T, answer func(city string) string) {
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Query     string            `json:"query"`
+			Variables map[string]string `json:"variables"`
+		}
+		if r.Method != "POST" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("%s with Content-Type %q, want a JSON POST", r.Method, r.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Query != graphQLDocument {
+			t.Errorf("request %+v, %v; want the configured document", req, err)
+		}
+		w.Write([]byte(answer(req.Variables["city"])))
+	}))
+}
+
+func newTestGraphQL(t *testing.T, pc providerConfig) weatherProvider {
+	t.Helper()
+	pc.Name, pc.URL, pc.Document = "internalWeather", "http://weather.internal/graphql", graphQLDocument
+	if pc.Field == "" {
+		pc.Field = "current.temp"
+	}
+	p, err := newGraphQLProvider(pc, providerEnv{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestGraphQLProvider(t *testing.T) {
+	graphQLStub(t, func(city string) string {
+		if city != "São Paulo" {
+			t.Errorf("$city %q", city)
+		}
+		return `{"data": {"current": {"temp": 50, "sky": "Fog"}}}`
+	})
+	p := newTestGraphQL(t, providerConfig{Unit: "f", ConditionField: "current.sky"})
+	if p.name() != "internalWeather" {
+		t.Errorf("name %q", p.name())
+	}
+	r, err := p.temperature(context.Background(), "São Paulo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !near(r.celsius, 10) || r.condition != "Fog" {
+		t.Errorf("%v°C, %q; want 10°C, Fog", r.celsius, r.condition)
+	}
+}
+
+func TestGraphQLProviderErrors(t *testing.T) {
+	graphQLStub(t, func(city string) string {
+		if city == "Atlantis" {
+			return `{"data": null, "errors": [{"message": "no such city"}, {"message": "second"}]}`
+		}
+		return `{"data": {"current": {"temp": "warm"}}}`
+	})
+	for _, tt := range []struct{ city, field, want string }{
+		{"Atlantis", "", "internalWeather: no such city"},
+		{"London", "", "is string, not a number"},
+		{"London", "current.humidity", `no "humidity"`},
+	} {
+		_, err := newTestGraphQL(t, providerConfig{Field: tt.field}).temperature(context.Background(), tt.city)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s %s: %v, want %q", tt.city, tt.field, err, tt.want)
+		}
+	}
+}
+
+func TestGraphQLProviderRetry(t *testing.T) {
+	// A retried POST sends its body again.
+	var calls atomic.Int32
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct{ Query string }
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Query != graphQLDocument {
+			t.Errorf("attempt %d: query %q", calls.Load()+1, req.Query)
+		}
+		if calls.Add(1) == 1 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"data": {"current": {"temp": 12}}}`))
+	}))
+	withRetries(t, 1)
+	if r, err := newTestGraphQL(t, providerConfig{}).temperature(context.Background(), "London"); err != nil || r.celsius != 12 || calls.Load() != 2 {
+		t.Errorf("%v, %v after %d calls, want 12 on the retry", r.celsius, err, calls.Load())
+	}
+}
+
+func TestGraphQLProviderAuth(t *testing.T) {
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer s3cret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"data": {"current": {"temp": 12}}}`))
+	}))
+	pc := providerConfig{}
+	pc.Auth.Scheme, pc.Auth.Token = "bearer", "s3cret"
+	if _, err := newTestGraphQL(t, pc).temperature(context.Background(), "London"); err != nil {
+		t.Errorf("with the token: %v", err)
+	}
+	if _, err := newTestGraphQL(t, providerConfig{}).temperature(context.Background(), "London"); err == nil {
+		t.Error("accepted without the token")
+	}
+}
+
+func TestGraphQLProviderConfig(t *testing.T) {
+	for _, pc := range []providerConfig{
+		{URL: "http://weather.internal/graphql", Document: graphQLDocument, Field: "t"},
+		{Name: "a", Document: graphQLDocument, Field: "t"},
+		{Name: "a", URL: "http://weather.internal/graphql", Field: "t"},
+		{Name: "a", URL: "http://weather.internal/graphql", Document: graphQLDocument},
+		{Name: "a", URL: "http://weather.internal/graphql", Document: graphQLDocument, Field: "t", Unit: "rankine"},
+	} {
+		if _, err := newGraphQLProvider(pc, providerEnv{}); err == nil {
+			t.Errorf("%+v: created", pc)
+		}
+	}
+	if _, ok := providerTypes["graphql"]; !ok {
+		t.Error("graphql isn't a provider type")
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// readyTTL is how long a readiness probe's result is reused, so frequent
+// orchestrator checks don't turn into upstream traffic.
+const readyTTL = 30 * time.Second
+
+// readiness remembers the last provider probe.
+type readiness struct {
+	mu      sync.Mutex
+	checked time.Time
+	err     error
+}
+
+// handleLive serves /livez: 200 while the process is serving, 503 once it
+// has begun shutting down.
+func (s *server) handleLive(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-s.stopping:
+		writeError(w, r, "shutting down", http.StatusServiceUnavailable)
+	default:
+		w.Write([]byte("ok\n"))
+	}
+}
+
+// handleReady serves /readyz: 200 if at least one provider answered for the
+// probe city within the last readyTTL, 503 otherwise.
+func (s *server) handleReady(w http.ResponseWriter, r *http.Request) {
+	if err := s.ready(r.Context()); err != nil {
+		writeError(w, r, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+func (s *server) ready(ctx context.Context) error {
+	select {
+	case <-s.stopping:
+		return errors.New("shutting down")
+	default:
+	}
+
+	s.readiness.mu.Lock()
+	defer s.readiness.mu.Unlock()
+	if time.Since(s.readiness.checked) < readyTTL {
+		return s.readiness.err
+	}
+	outcomes, _ := s.mw.collect(ctx, s.readyCity)
+	errs := make([]error, 0, len(outcomes))
+	for _, o := range outcomes {
+		if o.err == nil {
+			errs = nil
+			break
+		}
+		errs = append(errs, errors.New(o.provider+": "+o.err.Error()))
+	}
+	s.readiness.checked, s.readiness.err = time.Now(), nil
+	if len(outcomes) == 0 {
+		s.readiness.err = errors.New("no providers available")
+	} else if errs != nil {
+		s.readiness.err = errors.Join(errs...)
+	}
+	return s.readiness.err
+}
+
+// startupRetry is how long the startup gate waits between probes. Tests
+// shorten it.
+var startupRetry = 5 * time.Second
+
+// awaitProviders probes the providers for the probe city until at least
+// min of them answer, logging those that fail each time. It gives up with
+// an error when ctx is done. A successful probe seeds /readyz.
+func (s *server) awaitProviders(ctx context.Context, min int) error {
+	for {
+		outcomes, _ := s.mw.collect(ctx, s.readyCity)
+		ok := 0
+		for _, o := range outcomes {
+			if o.err != nil {
+				log.Printf("startup: %s: %s", o.provider, o.err)
+				continue
+			}
+			ok++
+		}
+		if ok >= min {
+			log.Printf("startup: %d of %d providers answered", ok, len(outcomes))
+			s.readiness.mu.Lock()
+			s.readiness.checked, s.readiness.err = time.Now(), nil
+			s.readiness.mu.Unlock()
+			return nil
+		}
+		log.Printf("startup: %d of %d providers answered, waiting for %d", ok, len(outcomes), min)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("startup: gave up waiting for %d providers: %w", min, ctx.Err())
+		case <-time.After(startupRetry):
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLiveAndReady(t *testing.T) {
+	a, b := newFake("a", 10), newFake("b", 10)
+	a.err, b.err = errors.New("a down"), errors.New("b down")
+	s := newTestServer(a, b)
+	s.readyCity = "London"
+	s.stopping = make(chan struct{})
+
+	if w := get(s.handleLive, "/livez"); w.Code != http.StatusOK {
+		t.Errorf("/livez with every provider down: status %d", w.Code)
+	}
+	w := get(s.handleReady, "/readyz")
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "a: a down") || !strings.Contains(w.Body.String(), "b: b down") {
+		t.Errorf("/readyz with every provider down: status %d: %s", w.Code, w.Body)
+	}
+	if calls := a.calls.Load(); calls != 1 {
+		t.Errorf("/livez or /readyz called a %d times, want once, by /readyz", calls)
+	}
+
+	// One provider answering is enough, once the last result expires.
+	b.err = nil
+	if w := get(s.handleReady, "/readyz"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz within readyTTL: status %d, want the cached 503", w.Code)
+	}
+	s.readiness.checked = time.Now().Add(-readyTTL)
+	if w := get(s.handleReady, "/readyz"); w.Code != http.StatusOK {
+		t.Errorf("/readyz with one provider up: status %d: %s", w.Code, w.Body)
+	}
+
+	close(s.stopping)
+	for path, h := range map[string]http.HandlerFunc{"/livez": s.handleLive, "/readyz": s.handleReady} {
+		if w := get(h, path); w.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s while shutting down: status %d", path, w.Code)
+		}
+	}
+}
+
+func TestReadyNoProviders(t *testing.T) {
+	s := newTestServer()
+	if w := get(s.handleReady, "/readyz"); w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "no providers") {
+		t.Errorf("status %d: %s", w.Code, w.Body)
+	}
+}
+
+// flakyProvider fails until up is set.
+type flakyProvider struct {
+	*fakeProvider
+	up atomic.Bool
+}
+
+func (p *flakyProvider) temperature(ctx context.Context, city string) (reading, error) {
+	r, err := p.fakeProvider.temperature(ctx, city)
+	if !p.up.Load() {
+		return reading{}, errors.New(p.label + " unreachable")
+	}
+	return r, err
+}
+
+func TestStartupGate(t *testing.T) {
+	old := startupRetry
+	startupRetry = 20 * time.Millisecond
+	t.Cleanup(func() { startupRetry = old })
+
+	a, b := &flakyProvider{fakeProvider: newFake("a", 10)}, &flakyProvider{fakeProvider: newFake("b", 10)}
+	down := newFake("down", 0)
+	down.err = errors.New("down")
+	s := newTestServer(a, b, down)
+	s.readyCity = "London"
+
+	// listening stands in for main starting its listener once the gate
+	// opens.
+	listening := make(chan error, 1)
+	go func() { listening <- s.awaitProviders(context.Background(), 2) }()
+
+	select {
+	case err := <-listening:
+		t.Fatalf("listening with every provider down: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	a.up.Store(true)
+	select {
+	case err := <-listening:
+		t.Fatalf("listening with one of the two providers needed: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	b.up.Store(true)
+	select {
+	case err := <-listening:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("still not listening once two providers answered")
+	}
+
+	// The passing probe seeded /readyz.
+	calls := a.calls.Load()
+	if w := get(s.handleReady, "/readyz"); w.Code != http.StatusOK || a.calls.Load() != calls {
+		t.Errorf("/readyz after the gate: status %d after %d more probes, want 200 and none", w.Code, a.calls.Load()-calls)
+	}
+}
+
+func TestStartupGateTimeout(t *testing.T) {
+	down := newFake("down", 0)
+	down.err = errors.New("down")
+	s := newTestServer(down)
+	s.readyCity = "London"
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	logs := captureLog(t)
+	err := s.awaitProviders(ctx, 1)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error %v, want the gate to give up", err)
+	}
+	if !strings.Contains(logs.String(), "startup: down: down") {
+		t.Errorf("log %q doesn't name the failing provider", logs)
+	}
+}
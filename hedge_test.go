@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestHedgePreferredInTime(t *testing.T) {
+	preferred, a, b := newFake("preferred", 10), newFake("a", 20), newFake("b", 30)
+	preferred.delay = 10 * time.Millisecond
+	mw := newTestMW(a, preferred, b)
+	mw.priority, mw.hedge = []string{"preferred"}, 100*time.Millisecond
+
+	agg, err := mw.aggregate(context.Background(), "London")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agg.celsius != 10 || len(agg.readings) != 1 || len(agg.warnings) != 0 {
+		t.Errorf("mean %v over %d readings with warnings %q, want preferred's 10 alone", agg.celsius, len(agg.readings), agg.warnings)
+	}
+	if n := a.calls.Load() + b.calls.Load(); n != 0 {
+		t.Errorf("%d backups called, want none", n)
+	}
+}
+
+func TestHedgeSlowPreferred(t *testing.T) {
+	const hedge = 100 * time.Millisecond
+	preferred, a, b := newFake("preferred", 10), newFake("a", 20), newFake("b", 30)
+	preferred.delay = 300 * time.Millisecond
+	mw := newTestMW(preferred, a, b)
+	mw.hedge = hedge
+
+	begin := time.Now()
+	agg, err := mw.aggregate(context.Background(), "London")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agg.celsius != 20 || len(agg.readings) != 3 {
+		t.Errorf("mean %v over %d readings, want all three's 20", agg.celsius, len(agg.readings))
+	}
+	if took := time.Since(begin); took > 500*time.Millisecond {
+		t.Errorf("took %s, want about preferred's 300ms", took)
+	}
+}
+
+func TestHedgeImplausiblePreferred(t *testing.T) {
+	// An implausible answer brings the backups in at once.
+	preferred, a, b := newFake("preferred", 500), newFake("a", 20), newFake("b", 30)
+	mw := newTestMW(preferred, a, b)
+	mw.hedge = time.Second
+
+	begin := time.Now()
+	agg, err := mw.aggregate(context.Background(), "London")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agg.celsius != 25 || time.Since(begin) >= time.Second {
+		t.Errorf("mean %v in %s, want a's and b's 25 before the hedge delay", agg.celsius, time.Since(begin))
+	}
+}
+
+func TestHedgeRequired(t *testing.T) {
+	preferred, required, backup := newFake("preferred", 10), newFake("required", 20), newFake("backup", 30)
+	mw := newTestMW(preferred, backup, required)
+	mw.hedge, mw.required = time.Second, []string{"required"}
+
+	now, backups := mw.hedged(mw.providers)
+	if names(now) != "preferred,required" || names(backups) != "backup" {
+		t.Errorf("called %s at once and %s as backups, want preferred,required and backup", names(now), names(backups))
+	}
+	agg, err := mw.aggregate(context.Background(), "London")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agg.celsius != 15 || backup.calls.Load() != 0 {
+		t.Errorf("mean %v, backup called %d times; want preferred's and required's 15 alone", agg.celsius, backup.calls.Load())
+	}
+}
+
+func TestHedgeCollect(t *testing.T) {
+	// /readings/ and /diagnose/ report on every provider.
+	preferred, a := newFake("preferred", 10), newFake("a", 20)
+	mw := newTestMW(preferred, a)
+	mw.hedge = time.Second
+	outcomes, _ := mw.collect(context.Background(), "London")
+	if len(outcomes) != 2 || a.calls.Load() != 1 {
+		t.Errorf("collected %v, want both providers called", outcomes)
+	}
+}
+
+func TestHedgeConfig(t *testing.T) {
+	var conf config
+	if err := json.Unmarshal([]byte(`{"hedge": {"delay": "150ms"}, "providers": [{"type": "openweathermap"}]}`), &conf); err != nil {
+		t.Fatal(err)
+	}
+	mw, err := getMultiWeatherProvider(conf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mw.hedge != 150*time.Millisecond {
+		t.Errorf("hedge %s, want 150ms", mw.hedge)
+	}
+}
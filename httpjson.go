@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// httpJSONProvider is a provider described entirely in conf.json: a URL
+// template with {city} in it, the path to the temperature in the JSON
+// response and the unit it is in. For example:
+//
+//	{"type": "httpjson", "name": "openWeatherMapRaw",
+//	 "url": "http://api.openweathermap.org/data/2.5/weather?q={city}&appid=KEY",
+//	 "field": "main.temp", "unit": "k", "conditionField": "weather.0.main"}
+//
+// Paths are dot-separated object keys and array indexes. Services that
+// need credentials take them in "auth", e.g.
+//
+//	"auth": {"scheme": "bearer", "token": "..."}
+//	"auth": {"scheme": "query", "name": "appid", "token": "..."}
+type httpJSONProvider struct {
+	providerName   string
+	url            string
+	field          string
+	conditionField string
+	unit           unit
+	header         http.Header
+	query          url.Values
+	// queryKey and queryToken, if set, add the token to every request
+	// URL as that parameter.
+	queryKey, queryToken string
+}
+
+func newHTTPJSONProvider(pc providerConfig, env providerEnv) (weatherProvider, error) {
+	if pc.Name == "" || pc.URL == "" || pc.Field == "" {
+		return nil, errors.New("httpjson: name, url and field are required")
+	}
+	if !strings.Contains(pc.URL, "{city}") {
+		return nil, errors.New("httpjson: url must contain {city}")
+	}
+	u := celsius
+	if pc.Unit != "" {
+		var err error
+		if u, err = parseUnit(pc.Unit); err != nil {
+			return nil, fmt.Errorf("httpjson: %s", err)
+		}
+	}
+	w := httpJSONProvider{
+		providerName:   pc.Name,
+		url:            pc.URL,
+		field:          pc.Field,
+		conditionField: pc.ConditionField,
+		unit:           u,
+		header:         pc.header(),
+		query:          pc.query(),
+	}
+	if err := w.setAuth(pc.Auth.Scheme, pc.Auth.Name, pc.Auth.Token); err != nil {
+		return nil, fmt.Errorf("httpjson %s: %s", pc.Name, err)
+	}
+	return w, nil
+}
+
+// setAuth arranges for every request to carry token as scheme asks.
+func (w *httpJSONProvider) setAuth(scheme, name, token string) error {
+	if scheme == "" {
+		return nil
+	}
+	if token == "" {
+		return errors.New("auth: token is required")
+	}
+	switch strings.ToLower(scheme) {
+	case "bearer":
+		name, token = "Authorization", "Bearer "+token
+	case "header":
+		if name == "" {
+			return errors.New("auth: header scheme needs a name")
+		}
+	case "query":
+		if name == "" {
+			return errors.New("auth: query scheme needs a name")
+		}
+		w.queryKey, w.queryToken = name, token
+		return nil
+	default:
+		return fmt.Errorf("auth: unknown scheme %q, want bearer, header or query", scheme)
+	}
+	if w.header == nil {
+		w.header = make(http.Header)
+	}
+	w.header.Set(name, token)
+	return nil
+}
+
+// requestURL fills the URL template in for city, adding the query token
+// if there is one. shown is the same URL without the token, for errors.
+func (w httpJSONProvider) requestURL(city string) (u, shown string, err error) {
+	shown = strings.ReplaceAll(w.url, "{city}", url.QueryEscape(city))
+	if w.queryKey == "" {
+		return shown, shown, nil
+	}
+	parsed, err := url.Parse(shown)
+	if err != nil {
+		return "", shown, err
+	}
+	q := parsed.Query()
+	q.Set(w.queryKey, w.queryToken)
+	parsed.RawQuery = q.Encode()
+	return parsed.String(), shown, nil
+}
+
+func (w httpJSONProvider) name() string { return w.providerName }
+
+func (w httpJSONProvider) origins() []string {
+	u, err := url.Parse(strings.ReplaceAll(w.url, "{city}", "x"))
+	if err != nil || u.Host == "" {
+		return nil
+	}
+	return []string{u.Scheme + "://" + u.Host}
+}
+
+func (w httpJSONProvider) temperature(ctx context.Context, city string) (reading, error) {
+	begin := time.Now()
+	u, shown, err := w.requestURL(city)
+	if err != nil {
+		return reading{}, fmt.Errorf("%s: %w", w.providerName, err)
+	}
+	var d interface{}
+	if err := getJSONWith(ctx, u, w.header, w.query, &d); err != nil {
+		// Keep the token out of logs and responses.
+		var ue *url.Error
+		if errors.As(err, &ue) {
+			ue.URL = shown
+		}
+		return reading{}, fmt.Errorf("%s: %w", w.providerName, err)
+	}
+
+	v, err := jsonPath(d, w.field)
+	if err != nil {
+		return reading{}, fmt.Errorf("%s: %s", w.providerName, err)
+	}
+	temp, ok := v.(float64)
+	if !ok {
+		return reading{}, fmt.Errorf("%s: %s is %T, not a number", w.providerName, w.field, v)
+	}
+	r := reading{celsius: w.unit.toCelsius(temp), native: nativeTemp{temp, w.unit}}
+	if w.conditionField != "" {
+		if v, err := jsonPath(d, w.conditionField); err == nil {
+			r.condition, _ = v.(string)
+		}
+	}
+	logReading(ctx, "%s: %s: %.2f; took %s", w.providerName, city, r.celsius, time.Since(begin).String())
+	return r, nil
+}
+
+// jsonPath follows a dot-separated path of object keys and array indexes
+// through a decoded JSON value.
+func jsonPath(v interface{}, path string) (interface{}, error) {
+	for _, step := range strings.Split(path, ".") {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			next, ok := node[step]
+			if !ok {
+				return nil, fmt.Errorf("no %q in %s", step, path)
+			}
+			v = next
+		case []interface{}:
+			i, err := strconv.Atoi(step)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, fmt.Errorf("no index %q in %s", step, path)
+			}
+			v = node[i]
+		default:
+			return nil, fmt.Errorf("cannot step into %q in %s", step, path)
+		}
+	}
+	return v, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestHTTPJSONProvider(t *testing.T) {
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Host {
+		case "owm-like.example":
+			if r.URL.Query().Get("q") != "São Paulo" {
+				t.Errorf("city %q", r.URL.Query().Get("q"))
+			}
+			w.Write([]byte(`{"main": {"temp": 21.5}, "weather": [{"main": "Clear"}]}`))
+		case "observations.example":
+			w.Write([]byte(`{"observations": [{"station": "KBOS", "temperature": {"value": 50}, "text": "Fog"}]}`))
+		case "kelvin.example":
+			w.Write([]byte(`{"t": 300}`))
+		}
+	}))
+
+	for _, tt := range []struct {
+		pc        providerConfig
+		celsius   float64
+		condition string
+		native    nativeTemp
+	}{
+		{providerConfig{Name: "owmLike", URL: "http://owm-like.example/now?q={city}", Field: "main.temp", ConditionField: "weather.0.main"}, 21.5, "Clear", nativeTemp{21.5, celsius}},
+		{providerConfig{Name: "obs", URL: "http://observations.example/{city}/latest", Field: "observations.0.temperature.value", ConditionField: "observations.0.text", Unit: "f"}, 10, "Fog", nativeTemp{50, fahrenheit}},
+		{providerConfig{Name: "kelvin", URL: "http://kelvin.example/{city}", Field: "t", Unit: "k"}, 26.85, "", nativeTemp{300, kelvin}},
+	} {
+		p, err := newHTTPJSONProvider(tt.pc, providerEnv{})
+		if err != nil {
+			t.Fatalf("%s: %s", tt.pc.Name, err)
+		}
+		if p.name() != tt.pc.Name {
+			t.Errorf("name %q, want %q", p.name(), tt.pc.Name)
+		}
+		r, err := p.temperature(context.Background(), "São Paulo")
+		if err != nil {
+			t.Errorf("%s: %s", tt.pc.Name, err)
+			continue
+		}
+		if !near(r.celsius, tt.celsius) || r.condition != tt.condition {
+			t.Errorf("%s: %v°C, %q; want %v°C, %q", tt.pc.Name, r.celsius, r.condition, tt.celsius, tt.condition)
+		}
+		if r.native != tt.native {
+			t.Errorf("%s: native %v, want %v as sent", tt.pc.Name, r.native, tt.native)
+		}
+	}
+}
+
+func TestHTTPJSONProviderErrors(t *testing.T) {
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"main": {"temp": "warm"}, "list": []}`))
+	}))
+	for field, want := range map[string]string{
+		"main.temp":     "is string, not a number",
+		"main.humidity": `no "humidity" in main.humidity`,
+		"list.0":        `no index "0" in list.0`,
+		"main.temp.x":   `cannot step into "x"`,
+	} {
+		p, _ := newHTTPJSONProvider(providerConfig{Name: "p", URL: "http://p.example/{city}", Field: field}, providerEnv{})
+		if _, err := p.temperature(context.Background(), "London"); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: error %v, want %q", field, err, want)
+		}
+	}
+
+	for _, pc := range []providerConfig{
+		{URL: "http://p.example/{city}", Field: "t"},
+		{Name: "p", URL: "http://p.example/", Field: "t"},
+		{Name: "p", URL: "http://p.example/{city}", Field: "t", Unit: "rankine"},
+		{Name: "p", URL: "http://p.example/{city}", Field: "t", Auth: struct{ Scheme, Name, Token string }{Scheme: "bearer"}},
+	} {
+		if _, err := newHTTPJSONProvider(pc, providerEnv{}); err == nil {
+			t.Errorf("%+v: no error", pc)
+		}
+	}
+}
+
+func TestHTTPJSONProviderAuth(t *testing.T) {
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ok bool
+		switch r.Host {
+		case "bearer.example":
+			ok = r.Header.Get("Authorization") == "Bearer s3cret"
+		case "header.example":
+			ok = r.Header.Get("X-Api-Key") == "s3cret"
+		case "query.example":
+			ok = r.URL.Query().Get("appid") == "s3cret" && r.URL.Query().Get("q") == "London" && r.URL.Query().Get("units") == "metric"
+		}
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"temp": 12}`))
+	}))
+
+	for _, tt := range []struct {
+		host, scheme, name string
+	}{
+		{"bearer.example", "bearer", ""},
+		{"header.example", "header", "X-Api-Key"},
+		{"query.example", "Query", "appid"},
+	} {
+		pc := providerConfig{Name: tt.scheme, URL: "http://" + tt.host + "/now?q={city}&units=metric", Field: "temp"}
+		pc.Auth.Scheme, pc.Auth.Name, pc.Auth.Token = tt.scheme, tt.name, "s3cret"
+		p, err := newHTTPJSONProvider(pc, providerEnv{})
+		if err != nil {
+			t.Fatalf("%s: %s", tt.scheme, err)
+		}
+		if r, err := p.temperature(context.Background(), "London"); err != nil || r.celsius != 12 {
+			t.Errorf("%s: got %v, %v", tt.scheme, r.celsius, err)
+		}
+
+		// Without the token the stub refuses.
+		pc.Auth.Scheme = ""
+		p, _ = newHTTPJSONProvider(pc, providerEnv{})
+		if _, err := p.temperature(context.Background(), "London"); err == nil {
+			t.Errorf("%s: the stub answered without credentials", tt.scheme)
+		}
+	}
+}
+
+func TestHTTPJSONProviderQueryTokenHidden(t *testing.T) {
+	// Nothing listens on port 1, so the transport error carries the URL.
+	pc := providerConfig{Name: "svc", URL: "http://127.0.0.1:1/now?q={city}", Field: "temp"}
+	pc.Auth.Scheme, pc.Auth.Name, pc.Auth.Token = "query", "key", "s3cret"
+	p, err := newHTTPJSONProvider(pc, providerEnv{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = p.temperature(context.Background(), "London")
+	if err == nil {
+		t.Fatal("no error from a closed port")
+	}
+	if strings.Contains(err.Error(), "s3cret") || !strings.Contains(err.Error(), "q=London") {
+		t.Errorf("error %q, want the URL without the token", err)
+	}
+}
+
+func TestHTTPJSONProviderAuthConfig(t *testing.T) {
+	for _, auth := range []struct{ scheme, name, token string }{
+		{"bearer", "", ""},
+		{"header", "", "t"},
+		{"query", "", "t"},
+		{"basic", "", "t"},
+	} {
+		pc := providerConfig{Name: "svc", URL: "http://svc.example/{city}", Field: "temp"}
+		pc.Auth.Scheme, pc.Auth.Name, pc.Auth.Token = auth.scheme, auth.name, auth.token
+		if _, err := newHTTPJSONProvider(pc, providerEnv{}); err == nil {
+			t.Errorf("%+v: accepted", auth)
+		}
+	}
+}
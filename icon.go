@@ -0,0 +1,126 @@
+package main
+
+import "strings"
+
+// Icons are normalized to Dark Sky's vocabulary, which forecast.io and
+// Visual Crossing already use, so readings from every provider can vote on
+// one.
+var iconVocabulary = map[string]bool{
+	"clear-day":           true,
+	"clear-night":         true,
+	"partly-cloudy-day":   true,
+	"partly-cloudy-night": true,
+	"cloudy":              true,
+	"rain":                true,
+	"sleet":               true,
+	"snow":                true,
+	"hail":                true,
+	"thunderstorm":        true,
+	"wind":                true,
+	"fog":                 true,
+}
+
+// owmIcons maps OpenWeatherMap's icon codes, less their d/n suffix.
+var owmIcons = map[string]string{
+	"01": "clear",
+	"02": "partly-cloudy",
+	"03": "cloudy",
+	"04": "cloudy",
+	"09": "rain",
+	"10": "rain",
+	"11": "thunderstorm",
+	"13": "snow",
+	"50": "fog",
+}
+
+// wuIcons maps Weather Underground's icon names, less their nt_ prefix.
+var wuIcons = map[string]string{
+	"clear":          "clear",
+	"sunny":          "clear",
+	"mostlysunny":    "partly-cloudy",
+	"partlycloudy":   "partly-cloudy",
+	"partlysunny":    "partly-cloudy",
+	"mostlycloudy":   "cloudy",
+	"cloudy":         "cloudy",
+	"fog":            "fog",
+	"hazy":           "fog",
+	"rain":           "rain",
+	"chancerain":     "rain",
+	"sleet":          "sleet",
+	"chancesleet":    "sleet",
+	"snow":           "snow",
+	"chancesnow":     "snow",
+	"flurries":       "snow",
+	"chanceflurries": "snow",
+	"tstorms":        "thunderstorm",
+	"chancetstorms":  "thunderstorm",
+}
+
+// visualCrossingIcons maps the names Visual Crossing's icons2 set adds to
+// Dark Sky's.
+var visualCrossingIcons = map[string]string{
+	"showers-day":           "rain",
+	"showers-night":         "rain",
+	"snow-showers-day":      "snow",
+	"snow-showers-night":    "snow",
+	"thunder":               "thunderstorm",
+	"thunder-rain":          "thunderstorm",
+	"thunder-showers-day":   "thunderstorm",
+	"thunder-showers-night": "thunderstorm",
+}
+
+// accuWeatherIcons maps AccuWeather's numbered icons. 30 (hot) and 31
+// (cold) say nothing about the sky and are left out.
+var accuWeatherIcons = map[int]string{
+	1: "clear-day", 2: "clear-day", 3: "partly-cloudy-day", 4: "partly-cloudy-day",
+	5: "fog", 6: "cloudy", 7: "cloudy", 8: "cloudy", 11: "fog",
+	12: "rain", 13: "rain", 14: "rain", 15: "thunderstorm", 16: "thunderstorm",
+	17: "thunderstorm", 18: "rain", 19: "snow", 20: "snow", 21: "snow",
+	22: "snow", 23: "snow", 24: "sleet", 25: "sleet", 26: "sleet", 29: "sleet",
+	32: "wind", 33: "clear-night", 34: "clear-night", 35: "partly-cloudy-night",
+	36: "partly-cloudy-night", 37: "fog", 38: "cloudy", 39: "rain", 40: "rain",
+	41: "thunderstorm", 42: "thunderstorm", 43: "snow", 44: "snow",
+}
+
+// dayOrNight completes a clear or partly-cloudy icon with -day or -night,
+// leaving the rest alone.
+func dayOrNight(icon string, night bool) string {
+	if icon != "clear" && icon != "partly-cloudy" {
+		return icon
+	}
+	if night {
+		return icon + "-night"
+	}
+	return icon + "-day"
+}
+
+// owmIcon normalizes an OpenWeatherMap icon code such as "10n".
+func owmIcon(code string) string {
+	if len(code) != 3 {
+		return ""
+	}
+	icon, ok := owmIcons[code[:2]]
+	if !ok {
+		return ""
+	}
+	return dayOrNight(icon, code[2] == 'n')
+}
+
+// wuIcon normalizes a Weather Underground icon name such as "nt_cloudy".
+func wuIcon(name string) string {
+	night := strings.HasPrefix(name, "nt_")
+	icon, ok := wuIcons[strings.TrimPrefix(name, "nt_")]
+	if !ok {
+		return ""
+	}
+	return dayOrNight(icon, night)
+}
+
+// darkSkyIcon normalizes an icon from forecast.io or Visual Crossing,
+// dropping any it doesn't know.
+func darkSkyIcon(name string) string {
+	if iconVocabulary[name] {
+		return name
+	}
+	return visualCrossingIcons[name]
+}
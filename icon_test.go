@@ -0,0 +1,78 @@
+package main
+
+import "testing"
+
+func TestIconNormalization(t *testing.T) {
+	// Each provider's own code for the same sky maps to one icon.
+	for _, tt := range []struct {
+		provider, code, got, want string
+	}{
+		{"openWeatherMap", "10d", owmIcon("10d"), "rain"},
+		{"openWeatherMap", "09n", owmIcon("09n"), "rain"},
+		{"weatherUnderground", "chancerain", wuIcon("chancerain"), "rain"},
+		{"forecastIo", "rain", darkSkyIcon("rain"), "rain"},
+		{"visualCrossing", "showers-day", darkSkyIcon("showers-day"), "rain"},
+		{"accuWeather", "12", accuWeatherIcons[12], "rain"},
+
+		{"openWeatherMap", "02n", owmIcon("02n"), "partly-cloudy-night"},
+		{"weatherUnderground", "nt_partlycloudy", wuIcon("nt_partlycloudy"), "partly-cloudy-night"},
+		{"accuWeather", "35", accuWeatherIcons[35], "partly-cloudy-night"},
+		{"forecastIo", "partly-cloudy-night", darkSkyIcon("partly-cloudy-night"), "partly-cloudy-night"},
+
+		{"openWeatherMap", "01d", owmIcon("01d"), "clear-day"},
+		{"weatherUnderground", "sunny", wuIcon("sunny"), "clear-day"},
+		{"accuWeather", "1", accuWeatherIcons[1], "clear-day"},
+
+		{"visualCrossing", "thunder-rain", darkSkyIcon("thunder-rain"), "thunderstorm"},
+		{"openWeatherMap", "11d", owmIcon("11d"), "thunderstorm"},
+	} {
+		if tt.got != tt.want {
+			t.Errorf("%s %q = %q, want %q", tt.provider, tt.code, tt.got, tt.want)
+		}
+		if !iconVocabulary[tt.got] {
+			t.Errorf("%s %q normalized to %q, outside the vocabulary", tt.provider, tt.code, tt.got)
+		}
+	}
+
+	// Codes no table knows, and AccuWeather's hot and cold, get no icon.
+	for _, got := range []string{owmIcon("99d"), owmIcon("10"), wuIcon("unknown"), darkSkyIcon("tornado"), accuWeatherIcons[30], accuWeatherIcons[31]} {
+		if got != "" {
+			t.Errorf("unknown code normalized to %q", got)
+		}
+	}
+}
+
+func TestIconMajority(t *testing.T) {
+	withIcon := func(label, icon string) *fakeProvider {
+		p := newFake(label, 10)
+		p.reading.icon = icon
+		return p
+	}
+	for _, tt := range []struct {
+		name      string
+		providers []weatherProvider
+		want      string
+	}{
+		{"majority", []weatherProvider{
+			withIcon("a", owmIcon("10d")), withIcon("b", wuIcon("chancerain")),
+			withIcon("c", darkSkyIcon("showers-day")), withIcon("d", accuWeatherIcons[6]),
+		}, "rain"},
+		{"tie goes alphabetically", []weatherProvider{
+			withIcon("a", "snow"), withIcon("b", "cloudy"),
+		}, "cloudy"},
+		{"unknown codes get no vote", []weatherProvider{
+			withIcon("a", owmIcon("99d")), withIcon("b", owmIcon("99d")), withIcon("c", "fog"),
+		}, "fog"},
+	} {
+		s := newTestServer(tt.providers...)
+		body := decode(t, get(s.handleWeather, "/weather/London"))
+		if body["icon"] != tt.want {
+			t.Errorf("%s: icon %v, want %q", tt.name, body["icon"], tt.want)
+		}
+	}
+
+	s := newTestServer(newFake("a", 10))
+	if _, ok := decode(t, get(s.handleWeather, "/weather/London"))["icon"]; ok {
+		t.Error("icon reported without any provider's")
+	}
+}
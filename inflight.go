@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// inflightExempt are paths the in-flight limit doesn't apply to: health
+// checks and metrics must answer under load, and streams are long-lived by
+// design.
+var inflightExempt = []string{"/livez", "/readyz", "/metrics", "/stream/"}
+
+type degradedKey struct{}
+
+// withInflightLimit answers 503 with Retry-After once max requests are
+// already being served, rather than letting goroutines and upstream calls
+// pile up. A max of 0 means no limit. Once degradeAt requests are in
+// flight, usually fewer than max, further requests are marked degraded so
+// handlers can shed work; a degradeAt of 0 never degrades. With signal set,
+// refusals say so in degradedHeader.
+func withInflightLimit(next http.Handler, max, degradeAt int, signal bool) http.Handler {
+	if max <= 0 && degradeAt <= 0 {
+		return next
+	}
+	var inflight atomic.Int64
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, p := range inflightExempt {
+			if strings.HasPrefix(r.URL.Path, p) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		n := inflight.Add(1)
+		if max > 0 && n > int64(max) {
+			inflight.Add(-1)
+			w.Header().Set("Retry-After", "1")
+			if signal {
+				setDegraded(w.Header(), degradedOverloaded)
+			}
+			writeError(w, r, "too many requests in flight", http.StatusServiceUnavailable)
+			return
+		}
+		defer inflight.Add(-1)
+		if degradeAt > 0 && n >= int64(degradeAt) {
+			r = r.WithContext(context.WithValue(r.Context(), degradedKey{}, true))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// degraded reports whether r arrived while the server was near its
+// in-flight limit.
+func degraded(r *http.Request) bool {
+	d, _ := r.Context().Value(degradedKey{}).(bool)
+	return d
+}
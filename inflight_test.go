@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestInflightLimit(t *testing.T) {
+	release := make(chan struct{})
+	var started sync.WaitGroup
+	h := withInflightLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started.Done()
+		<-release
+	}), 3, 0, true)
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	var wg sync.WaitGroup
+	started.Add(3)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if w := serve("/weather/London"); w.Code != http.StatusOK {
+				t.Errorf("request within the limit: status %d", w.Code)
+			}
+		}()
+	}
+	started.Wait()
+
+	for i := 0; i < 5; i++ {
+		w := serve("/weather/London")
+		if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "1" {
+			t.Errorf("request past the limit: status %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+		}
+		if w.Header().Get(degradedHeader) == "" {
+			t.Errorf("refusal doesn't say it was overloaded: %v", w.Header())
+		}
+	}
+	// Health checks still answer.
+	started.Add(1)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if w := serve("/readyz"); w.Code != http.StatusOK {
+			t.Errorf("/readyz at the limit: status %d", w.Code)
+		}
+	}()
+	started.Wait()
+
+	close(release)
+	wg.Wait()
+	started.Add(1)
+	if w := serve("/weather/London"); w.Code != http.StatusOK {
+		t.Errorf("after the others finished: status %d", w.Code)
+	}
+}
+
+func TestInflightDegrade(t *testing.T) {
+	release := make(chan struct{})
+	marked := make(chan bool, 3)
+	h := withInflightLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		marked <- degraded(r)
+		<-release
+	}), 0, 2, false)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/weather/London", nil))
+		}()
+	}
+	n := 0
+	for i := 0; i < 3; i++ {
+		if <-marked {
+			n++
+		}
+	}
+	close(release)
+	wg.Wait()
+	if n != 2 {
+		t.Errorf("%d of 3 concurrent requests degraded, want the 2nd and 3rd", n)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// hereCity is the reserved /weather/ city that stands for wherever the
+// client's IP address is.
+const hereCity = "here"
+
+// ipLocator resolves an IP address to approximate coordinates, like a
+// geocoder does for place names.
+type ipLocator interface {
+	locate(ctx context.Context, ip string) (point, error)
+}
+
+func newIPLocator(kind, token string, timeout time.Duration) (ipLocator, error) {
+	switch kind {
+	case "":
+		return nil, nil
+	case "ip-api":
+		return ipAPILocator{timeout: timeout}, nil
+	case "ipinfo":
+		return ipinfoLocator{token: token, timeout: timeout}, nil
+	}
+	return nil, fmt.Errorf("unknown IP geolocation provider %q", kind)
+}
+
+// ipAPILocator uses ip-api.com.
+type ipAPILocator struct {
+	timeout time.Duration
+}
+
+func (l ipAPILocator) locate(ctx context.Context, ip string) (point, error) {
+	ctx, cancel := context.WithTimeout(ctx, l.timeout)
+	defer cancel()
+	var d struct {
+		Status  string  `json:"status"`
+		Message string  `json:"message"`
+		Lat     float64 `json:"lat"`
+		Lon     float64 `json:"lon"`
+	}
+	if err := getJSON(ctx, "http://ip-api.com/json/"+ip+"?fields=status,message,lat,lon", &d); err != nil {
+		return point{}, fmt.Errorf("ip-api: %w", err)
+	}
+	if d.Status != "success" {
+		return point{}, fmt.Errorf("ip-api: cannot locate %s: %s", ip, d.Message)
+	}
+	return point{d.Lat, d.Lon}, nil
+}
+
+// ipinfoLocator uses ipinfo.io.
+type ipinfoLocator struct {
+	token   string
+	timeout time.Duration
+}
+
+func (l ipinfoLocator) locate(ctx context.Context, ip string) (point, error) {
+	ctx, cancel := context.WithTimeout(ctx, l.timeout)
+	defer cancel()
+	var d struct {
+		Loc string `json:"loc"` // "lat,lon"
+	}
+	if err := getJSON(ctx, "https://ipinfo.io/"+ip+"/json?token="+l.token, &d); err != nil {
+		return point{}, fmt.Errorf("ipinfo: %w", err)
+	}
+	if d.Loc == "" {
+		return point{}, fmt.Errorf("ipinfo: cannot locate %s", ip)
+	}
+	return parsePoint(d.Loc)
+}
+
+// trustedProxies are the networks whose X-Forwarded-For headers are
+// believed.
+type trustedProxies []*net.IPNet
+
+func parseTrustedProxies(cidrs []string) (trustedProxies, error) {
+	var t trustedProxies
+	for _, c := range cidrs {
+		if !strings.Contains(c, "/") {
+			if strings.Contains(c, ":") {
+				c += "/128"
+			} else {
+				c += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy: %s", err)
+		}
+		t = append(t, n)
+	}
+	return t, nil
+}
+
+func (t trustedProxies) contains(ip string) bool {
+	addr := net.ParseIP(ip)
+	for _, n := range t {
+		if addr != nil && n.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP is the address of the client behind r. X-Forwarded-For is read
+// from right to left only while each hop is a trusted proxy, so clients
+// can't spoof it.
+func (t trustedProxies) clientIP(r *http.Request) string {
+	ip := clientID(r)
+	if !t.contains(ip) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		ip = hop
+		if !t.contains(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// locateClient finds the coordinates of the client behind r.
+func (s *server) locateClient(ctx context.Context, r *http.Request) (point, error) {
+	return s.ipLocator.locate(ctx, s.trustedProxies.clientIP(r))
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWeatherHere(t *testing.T) {
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/json/203.0.113.7":
+			w.Write([]byte(`{"status":"success","lat":51.5,"lon":-0.12}`))
+		case "/json/198.51.100.9":
+			w.Write([]byte(`{"status":"success","lat":48.85,"lon":2.35}`))
+		default:
+			w.Write([]byte(`{"status":"fail","message":"reserved range"}`))
+		}
+	}))
+	p := &pointProvider{fakeProvider: newFake("a", 10)}
+	s := newTestServer(p)
+	s.ipLocator = ipAPILocator{timeout: time.Second}
+	var err error
+	if s.trustedProxies, err = parseTrustedProxies([]string{"10.0.0.0/8"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		remote, forwarded string
+		want              point
+	}{
+		{"203.0.113.7:5000", "", point{51.5, -0.12}},
+		// Behind a trusted proxy, the forwarded client is located.
+		{"10.0.0.1:5000", "203.0.113.7", point{51.5, -0.12}},
+		{"10.0.0.1:5000", "198.51.100.9, 10.0.0.2", point{48.85, 2.35}},
+		// An untrusted client can't claim to be somewhere else.
+		{"198.51.100.9:5000", "203.0.113.7", point{48.85, 2.35}},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/weather/here", nil)
+		r.RemoteAddr = tt.remote
+		if tt.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+		s.handleWeather(w, r)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s via %q: status %d: %s", tt.remote, tt.forwarded, w.Code, w.Body)
+			continue
+		}
+		if p.last != tt.want {
+			t.Errorf("%s via %q: looked up %v, want %v", tt.remote, tt.forwarded, p.last, tt.want)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/weather/here", nil)
+	r.RemoteAddr = "127.0.0.1:5000"
+	s.handleWeather(w, r)
+	if w.Code == http.StatusOK || !strings.Contains(w.Body.String(), "reserved range") {
+		t.Errorf("unlocatable client: status %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestWeatherHereNotConfigured(t *testing.T) {
+	s := newTestServer(newFake("a", 10))
+	if w := get(s.handleWeather, "/weather/here"); w.Code != http.StatusNotFound {
+		t.Errorf("status %d, want 404", w.Code)
+	}
+}
+
+func TestIPInfoLocator(t *testing.T) {
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host != "ipinfo.io" || r.URL.Path != "/203.0.113.7/json" || r.URL.Query().Get("token") != "tok" {
+			w.Write([]byte(`{}`))
+			return
+		}
+		w.Write([]byte(`{"loc":"51.5,-0.12"}`))
+	}))
+	l, err := newIPLocator("ipinfo", "tok", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, err := l.locate(context.Background(), "203.0.113.7"); err != nil || p != (point{51.5, -0.12}) {
+		t.Errorf("got %v, %v", p, err)
+	}
+	if _, err := l.locate(context.Background(), "192.0.2.1"); err == nil {
+		t.Error("no error for an address ipinfo can't place")
+	}
+	if _, err := newIPLocator("geoip", "", time.Second); err == nil {
+		t.Error("no error for an unknown provider")
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	tp, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]bool{"10.1.2.3": true, "192.0.2.1": true, "192.0.2.2": false, "::1": true, "garbage": false} {
+		if got := tp.contains(ip); got != want {
+			t.Errorf("contains(%s) = %v, want %v", ip, got, want)
+		}
+	}
+	if _, err := parseTrustedProxies([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("no error for an invalid CIDR")
+	}
+}
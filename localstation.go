@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// localStationProvider reads readings from a JSON file maintained out of
+// band, e.g. by a weather station's uploader:
+//
+//	{"London": {"celsius": 11.5, "observed": "2016-01-02T15:04:05Z"}}
+//
+// A station may also give its "elevation" in metres.
+//
+// The file is re-read on every call so updates are picked up immediately.
+type localStationProvider struct {
+	path string
+}
+
+func newLocalStationProvider(pc providerConfig, env providerEnv) (weatherProvider, error) {
+	if pc.Path == "" {
+		return nil, errors.New("localfile: path is required")
+	}
+	return localStationProvider{path: pc.Path}, nil
+}
+
+func (w localStationProvider) name() string { return "localStation" }
+
+func (w localStationProvider) temperature(ctx context.Context, city string) (reading, error) {
+	file, err := os.Open(w.path)
+	if err != nil {
+		return reading{}, err
+	}
+	defer file.Close()
+
+	var stations map[string]struct {
+		Celsius   *float64  `json:"celsius"`
+		Observed  time.Time `json:"observed"`
+		Elevation *float64  `json:"elevation"`
+	}
+	if err := json.NewDecoder(file).Decode(&stations); err != nil {
+		return reading{}, fmt.Errorf("localfile: %s: %s", w.path, err)
+	}
+
+	for name, s := range stations {
+		if !strings.EqualFold(name, city) {
+			continue
+		}
+		if s.Celsius == nil {
+			return reading{}, fmt.Errorf("localfile: no temperature for %q", city)
+		}
+		return reading{celsius: *s.Celsius, native: nativeTemp{*s.Celsius, celsius}, observed: s.Observed, elevation: s.Elevation}, nil
+	}
+	return reading{}, fmt.Errorf("localfile: no reading for %q", city)
+}
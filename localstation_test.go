@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLocalStation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stations.json")
+	write := func(s string) {
+		if err := os.WriteFile(path, []byte(s), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"London": {"celsius": 11.5, "observed": "2016-01-02T15:04:05Z", "elevation": 24}, "Paris": {}}`)
+	p, err := newLocalStationProvider(providerConfig{Type: "localfile", Path: path}, providerEnv{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := p.temperature(context.Background(), "london")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.celsius != 11.5 || !r.observed.Equal(time.Date(2016, 1, 2, 15, 4, 5, 0, time.UTC)) || r.elevation == nil || *r.elevation != 24 {
+		t.Errorf("got %+v", r)
+	}
+	if _, err := p.temperature(context.Background(), "Paris"); err == nil {
+		t.Error("Paris has no temperature, but no error")
+	}
+	if _, err := p.temperature(context.Background(), "Berlin"); err == nil {
+		t.Error("Berlin isn't listed, but no error")
+	}
+
+	write(`{"London": {"celsius": 12}}`)
+	if r, err := p.temperature(context.Background(), "London"); err != nil || r.celsius != 12 {
+		t.Errorf("after an update: %v, %v; want 12", r.celsius, err)
+	}
+
+	write(`{"London":`)
+	if _, err := p.temperature(context.Background(), "London"); err == nil {
+		t.Error("malformed file, but no error")
+	}
+}
+
+func TestLocalStationRequiresPath(t *testing.T) {
+	if _, err := newLocalStationProvider(providerConfig{Type: "localfile"}, providerEnv{}); err == nil {
+		t.Error("no error without a path")
+	}
+	p, _ := newLocalStationProvider(providerConfig{Type: "localfile", Path: filepath.Join(t.TempDir(), "missing.json")}, providerEnv{})
+	if _, err := p.temperature(context.Background(), "London"); err == nil {
+		t.Error("missing file, but no error")
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// whenTolerance is how far from now ?when= may point. Providers only
+// report current conditions, so anything further is refused rather than
+// answered with the weather now.
+const whenTolerance = 15 * time.Minute
+
+// parseWhen reads ?when=: "now", or an offset from now such as "+3h" or
+// "-90m". An offset's + may arrive unescaped, as a space.
+func parseWhen(s string) (time.Duration, error) {
+	if strings.HasPrefix(s, " ") {
+		s = "+" + s[1:] // a + left unescaped in the query
+	}
+	if s == "" || strings.EqualFold(s, "now") {
+		return 0, nil
+	}
+	if s[0] != '+' && s[0] != '-' {
+		return 0, fmt.Errorf("when must be now or an offset such as +3h, not %q", s)
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("when must be now or an offset such as +3h, not %q", s)
+	}
+	return d, nil
+}
+
+// zoneResolver finds the time zone of a place from Open-Meteo, which names
+// the zone of any coordinates it forecasts for with timezone=auto.
+type zoneResolver struct {
+	geocoder geocoder
+	zones    *locationCache[*time.Location] // by point
+}
+
+func newZoneResolver(geo geocoder) *zoneResolver {
+	return &zoneResolver{geocoder: geo, zones: newLocationCache[*time.Location](0)}
+}
+
+// forCity is the time zone of city.
+func (z *zoneResolver) forCity(ctx context.Context, city string) (*time.Location, error) {
+	p, err := z.geocoder.geocode(ctx, city)
+	if err != nil {
+		return nil, err
+	}
+	return z.at(ctx, p)
+}
+
+// at is the time zone at p, looked up once.
+func (z *zoneResolver) at(ctx context.Context, p point) (*time.Location, error) {
+	if loc, ok := z.zones.get(p.String()); ok {
+		return loc, nil
+	}
+	var d struct {
+		Timezone string `json:"timezone"`
+	}
+	if err := getJSON(ctx, "https://api.open-meteo.com/v1/forecast?timezone=auto&forecast_days=1&latitude="+strconv.FormatFloat(p.lat, 'f', -1, 64)+"&longitude="+strconv.FormatFloat(p.lon, 'f', -1, 64), &d); err != nil {
+		return nil, fmt.Errorf("time zone lookup failed: %w", err)
+	}
+	if d.Timezone == "" {
+		return nil, fmt.Errorf("no time zone for %s", p)
+	}
+	loc, err := time.LoadLocation(d.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("time zone lookup for %s: %s", p, err)
+	}
+	z.zones.set(p.String(), loc)
+	return loc, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseWhen(t *testing.T) {
+	for s, want := range map[string]time.Duration{
+		"":     0,
+		"now":  0,
+		"NOW":  0,
+		"+10m": 10 * time.Minute,
+		"-90m": -90 * time.Minute,
+		" 5m":  5 * time.Minute, // an unescaped +
+		"+3h":  3 * time.Hour,
+	} {
+		if got, err := parseWhen(s); err != nil || got != want {
+			t.Errorf("parseWhen(%q) = %s, %v; want %s", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"10m", "tomorrow", "+ten", "+"} {
+		if _, err := parseWhen(s); err == nil {
+			t.Errorf("parseWhen(%q) accepted", s)
+		}
+	}
+}
+
+func TestZoneResolver(t *testing.T) {
+	var lookups int
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lookups++
+		q := r.URL.Query()
+		if r.Host != "api.open-meteo.com" || q.Get("timezone") != "auto" || q.Get("latitude") != "35.68" || q.Get("longitude") != "139.69" {
+			t.Errorf("looked up %s%s", r.Host, r.URL)
+		}
+		w.Write([]byte(`{"timezone": "Asia/Tokyo"}`))
+	}))
+	z := newZoneResolver(&stubGeocoder{points: map[string]point{"Tokyo": {lat: 35.68, lon: 139.69}}})
+	for i := 0; i < 2; i++ {
+		loc, err := z.forCity(context.Background(), "Tokyo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loc.String() != "Asia/Tokyo" {
+			t.Errorf("zone %s, want Asia/Tokyo", loc)
+		}
+	}
+	if lookups != 1 {
+		t.Errorf("%d lookups, want the zone remembered", lookups)
+	}
+}
+
+func TestZoneResolverErrors(t *testing.T) {
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"timezone": "Mars/Olympus_Mons"}`))
+	}))
+	z := newZoneResolver(&stubGeocoder{points: map[string]point{"Olympus": {lat: 18.65, lon: -133.8}}})
+	if _, err := z.forCity(context.Background(), "Olympus"); err == nil {
+		t.Error("an unknown zone was loaded")
+	}
+	if _, err := z.forCity(context.Background(), "Atlantis"); err == nil {
+		t.Error("a city the geocoder can't place has a zone")
+	}
+}
+
+func TestLocalTime(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Skip(err)
+	}
+	s := newTestServer(newFake("a", 10))
+	s.zones = newZoneResolver(&stubGeocoder{points: map[string]point{"Tokyo": {lat: 35.68, lon: 139.69}}})
+	s.zones.zones.set(point{lat: 35.68, lon: 139.69}.String(), tokyo)
+
+	localTime := func(body map[string]interface{}) time.Time {
+		t.Helper()
+		if body["time_zone"] != "Asia/Tokyo" {
+			t.Errorf("time_zone %v, want Asia/Tokyo", body["time_zone"])
+		}
+		lt, err := time.Parse(time.RFC3339, body["local_time"].(string))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, offset := lt.Zone(); offset != 9*3600 {
+			t.Errorf("local_time %v, want it in Tokyo's +09:00", body["local_time"])
+		}
+		return lt
+	}
+	now := localTime(decode(t, get(s.handleWeather, "/weather/Tokyo")))
+	if d := time.Since(now); d < -time.Second || d > 2*time.Second {
+		t.Errorf("local_time %s is %s from now", now, d)
+	}
+	later := localTime(decode(t, get(s.handleWeather, "/weather/Tokyo?when=%2B10m")))
+	if d := later.Sub(now); d < 9*time.Minute || d > 11*time.Minute {
+		t.Errorf("?when=+10m is %s after now, want 10m", d)
+	}
+
+	w := get(s.handleWeather, "/weather/Tokyo?when=%2B3h")
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "too far from now") {
+		t.Errorf("+3h: status %d: %s, want a 400", w.Code, w.Body)
+	}
+}
+
+func TestLocalTimeUnknown(t *testing.T) {
+	// A failed lookup leaves the fields out but serves the weather.
+	logs := captureLog(t)
+	s := newTestServer(newFake("a", 10))
+	s.zones = newZoneResolver(&stubGeocoder{})
+	w := get(s.handleWeather, "/weather/Atlantis")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if body := decode(t, w); body["local_time"] != nil || body["time_zone"] != nil {
+		t.Errorf("local time in %v", body)
+	}
+	if !strings.Contains(logs.String(), "local time unknown") {
+		t.Errorf("failure not logged: %s", logs)
+	}
+}
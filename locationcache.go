@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// locationCache remembers per-place lookups that rarely change, such as
+// geocoded coordinates or AccuWeather location keys. Keys are compared
+// case-insensitively. With a ttl, entries are forgotten once they are
+// that old, so a wrong or outdated answer doesn't stick forever.
+type locationCache[V any] struct {
+	ttl time.Duration // 0 keeps entries forever
+
+	mu      sync.Mutex
+	entries map[string]locationEntry[V]
+}
+
+type locationEntry[V any] struct {
+	v       V
+	expires time.Time // zero if it never does
+}
+
+func newLocationCache[V any](ttl time.Duration) *locationCache[V] {
+	return &locationCache[V]{ttl: ttl, entries: make(map[string]locationEntry[V])}
+}
+
+func (c *locationCache[V]) get(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key = strings.ToLower(key)
+	e, ok := c.entries[key]
+	if ok && !e.expires.IsZero() && !time.Now().Before(e.expires) {
+		delete(c.entries, key)
+		var zero V
+		return zero, false
+	}
+	return e.v, ok
+}
+
+// lookup is get on a cache that may be nil, which holds nothing.
+func (c *locationCache[V]) lookup(key string) (V, bool) {
+	if c == nil {
+		var zero V
+		return zero, false
+	}
+	return c.get(key)
+}
+
+func (c *locationCache[V]) set(key string, v V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := locationEntry[V]{v: v}
+	if c.ttl > 0 {
+		e.expires = time.Now().Add(c.ttl)
+	}
+	c.entries[strings.ToLower(key)] = e
+}
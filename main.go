@@ -1,203 +1,624 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
 func main() {
-	mw, err := getMultiWeatherProvider("conf.json")
+	// conf.json is the base; files named on the command line, then
+	// conf.d/*.json, then the environment and then flags override it. It
+	// may be left out if they are enough.
+	files, flagConfig, err := parseArgs(os.Args[1:])
 	if err != nil {
 		log.Fatal(err)
 		return
 	}
-	http.HandleFunc("/weather/", func(w http.ResponseWriter, r *http.Request) {
-		begin := time.Now()
-		city := strings.SplitN(r.URL.Path, "/", 3)[2]
-
-		temp, err := mw.temperature(city)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+	envConf, err := envConfig(os.Getenv)
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+	conf, err := loadConfig("conf.json", append(files, "conf.d"), envConf, flagConfig)
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+	upstreamClient, err = newUpstreamClient(conf)
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+	errorSnippetLen = conf.Upstream.ErrorSnippet
+	upstreamRetry = retryPolicy{attempts: conf.Upstream.Retries.Attempts, backoff: conf.Upstream.Retries.Backoff.Duration}
+	if upstreamRetry.backoff == 0 {
+		upstreamRetry.backoff = 100 * time.Millisecond
+	}
+	if d := conf.FreshHalfLife.Duration; d > 0 {
+		freshHalfLife = d
+	}
+	// One geocoder serves the server and the providers that geocode, so
+	// they share its concurrency limit and cache.
+	geo, err := newGeocoder(conf)
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+	mw, err := getMultiWeatherProvider(conf, geo)
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+	tr, err := newTracer(conf.Tracing.Exporter, conf.Tracing.Endpoint)
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+	envelope = conf.Envelope
+	always200 = conf.Always200
+	defaultUnit := kelvin
+	if conf.Units != "" {
+		if defaultUnit, err = parseUnit(conf.Units); err != nil {
+			log.Fatal(err)
+			return
+		}
+	}
+	took := tookString
+	if conf.Took != "" {
+		if took, err = parseTookFormat(conf.Took); err != nil {
+			log.Fatal(err)
 			return
 		}
+	}
+	batchLogging, err := parseBatchLogging(conf.Batch.Logging)
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+	if conf.Limits.MaxBodyBytes <= 0 {
+		conf.Limits.MaxBodyBytes = 1 << 20
+	}
+	if conf.LogConfig {
+		log.Printf("configuration: %s", conf)
+	}
+	ipl, err := newIPLocator(conf.IPGeo.Provider, conf.IPGeo.Token, conf.Geocoder.Timeout.Duration)
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+	trusted, err := parseTrustedProxies(conf.TrustedProxies)
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+	accessFormat, err := parseAccessLogFormat(conf.AccessLog.Format)
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+	accessOut := os.Stdout
+	if conf.AccessLog.Path != "" {
+		if accessOut, err = os.OpenFile(conf.AccessLog.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644); err != nil {
+			log.Fatal(err)
+			return
+		}
+	}
+	access := newAccessLogger(accessOut, accessFormat, conf.AccessLog.Duration, trusted)
+	var clim climate
+	if conf.Fallback.Climate {
+		if clim, err = loadClimate(conf.Fallback.ClimatePath); err != nil {
+			log.Fatal(err)
+			return
+		}
+	}
+	confidence, err := newConfidenceScorer(conf)
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+	reg := newRegistry()
+	metrics := newServerMetrics(reg, conf.Metrics.SpreadBuckets)
+	mw.latency = metrics.latency
+	memCache := newMemoryCache(conf.Cache.MaxEntries)
+	s := &server{
+		mw:           mw,
+		metrics:      metrics,
+		geocoder:     geo,
+		tracer:       tr,
+		cache:        memCache,
+		trends:       newTrendStore(),
+		cacheTTL:     conf.Cache.TTL.Duration,
+		cacheJitter:  conf.Cache.Jitter.Duration,
+		flights:      flightGroup{window: conf.Cache.CoalesceWindow.Duration},
+		errorTTL:     conf.Cache.ErrorTTL.Duration,
+		staleOnError: conf.Cache.StaleOnError,
+		defaultUnit:  defaultUnit,
+		kelvin:       conf.Kelvin,
+		asOf:         conf.AsOf,
+		cardinal:     conf.CardinalWind,
+		confidence:   confidence,
+
+		batchMaxSize:  conf.Batch.MaxSize,
+		batchPageSize: conf.Batch.PageSize,
+		pool:          newWorkerPool(conf.Batch.MaxConcurrency, conf.Batch.MaxConcurrencyPerClient),
+		batchTimeout:  conf.Batch.Timeout.Duration,
+		batchLogging:  batchLogging,
+		maxBodyBytes:  conf.Limits.MaxBodyBytes,
+
+		slowThreshold:  conf.SlowThreshold.Duration,
+		tookFormat:     took,
+		partialContent: conf.PartialContent,
+		sampleRate:     conf.SampleRate,
+
+		streamInterval: conf.Stream.Interval.Duration,
+		stopping:       make(chan struct{}),
+
+		readyCity: conf.Health.ReadyCity,
+
+		ipLocator:      ipl,
+		trustedProxies: trusted,
+
+		requireQualifier: conf.Geocoder.RequireQualifier,
+		climate:          clim,
+
+		errorCategories: conf.ErrorCategories,
+		method:          conf.Method,
+		cacheOnlyAll:    conf.CacheOnly,
+
+		signalDegraded: conf.DegradedHeader,
+		provenance:     conf.Provenance,
+	}
+	if conf.LocalTime {
+		s.zones = newZoneResolver(geo)
+	}
+	if n := conf.Outage.Failures; n > 0 {
+		cooldown := conf.Outage.Cooldown.Duration
+		if cooldown == 0 {
+			cooldown = 30 * time.Second
+		}
+		s.outage = newCircuitBreaker(n, cooldown)
+	}
+	if s.minResponseTime = conf.minResponseTime(); s.minResponseTime > 0 {
+		log.Printf("debug: padding /weather/ responses to at least %s", s.minResponseTime)
+	}
+	if conf.Limits.DegradeAt > 0 && len(mw.providers) > 0 {
+		s.degradedProvider = mw.providers[0]
+		if name := conf.Limits.DegradedProvider; name != "" {
+			p, ok := mw.provider(name)
+			if !ok {
+				log.Fatalf("limits: degraded provider %q is not configured", name)
+				return
+			}
+			s.degradedProvider = p
+		}
+	}
+	http.HandleFunc("/weather/", s.handleWeather)
+	http.HandleFunc("/weather/batch", s.handleBatch)
+	http.HandleFunc("/weather/extremes", s.handleExtremes)
+	s.handleVersions(http.DefaultServeMux)
+	http.HandleFunc("/point/", s.handlePoint)
+	http.HandleFunc("/readings/", s.handleReadings)
+	http.HandleFunc("/compare/", s.handleCompare)
+	http.HandleFunc("/stream/", s.handleStream)
+	http.HandleFunc("/air/", s.handleAir)
+	http.Handle("/metrics", reg)
+	http.HandleFunc("/livez", s.handleLive)
+	http.HandleFunc("/readyz", s.handleReady)
+	if conf.Compat.DarkSky {
+		http.Handle("/compat/darksky/", withoutEnvelope(http.HandlerFunc(s.handleDarkSky)))
+	}
+	if conf.Admin.Token != "" {
+		http.Handle("/admin/probe", withAdminToken(http.HandlerFunc(s.handleProbe), conf.Admin.Token))
+		http.Handle("/admin/cache", withAdminToken(http.HandlerFunc(s.handleCache), conf.Admin.Token))
+		if conf.Admin.Diagnose {
+			http.Handle("/diagnose/", withAdminToken(http.HandlerFunc(s.handleDiagnose), conf.Admin.Token))
+		}
+	}
+	var handler http.Handler = withInflightLimit(http.DefaultServeMux, conf.Limits.MaxInFlight, conf.Limits.DegradeAt, conf.DegradedHeader)
+	if handler, err = withOverrides(handler, conf.Overrides.Allow, conf.Overrides.Reject); err != nil {
+		log.Fatal(err)
+		return
+	}
+	handler = withDeprecation(handler, conf.Deprecated, trusted)
+	handler = withPathPrefix(handler, conf.Server.PathPrefix)
+	if conf.Cache.RecordOrigin {
+		handler = withCacheOrigin(handler, trusted)
+	}
+	handler = withCORS(handler, conf.CORS.AllowedOrigins)
+	if handler, err = withCompression(handler, conf.Compression.Encodings, conf.Compression.MinBytes); err != nil {
+		log.Fatal(err)
+		return
+	}
+	srv := newHTTPServer(conf, withAccessLog(handler, access))
 
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"city": city,
-			"temp": temp,
-			"took": time.Since(begin).String(),
-		})
-	})
-	http.ListenAndServe(":8080", nil)
-}
+	srv.RegisterOnShutdown(func() { close(s.stopping) })
 
-func getMultiWeatherProvider(confFile string) (mw multiWeatherProvider, err error) {
-	var conf struct {
-		WeatherUnderground struct {
-			ApiKey string
+	// On SIGINT or SIGTERM, stop accepting connections and give in-flight
+	// requests up to ShutdownTimeout to finish.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	warmEvery := conf.Warm.Interval.Duration
+	if warmEvery == 0 {
+		warmEvery = s.cacheTTL / 2
+	}
+	if min := conf.Health.StartupProviders; min > 0 {
+		gateCtx := ctx
+		if t := conf.Health.StartupTimeout.Duration; t > 0 {
+			var cancel context.CancelFunc
+			gateCtx, cancel = context.WithTimeout(ctx, t)
+			defer cancel()
 		}
-		ForecastIo struct {
-			ApiKey string
+		if err := s.awaitProviders(gateCtx, min); err != nil {
+			log.Fatal(err)
+			return
 		}
 	}
-	file, err := os.Open(confFile)
-	defer file.Close()
-	if err != nil {
-		return nil, err
+	if path := conf.Cache.PersistPath; path != "" {
+		n, err := memCache.load(path, time.Now())
+		if err != nil {
+			log.Fatalf("cache: %s", err)
+			return
+		}
+		log.Printf("cache: loaded %d entries from %s", n, path)
+	}
+	if pc := conf.Upstream.Preconnect; pc.Enabled {
+		providers := append([]weatherProvider(nil), mw.providers...)
+		for _, ps := range mw.overrides {
+			providers = append(providers, ps...)
+		}
+		origins := providerOrigins(providers)
+		timeout := pc.Timeout.Duration
+		if timeout == 0 {
+			timeout = 5 * time.Second
+		}
+		begin := time.Now()
+		preconnectCtx, cancel := context.WithTimeout(ctx, timeout)
+		preconnect(preconnectCtx, origins)
+		cancel()
+		log.Printf("preconnect: %d upstreams in %s", len(origins), time.Since(begin).Round(time.Millisecond))
+		if pc.Interval.Duration > 0 {
+			go keepConnected(ctx, origins, pc.Interval.Duration, timeout)
+		}
+	}
+	if !conf.CacheOnly {
+		go s.warm(ctx, conf.Warm.Cities, warmEvery)
+	} else if len(conf.Warm.Cities) > 0 {
+		log.Printf("cache-only: not warming %d cities", len(conf.Warm.Cities))
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), conf.Server.ShutdownTimeout.Duration)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Printf("shutdown: %s", err)
+		}
+	}()
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
 	}
-	if err := json.NewDecoder(file).Decode(&conf); err != nil {
-		return nil, err
+	<-done
+	flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	if err := tr.shutdown(flushCtx); err != nil {
+		log.Printf("tracing: %s", err)
 	}
-	mw = multiWeatherProvider{
-		openWeatherMap{},
-		weatherUnderground{apiKey: conf.WeatherUnderground.ApiKey},
-		forecastIo{apiKey: conf.ForecastIo.ApiKey},
+	cancel()
+	if path := conf.Cache.PersistPath; path != "" {
+		n, err := memCache.save(path)
+		if err != nil {
+			log.Printf("cache: not saved: %s", err)
+		} else {
+			log.Printf("cache: saved %d entries to %s", n, path)
+		}
 	}
-	return
 }
 
-type openWeatherMap struct{}
+// openWeatherMap reads the city's current weather or, when stations is more
+// than one, averages that many stations near it.
+type openWeatherMap struct {
+	stations int
+	header   http.Header
+	query    url.Values
+}
+
+func (w openWeatherMap) name() string { return "openWeatherMap" }
+
+func (w openWeatherMap) origins() []string { return []string{"http://api.openweathermap.org"} }
+
+type owmObservation struct {
+	Name string `json:"name"`
+	Main struct {
+		Celsius   float64  `json:"temp"`
+		FeelsLike *float64 `json:"feels_like"`
+		Pressure  *float64 `json:"pressure"`
+	} `json:"main"`
+	Weather []struct {
+		Main string `json:"main"`
+		Icon string `json:"icon"` // e.g. "10n"
+	} `json:"weather"`
+	Wind struct {
+		Speed *float64 `json:"speed"`
+		Deg   *float64 `json:"deg"`
+	} `json:"wind"`
+	Clouds struct {
+		All *float64 `json:"all"` // percent
+	} `json:"clouds"`
+	Sys struct {
+		Country string `json:"country"`
+		Sunrise int64  `json:"sunrise"`
+		Sunset  int64  `json:"sunset"`
+	} `json:"sys"`
+	Timezone int `json:"timezone"` // seconds east of UTC
+}
+
+func (o owmObservation) reading() reading {
+	r := reading{provider: o.Name, celsius: o.Main.Celsius, native: nativeTemp{o.Main.Celsius, celsius}, feelsLike: o.Main.FeelsLike, windSpeed: o.Wind.Speed, windBearing: o.Wind.Deg, pressure: o.Main.Pressure, cloudCover: o.Clouds.All}
+	r.place = o.Name
+	if o.Name != "" && o.Sys.Country != "" {
+		r.place += ", " + o.Sys.Country
+	}
+	if len(o.Weather) > 0 {
+		r.condition = o.Weather[0].Main
+		r.icon = owmIcon(o.Weather[0].Icon)
+	}
+	if o.Sys.Sunrise > 0 && o.Sys.Sunset > 0 {
+		zone := time.FixedZone("", o.Timezone)
+		r.sunrise, r.sunset = time.Unix(o.Sys.Sunrise, 0).In(zone), time.Unix(o.Sys.Sunset, 0).In(zone)
+	}
+	return r
+}
 
-func (w openWeatherMap) temperature(city string) (float64, error) {
+func (w openWeatherMap) temperature(ctx context.Context, city string) (reading, error) {
 	begin := time.Now()
-	resp, err := http.Get("http://api.openweathermap.org/data/2.5/weather?q=" + city)
+	r, err := w.fetch(ctx, "q="+city)
 	if err != nil {
-		return 0, err
+		return reading{}, err
 	}
+	logReading(ctx, "openWeatherMap: %s: %.2f; took %s", city, r.celsius, time.Since(begin).String())
+	return r, nil
+}
 
-	defer resp.Body.Close()
+func (w openWeatherMap) temperatureAt(ctx context.Context, p point) (reading, error) {
+	return w.fetch(ctx, "lat="+strconv.FormatFloat(p.lat, 'f', -1, 64)+"&lon="+strconv.FormatFloat(p.lon, 'f', -1, 64))
+}
 
-	var d struct {
-		Main struct {
-			Kelvin float64 `json:"temp"`
-		} `json:"main"`
+// fetch reads the weather for a location given as query parameters.
+func (w openWeatherMap) fetch(ctx context.Context, location string) (reading, error) {
+	var r reading
+	if w.stations > 1 {
+		var d struct {
+			List []owmObservation `json:"list"`
+		}
+		if err := getJSONWith(ctx, "http://api.openweathermap.org/data/2.5/find?units=metric&"+location+"&cnt="+strconv.Itoa(w.stations), w.header, w.query, &d); err != nil {
+			return reading{}, err
+		}
+		if len(d.List) == 0 {
+			return reading{}, fmt.Errorf("openWeatherMap: no stations near %s", location)
+		}
+		for _, o := range d.List {
+			r.stations = append(r.stations, o.reading())
+		}
+		r.celsius = *meanOf(r.stations, func(s reading) *float64 { return &s.celsius })
+		r.feelsLike = meanOf(r.stations, func(s reading) *float64 { return s.feelsLike })
+		r.condition = majorityCondition(r.stations)
+		r.icon = majorityOf(r.stations, func(s reading) string { return s.icon })
+		r.windSpeed = meanOf(r.stations, func(s reading) *float64 { return s.windSpeed })
+		r.windBearing = circularMeanOf(r.stations, func(s reading) *float64 { return s.windBearing })
+		r.pressure = meanOf(r.stations, func(s reading) *float64 { return s.pressure })
+		r.cloudCover = meanOf(r.stations, func(s reading) *float64 { return s.cloudCover })
+		r.place = r.stations[0].place // the nearest
+	} else {
+		var d owmObservation
+		if err := getJSONWith(ctx, "http://api.openweathermap.org/data/2.5/weather?units=metric&"+location, w.header, w.query, &d); err != nil {
+			return reading{}, err
+		}
+		r = d.reading()
+		r.provider = ""
 	}
+	return r, nil
+}
 
-	if err := json.NewDecoder(resp.Body).Decode(&d); err != nil {
+// airQuality reports OpenWeatherMap's air quality index, from 1 (good) to
+// 5 (very poor). The air pollution API only takes coordinates, so the city
+// is located with OpenWeatherMap's own geocoding first.
+func (w openWeatherMap) airQuality(ctx context.Context, city string) (float64, error) {
+	var places []struct {
+		Lat float64 `json:"lat"`
+		Lon float64 `json:"lon"`
+	}
+	if err := getJSONWith(ctx, "http://api.openweathermap.org/geo/1.0/direct?limit=1&q="+url.QueryEscape(city), w.header, w.query, &places); err != nil {
 		return 0, err
 	}
+	if len(places) == 0 {
+		return 0, fmt.Errorf("openWeatherMap: cannot locate %q", city)
+	}
+	p := point{places[0].Lat, places[0].Lon}
 
-	log.Printf("openWeatherMap: %s: %.2f; took %s", city, d.Main.Kelvin, time.Since(begin).String())
-	return d.Main.Kelvin, nil
+	var d struct {
+		List []struct {
+			Main struct {
+				AQI float64 `json:"aqi"`
+			} `json:"main"`
+		} `json:"list"`
+	}
+	if err := getJSONWith(ctx, "http://api.openweathermap.org/data/2.5/air_pollution?lat="+strconv.FormatFloat(p.lat, 'f', -1, 64)+"&lon="+strconv.FormatFloat(p.lon, 'f', -1, 64), w.header, w.query, &d); err != nil {
+		return 0, err
+	}
+	if len(d.List) == 0 {
+		return 0, fmt.Errorf("openWeatherMap: no air quality for %q", city)
+	}
+	return d.List[0].Main.AQI, nil
 }
 
 type weatherUnderground struct {
 	apiKey string
+	header http.Header
+	query  url.Values
 }
 
-func (w weatherUnderground) temperature(city string) (float64, error) {
+func (w weatherUnderground) name() string { return "weatherUnderground" }
+
+func (w weatherUnderground) origins() []string { return []string{"http://api.wunderground.com"} }
+
+func (w weatherUnderground) temperature(ctx context.Context, city string) (reading, error) {
 	begin := time.Now()
-	resp, err := http.Get("http://api.wunderground.com/api/" + w.apiKey + "/conditions/q/" + city + ".json")
+	r, err := w.fetch(ctx, city)
 	if err != nil {
-		return 0, err
+		return reading{}, err
 	}
+	logReading(ctx, "weatherUnderground: %s: %.2f; took %s", city, r.celsius, time.Since(begin).String())
+	return r, nil
+}
 
-	defer resp.Body.Close()
+func (w weatherUnderground) temperatureAt(ctx context.Context, p point) (reading, error) {
+	return w.fetch(ctx, p.String())
+}
 
+func (w weatherUnderground) fetch(ctx context.Context, query string) (reading, error) {
 	var d struct {
 		Observation struct {
-			Celsius float64 `json:"temp_c"`
+			Celsius     float64  `json:"temp_c"`
+			Weather     string   `json:"weather"`
+			Icon        string   `json:"icon"`
+			WindKph     *float64 `json:"wind_kph"`
+			WindDegrees *float64 `json:"wind_degrees"`
+			Display     struct {
+				Full string `json:"full"` // e.g. "San Francisco, CA"
+			} `json:"display_location"`
+			Station struct {
+				Elevation string `json:"elevation"` // e.g. "280 ft"
+			} `json:"observation_location"`
 		} `json:"current_observation"`
 	}
 
-	if err := json.NewDecoder(resp.Body).Decode(&d); err != nil {
-		return 0, err
+	if err := getJSONWith(ctx, "http://api.wunderground.com/api/"+w.apiKey+"/conditions/q/"+query+".json", w.header, w.query, &d); err != nil {
+		return reading{}, err
 	}
 
-	kelvin := d.Observation.Celsius + 273.15
-	log.Printf("weatherUnderground: %s: %.2f; took %s", city, kelvin, time.Since(begin).String())
-	return kelvin, nil
+	r := reading{place: d.Observation.Display.Full, celsius: d.Observation.Celsius, native: nativeTemp{d.Observation.Celsius, celsius}, condition: d.Observation.Weather, icon: wuIcon(d.Observation.Icon), windBearing: d.Observation.WindDegrees}
+	if kph := d.Observation.WindKph; kph != nil {
+		speed := *kph / 3.6
+		r.windSpeed = &speed
+	}
+	r.elevation = parseElevation(d.Observation.Station.Elevation)
+	return r, nil
 }
 
 type weatherProvider interface {
-	temperature(city string) (float64, error) // In Kelvin!
+	name() string
+	temperature(ctx context.Context, city string) (reading, error)
+}
+
+// coordinateProvider is implemented by providers that can also look up the
+// weather at a point.
+type coordinateProvider interface {
+	temperatureAt(ctx context.Context, p point) (reading, error)
+}
+
+// geocodingProvider is implemented by providers that geocode city names
+// before looking up the weather at the point, two hops per reading.
+type geocodingProvider interface {
+	geocodesCities()
 }
 
 type forecastIo struct {
-	apiKey string
+	apiKey   string
+	geocoder geocoder
+	header   http.Header
+	query    url.Values
 }
 
-func (w forecastIo) temperature(city string) (float64, error) {
-	begin := time.Now()
+func (w forecastIo) name() string { return "forecastIo" }
 
-	locationResp, err := http.Get("https://maps.googleapis.com/maps/api/geocode/json?address=" + city)
-	if err != nil {
-		return 0, err
-	}
-	defer locationResp.Body.Close()
+func (w forecastIo) origins() []string { return []string{"https://api.forecast.io"} }
 
-	var location struct {
-		Results []struct {
-			Geometry struct {
-				Location struct {
-					Latitude  float64 `json:"lat"`
-					Longitude float64 `json:"lng"`
-				} `json:"location"`
-			} `json:"geometry"`
-		} `json:"results"`
-	}
+func (w forecastIo) geocodesCities() {}
 
-	if err := json.NewDecoder(locationResp.Body).Decode(&location); err != nil {
-		return 0, err
-	}
+func (w forecastIo) temperature(ctx context.Context, city string) (reading, error) {
+	begin := time.Now()
 
-	latitude, longitude := strconv.FormatFloat(location.Results[0].Geometry.Location.Latitude, 'f', -1, 64), strconv.FormatFloat(location.Results[0].Geometry.Location.Longitude, 'f', -1, 64)
-	resp, err := http.Get("https://api.forecast.io/forecast/" + w.apiKey + "/" + latitude + "," + longitude + "?units=si")
+	location, err := w.geocoder.geocode(ctx, city)
 	if err != nil {
-		return 0, err
+		return reading{}, err
 	}
 
-	defer resp.Body.Close()
+	r, err := w.temperatureAt(ctx, location)
+	if err != nil {
+		return reading{}, err
+	}
+	logReading(ctx, "forecast.io: %s: %.2f; took %s", city, r.celsius, time.Since(begin).String())
+	return r, nil
+}
 
+func (w forecastIo) temperatureAt(ctx context.Context, p point) (reading, error) {
 	var d struct {
 		Currently struct {
-			Temperature float64 `json:"temperature"`
+			Temperature         float64  `json:"temperature"`
+			ApparentTemperature *float64 `json:"apparentTemperature"`
+			Summary             string   `json:"summary"`
+			Icon                string   `json:"icon"`
+			WindSpeed           *float64 `json:"windSpeed"`
+			WindBearing         *float64 `json:"windBearing"`
+			Pressure            *float64 `json:"pressure"`
+			UVIndex             *float64 `json:"uvIndex"`
+			PrecipProbability   *float64 `json:"precipProbability"`
+			CloudCover          *float64 `json:"cloudCover"` // 0 to 1
 		} `json:"currently"`
 	}
 
-	if err := json.NewDecoder(resp.Body).Decode(&d); err != nil {
-		return 0, err
+	if err := getJSONWith(ctx, "https://api.forecast.io/forecast/"+w.apiKey+"/"+p.String()+"?units=si", w.header, w.query, &d); err != nil {
+		return reading{}, fmt.Errorf("forecastIo: weather fetch failed: %w", err)
 	}
 
-	kelvin := d.Currently.Temperature + 273.15
-	log.Printf("forecast.io: %s: %.2f; took %s", city, kelvin, time.Since(begin).String())
-	return kelvin, nil
+	c := d.Currently
+	r := reading{celsius: c.Temperature, native: nativeTemp{c.Temperature, celsius}, condition: c.Summary, icon: darkSkyIcon(c.Icon), feelsLike: c.ApparentTemperature, windSpeed: c.WindSpeed, windBearing: c.WindBearing, pressure: c.Pressure, uvIndex: c.UVIndex, precipProbability: c.PrecipProbability}
+	if c.CloudCover != nil {
+		cover := *c.CloudCover * 100
+		r.cloudCover = &cover
+	}
+	return r, nil
 }
 
-type multiWeatherProvider []weatherProvider
-
-func (w multiWeatherProvider) temperature(city string) (float64, error) {
-	temps := make(chan float64, len(w))
-	errs := make(chan error, len(w))
-
-	for _, provider := range w {
-		go func(p weatherProvider) {
-			k, err := p.temperature(city)
-			if err != nil {
-				errs <- err
-				return
-			}
-			temps <- k
-		}(provider)
+// withPathPrefix strips prefix, e.g. "/api/gollo", from request paths
+// before next routes them, and answers 404 for paths outside it. An empty
+// prefix leaves paths alone.
+func withPathPrefix(next http.Handler, prefix string) http.Handler {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return next
 	}
-
-	sum := 0.0
-
-	for i := 0; i < len(w); i++ {
-		select {
-		case temp := <-temps:
-			sum += temp
-		case err := <-errs:
-			return 0, err
-		case <-time.After(time.Millisecond * 1500):
-			log.Printf("%s timed out", w)
+	prefix = "/" + prefix
+	strip := http.StripPrefix(prefix, next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// "/api/gollox" shares the prefix's bytes but isn't under it.
+		if r.URL.Path != prefix && !strings.HasPrefix(r.URL.Path, prefix+"/") {
+			http.NotFound(w, r)
+			return
 		}
-	}
+		strip.ServeHTTP(w, r)
+	})
+}
 
-	return sum / float64(len(w)), nil
+// newHTTPServer serves handler on :8080 with conf's header limit and
+// timeouts, so slow clients cannot hold connections open indefinitely.
+func newHTTPServer(conf config, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              ":8080",
+		Handler:           handler,
+		MaxHeaderBytes:    conf.Limits.MaxHeaderBytes,
+		ReadHeaderTimeout: conf.Server.ReadHeaderTimeout.Duration,
+		ReadTimeout:       conf.Server.ReadTimeout.Duration,
+		WriteTimeout:      conf.Server.WriteTimeout.Duration,
+		IdleTimeout:       conf.Server.IdleTimeout.Duration,
+	}
 }
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeProvider answers every city with the same reading, or err, after
+// delay, counting its calls.
+type fakeProvider struct {
+	label   string
+	reading reading
+	err     error
+	delay   time.Duration
+	calls   atomic.Int32
+}
+
+func (p *fakeProvider) name() string { return p.label }
+
+func (p *fakeProvider) temperature(ctx context.Context, city string) (reading, error) {
+	p.calls.Add(1)
+	if p.delay > 0 {
+		t := time.NewTimer(p.delay)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return reading{}, ctx.Err()
+		}
+	}
+	if p.err != nil {
+		return reading{}, p.err
+	}
+	r := p.reading
+	r.provider = p.label
+	return r, nil
+}
+
+// pointProvider is a fakeProvider that also answers for coordinates,
+// noting the last it was asked about.
+type pointProvider struct {
+	*fakeProvider
+	mu   sync.Mutex
+	last point
+}
+
+func (p *pointProvider) temperatureAt(ctx context.Context, pt point) (reading, error) {
+	p.mu.Lock()
+	p.last = pt
+	p.mu.Unlock()
+	return p.temperature(ctx, pt.String())
+}
+
+// stubGeocoder places the cities in points, and names any point name, or
+// fails with err, counting its calls.
+type stubGeocoder struct {
+	points map[string]point
+	name   string
+	err    error
+	calls  atomic.Int32
+}
+
+func (g *stubGeocoder) geocode(ctx context.Context, city string) (point, error) {
+	g.calls.Add(1)
+	if g.err != nil {
+		return point{}, geocodeError{city, g.err}
+	}
+	p, ok := g.points[city]
+	if !ok {
+		return point{}, geocodeError{city, errNoResults}
+	}
+	return p, nil
+}
+
+func (g *stubGeocoder) reverseGeocode(ctx context.Context, p point) (string, error) {
+	g.calls.Add(1)
+	if g.err != nil {
+		return "", g.err
+	}
+	return g.name, nil
+}
+
+// ptr returns a pointer to v, for readings' optional fields.
+func ptr[T any](v T) *T { return &v }
+
+func newFake(label string, celsius float64) *fakeProvider {
+	return &fakeProvider{label: label, reading: reading{celsius: celsius}}
+}
+
+// newTestServer is a server over providers with the defaults main would
+// give it: Celsius, a minute's caching and the mean.
+func newTestServer(providers ...weatherProvider) *server {
+	return &server{
+		defaultUnit:  celsius,
+		cache:        newMemoryCache(0),
+		trends:       newTrendStore(),
+		metrics:      newServerMetrics(newRegistry(), nil),
+		cacheTTL:     time.Minute,
+		mw:           newTestMW(providers...),
+		pool:         newWorkerPool(0, 0),
+		maxBodyBytes: 1 << 20,
+	}
+}
+
+// newTestMW averages providers, as getMultiWeatherProvider would by
+// default.
+func newTestMW(providers ...weatherProvider) multiWeatherProvider {
+	return multiWeatherProvider{
+		providers:   providers,
+		minCelsius:  -90,
+		maxCelsius:  60,
+		aggregation: meanAggregation,
+	}
+}
+
+// get serves a GET of target with h.
+func get(h http.HandlerFunc, target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", target, nil))
+	return w
+}
+
+// post serves a POST of body to target with h.
+func post(h http.HandlerFunc, target, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("POST", target, strings.NewReader(body)))
+	return w
+}
+
+// stubUpstream points upstreamClient at h for the rest of the test. Every
+// upstream request reaches h, with its original Host, whatever its URL.
+func stubUpstream(t *testing.T, h http.Handler) {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	old := upstreamClient
+	upstreamClient = &http.Client{Transport: redirectTransport{srv.URL[len("http://"):]}}
+	t.Cleanup(func() {
+		upstreamClient = old
+		srv.Close()
+	})
+}
+
+type redirectTransport struct{ addr string }
+
+func (rt redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Host = req.URL.Host
+	req.URL.Scheme, req.URL.Host = "http", rt.addr
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// decode decodes w's JSON body into a map.
+func decode(t *testing.T, w *httptest.ResponseRecorder) map[string]interface{} {
+	t.Helper()
+	var body map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decoding %q: %s", w.Body, err)
+	}
+	return body
+}
+
+// near reports whether got is within 1e-9 of want.
+func near(got, want float64) bool {
+	return math.Abs(got-want) < 1e-9
+}
+
+// number is body[key] as a float64, failing the test otherwise.
+func number(t *testing.T, body map[string]interface{}, key string) float64 {
+	t.Helper()
+	v, ok := body[key].(float64)
+	if !ok {
+		t.Fatalf("%s is %v, not a number, in %v", key, body[key], body)
+	}
+	return v
+}
+
+func TestProvidersFeelsLike(t *testing.T) {
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Host {
+		case "api.openweathermap.org":
+			w.Write([]byte(`{"name":"London","main":{"temp":10,"feels_like":7.5}}`))
+		case "api.forecast.io":
+			w.Write([]byte(`{"currently":{"temperature":11,"apparentTemperature":8.5}}`))
+		}
+	}))
+	for _, p := range []interface {
+		weatherProvider
+		coordinateProvider
+	}{openWeatherMap{}, forecastIo{}} {
+		r, err := p.temperatureAt(context.Background(), point{51.5, -0.12})
+		if err != nil {
+			t.Fatalf("%s: %s", p.name(), err)
+		}
+		if r.feelsLike == nil || *r.feelsLike != r.celsius-2.5 {
+			t.Errorf("%s: feels like %v, want %v", p.name(), r.feelsLike, r.celsius-2.5)
+		}
+	}
+}
+
+func TestOpenWeatherMapStations(t *testing.T) {
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/data/2.5/find" || r.URL.Query().Get("cnt") != "3" || r.URL.Query().Get("q") != "London" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"list":[
+			{"name":"City of London","main":{"temp":10},"weather":[{"main":"Rain"}]},
+			{"name":"Camden","main":{"temp":11},"weather":[{"main":"Clouds"}]},
+			{"name":"Islington","main":{"temp":12},"weather":[{"main":"Rain"}]}]}`))
+	}))
+	s := newTestServer(openWeatherMap{stations: 3})
+
+	w := get(s.handleWeather, "/weather/London?detail=true")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	body := decode(t, w)
+	if got := number(t, body, "temp"); got != 11 {
+		t.Errorf("temp %v, want the stations' mean, 11", got)
+	}
+	if body["condition"] != "rain" {
+		t.Errorf("condition %v, want the stations' majority, rain", body["condition"])
+	}
+	providers := body["providers"].([]interface{})
+	stations, _ := providers[0].(map[string]interface{})["stations"].([]interface{})
+	if len(stations) != 3 {
+		t.Fatalf("stations %v, want 3", stations)
+	}
+	for i, want := range []string{"City of London", "Camden", "Islington"} {
+		st := stations[i].(map[string]interface{})
+		if st["provider"] != want || st["temp"] != float64(10+i) {
+			t.Errorf("station %d is %v, want %s at %d", i, st, want, 10+i)
+		}
+	}
+}
+
+// logBuffer is a bytes.Buffer safe for goroutines still logging while a
+// test reads it.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLog sends slog's output, as JSON lines, to the returned buffer for
+// the rest of the test.
+func captureLog(t *testing.T) *logBuffer {
+	buf := new(logBuffer)
+	old := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(old) })
+	return buf
+}
+
+func TestOpenWeatherMapSunriseSunset(t *testing.T) {
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"name":"London","main":{"temp":10},"timezone":3600,
+			"sys":{"country":"GB","sunrise":1700000000,"sunset":1700030000}}`))
+	}))
+	s := newTestServer(openWeatherMap{})
+
+	body := decode(t, get(s.handleWeather, "/weather/London"))
+	if body["sunrise"] != "2023-11-14T23:13:20+01:00" || body["sunset"] != "2023-11-15T07:33:20+01:00" {
+		t.Errorf("sunrise %v, sunset %v; want the location's local times", body["sunrise"], body["sunset"])
+	}
+
+	body = decode(t, get(s.handleWeather, "/weather/London?tz=UTC"))
+	if body["sunrise"] != "2023-11-14T22:13:20Z" || body["sunset"] != "2023-11-15T06:33:20Z" {
+		t.Errorf("?tz=UTC: sunrise %v, sunset %v", body["sunrise"], body["sunset"])
+	}
+}
+
+func TestOpenWeatherMapNoSunriseSunset(t *testing.T) {
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"name":"Longyearbyen","main":{"temp":-10},"sys":{"country":"SJ"}}`))
+	}))
+	body := decode(t, get(newTestServer(openWeatherMap{}).handleWeather, "/weather/Longyearbyen"))
+	if _, ok := body["sunrise"]; ok {
+		t.Errorf("sunrise %v without one from the provider", body["sunrise"])
+	}
+}
+
+func TestTimestamp(t *testing.T) {
+	at := time.Unix(1700000000, 0)
+	for _, tt := range []struct {
+		t    time.Time
+		zone *time.Location
+		want string
+	}{
+		{at.UTC(), nil, "2023-11-14T22:13:20Z"},
+		{at.In(time.FixedZone("", -5*3600)), nil, "2023-11-14T17:13:20-05:00"},
+		{at.In(time.FixedZone("", -5*3600)), time.UTC, "2023-11-14T22:13:20Z"},
+		{at.UTC(), time.FixedZone("", 5*3600+1800), "2023-11-15T03:43:20+05:30"},
+	} {
+		if got := timestamp(tt.t, tt.zone); got != tt.want {
+			t.Errorf("timestamp(%s, %v) = %s, want %s", tt.t, tt.zone, got, tt.want)
+		}
+	}
+}
+
+func TestForecastIoPrecipProbability(t *testing.T) {
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/forecast/k/51.5") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"currently":{"temperature":10,"precipProbability":0.3}}`))
+	}))
+	p := forecastIo{apiKey: "k", geocoder: &stubGeocoder{points: map[string]point{"London": {51.5, -0.12}}}}
+	r, err := p.temperature(context.Background(), "London")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.precipProbability == nil || *r.precipProbability != 0.3 {
+		t.Errorf("precipProbability %v, want 0.3", r.precipProbability)
+	}
+}
+
+func TestAggregatePrecipProbability(t *testing.T) {
+	a, b, c := newFake("a", 10), newFake("b", 10), newFake("c", 10)
+	a.reading.precipProbability, b.reading.precipProbability = ptr(0.2), ptr(0.6)
+	// c reports none, so it doesn't count as a 0% chance of rain.
+	s := newTestServer(a, b, c)
+	body := decode(t, get(s.handleWeather, "/weather/London?detail=true"))
+	if got := number(t, body, "precip_probability"); !near(got, 0.4) {
+		t.Errorf("precip_probability %v, want 0.4", got)
+	}
+	for _, p := range body["providers"].([]interface{}) {
+		d := p.(map[string]interface{})
+		if _, ok := d["precip_probability"]; ok != (d["provider"] != "c") {
+			t.Errorf("%s: precip_probability %v", d["provider"], d["precip_probability"])
+		}
+	}
+
+	s = newTestServer(newFake("c", 10))
+	if _, ok := decode(t, get(s.handleWeather, "/weather/London"))["precip_probability"]; ok {
+		t.Error("precip_probability reported without any provider's")
+	}
+}
+
+func TestCloudCover(t *testing.T) {
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Host {
+		case "api.openweathermap.org":
+			w.Write([]byte(`{"name":"London","main":{"temp":10},"clouds":{"all":40}}`))
+		case "api.forecast.io":
+			w.Write([]byte(`{"currently":{"temperature":10,"cloudCover":0.8}}`))
+		default:
+			w.Write([]byte(`{}`))
+		}
+	}))
+	owm := openWeatherMap{}
+	fio := forecastIo{apiKey: "k", geocoder: &stubGeocoder{points: map[string]point{"London": {51.5, -0.12}}}}
+	for _, tt := range []struct {
+		p    weatherProvider
+		want float64
+	}{{owm, 40}, {fio, 80}} {
+		r, err := tt.p.temperature(context.Background(), "London")
+		if err != nil {
+			t.Fatalf("%s: %s", tt.p.name(), err)
+		}
+		if r.cloudCover == nil || !near(*r.cloudCover, tt.want) {
+			t.Errorf("%s: cloud cover %v, want %v%%", tt.p.name(), r.cloudCover, tt.want)
+		}
+	}
+
+	// A provider without cloud cover doesn't count as a clear sky.
+	s := newTestServer(owm, fio, newFake("noClouds", 10))
+	if got := number(t, decode(t, get(s.handleWeather, "/weather/London")), "cloud_cover"); !near(got, 60) {
+		t.Errorf("cloud_cover %v, want 60", got)
+	}
+	s = newTestServer(newFake("noClouds", 10))
+	if _, ok := decode(t, get(s.handleWeather, "/weather/London"))["cloud_cover"]; ok {
+		t.Error("cloud_cover reported without any provider's")
+	}
+}
+
+func TestPathPrefix(t *testing.T) {
+	s := newTestServer(newFake("fake", 10))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/weather/", s.handleWeather)
+	mux.HandleFunc("/livez", func(w http.ResponseWriter, r *http.Request) {})
+	serve := func(h http.Handler, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	// No prefix: paths route as they are.
+	if w := serve(withPathPrefix(mux, ""), "/weather/London"); w.Code != http.StatusOK || decode(t, w)["city"] != "London" {
+		t.Errorf("default: status %d: %s", w.Code, w.Body)
+	}
+
+	for _, prefix := range []string{"/api/gollo", "api/gollo/"} {
+		h := withPathPrefix(mux, prefix)
+		w := serve(h, "/api/gollo/weather/London")
+		if w.Code != http.StatusOK || decode(t, w)["city"] != "London" {
+			t.Errorf("%q: status %d: %s", prefix, w.Code, w.Body)
+		}
+		if w := serve(h, "/api/gollo/livez"); w.Code != http.StatusOK {
+			t.Errorf("%q: /livez status %d", prefix, w.Code)
+		}
+		for _, outside := range []string{"/weather/London", "/api/golloweather/London", "/api/gollox/weather/London"} {
+			if w := serve(h, outside); w.Code != http.StatusNotFound {
+				t.Errorf("%q: %s: status %d, want 404", prefix, outside, w.Code)
+			}
+		}
+	}
+}
+
+func TestOpenWeatherMapPlace(t *testing.T) {
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"name":"London","main":{"temp":10},"sys":{"country":"CA"}}`))
+	}))
+	if body := decode(t, get(newTestServer(openWeatherMap{}).handleWeather, "/weather/London")); body["place"] != "London, CA" {
+		t.Errorf("place %v, want OpenWeatherMap's name and country", body["place"])
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+// method describes how w combines readings, for detail responses to
+// explain their number: the aggregation, which readings it leaves out and
+// how the rest are weighted.
+func (w multiWeatherProvider) method() map[string]interface{} {
+	m := map[string]interface{}{
+		"aggregation": string(w.aggregation),
+		"plausible":   map[string]interface{}{"min_celsius": w.minCelsius, "max_celsius": w.maxCelsius},
+	}
+	// Registered aggregators may drop or weight readings however they
+	// like, so only the built-in ones are described.
+	switch w.aggregation {
+	case meanAggregation:
+		m["outliers"], m["weighting"] = "none", w.weights.scheme()
+	case trimmedAggregation:
+		m["outliers"], m["weighting"] = "trimmed", w.weights.scheme()
+	case freshAggregation:
+		m["outliers"], m["weighting"] = "none", w.weights.scheme()
+		m["fresh_half_life"] = freshHalfLife.String()
+	case firstAggregation:
+		m["outliers"], m["weighting"] = "none", "none"
+	}
+	if w.tier != noTier {
+		m["min_tier"] = w.tier.String()
+	}
+	if w.requireFresh > 0 {
+		m["require_fresh"] = w.requireFresh.String()
+	}
+	if w.consensusWithin > 0 && w.aggregation != firstAggregation {
+		m["consensus"] = map[string]interface{}{"within_celsius": w.consensusWithin, "min": w.consensusMin}
+	}
+	if w.altitude != nil {
+		m["altitude_lapse_rate"] = w.altitude.lapseRate
+	}
+	return m
+}
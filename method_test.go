@@ -0,0 +1,97 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMethod(t *testing.T) {
+	plain := newTestMW(newFake("a", 10))
+	plain.minCelsius, plain.maxCelsius = -90, 60
+
+	mean := plain.method()
+	if mean["aggregation"] != "mean" || mean["outliers"] != "none" || mean["weighting"] != "equal" {
+		t.Errorf("mean described as %v", mean)
+	}
+	if want := map[string]interface{}{"min_celsius": -90.0, "max_celsius": 60.0}; !reflect.DeepEqual(mean["plausible"], want) {
+		t.Errorf("plausible %v, want %v", mean["plausible"], want)
+	}
+	for _, k := range []string{"consensus", "require_fresh", "altitude_lapse_rate"} {
+		if _, ok := mean[k]; ok {
+			t.Errorf("%s in %v, though not configured", k, mean)
+		}
+	}
+
+	trimmed := plain
+	trimmed.aggregation, trimmed.weights = trimmedAggregation, &providerWeights{decay: 0.5}
+	trimmed.consensusWithin, trimmed.consensusMin = 2, 3
+	trimmed.requireFresh = time.Hour
+	trimmed.altitude = &altitudeNormalizer{lapseRate: 6.5}
+	m := trimmed.method()
+	if m["outliers"] != "trimmed" || m["weighting"] != "adaptive" || m["require_fresh"] != "1h0m0s" || m["altitude_lapse_rate"] != 6.5 {
+		t.Errorf("trimmed described as %v", m)
+	}
+	if want := map[string]interface{}{"within_celsius": 2.0, "min": 3}; !reflect.DeepEqual(m["consensus"], want) {
+		t.Errorf("consensus %v, want %v", m["consensus"], want)
+	}
+
+	fresh := plain
+	fresh.aggregation = freshAggregation
+	if m := fresh.method(); m["outliers"] != "none" || m["weighting"] != "equal" || m["fresh_half_life"] != "10m0s" {
+		t.Errorf("fresh described as %v", m)
+	}
+	if _, ok := mean["fresh_half_life"]; ok {
+		t.Errorf("fresh_half_life in %v", mean)
+	}
+
+	// first takes one reading, so weighs nothing and checks no consensus.
+	first := trimmed
+	first.aggregation = firstAggregation
+	m = first.method()
+	if m["weighting"] != "none" || m["consensus"] != nil {
+		t.Errorf("first described as %v", m)
+	}
+
+	// Registered aggregators are only named.
+	custom := plain
+	custom.aggregation = "custom"
+	if m := custom.method(); m["aggregation"] != "custom" || m["outliers"] != nil || m["weighting"] != nil {
+		t.Errorf("custom described as %v", m)
+	}
+}
+
+func TestWeightsScheme(t *testing.T) {
+	for _, tt := range []struct {
+		pw   *providerWeights
+		want string
+	}{
+		{nil, "equal"},
+		{&providerWeights{base: map[string]float64{"a": 2}}, "configured"},
+		{&providerWeights{decay: 0.5, recovery: 0.1}, "adaptive"},
+	} {
+		if got := tt.pw.scheme(); got != tt.want {
+			t.Errorf("%+v: scheme %s, want %s", tt.pw, got, tt.want)
+		}
+	}
+}
+
+func TestMethodResponse(t *testing.T) {
+	s := newTestServer(newFake("a", 10), newFake("b", 20), newFake("c", 30))
+	if _, ok := decode(t, get(s.handleWeather, "/weather/London?detail=true"))["method"]; ok {
+		t.Error("method reported with the option off")
+	}
+
+	s.method = true
+	if _, ok := decode(t, get(s.handleWeather, "/weather/London"))["method"]; ok {
+		t.Error("method reported without ?detail=true")
+	}
+	method, _ := decode(t, get(s.handleWeather, "/weather/London?detail=true&agg=trimmed"))["method"].(map[string]interface{})
+	if method["aggregation"] != "trimmed" || method["outliers"] != "trimmed" {
+		t.Errorf("method %v, want ?agg=trimmed described", method)
+	}
+	method, _ = decode(t, get(s.handleWeather, "/weather/London?detail=true"))["method"].(map[string]interface{})
+	if method["aggregation"] != "mean" {
+		t.Errorf("method %v, want the configured mean", method)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// registry holds metrics and serves them in the Prometheus text exposition
+// format.
+type registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+type metric interface {
+	writeTo(w io.Writer)
+}
+
+func newRegistry() *registry {
+	return &registry{}
+}
+
+func (reg *registry) register(m metric) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.metrics = append(reg.metrics, m)
+}
+
+func (reg *registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range reg.metrics {
+		m.writeTo(w)
+	}
+}
+
+// counterVec is a family of counters partitioned by label values.
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]float64 // keyed by formatted label set
+}
+
+func (reg *registry) counterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	reg.register(c)
+	return c
+}
+
+// inc adds one to the counter for the given label values, in the order the
+// labels were declared.
+func (c *counterVec) inc(values ...string) {
+	c.add(1, values...)
+}
+
+func (c *counterVec) add(v float64, values ...string) {
+	if c == nil {
+		return
+	}
+	key := labelSet(c.labels, values)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[key] += v
+}
+
+// value returns the current count for the given label values.
+func (c *counterVec) value(values ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[labelSet(c.labels, values)]
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %g\n", c.name, k, c.values[k])
+	}
+}
+
+// histogram counts observations into cumulative buckets.
+type histogram struct {
+	name, help string
+	bounds     []float64 // upper bounds, ascending; +Inf is implicit
+
+	mu     sync.Mutex
+	counts []uint64 // per bound, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func (reg *registry) histogram(name, help string, bounds []float64) *histogram {
+	bounds = append([]float64(nil), bounds...)
+	sort.Float64s(bounds)
+	h := &histogram{name: name, help: help, bounds: bounds, counts: make([]uint64, len(bounds))}
+	reg.register(h)
+	return h
+}
+
+func (h *histogram) observe(v float64) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if i := sort.SearchFloat64s(h.bounds, v); i < len(h.bounds) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += v
+}
+
+func (h *histogram) writeTo(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	var cumulative uint64
+	for i, b := range h.bounds {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", h.name, b, cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n%s_count %d\n", h.name, h.sum, h.name, h.count)
+}
+
+// summaryVec reports quantiles of a rolling window of observations per
+// label set: the last window of them, so old behaviour ages out.
+type summaryVec struct {
+	name, help string
+	labels     []string
+	quantiles  []float64
+	window     int
+
+	mu     sync.Mutex
+	series map[string]*summarySeries // keyed by formatted label set
+}
+
+type summarySeries struct {
+	ring  []float64 // the last window observations, oldest overwritten
+	next  int
+	count uint64
+	sum   float64
+}
+
+func (reg *registry) summaryVec(name, help string, quantiles []float64, window int, labels ...string) *summaryVec {
+	s := &summaryVec{name: name, help: help, labels: labels, quantiles: quantiles, window: window, series: make(map[string]*summarySeries)}
+	reg.register(s)
+	return s
+}
+
+func (s *summaryVec) observe(v float64, values ...string) {
+	if s == nil {
+		return
+	}
+	key := labelSet(s.labels, values)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ss, ok := s.series[key]
+	if !ok {
+		ss = &summarySeries{ring: make([]float64, 0, s.window)}
+		s.series[key] = ss
+	}
+	if len(ss.ring) < s.window {
+		ss.ring = append(ss.ring, v)
+	} else {
+		ss.ring[ss.next] = v
+		ss.next = (ss.next + 1) % s.window
+	}
+	ss.count++
+	ss.sum += v
+}
+
+func (s *summaryVec) writeTo(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s summary\n", s.name, s.help, s.name)
+	keys := make([]string, 0, len(s.series))
+	for k := range s.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		ss := s.series[k]
+		sorted := sortedCopy(ss.ring)
+		inner := strings.TrimSuffix(strings.TrimPrefix(k, "{"), "}")
+		if inner != "" {
+			inner += ","
+		}
+		for _, q := range s.quantiles {
+			fmt.Fprintf(w, "%s{%squantile=\"%g\"} %g\n", s.name, inner, q, nearestRank(sorted, q))
+		}
+		fmt.Fprintf(w, "%s_sum%s %g\n%s_count%s %d\n", s.name, k, ss.sum, s.name, k, ss.count)
+	}
+}
+
+func sortedCopy(vs []float64) []float64 {
+	sorted := append([]float64(nil), vs...)
+	sort.Float64s(sorted)
+	return sorted
+}
+
+// nearestRank is the q-quantile of sorted, which must not be empty.
+func nearestRank(sorted []float64, q float64) float64 {
+	i := int(math.Ceil(q*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+func labelSet(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, n := range names {
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		pairs[i] = fmt.Sprintf("%s=%q", n, v)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
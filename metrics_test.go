@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sample is the value of the series named exactly series in out, or NaN.
+func sample(out, series string) float64 {
+	for _, line := range strings.Split(out, "\n") {
+		if v, ok := strings.CutPrefix(line, series+" "); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				return f
+			}
+		}
+	}
+	return math.NaN()
+}
+
+// scrape is reg's /metrics output.
+func scrape(reg *registry) string {
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	return w.Body.String()
+}
+
+func TestSummaryQuantiles(t *testing.T) {
+	reg := newRegistry()
+	s := reg.summaryVec("latency_seconds", "Latency.", []float64{0.5, 0.95, 0.99}, 1000, "provider")
+
+	// 1ms to 1000ms, shuffled and observed concurrently.
+	values := rand.Perm(1000)
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for _, v := range values[w*250 : (w+1)*250] {
+				s.observe(float64(v+1)/1000, "a")
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	out := scrape(reg)
+	for _, line := range []string{
+		`# TYPE latency_seconds summary`,
+		`latency_seconds{provider="a",quantile="0.5"} 0.5`,
+		`latency_seconds{provider="a",quantile="0.95"} 0.95`,
+		`latency_seconds{provider="a",quantile="0.99"} 0.99`,
+		`latency_seconds_count{provider="a"} 1000`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("/metrics lacks %s:\n%s", line, out)
+		}
+	}
+	if got := sample(out, `latency_seconds_sum{provider="a"}`); !near(got, 500.5) {
+		t.Errorf("sum %v, want 500.5", got)
+	}
+}
+
+func TestSummaryWindow(t *testing.T) {
+	reg := newRegistry()
+	s := reg.summaryVec("latency_seconds", "Latency.", []float64{0.5, 0.99}, 100, "provider")
+	for i := 0; i < 100; i++ {
+		s.observe(1, "slow")
+		s.observe(0.1, "fast")
+	}
+	// A recovered provider's old calls age out of the quantiles, but not
+	// of the sum and count.
+	for i := 0; i < 100; i++ {
+		s.observe(0.2, "slow")
+	}
+	out := scrape(reg)
+	for _, line := range []string{
+		`latency_seconds{provider="slow",quantile="0.99"} 0.2`,
+		`latency_seconds_count{provider="slow"} 200`,
+		`latency_seconds{provider="fast",quantile="0.5"} 0.1`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("/metrics lacks %s:\n%s", line, out)
+		}
+	}
+	if got := sample(out, `latency_seconds_sum{provider="slow"}`); !near(got, 120) {
+		t.Errorf("sum %v, want 120 over every call", got)
+	}
+
+	var none *summaryVec
+	none.observe(1, "a") // a nil summary records nothing, without panicking
+}
+
+func TestNearestRank(t *testing.T) {
+	sorted := []float64{1, 2, 3, 4}
+	for q, want := range map[float64]float64{0: 1, 0.25: 1, 0.5: 2, 0.51: 3, 0.99: 4, 1: 4} {
+		if got := nearestRank(sorted, q); got != want {
+			t.Errorf("nearestRank(%v) = %v, want %v", q, got, want)
+		}
+	}
+}
+
+func TestProviderLatencyMetric(t *testing.T) {
+	reg := newRegistry()
+	slow, cancelled := newFake("slow", 10), newFake("cancelled", 10)
+	slow.delay = 20 * time.Millisecond
+	mw := newTestMW(slow)
+	mw.latency = newServerMetrics(reg, nil).latency
+	if _, err := mw.aggregate(context.Background(), "London"); err != nil {
+		t.Fatal(err)
+	}
+	// Calls cut short by the request don't count.
+	cancelled.delay = time.Second
+	mw.providers = []weatherProvider{cancelled}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	mw.aggregate(ctx, "London")
+
+	out := scrape(reg)
+	if !strings.Contains(out, `gollo_provider_latency_seconds_count{provider="slow"} 1`) {
+		t.Errorf("/metrics lacks slow's call:\n%s", out)
+	}
+	if strings.Contains(out, `provider="cancelled"`) {
+		t.Errorf("/metrics counts a cancelled call:\n%s", out)
+	}
+}
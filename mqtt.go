@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mqttProvider reads sensors that publish retained readings to an MQTT
+// broker, one topic per city. A payload is either a bare number of degrees
+// Celsius or the localfile shape:
+//
+//	{"celsius": 11.5, "observed": "2016-01-02T15:04:05Z"}
+//
+// Each lookup subscribes just long enough to receive the topic's retained
+// message. With maxAge set, readings must carry an observation time within
+// it, since MQTT itself doesn't say how old a retained message is.
+type mqttProvider struct {
+	broker  string // tcp://host:port
+	topics  map[string]string
+	maxAge  time.Duration
+	timeout time.Duration
+}
+
+// mqttTimeout is how long a lookup waits for the broker by default. It is
+// well inside fanOut's 1500ms deadline, so a topic with nothing retained
+// fails as such rather than as a timed-out provider.
+const mqttTimeout = time.Second
+
+// errNoRetained is a topic with no retained message for the lookup to read.
+var errNoRetained = errors.New("no retained message")
+
+func newMQTTProvider(pc providerConfig, env providerEnv) (weatherProvider, error) {
+	if pc.Broker == "" {
+		return nil, errors.New("mqtt: broker is required")
+	}
+	if len(pc.Topics) == 0 {
+		return nil, errors.New("mqtt: topics are required")
+	}
+	broker := strings.TrimPrefix(pc.Broker, "tcp://")
+	if _, _, err := net.SplitHostPort(broker); err != nil {
+		broker = net.JoinHostPort(broker, "1883")
+	}
+	topics := make(map[string]string, len(pc.Topics))
+	for city, topic := range pc.Topics {
+		topics[strings.ToLower(city)] = topic
+	}
+	timeout := pc.Timeout.Duration
+	if timeout == 0 {
+		timeout = mqttTimeout
+	}
+	return mqttProvider{broker: "tcp://" + broker, topics: topics, maxAge: pc.MaxAge.Duration, timeout: timeout}, nil
+}
+
+func (w mqttProvider) name() string { return "mqtt" }
+
+func (w mqttProvider) temperature(ctx context.Context, city string) (reading, error) {
+	topic, ok := w.topics[strings.ToLower(city)]
+	if !ok {
+		return reading{}, fmt.Errorf("mqtt: no topic for %q", city)
+	}
+	ctx, cancel := context.WithTimeout(ctx, w.timeout)
+	defer cancel()
+
+	payload, err := w.retained(ctx, topic)
+	if err != nil {
+		return reading{}, fmt.Errorf("mqtt: %s: %w", topic, err)
+	}
+
+	var s struct {
+		Celsius  *float64  `json:"celsius"`
+		Observed time.Time `json:"observed"`
+	}
+	if c, err := strconv.ParseFloat(strings.TrimSpace(string(payload)), 64); err == nil {
+		s.Celsius = &c
+	} else if err := json.Unmarshal(payload, &s); err != nil {
+		return reading{}, fmt.Errorf("mqtt: %s: unreadable payload %q", topic, payload)
+	}
+	if s.Celsius == nil {
+		return reading{}, fmt.Errorf("mqtt: %s: no temperature", topic)
+	}
+	if w.maxAge > 0 && (s.Observed.IsZero() || time.Since(s.Observed) > w.maxAge) {
+		return reading{}, fmt.Errorf("mqtt: %s: no reading within the last %s", topic, w.maxAge)
+	}
+	return reading{celsius: *s.Celsius, native: nativeTemp{*s.Celsius, celsius}, observed: s.Observed}, nil
+}
+
+// retained connects to the broker with a clean session, subscribes to
+// topic and returns the retained message the broker sends in response,
+// ignoring live ones. It fails with errNoRetained if none has arrived by
+// the time ctx is done.
+func (w mqttProvider) retained(ctx context.Context, topic string) ([]byte, error) {
+	opts := paho.NewClientOptions().
+		AddBroker(w.broker).
+		SetCleanSession(true).
+		SetAutoReconnect(false).
+		SetConnectRetry(false).
+		SetConnectTimeout(w.timeout).
+		SetWriteTimeout(w.timeout)
+	client := paho.NewClient(opts)
+	if err := mqttWait(ctx, client.Connect()); err != nil {
+		return nil, err
+	}
+	defer client.Disconnect(0)
+
+	messages := make(chan []byte, 1)
+	sub := client.Subscribe(topic, 0, func(_ paho.Client, m paho.Message) {
+		if m.Retained() && m.Topic() == topic {
+			select {
+			case messages <- m.Payload():
+			default:
+			}
+		}
+	})
+	if err := mqttWait(ctx, sub); err != nil {
+		return nil, err
+	}
+	if codes := sub.(*paho.SubscribeToken).Result(); codes[topic] == 0x80 {
+		return nil, errors.New("subscription refused")
+	}
+	select {
+	case payload := <-messages:
+		return payload, nil
+	case <-ctx.Done():
+		return nil, errNoRetained
+	}
+}
+
+// mqttWait waits for t to complete, or for ctx to be done.
+func mqttWait(ctx context.Context, t paho.Token) error {
+	select {
+	case <-t.Done():
+		return t.Error()
+	case <-ctx.Done():
+		return fmt.Errorf("broker didn't answer: %w", ctx.Err())
+	}
+}
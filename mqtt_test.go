@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// stubBroker is an MQTT broker on a local port. It acknowledges a CONNECT
+// with connack's return code and answers a SUBSCRIBE with the topic's
+// retained message, if it has one.
+type stubBroker struct {
+	connack  byte
+	retained map[string]string
+	// live, if set, is published without the retain flag first.
+	live string
+	// silent brokers accept connections but never answer.
+	silent bool
+}
+
+// start serves b until the end of the test and returns its address.
+func (b stubBroker) start(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func (b stubBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		p, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		if b.silent {
+			continue
+		}
+		switch p := p.(type) {
+		case *packets.ConnectPacket:
+			ack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+			ack.ReturnCode = b.connack
+			if ack.Write(conn) != nil || b.connack != 0 {
+				return
+			}
+		case *packets.SubscribePacket:
+			ack := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			ack.MessageID, ack.ReturnCodes = p.MessageID, []byte{0}
+			ack.Write(conn)
+			topic := p.Topics[0]
+			if b.live != "" {
+				b.publish(conn, topic, b.live, false)
+			}
+			if payload, ok := b.retained[topic]; ok {
+				b.publish(conn, topic, payload, true)
+			}
+		case *packets.PingreqPacket:
+			packets.NewControlPacket(packets.Pingresp).Write(conn)
+		case *packets.DisconnectPacket:
+			return
+		}
+	}
+}
+
+func (b stubBroker) publish(conn net.Conn, topic, payload string, retain bool) {
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName, pub.Payload, pub.Retain = topic, []byte(payload), retain
+	pub.Write(conn)
+}
+
+func testMQTTProvider(t *testing.T, b stubBroker, maxAge time.Duration) weatherProvider {
+	t.Helper()
+	p, err := newMQTTProvider(providerConfig{
+		Type:    "mqtt",
+		Broker:  "tcp://" + b.start(t),
+		Topics:  map[string]string{"London": "sensors/london"},
+		MaxAge:  duration{maxAge},
+		Timeout: duration{200 * time.Millisecond},
+	}, providerEnv{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestMQTTRetained(t *testing.T) {
+	fresh := time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	for _, payload := range []string{"11.5", ` 11.5 `, `{"celsius": 11.5, "observed": "` + fresh + `"}`} {
+		b := stubBroker{retained: map[string]string{"sensors/london": payload}, live: "99"}
+		r, err := testMQTTProvider(t, b, time.Hour).temperature(context.Background(), "London")
+		if strings.HasPrefix(payload, "{") {
+			if err != nil || r.celsius != 11.5 || r.observed.IsZero() {
+				t.Errorf("%s: got %+v, %v", payload, r, err)
+			}
+		} else if err == nil {
+			t.Errorf("%s: no error, but a bare number has no observation time to check maxAge with", payload)
+		}
+
+		r, err = testMQTTProvider(t, b, 0).temperature(context.Background(), "London")
+		if err != nil || r.celsius != 11.5 || r.native != (nativeTemp{11.5, celsius}) {
+			t.Errorf("%s without maxAge: got %+v, %v; want the retained, not the live, message", payload, r, err)
+		}
+	}
+}
+
+func TestMQTTFailures(t *testing.T) {
+	stale := time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339)
+	for _, tt := range []struct {
+		name   string
+		broker stubBroker
+		want   string
+	}{
+		{"connack refused", stubBroker{connack: 5}, "not Authorized"},
+		{"no retained message", stubBroker{retained: map[string]string{"sensors/paris": "20"}, live: "20"}, "no retained message"},
+		{"silent broker", stubBroker{silent: true}, "broker didn't answer"},
+		{"stale", stubBroker{retained: map[string]string{"sensors/london": `{"celsius": 11.5, "observed": "` + stale + `"}`}}, "no reading within the last 30m0s"},
+		{"unreadable", stubBroker{retained: map[string]string{"sensors/london": "warm"}}, "unreadable payload"},
+		{"no temperature", stubBroker{retained: map[string]string{"sensors/london": `{"humidity": 80}`}}, "no temperature"},
+	} {
+		begin := time.Now()
+		_, err := testMQTTProvider(t, tt.broker, 30*time.Minute).temperature(context.Background(), "London")
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.want)
+		}
+		if took := time.Since(begin); took > time.Second {
+			t.Errorf("%s: took %s, want the 200ms timeout kept", tt.name, took)
+		}
+	}
+
+	if _, err := testMQTTProvider(t, stubBroker{}, 0).temperature(context.Background(), "Paris"); err == nil || !strings.Contains(err.Error(), "no topic") {
+		t.Errorf("unknown city: error %v", err)
+	}
+	if _, err := newMQTTProvider(providerConfig{Topics: map[string]string{"London": "x"}}, providerEnv{}); err == nil {
+		t.Error("no broker accepted")
+	}
+}
+
+func TestMQTTNoRetainedInAggregate(t *testing.T) {
+	// With the default timeout, a topic with nothing retained fails as
+	// such, inside the aggregate's deadline, rather than timing out.
+	addr := stubBroker{}.start(t)
+	p, err := newMQTTProvider(providerConfig{Type: "mqtt", Broker: addr, Topics: map[string]string{"London": "sensors/london"}}, providerEnv{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.(mqttProvider).timeout != mqttTimeout || p.(mqttProvider).broker != "tcp://"+addr {
+		t.Errorf("provider %+v, want the default timeout and a tcp:// broker", p)
+	}
+	agg, err := newTestMW(p, newFake("other", 10)).aggregate(context.Background(), "London")
+	if err == nil || !strings.Contains(err.Error(), "no retained message") {
+		t.Errorf("aggregate %v, %v; want the missing retained message", agg.celsius, err)
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// allProviders is the single circuit of the outage breaker, which opens
+// when lookups keep failing with no provider answering at all.
+const allProviders = "all providers"
+
+// outageError fails lookups while the outage breaker is open, so clients
+// get a 503 at once rather than waiting out every provider's timeout.
+type outageError struct {
+	err        error
+	retryAfter time.Duration
+}
+
+func (e outageError) Error() string {
+	return fmt.Sprintf("providers unavailable: %s; retry after %s", e.err, e.retryAfter)
+}
+
+// retryAfterSeconds is e.retryAfter for a Retry-After header, at least 1.
+func (e outageError) retryAfterSeconds() string {
+	return strconv.Itoa(max(1, int(e.retryAfter.Round(time.Second)/time.Second)))
+}
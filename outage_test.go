@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestOutageBreaker(t *testing.T) {
+	p := newFake("a", 20)
+	s := newTestServer(p)
+	s.outage = newCircuitBreaker(2, 20*time.Millisecond)
+	if w := get(s.handleWeather, "/weather/Paris"); w.Code != http.StatusOK {
+		t.Fatalf("Paris: status %d: %s", w.Code, w.Body)
+	}
+
+	p.err = errors.New("unavailable")
+	for i := 0; i < 2; i++ {
+		if w := get(s.handleWeather, "/weather/London"); w.Code != http.StatusInternalServerError {
+			t.Fatalf("lookup %d: status %d, want the provider's failure", i, w.Code)
+		}
+	}
+	w := get(s.handleWeather, "/weather/London")
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("status %d, Retry-After %q, want 503 and 1", w.Code, w.Header().Get("Retry-After"))
+	}
+	if p.calls.Load() != 3 {
+		t.Errorf("provider called %d times, want none while the breaker is open", p.calls.Load())
+	}
+	// Cached answers are still served.
+	if w := get(s.handleWeather, "/weather/Paris"); w.Code != http.StatusOK {
+		t.Errorf("cached Paris: status %d", w.Code)
+	}
+
+	p.err = nil
+	time.Sleep(30 * time.Millisecond)
+	for _, city := range []string{"London", "Berlin"} {
+		if w := get(s.handleWeather, "/weather/"+city); w.Code != http.StatusOK {
+			t.Errorf("%s after recovery: status %d: %s", city, w.Code, w.Body)
+		}
+	}
+}
+
+func TestOutageBreakerPartialFailure(t *testing.T) {
+	// A lookup providers answered isn't an outage, even if it failed.
+	s := newTestServer(newFake("a", 10), newFake("b", 30))
+	s.mw.consensusWithin = 2
+	s.outage = newCircuitBreaker(1, time.Hour)
+	for i := 0; i < 3; i++ {
+		if w := get(s.handleWeather, "/weather/London"); w.Code != http.StatusConflict {
+			t.Fatalf("lookup %d: status %d, want the consensus failure", i, w.Code)
+		}
+	}
+}
+
+func TestOutageRetryAfter(t *testing.T) {
+	for d, want := range map[time.Duration]string{
+		30 * time.Second:        "30",
+		1500 * time.Millisecond: "2",
+		10 * time.Millisecond:   "1",
+	} {
+		if got := (outageError{retryAfter: d}).retryAfterSeconds(); got != want {
+			t.Errorf("Retry-After for %s is %s, want %s", d, got, want)
+		}
+	}
+}
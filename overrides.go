@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// overrideParams are the query parameters that override the server's
+// configuration for a request, and so can be restricted.
+var overrideParams = []string{"agg", "units", "providers", "min_tier", "kelvin", "cache_only"}
+
+// withOverrides lets requests use only the override parameters in allow.
+// Others are dropped from the request before next sees it or, with
+// reject, answered with a 400.
+func withOverrides(next http.Handler, allow []string, reject bool) (http.Handler, error) {
+	if allow == nil {
+		return next, nil
+	}
+	allowed := make(map[string]bool, len(allow))
+	for _, p := range allow {
+		p = strings.ToLower(p)
+		if !slices.Contains(overrideParams, p) {
+			return nil, fmt.Errorf("overrides: unknown parameter %q, want some of %s", p, strings.Join(overrideParams, ", "))
+		}
+		allowed[p] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		var denied []string
+		for _, p := range overrideParams {
+			if _, ok := q[p]; ok && !allowed[p] {
+				denied = append(denied, p)
+			}
+		}
+		if len(denied) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if reject {
+			sort.Strings(denied)
+			writeError(w, r, "not allowed to override: "+strings.Join(denied, ", "), http.StatusBadRequest)
+			return
+		}
+		for _, p := range denied {
+			q.Del(p)
+		}
+		r = r.Clone(r.Context())
+		r.URL.RawQuery = q.Encode()
+		next.ServeHTTP(w, r)
+	}), nil
+}
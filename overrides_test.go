@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// echoQuery answers with the query the handler was given.
+var echoQuery = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(r.URL.RawQuery))
+})
+
+func TestOverrides(t *testing.T) {
+	for _, tt := range []struct {
+		allow []string
+		query string
+		want  string
+	}{
+		{nil, "agg=trimmed&units=f", "agg=trimmed&units=f"},
+		{[]string{}, "agg=trimmed&pretty=true&units=f", "pretty=true"},
+		{[]string{"Units"}, "agg=trimmed&units=f", "units=f"},
+		{[]string{"agg", "providers"}, "providers=a,b&detail=true&cache_only=true", "detail=true&providers=a%2Cb"},
+		{[]string{"units"}, "min_tier=authoritative&units=f", "units=f"},
+		{[]string{"min_tier"}, "min_tier=authoritative&units=f", "min_tier=authoritative"},
+	} {
+		h, err := withOverrides(echoQuery, tt.allow, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/weather/London?"+tt.query, nil))
+		if got := w.Body.String(); got != tt.want {
+			t.Errorf("allow %q: %s passed as %q, want %q", tt.allow, tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestOverridesReject(t *testing.T) {
+	h, err := withOverrides(echoQuery, []string{"units"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/weather/London?units=f&providers=a&agg=first", nil))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "not allowed to override: agg, providers") {
+		t.Errorf("status %d: %s, want a 400 naming agg and providers", w.Code, w.Body)
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/weather/London?units=f", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("allowed override: status %d", w.Code)
+	}
+}
+
+func TestOverridesUnknown(t *testing.T) {
+	if _, err := withOverrides(echoQuery, []string{"units", "banana"}, false); err == nil || !strings.Contains(err.Error(), `"banana"`) {
+		t.Errorf("err %v, want banana named", err)
+	}
+}
+
+func TestOverridesWeather(t *testing.T) {
+	s := newTestServer(newFake("a", 10), newFake("b", 11), newFake("c", 30))
+	h, err := withOverrides(http.HandlerFunc(s.handleWeather), []string{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/weather/London?agg=trimmed&units=c", nil))
+	if got := number(t, decode(t, w), "temp"); !near(got, 17) {
+		t.Errorf("temp %v, want the configured mean, 17, not ?agg=trimmed's", got)
+	}
+}
+
+func TestOverridesConfig(t *testing.T) {
+	// An empty list allows nothing; no list allows everything.
+	for conf, wantNil := range map[string]bool{`{}`: true, `{"overrides": {"allow": null}}`: true, `{"overrides": {"allow": []}}`: false} {
+		var c config
+		if err := json.Unmarshal([]byte(conf), &c); err != nil {
+			t.Fatal(err)
+		}
+		if (c.Overrides.Allow == nil) != wantNil {
+			t.Errorf("%s: allow %#v", conf, c.Overrides.Allow)
+		}
+	}
+}
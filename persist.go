@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// The cache is saved as JSON in these shapes, the cache's own types having
+// no exported fields. Remembered failures are left out: they are short-lived
+// and the providers may well have recovered by the next start.
+type (
+	savedEntry struct {
+		Aggregate savedAggregate `json:"aggregate"`
+		Expires   time.Time      `json:"expires"`
+		Origin    savedOrigin    `json:"origin"`
+	}
+
+	savedOrigin struct {
+		At      time.Time `json:"at"`
+		Request string    `json:"request,omitempty"`
+		TraceID string    `json:"trace_id,omitempty"`
+	}
+
+	savedAggregate struct {
+		Place             string         `json:"place,omitempty"`
+		Celsius           float64        `json:"celsius"`
+		Condition         string         `json:"condition,omitempty"`
+		FeelsLike         *float64       `json:"feels_like,omitempty"`
+		WindSpeed         *float64       `json:"wind_speed,omitempty"`
+		WindBearing       *float64       `json:"wind_bearing,omitempty"`
+		Pressure          *float64       `json:"pressure,omitempty"`
+		UVIndex           *float64       `json:"uv_index,omitempty"`
+		PrecipProbability *float64       `json:"precip_probability,omitempty"`
+		CloudCover        *float64       `json:"cloud_cover,omitempty"`
+		Icon              string         `json:"icon,omitempty"`
+		Sunrise           time.Time      `json:"sunrise"`
+		Sunset            time.Time      `json:"sunset"`
+		AsOf              time.Time      `json:"as_of"`
+		Readings          []savedReading `json:"readings"`
+		Warnings          []string       `json:"warnings,omitempty"`
+		Failures          []savedFailure `json:"failures,omitempty"`
+	}
+
+	savedFailure struct {
+		Provider string        `json:"provider"`
+		Error    string        `json:"error"`
+		Category errorCategory `json:"category"`
+		Warning  string        `json:"warning,omitempty"`
+	}
+
+	savedReading struct {
+		Provider           string         `json:"provider"`
+		Place              string         `json:"place,omitempty"`
+		Celsius            float64        `json:"celsius"`
+		Condition          string         `json:"condition,omitempty"`
+		FeelsLike          *float64       `json:"feels_like,omitempty"`
+		Observed           time.Time      `json:"observed"`
+		WindSpeed          *float64       `json:"wind_speed,omitempty"`
+		WindBearing        *float64       `json:"wind_bearing,omitempty"`
+		Pressure           *float64       `json:"pressure,omitempty"`
+		UVIndex            *float64       `json:"uv_index,omitempty"`
+		PrecipProbability  *float64       `json:"precip_probability,omitempty"`
+		CloudCover         *float64       `json:"cloud_cover,omitempty"`
+		Icon               string         `json:"icon,omitempty"`
+		Elevation          *float64       `json:"elevation,omitempty"`
+		AltitudeCorrection *float64       `json:"altitude_correction,omitempty"`
+		Sunrise            time.Time      `json:"sunrise"`
+		Sunset             time.Time      `json:"sunset"`
+		Stations           []savedReading `json:"stations,omitempty"`
+		Took               time.Duration  `json:"took"`
+		Cached             bool           `json:"cached,omitempty"`
+		Native             float64        `json:"native"`
+		NativeUnit         unit           `json:"native_unit,omitempty"`
+		Upstream           []string       `json:"upstream,omitempty"`
+		Geocoded           *savedPoint    `json:"geocoded,omitempty"`
+		Share              *float64       `json:"share,omitempty"`
+	}
+
+	savedPoint struct {
+		Lat float64 `json:"lat"`
+		Lon float64 `json:"lon"`
+	}
+)
+
+// save writes every entry that hasn't expired to path, replacing it whole
+// so that a crash part way through leaves the last save intact.
+func (c *memoryCache) save(path string) (int, error) {
+	now := time.Now()
+	saved := make(map[string]savedEntry)
+	for k, e := range c.all() {
+		if e.expired(now) {
+			continue
+		}
+		saved[k] = savedEntry{
+			Aggregate: saveAggregate(e.agg),
+			Expires:   e.expires,
+			Origin:    savedOrigin{At: e.origin.at, Request: e.origin.request, TraceID: e.origin.traceID},
+		}
+	}
+	b, err := json.Marshal(saved)
+	if err != nil {
+		return 0, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name()) // fails harmlessly once renamed
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	return len(saved), os.Rename(tmp.Name(), path)
+}
+
+// load adds the entries saved at path that are still fresh at now, and
+// returns how many it added. A missing file is not an error: there is
+// nothing to warm the cache with on the first start. Entries are added in
+// the order they were stored, so that with more saved than the cache
+// holds the most recent are kept.
+func (c *memoryCache) load(path string, now time.Time) (int, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var saved map[string]savedEntry
+	if err := json.Unmarshal(b, &saved); err != nil {
+		return 0, fmt.Errorf("%s: %s", path, err)
+	}
+	keys := make([]string, 0, len(saved))
+	for k, e := range saved {
+		if now.Before(e.Expires) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return saved[keys[i]].Origin.At.Before(saved[keys[j]].Origin.At) })
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, k := range keys {
+		e := saved[k]
+		c.put(k, cacheEntry{
+			agg:     loadAggregate(e.Aggregate),
+			expires: e.Expires,
+			origin:  cacheOrigin{at: e.Origin.At, request: e.Origin.Request, traceID: e.Origin.TraceID},
+		})
+	}
+	if c.maxEntries > 0 {
+		return min(len(keys), c.maxEntries), nil
+	}
+	return len(keys), nil
+}
+
+func saveAggregate(a aggregate) savedAggregate {
+	return savedAggregate{
+		Place:             a.place,
+		Celsius:           a.celsius,
+		Condition:         a.condition,
+		FeelsLike:         a.feelsLike,
+		WindSpeed:         a.windSpeed,
+		WindBearing:       a.windBearing,
+		Pressure:          a.pressure,
+		UVIndex:           a.uvIndex,
+		PrecipProbability: a.precipProbability,
+		CloudCover:        a.cloudCover,
+		Icon:              a.icon,
+		Sunrise:           a.sunrise,
+		Sunset:            a.sunset,
+		AsOf:              a.asOf,
+		Readings:          saveReadings(a.readings),
+		Warnings:          a.warnings,
+		Failures:          saveFailures(a.failures),
+	}
+}
+
+func loadAggregate(a savedAggregate) aggregate {
+	return aggregate{
+		place:             a.Place,
+		celsius:           a.Celsius,
+		condition:         a.Condition,
+		feelsLike:         a.FeelsLike,
+		windSpeed:         a.WindSpeed,
+		windBearing:       a.WindBearing,
+		pressure:          a.Pressure,
+		uvIndex:           a.UVIndex,
+		precipProbability: a.PrecipProbability,
+		cloudCover:        a.CloudCover,
+		icon:              a.Icon,
+		sunrise:           a.Sunrise,
+		sunset:            a.Sunset,
+		asOf:              a.AsOf,
+		readings:          loadReadings(a.Readings),
+		warnings:          a.Warnings,
+		failures:          loadFailures(a.Failures),
+	}
+}
+
+func saveReadings(rs []reading) []savedReading {
+	if rs == nil {
+		return nil
+	}
+	saved := make([]savedReading, len(rs))
+	for i, r := range rs {
+		saved[i] = savedReading{
+			Provider:           r.provider,
+			Place:              r.place,
+			Celsius:            r.celsius,
+			Condition:          r.condition,
+			FeelsLike:          r.feelsLike,
+			Observed:           r.observed,
+			WindSpeed:          r.windSpeed,
+			WindBearing:        r.windBearing,
+			Pressure:           r.pressure,
+			UVIndex:            r.uvIndex,
+			PrecipProbability:  r.precipProbability,
+			CloudCover:         r.cloudCover,
+			Icon:               r.icon,
+			Elevation:          r.elevation,
+			AltitudeCorrection: r.altitudeCorrection,
+			Sunrise:            r.sunrise,
+			Sunset:             r.sunset,
+			Stations:           saveReadings(r.stations),
+			Took:               r.took,
+			Cached:             r.cached,
+			Native:             r.native.value,
+			NativeUnit:         r.native.unit,
+			Upstream:           r.upstream,
+			Share:              r.share,
+		}
+		if r.geocoded != nil {
+			saved[i].Geocoded = &savedPoint{Lat: r.geocoded.lat, Lon: r.geocoded.lon}
+		}
+	}
+	return saved
+}
+
+func loadReadings(saved []savedReading) []reading {
+	if saved == nil {
+		return nil
+	}
+	rs := make([]reading, len(saved))
+	for i, r := range saved {
+		rs[i] = reading{
+			provider:           r.Provider,
+			place:              r.Place,
+			celsius:            r.Celsius,
+			condition:          r.Condition,
+			feelsLike:          r.FeelsLike,
+			observed:           r.Observed,
+			windSpeed:          r.WindSpeed,
+			windBearing:        r.WindBearing,
+			pressure:           r.Pressure,
+			uvIndex:            r.UVIndex,
+			precipProbability:  r.PrecipProbability,
+			cloudCover:         r.CloudCover,
+			icon:               r.Icon,
+			elevation:          r.Elevation,
+			altitudeCorrection: r.AltitudeCorrection,
+			sunrise:            r.Sunrise,
+			sunset:             r.Sunset,
+			stations:           loadReadings(r.Stations),
+			took:               r.Took,
+			cached:             r.Cached,
+			native:             nativeTemp{r.Native, r.NativeUnit},
+			upstream:           r.Upstream,
+			share:              r.Share,
+		}
+		if r.Geocoded != nil {
+			rs[i].geocoded = &point{r.Geocoded.Lat, r.Geocoded.Lon}
+		}
+	}
+	return rs
+}
+
+func saveFailures(fs []providerFailure) []savedFailure {
+	if fs == nil {
+		return nil
+	}
+	saved := make([]savedFailure, len(fs))
+	for i, f := range fs {
+		saved[i] = savedFailure{Provider: f.provider, Error: f.err, Category: f.category, Warning: f.warning}
+	}
+	return saved
+}
+
+func loadFailures(saved []savedFailure) []providerFailure {
+	if saved == nil {
+		return nil
+	}
+	fs := make([]providerFailure, len(saved))
+	for i, f := range saved {
+		fs[i] = providerFailure{provider: f.Provider, err: f.Error, category: f.Category, warning: f.Warning}
+	}
+	return fs
+}
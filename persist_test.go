@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCachePersistRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	observed := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	agg := aggregate{
+		place:     "London, GB",
+		celsius:   11,
+		feelsLike: ptr(9.5),
+		asOf:      observed,
+		readings: []reading{{
+			provider: "owm",
+			celsius:  11,
+			observed: observed,
+			native:   nativeTemp{51.8, fahrenheit},
+			stations: []reading{{provider: "Camden", celsius: 11, windSpeed: ptr(4.0)}},
+		}},
+		warnings: []string{"b timed out; excluded from the average"},
+		failures: []providerFailure{newProviderFailure("b", errTimedOut, "b timed out; excluded from the average")},
+	}
+	c := newMemoryCache(0)
+	origin := cacheOrigin{at: observed, request: "GET /weather/London from 192.0.2.1"}
+	c.set("mean:London", agg, time.Hour, origin)
+	c.setError("mean:London", errors.New("down"), time.Hour)
+	if n, err := c.save(path); err != nil || n != 1 {
+		t.Fatalf("saved %d entries: %v", n, err)
+	}
+
+	loaded := newMemoryCache(0)
+	if n, err := loaded.load(path, time.Now()); err != nil || n != 1 {
+		t.Fatalf("loaded %d entries: %v", n, err)
+	}
+	e, ok := loaded.get("mean:London")
+	if !ok {
+		t.Fatal("entry not reloaded")
+	}
+	want, _ := c.get("mean:London")
+	if !e.expires.Equal(want.expires) || e.origin != origin {
+		t.Errorf("expires %s from %+v, want the original %s from %+v", e.expires, e.origin, want.expires, origin)
+	}
+	if e.err != nil {
+		t.Errorf("remembered failure %v survived a restart", e.err)
+	}
+	got := e.agg
+	if got.place != agg.place || got.celsius != 11 || *got.feelsLike != 9.5 || !got.asOf.Equal(observed) || len(got.warnings) != 1 {
+		t.Errorf("aggregate %+v, want %+v", got, agg)
+	}
+	if len(got.failures) != 1 || got.failures[0] != agg.failures[0] {
+		t.Errorf("failures %+v, want %+v", got.failures, agg.failures)
+	}
+	r := got.readings[0]
+	if r.provider != "owm" || !r.observed.Equal(observed) || r.native != agg.readings[0].native {
+		t.Errorf("reading %+v, want %+v", r, agg.readings[0])
+	}
+	if len(r.stations) != 1 || r.stations[0].provider != "Camden" || *r.stations[0].windSpeed != 4 {
+		t.Errorf("stations %+v, want Camden with its wind", r.stations)
+	}
+}
+
+func TestCachePersistExpiry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	c := newMemoryCache(0)
+	c.set("mean:London", aggregate{celsius: 11}, time.Hour, cacheOrigin{})
+	c.set("mean:Paris", aggregate{celsius: 15}, time.Minute, cacheOrigin{})
+	c.set("mean:Berlin", aggregate{celsius: 8}, -time.Second, cacheOrigin{})
+	if n, err := c.save(path); err != nil || n != 2 {
+		t.Fatalf("saved %d entries: %v; want the two unexpired", n, err)
+	}
+
+	// Paris expired while the server was down.
+	loaded := newMemoryCache(0)
+	if n, err := loaded.load(path, time.Now().Add(10*time.Minute)); err != nil || n != 1 {
+		t.Fatalf("loaded %d entries: %v; want London alone", n, err)
+	}
+	if _, ok := loaded.get("mean:Paris"); ok {
+		t.Error("Paris reloaded past its expiry")
+	}
+	if _, ok := loaded.get("mean:London"); !ok {
+		t.Error("London not reloaded")
+	}
+}
+
+func TestCachePersistFiles(t *testing.T) {
+	dir := t.TempDir()
+	// Nothing saved yet, as on a first start.
+	if n, err := newMemoryCache(0).load(filepath.Join(dir, "missing.json"), time.Now()); n != 0 || err != nil {
+		t.Errorf("missing file: %d entries, %v; want none and no error", n, err)
+	}
+
+	corrupt := filepath.Join(dir, "corrupt.json")
+	os.WriteFile(corrupt, []byte("{not json"), 0o644)
+	if _, err := newMemoryCache(0).load(corrupt, time.Now()); err == nil {
+		t.Error("corrupt file loaded")
+	}
+
+	// A save replaces the file whole and leaves no temporary behind.
+	path := filepath.Join(dir, "cache.json")
+	c := newMemoryCache(0)
+	c.set("mean:London", aggregate{celsius: 11}, time.Hour, cacheOrigin{})
+	for i := 0; i < 2; i++ {
+		if _, err := c.save(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 2 {
+		t.Errorf("%d files in %s, want just corrupt.json and cache.json", len(entries), dir)
+	}
+}
+
+func TestCachePersistMaxEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	c := newMemoryCache(0)
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		c.set(string(rune('a'+i)), aggregate{celsius: float64(i)}, time.Hour, cacheOrigin{at: start.Add(time.Duration(i) * time.Second)})
+	}
+	if _, err := c.save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := newMemoryCache(4)
+	if n, err := loaded.load(path, time.Now()); err != nil || n != 4 {
+		t.Fatalf("loaded %d entries: %v; want the cap of 4", n, err)
+	}
+	for _, k := range []string{"g", "h", "i", "j"} {
+		if _, ok := loaded.get(k); !ok {
+			t.Errorf("%s, one of the newest, wasn't kept", k)
+		}
+	}
+	if n := len(loaded.all()); n != 4 {
+		t.Errorf("%d entries, want 4", n)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// handlePoint serves /point/<lat>,<lon> from the providers that can look up
+// coordinates. With ?reverse=true the response also names the place.
+func (s *server) handlePoint(w http.ResponseWriter, r *http.Request) {
+	begin := time.Now()
+	pt, err := parsePoint(strings.SplitN(r.URL.Path, "/", 3)[2])
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	u, err := s.requestUnit(r)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, span := s.tracer.start(r.Context(), "GET /point/")
+	defer span.finish()
+	span.setAttr("point", pt.String())
+
+	if s.cacheOnly(ctx) {
+		// Points aren't cached.
+		writeError(w, r, errNotCached.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	agg, err := s.mw.aggregateAt(ctx, pt)
+	span.setStatus(err)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := map[string]interface{}{
+		"lat":  pt.lat,
+		"lon":  pt.lon,
+		"temp": u.fromCelsius(agg.celsius),
+	}
+	if reverse, _ := strconv.ParseBool(r.URL.Query().Get("reverse")); reverse {
+		if city, err := s.geocoder.reverseGeocode(ctx, pt); err != nil {
+			agg.warnings = append(agg.warnings, "reverse geocode: "+err.Error())
+		} else {
+			resp["city"] = city
+		}
+	}
+	if len(agg.warnings) > 0 {
+		resp["warnings"] = agg.warningList(s.errorCategories)
+	}
+	s.tookFormat.set(resp, begin)
+	writeJSON(w, r, resp)
+}
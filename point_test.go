@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestHandlePoint(t *testing.T) {
+	located := &pointProvider{fakeProvider: newFake("located", 10)}
+	cityOnly := newFake("cityOnly", 30)
+	s := newTestServer(located, cityOnly)
+	s.geocoder = &stubGeocoder{name: "London"}
+
+	w := get(s.handlePoint, "/point/51.5,-0.12?reverse=true")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	body := decode(t, w)
+	if body["lat"] != 51.5 || body["lon"] != -0.12 || body["temp"] != 10.0 || body["city"] != "London" {
+		t.Errorf("got %v", body)
+	}
+	if located.last != (point{51.5, -0.12}) {
+		t.Errorf("provider asked about %v", located.last)
+	}
+	if cityOnly.calls.Load() != 0 {
+		t.Error("provider without coordinate lookups was called")
+	}
+
+	body = decode(t, get(s.handlePoint, "/point/51.5,-0.12"))
+	if _, ok := body["city"]; ok {
+		t.Errorf("city without ?reverse=true: %v", body)
+	}
+}
+
+func TestHandlePointReverseFails(t *testing.T) {
+	s := newTestServer(&pointProvider{fakeProvider: newFake("located", 10)})
+	s.geocoder = &stubGeocoder{err: errors.New("geocoder down")}
+
+	w := get(s.handlePoint, "/point/51.5,-0.12?reverse=true")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	body := decode(t, w)
+	warnings, _ := body["warnings"].([]interface{})
+	if len(warnings) != 1 || warnings[0] != "reverse geocode: geocoder down" {
+		t.Errorf("warnings %v, want the reverse geocode failure", body["warnings"])
+	}
+}
+
+func TestHandlePointInvalid(t *testing.T) {
+	s := newTestServer(&pointProvider{fakeProvider: newFake("located", 10)})
+	for _, p := range []string{"51.5", "91,0", "0,181", "north,west"} {
+		if w := get(s.handlePoint, "/point/"+p); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", p, w.Code)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// workerPool bounds concurrent lookups both in total and per client, so a
+// single client's large batch queues behind its own limit instead of taking
+// every worker. A zero limit leaves that dimension unbounded.
+type workerPool struct {
+	global    chan struct{}
+	perClient int
+
+	mu      sync.Mutex
+	clients map[string]*clientSlots
+}
+
+type clientSlots struct {
+	sem   chan struct{}
+	users int
+}
+
+func newWorkerPool(global, perClient int) *workerPool {
+	p := &workerPool{perClient: perClient, clients: make(map[string]*clientSlots)}
+	if global > 0 {
+		p.global = make(chan struct{}, global)
+	}
+	return p
+}
+
+// acquire blocks until client may start another lookup or ctx is done. The
+// client's own slot is taken before a global one, so a client waiting on its
+// limit never holds workers other clients could use.
+func (p *workerPool) acquire(ctx context.Context, client string) (release func(), err error) {
+	var slots *clientSlots
+	if p.perClient > 0 {
+		p.mu.Lock()
+		slots = p.clients[client]
+		if slots == nil {
+			slots = &clientSlots{sem: make(chan struct{}, p.perClient)}
+			p.clients[client] = slots
+		}
+		slots.users++
+		p.mu.Unlock()
+
+		select {
+		case slots.sem <- struct{}{}:
+		case <-ctx.Done():
+			p.leave(client, slots)
+			return nil, ctx.Err()
+		}
+	}
+
+	if p.global != nil {
+		select {
+		case p.global <- struct{}{}:
+		case <-ctx.Done():
+			if slots != nil {
+				<-slots.sem
+				p.leave(client, slots)
+			}
+			return nil, ctx.Err()
+		}
+	}
+
+	return func() {
+		if p.global != nil {
+			<-p.global
+		}
+		if slots != nil {
+			<-slots.sem
+			p.leave(client, slots)
+		}
+	}, nil
+}
+
+// leave forgets a client's slots once nobody is using them.
+func (p *workerPool) leave(client string, slots *clientSlots) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	slots.users--
+	if slots.users == 0 {
+		delete(p.clients, client)
+	}
+}
+
+// clientID identifies the client a request came from by its address.
+func clientID(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
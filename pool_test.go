@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// maxCounter tracks the most that were ever running at once.
+type maxCounter struct {
+	running, max atomic.Int32
+}
+
+func (c *maxCounter) enter() {
+	n := c.running.Add(1)
+	for {
+		m := c.max.Load()
+		if n <= m || c.max.CompareAndSwap(m, n) {
+			return
+		}
+	}
+}
+
+func (c *maxCounter) leave() { c.running.Add(-1) }
+
+func TestWorkerPoolCaps(t *testing.T) {
+	p := newWorkerPool(3, 2)
+	var global maxCounter
+	perClient := map[string]*maxCounter{"a": {}, "b": {}, "c": {}}
+
+	var wg sync.WaitGroup
+	for client, c := range perClient {
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				release, err := p.acquire(context.Background(), client)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				global.enter()
+				c.enter()
+				time.Sleep(2 * time.Millisecond)
+				c.leave()
+				global.leave()
+				release()
+			}()
+		}
+	}
+	wg.Wait()
+
+	if m := global.max.Load(); m > 3 || m == 0 {
+		t.Errorf("%d lookups ran at once, want at most 3", m)
+	}
+	for client, c := range perClient {
+		if m := c.max.Load(); m > 2 {
+			t.Errorf("client %s ran %d lookups at once, want at most 2", client, m)
+		}
+	}
+	if len(p.clients) != 0 {
+		t.Errorf("%d clients still tracked after finishing", len(p.clients))
+	}
+}
+
+// A client queued on its own limit doesn't hold the global slots others
+// need.
+func TestWorkerPoolFairness(t *testing.T) {
+	p := newWorkerPool(2, 1)
+	release, err := p.acquire(context.Background(), "greedy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	queued, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.acquire(queued, "greedy")
+
+	ctx, stop := context.WithTimeout(context.Background(), time.Second)
+	defer stop()
+	other, err := p.acquire(ctx, "other")
+	if err != nil {
+		t.Fatalf("other client starved behind greedy's queue: %s", err)
+	}
+	other()
+}
+
+func TestWorkerPoolCancelled(t *testing.T) {
+	p := newWorkerPool(1, 0)
+	release, _ := p.acquire(context.Background(), "a")
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := p.acquire(ctx, "b"); err == nil {
+		t.Error("acquired a slot beyond the cap")
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// hostedProvider is implemented by providers that call upstreams over
+// HTTP, to name them for preconnect: the scheme and host of each, such as
+// "https://api.forecast.io".
+type hostedProvider interface {
+	origins() []string
+}
+
+// providerOrigins lists the upstreams of every provider in providers,
+// once each.
+func providerOrigins(providers []weatherProvider) []string {
+	seen := make(map[string]bool)
+	var origins []string
+	for _, p := range providers {
+		h, ok := capability[hostedProvider](p)
+		if !ok {
+			continue
+		}
+		for _, o := range h.origins() {
+			if !seen[o] {
+				seen[o] = true
+				origins = append(origins, o)
+			}
+		}
+	}
+	return origins
+}
+
+// preconnect opens a connection to each of origins through upstreamClient
+// and leaves it idle in the client's pool, so a provider's first real
+// request doesn't pay for DNS, TCP and TLS. Any response will do: a HEAD
+// of / is made and whatever comes back discarded. Failures are only
+// logged; the provider's requests will connect for themselves.
+func preconnect(ctx context.Context, origins []string) {
+	var wg sync.WaitGroup
+	for _, o := range origins {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, err := http.NewRequestWithContext(ctx, http.MethodHead, o+"/", nil)
+			if err != nil {
+				slog.Warn("preconnect failed", "origin", o, "err", err)
+				return
+			}
+			resp, err := upstreamClient.Do(req)
+			if err != nil {
+				slog.Warn("preconnect failed", "origin", o, "err", err)
+				return
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+}
+
+// keepConnected preconnects to origins every interval until ctx is done,
+// replacing connections the pool has closed for idling, each attempt
+// bounded by timeout.
+func keepConnected(ctx context.Context, origins []string, interval, timeout time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+			preconnect(attemptCtx, origins)
+			cancel()
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProviderOrigins(t *testing.T) {
+	obs, err := newHTTPJSONProvider(providerConfig{Name: "obs", URL: "https://obs.example:8443/{city}/latest", Field: "t"}, providerEnv{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	quota := newQuotaTracker(map[string]int{"openWeatherMap": 10})
+	providers := []weatherProvider{
+		openWeatherMap{},
+		quotaProvider{openWeatherMap{stations: 3}, quota}, // the same upstream, wrapped
+		obs,
+		forecastIo{},
+		newFake("local", 10), // no upstream
+	}
+	want := "http://api.openweathermap.org,https://obs.example:8443,https://api.forecast.io"
+	if got := strings.Join(providerOrigins(providers), ","); got != want {
+		t.Errorf("origins %s, want %s", got, want)
+	}
+}
+
+// preconnectServer counts the connections and HEAD requests it receives.
+func preconnectServer(t *testing.T) (srv *httptest.Server, conns, heads *atomic.Int32) {
+	conns, heads = new(atomic.Int32), new(atomic.Int32)
+	srv = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			heads.Add(1)
+		}
+		w.Write([]byte(`{}`))
+	}))
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.Start()
+	t.Cleanup(srv.Close)
+	old := upstreamClient
+	upstreamClient = &http.Client{Transport: &http.Transport{}}
+	t.Cleanup(func() { upstreamClient = old })
+	return srv, conns, heads
+}
+
+func TestPreconnect(t *testing.T) {
+	srv, conns, heads := preconnectServer(t)
+	preconnect(context.Background(), []string{srv.URL})
+	if heads.Load() != 1 || conns.Load() != 1 {
+		t.Fatalf("%d HEADs over %d connections, want one", heads.Load(), conns.Load())
+	}
+
+	// The provider's first request reuses the connection.
+	resp, err := upstreamClient.Get(srv.URL + "/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if n := conns.Load(); n != 1 {
+		t.Errorf("%d connections, want the preconnected one reused", n)
+	}
+}
+
+func TestPreconnectFailure(t *testing.T) {
+	logs := captureLog(t)
+	srv, _, heads := preconnectServer(t)
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	// One upstream failing doesn't stop the others.
+	preconnect(context.Background(), []string{unreachable.URL, srv.URL})
+	if heads.Load() != 1 {
+		t.Errorf("%d HEADs to the reachable upstream, want 1", heads.Load())
+	}
+	if !strings.Contains(logs.String(), "preconnect failed") || !strings.Contains(logs.String(), unreachable.URL) {
+		t.Errorf("failure not logged: %s", logs)
+	}
+}
+
+func TestKeepConnected(t *testing.T) {
+	srv, _, heads := preconnectServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		keepConnected(ctx, []string{srv.URL}, 20*time.Millisecond, time.Second)
+		close(done)
+	}()
+	time.Sleep(110 * time.Millisecond)
+	cancel()
+	<-done
+	if n := heads.Load(); n < 2 {
+		t.Errorf("%d HEADs in 110ms at a 20ms interval, want several", n)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"sync"
+)
+
+type provenanceKey struct{}
+
+// provenanceRecorder notes what a provider's lookup asked upstream, for
+// the reading's provenance: every URL requested on its behalf, geocoding
+// and elevation lookups included, and the coordinates it was geocoded to.
+type provenanceRecorder struct {
+	mu       sync.Mutex
+	upstream []string
+	geocoded *point
+}
+
+// withProvenance has ctx's upstream requests noted by the recorder it
+// returns.
+func withProvenance(ctx context.Context) (context.Context, *provenanceRecorder) {
+	rec := new(provenanceRecorder)
+	return context.WithValue(ctx, provenanceKey{}, rec), rec
+}
+
+// noteUpstream records u, less any credentials it carries, if ctx has a
+// recorder.
+func noteUpstream(ctx context.Context, u *url.URL) {
+	if rec, _ := ctx.Value(provenanceKey{}).(*provenanceRecorder); rec != nil {
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		rec.upstream = append(rec.upstream, redact(u.Redacted()))
+	}
+}
+
+// noteGeocoded records p as where ctx's city was placed, if ctx has a
+// recorder.
+func noteGeocoded(ctx context.Context, p point) {
+	if rec, _ := ctx.Value(provenanceKey{}).(*provenanceRecorder); rec != nil {
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		rec.geocoded = &p
+	}
+}
+
+// fill copies what rec noted into r.
+func (rec *provenanceRecorder) fill(r *reading) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	r.upstream, r.geocoded = rec.upstream, rec.geocoded
+}
+
+// provenanceChains traces each of res's readings from the city asked for
+// to its part in the temperature: the city as normalized for lookups,
+// where it was geocoded to if the provider needed coordinates, the
+// upstream URLs, the temperature as sent, in Kelvin once converted and
+// corrected for altitude, and its weight in the aggregate.
+func (res weatherResult) provenanceChains() []map[string]interface{} {
+	chain := make([]map[string]interface{}, 0, len(res.agg.readings))
+	for _, r := range res.agg.readings {
+		p := map[string]interface{}{
+			"provider":  r.provider,
+			"requested": res.requested,
+			"city":      normalizeCity(res.city),
+			"kelvin":    kelvin.fromCelsius(r.celsius),
+		}
+		if r.geocoded != nil {
+			p["geocoded"] = map[string]interface{}{"lat": r.geocoded.lat, "lon": r.geocoded.lon}
+		}
+		if len(r.upstream) > 0 {
+			p["upstream"] = r.upstream
+		}
+		if r.native.unit != "" {
+			p["native"] = map[string]interface{}{"value": r.native.value, "unit": r.native.unit}
+		}
+		if r.altitudeCorrection != nil {
+			p["altitude_correction"] = *r.altitudeCorrection // the same in K as in °C
+		}
+		if r.share != nil {
+			p["weight"] = *r.share
+		}
+		if r.cached {
+			p["cached"] = true
+		}
+		chain = append(chain, p)
+	}
+	return chain
+}
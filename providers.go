@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// providerConfig configures one entry of the providers list in conf.json.
+// Which fields matter depends on the type.
+type providerConfig struct {
+	Type string
+	// Label names the provider in logs, metrics, quotas and responses.
+	// Unset, it is the type's own name, with "#2", "#3" and so on
+	// appended when the same one is listed again.
+	Label  string
+	ApiKey string
+	Path   string
+	// Stations is the number of nearby stations to average, for providers
+	// that support it.
+	Stations int
+	// Headers are added to every request the provider makes upstream.
+	Headers map[string]string
+	// Query adds parameters, e.g. {"lang": "fr"}, to every request the
+	// provider makes upstream. It can't replace the provider's own, such
+	// as units.
+	Query map[string]string
+	// Weight is how much the provider counts towards the mean; 1 if
+	// unset.
+	Weight *float64
+	// Tier is how far the provider's data can be trusted:
+	// "authoritative", "standard", the default, or "supplementary".
+	// Requests with ?min_tier= leave out providers below it.
+	Tier string
+	// Name, URL, Field, ConditionField and Unit describe an httpjson or
+	// graphql provider. A gollo provider takes Name and URL, the other
+	// server's base.
+	Name, URL             string
+	Field, ConditionField string
+	Unit                  string
+	// Document is the query a graphql provider POSTs to URL, with the
+	// city as $city. Its Field is a path under the response's data.
+	Document string
+	// Auth authenticates an httpjson or graphql provider's requests with
+	// Token: Scheme "bearer" sends it as an Authorization bearer token,
+	// "header" as the header called Name, and "query" as the URL
+	// parameter called Name.
+	Auth struct {
+		Scheme, Name, Token string
+	}
+	// Broker, Topics (city to topic), MaxAge and Timeout configure mqtt.
+	// Timeout is how long a lookup waits for the broker; 1s if unset,
+	// inside the aggregate's deadline.
+	Broker  string
+	Topics  map[string]string
+	MaxAge  duration
+	Timeout duration
+	// CacheTTL, if set, reuses the provider's reading for a location for
+	// that long rather than calling it again, whether or not the
+	// aggregate is cached.
+	CacheTTL duration
+}
+
+func (pc providerConfig) header() http.Header {
+	if len(pc.Headers) == 0 {
+		return nil
+	}
+	h := make(http.Header, len(pc.Headers))
+	for k, v := range pc.Headers {
+		h.Set(k, v)
+	}
+	return h
+}
+
+func (pc providerConfig) query() url.Values {
+	if len(pc.Query) == 0 {
+		return nil
+	}
+	q := make(url.Values, len(pc.Query))
+	for k, v := range pc.Query {
+		q.Set(k, v)
+	}
+	return q
+}
+
+// providerEnv holds what providers share, whatever their type.
+type providerEnv struct {
+	geocoder geocoder
+}
+
+// providerTypes builds providers by their type in conf.json.
+var providerTypes = map[string]func(pc providerConfig, env providerEnv) (weatherProvider, error){
+	"openweathermap": func(pc providerConfig, env providerEnv) (weatherProvider, error) {
+		return openWeatherMap{stations: pc.Stations, header: pc.header(), query: pc.query()}, nil
+	},
+	"weatherunderground": func(pc providerConfig, env providerEnv) (weatherProvider, error) {
+		return weatherUnderground{apiKey: pc.ApiKey, header: pc.header(), query: pc.query()}, nil
+	},
+	"forecastio": func(pc providerConfig, env providerEnv) (weatherProvider, error) {
+		return forecastIo{apiKey: pc.ApiKey, geocoder: env.geocoder, header: pc.header(), query: pc.query()}, nil
+	},
+	"localfile":      newLocalStationProvider,
+	"visualcrossing": newVisualCrossing,
+	"accuweather":    newAccuWeather,
+	"mqtt":           newMQTTProvider,
+	"httpjson":       newHTTPJSONProvider,
+	"graphql":        newGraphQLProvider,
+	"gollo":          newGolloProvider,
+	"climatology":    newClimatologyProvider,
+}
+
+// attributions are the credits each provider's terms ask consuming apps to
+// display, by provider name. Local sources need none.
+var attributions = map[string]string{
+	"openWeatherMap":     "Weather data provided by OpenWeather (https://openweathermap.org)",
+	"weatherUnderground": "Data provided by Weather Underground (https://www.wunderground.com)",
+	"forecastIo":         "Powered by Dark Sky (https://darksky.net/poweredby/)",
+	"visualCrossing":     "Weather data provided by Visual Crossing Weather (https://www.visualcrossing.com)",
+	"accuWeather":        "Weather data provided by AccuWeather (https://www.accuweather.com)",
+}
+
+// labelledProvider is a provider under the name its providerConfig gives
+// it.
+type labelledProvider struct {
+	weatherProvider
+	label string
+}
+
+func (p labelledProvider) name() string            { return p.label }
+func (p labelledProvider) unwrap() weatherProvider { return p.weatherProvider }
+
+// labelProviders gives each provider its configured label, or numbers
+// repeats of the same name, so every provider's name is unique. Labelled
+// providers keep their type's attribution.
+func labelProviders(providers []weatherProvider, configs []providerConfig) ([]weatherProvider, error) {
+	taken := make(map[string]bool)
+	for _, pc := range configs {
+		if pc.Label == "" {
+			continue
+		}
+		if taken[pc.Label] {
+			return nil, fmt.Errorf("providers: label %q is used twice", pc.Label)
+		}
+		taken[pc.Label] = true
+	}
+	labelled := make([]weatherProvider, len(providers))
+	for i, p := range providers {
+		label := configs[i].Label
+		if label == "" {
+			label = p.name()
+			for n := 2; taken[label]; n++ {
+				label = fmt.Sprintf("%s#%d", p.name(), n)
+			}
+			taken[label] = true
+		}
+		if label == p.name() {
+			labelled[i] = p
+			continue
+		}
+		if a, ok := attributions[p.name()]; ok {
+			attributions[label] = a
+		}
+		labelled[i] = labelledProvider{p, label}
+	}
+	return labelled, nil
+}
+
+func newProvider(pc providerConfig, env providerEnv) (weatherProvider, error) {
+	build, ok := providerTypes[pc.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown provider type %q", pc.Type)
+	}
+	return build(pc, env)
+}
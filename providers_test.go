@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestProviderHeaders(t *testing.T) {
+	var mu sync.Mutex
+	seen := make(map[string]http.Header)
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen[r.Host] = r.Header.Clone()
+		mu.Unlock()
+		http.Error(w, "stub", http.StatusNotFound)
+	}))
+	// forecast.io geocodes the city first.
+	env := providerEnv{geocoder: &stubGeocoder{points: map[string]point{"London": {51.5, -0.12}}}}
+
+	for _, tt := range []struct{ typ, host string }{
+		{"openweathermap", "api.openweathermap.org"},
+		{"weatherunderground", "api.wunderground.com"},
+		{"accuweather", "dataservice.accuweather.com"},
+		{"visualcrossing", "weather.visualcrossing.com"},
+		{"forecastio", "api.forecast.io"},
+	} {
+		pc := providerConfig{Type: tt.typ, ApiKey: "key", Headers: map[string]string{"x-gateway-key": "secret", "X-Route": tt.typ}}
+		p, err := newProvider(pc, env)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.typ, err)
+		}
+		p.temperature(context.Background(), "London")
+
+		mu.Lock()
+		h, ok := seen[tt.host]
+		mu.Unlock()
+		if !ok {
+			t.Fatalf("%s: no request reached %s; saw %v", tt.typ, tt.host, seen)
+		}
+		if h.Get("X-Gateway-Key") != "secret" || h.Get("X-Route") != tt.typ {
+			t.Errorf("%s: headers %v", tt.typ, h)
+		}
+	}
+}
+
+func TestProviderQuery(t *testing.T) {
+	var mu sync.Mutex
+	seen := make(map[string]url.Values)
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen[r.Host] = r.URL.Query()
+		mu.Unlock()
+		http.Error(w, "stub", http.StatusNotFound)
+	}))
+	// forecast.io geocodes the city first.
+	env := providerEnv{geocoder: &stubGeocoder{points: map[string]point{"London": {51.5, -0.12}}}}
+
+	for _, tt := range []struct{ typ, host string }{
+		{"openweathermap", "api.openweathermap.org"},
+		{"weatherunderground", "api.wunderground.com"},
+		{"accuweather", "dataservice.accuweather.com"},
+		{"visualcrossing", "weather.visualcrossing.com"},
+		{"forecastio", "api.forecast.io"},
+	} {
+		// units is the provider's own where it sets one, and stays so.
+		pc := providerConfig{Type: tt.typ, ApiKey: "key", Query: map[string]string{"lang": "fr", "extended": "1", "units": "imperial"}}
+		p, err := newProvider(pc, env)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.typ, err)
+		}
+		p.temperature(context.Background(), "London")
+
+		mu.Lock()
+		q, ok := seen[tt.host]
+		mu.Unlock()
+		if !ok {
+			t.Fatalf("%s: no request reached %s; saw %v", tt.typ, tt.host, seen)
+		}
+		if q.Get("lang") != "fr" || q.Get("extended") != "1" {
+			t.Errorf("%s: query %v, want the configured parameters", tt.typ, q)
+		}
+	}
+	if q := seen["api.openweathermap.org"]; q.Get("units") != "metric" || len(q["units"]) != 1 {
+		t.Errorf("openweathermap units %v, want its own metric alone", q["units"])
+	}
+
+	if q := (providerConfig{}).query(); q != nil {
+		t.Errorf("query %v without any configured", q)
+	}
+}
+
+func TestDetailAttribution(t *testing.T) {
+	s := newTestServer(newFake("openWeatherMap", 10), newFake("forecastIo", 11), newFake("localFile", 12))
+	body := decode(t, get(s.handleWeather, "/weather/London?detail=true"))
+	providers, _ := body["providers"].([]interface{})
+	if len(providers) != 3 {
+		t.Fatalf("providers %v", body["providers"])
+	}
+	want := map[string]interface{}{
+		"openWeatherMap": "Weather data provided by OpenWeather (https://openweathermap.org)",
+		"forecastIo":     "Powered by Dark Sky (https://darksky.net/poweredby/)",
+		"localFile":      nil,
+	}
+	for _, p := range providers {
+		d := p.(map[string]interface{})
+		if d["attribution"] != want[d["provider"].(string)] {
+			t.Errorf("%s: attribution %v, want %v", d["provider"], d["attribution"], want[d["provider"].(string)])
+		}
+	}
+
+	if _, ok := decode(t, get(s.handleWeather, "/weather/London"))["attribution"]; ok {
+		t.Error("attribution outside detail mode")
+	}
+}
+
+func TestLabelledProviderAttribution(t *testing.T) {
+	t.Cleanup(func() {
+		delete(attributions, "owm-eu")
+		delete(attributions, "accuWeather#2")
+	})
+	providers, err := labelProviders(
+		[]weatherProvider{openWeatherMap{}, accuWeather{}, accuWeather{}},
+		[]providerConfig{{Label: "owm-eu"}, {}, {}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range []string{"owm-eu", "accuWeather", "accuWeather#2"} {
+		if providers[i].name() != name {
+			t.Errorf("provider %d named %q, want %q", i, providers[i].name(), name)
+		}
+	}
+	if attributions["owm-eu"] != attributions["openWeatherMap"] || attributions["accuWeather#2"] != attributions["accuWeather"] {
+		t.Errorf("labelled providers lost their type's attribution: %q, %q", attributions["owm-eu"], attributions["accuWeather#2"])
+	}
+}
+
+func TestDuplicateProviderTypes(t *testing.T) {
+	var conf config
+	// A label claims its name before repeats are numbered around it.
+	if err := json.Unmarshal([]byte(`{"providers": [
+		{"type": "openweathermap"}, {"type": "openweathermap", "label": "openWeatherMap#2"},
+		{"type": "openweathermap"}, {"type": "forecastio", "label": "darksky-eu"}]}`), &conf); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		for _, label := range []string{"openWeatherMap#2", "openWeatherMap#3", "darksky-eu"} {
+			delete(attributions, label)
+		}
+	})
+	mw, err := getMultiWeatherProvider(conf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, p := range mw.providers {
+		names = append(names, p.name())
+	}
+	if got := strings.Join(names, ","); got != "openWeatherMap,openWeatherMap#2,openWeatherMap#3,darksky-eu" {
+		t.Errorf("names %s, want each unique", got)
+	}
+	// A labelled provider keeps its type's capabilities.
+	if _, ok := capability[coordinateProvider](mw.providers[3]); !ok {
+		t.Error("labelled forecastIo lost its coordinate lookups")
+	}
+
+	conf.Providers[2].Label = "darksky-eu"
+	if _, err := getMultiWeatherProvider(conf, nil); err == nil || !strings.Contains(err.Error(), `label "darksky-eu" is used twice`) {
+		t.Errorf("duplicate label: %v", err)
+	}
+}
+
+func TestDuplicateProviderDetail(t *testing.T) {
+	providers, err := labelProviders([]weatherProvider{newFake("fake", 10), newFake("fake", 20)}, []providerConfig{{}, {}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(providers...)
+	temps := map[interface{}]interface{}{}
+	for _, d := range decode(t, get(s.handleWeather, "/weather/London?detail=true"))["providers"].([]interface{}) {
+		d := d.(map[string]interface{})
+		temps[d["provider"]] = d["temp"]
+	}
+	if len(temps) != 2 || temps["fake"] != 10.0 || temps["fake#2"] != 20.0 {
+		t.Errorf("detail temps by provider %v, want fake and fake#2 apart", temps)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// quotaTracker counts requests per provider against daily limits. Counters
+// reset at midnight UTC.
+type quotaTracker struct {
+	mu     sync.Mutex
+	limits map[string]int
+	used   map[string]int
+}
+
+func newQuotaTracker(limits map[string]int) *quotaTracker {
+	q := &quotaTracker{limits: limits, used: make(map[string]int)}
+	q.scheduleReset()
+	return q
+}
+
+func (q *quotaTracker) scheduleReset() {
+	now := time.Now().UTC()
+	midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	time.AfterFunc(midnight.Sub(now), func() {
+		q.reset()
+		q.scheduleReset()
+	})
+}
+
+func (q *quotaTracker) reset() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.used = make(map[string]int)
+}
+
+// take consumes one request from provider's quota, failing once the limit
+// for the day is reached. Providers without a limit always succeed.
+func (q *quotaTracker) take(provider string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	limit, ok := q.limits[provider]
+	if !ok {
+		return nil
+	}
+	if q.used[provider] >= limit {
+		return fmt.Errorf("daily quota of %d requests exhausted", limit)
+	}
+	q.used[provider]++
+	return nil
+}
+
+// quotaProvider gates a provider on its daily quota.
+type quotaProvider struct {
+	weatherProvider
+	quota *quotaTracker
+}
+
+func (p quotaProvider) admit() error {
+	return p.quota.take(p.name())
+}
+
+func (p quotaProvider) unwrap() weatherProvider { return p.weatherProvider }
+
+// remaining is the share of provider's daily quota still unused; 1 for
+// providers without one, and if q is nil.
+func (q *quotaTracker) remaining(provider string) float64 {
+	if q == nil {
+		return 1
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	limit, ok := q.limits[provider]
+	if !ok {
+		return 1
+	}
+	if limit <= 0 {
+		return 0
+	}
+	return math.Max(0, 1-float64(q.used[provider])/float64(limit))
+}
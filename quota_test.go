@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestQuotaExhaustedProviderSkipped(t *testing.T) {
+	limited, free := newFake("limited", 10), newFake("free", 20)
+	q := &quotaTracker{limits: map[string]int{"limited": 2}, used: make(map[string]int)}
+	mw := newTestMW(quotaProvider{limited, q}, free)
+	mw.quota = q
+
+	for i := 0; i < 2; i++ {
+		agg, err := mw.aggregate(context.Background(), "London")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if agg.celsius != 15 || len(agg.warnings) != 0 {
+			t.Fatalf("call %d: got %v°C, warnings %v; want 15, none", i+1, agg.celsius, agg.warnings)
+		}
+	}
+
+	agg, err := mw.aggregate(context.Background(), "London")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agg.celsius != 20 {
+		t.Errorf("got %v°C, want only the free provider's 20", agg.celsius)
+	}
+	if len(agg.warnings) != 1 || !strings.HasPrefix(agg.warnings[0], "limited skipped: daily quota of 2") {
+		t.Errorf("warnings %v, want limited skipped", agg.warnings)
+	}
+	if n := limited.calls.Load(); n != 2 {
+		t.Errorf("limited called %d times, want 2", n)
+	}
+	if n := free.calls.Load(); n != 3 {
+		t.Errorf("free called %d times, want 3", n)
+	}
+}
+
+func TestAllQuotasExhausted(t *testing.T) {
+	p := newFake("limited", 10)
+	q := &quotaTracker{limits: map[string]int{"limited": 0}, used: make(map[string]int)}
+	mw := newTestMW(quotaProvider{p, q})
+
+	if _, err := mw.aggregate(context.Background(), "London"); err == nil {
+		t.Error("no error with every provider out of quota")
+	}
+	if p.calls.Load() != 0 {
+		t.Error("provider out of quota was called")
+	}
+}
+
+func TestQuotaReset(t *testing.T) {
+	q := &quotaTracker{limits: map[string]int{"p": 1}, used: make(map[string]int)}
+	if err := q.take("p"); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.take("p"); err == nil {
+		t.Fatal("second take within a limit of 1 succeeded")
+	}
+	if got := q.remaining("p"); got != 0 {
+		t.Errorf("remaining %v, want 0", got)
+	}
+	q.reset()
+	if err := q.take("p"); err != nil {
+		t.Errorf("take after reset: %s", err)
+	}
+	if err := q.take("unlimited"); err != nil {
+		t.Errorf("provider without a limit: %s", err)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxRetryAfter bounds how long an upstream's Retry-After is honoured, so
+// a bogus one can't shut a provider out for good.
+const maxRetryAfter = time.Hour
+
+// rateLimitedError is returned for an upstream's 429, and for requests to
+// it not made because the Retry-After it sent hasn't passed, so that no
+// provider hammers an upstream that asked for a pause. It unwraps to the
+// 429's statusError.
+type rateLimitedError struct {
+	host  string
+	until time.Time // zero if the upstream didn't say
+}
+
+func (e rateLimitedError) Error() string {
+	if e.until.IsZero() {
+		return e.host + ": rate limited"
+	}
+	return fmt.Sprintf("%s: rate limited; retry after %s", e.host, e.until.Format(time.RFC3339))
+}
+
+func (e rateLimitedError) Unwrap() error {
+	return statusError{host: e.host, status: http.StatusTooManyRequests}
+}
+
+// rateLimits holds, by host, when each upstream that sent a 429 with a
+// Retry-After may be called again.
+var rateLimits = struct {
+	sync.Mutex
+	until map[string]time.Time
+}{until: make(map[string]time.Time)}
+
+// checkRateLimit fails requests to host until its Retry-After has passed.
+func checkRateLimit(host string) error {
+	rateLimits.Lock()
+	defer rateLimits.Unlock()
+	until, ok := rateLimits.until[host]
+	if !ok {
+		return nil
+	}
+	if time.Now().Before(until) {
+		return rateLimitedError{host: host, until: until}
+	}
+	delete(rateLimits.until, host)
+	return nil
+}
+
+// noteRateLimit remembers host's Retry-After, if it sent one, and returns
+// the 429's error.
+func noteRateLimit(host, retryAfter string) error {
+	until := parseRetryAfter(retryAfter, time.Now())
+	if !until.IsZero() {
+		rateLimits.Lock()
+		rateLimits.until[host] = until
+		rateLimits.Unlock()
+	}
+	return rateLimitedError{host: host, until: until}
+}
+
+// parseRetryAfter reads a Retry-After header, in seconds or as an HTTP
+// date, as the time it names, at most maxRetryAfter after now. It is zero
+// if the header is missing, malformed or already past.
+func parseRetryAfter(h string, now time.Time) time.Time {
+	var until time.Time
+	if secs, err := strconv.Atoi(h); err == nil {
+		until = now.Add(time.Duration(secs) * time.Second)
+	} else if t, err := http.ParseTime(h); err == nil {
+		until = t
+	}
+	if !until.After(now) {
+		return time.Time{}
+	}
+	if until.Sub(now) > maxRetryAfter {
+		until = now.Add(maxRetryAfter)
+	}
+	return until
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRateLimited(t *testing.T) {
+	const host = "ratelimited.example"
+	t.Cleanup(func() {
+		rateLimits.Lock()
+		delete(rateLimits.until, host)
+		rateLimits.Unlock()
+	})
+	var calls atomic.Int32
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Retry-After", "120")
+		http.Error(w, "slow down", http.StatusTooManyRequests)
+	}))
+	old := upstreamRetry
+	upstreamRetry = retryPolicy{attempts: 3, backoff: time.Millisecond}
+	t.Cleanup(func() { upstreamRetry = old })
+
+	var v interface{}
+	begin := time.Now()
+	err := getJSON(context.Background(), "http://"+host+"/weather", &v)
+	var rl rateLimitedError
+	if !errors.As(err, &rl) {
+		t.Fatalf("error %v, want a rateLimitedError", err)
+	}
+	if d := rl.until.Sub(begin); d < 119*time.Second || d > 121*time.Second {
+		t.Errorf("retry after %s, want 2m", d)
+	}
+	var se statusError
+	if !errors.As(err, &se) || se.status != http.StatusTooManyRequests {
+		t.Errorf("error %v does not unwrap to the 429", err)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("%d calls, want one: a Retry-After is waited out, not retried", calls.Load())
+	}
+
+	// Until then, requests to the host fail without being made.
+	if err := getJSON(context.Background(), "http://"+host+"/other", &v); !errors.As(err, &rl) {
+		t.Errorf("second request: error %v, want a rateLimitedError", err)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("%d calls, want the second request held back", calls.Load())
+	}
+}
+
+func TestRateLimitedWithoutRetryAfter(t *testing.T) {
+	var calls atomic.Int32
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{"ok": true}`))
+	}))
+	old := upstreamRetry
+	upstreamRetry = retryPolicy{attempts: 1, backoff: time.Millisecond}
+	t.Cleanup(func() { upstreamRetry = old })
+
+	var v struct{ OK bool }
+	if err := getJSON(context.Background(), "http://noretryafter.example/", &v); err != nil || !v.OK {
+		t.Errorf("got %v, %v; want the retry to succeed", v, err)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for h, want := range map[string]time.Time{
+		"30":                            now.Add(30 * time.Second),
+		"Mon, 01 Jan 2024 12:05:00 GMT": now.Add(5 * time.Minute),
+		"86400":                         now.Add(maxRetryAfter),
+		"0":                             {},
+		"-5":                            {},
+		"Mon, 01 Jan 2024 11:00:00 GMT": {},
+		"soon":                          {},
+		"":                              {},
+	} {
+		if got := parseRetryAfter(h, now); !got.Equal(want) {
+			t.Errorf("%q: %s, want %s", h, got, want)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// handleReadings serves /readings/<city>: every provider's reading or error,
+// with no averaging, for clients that aggregate for themselves. It bypasses
+// the cache, which only holds aggregates.
+func (s *server) handleReadings(w http.ResponseWriter, r *http.Request) {
+	begin := time.Now()
+	city := strings.SplitN(r.URL.Path, "/", 3)[2]
+
+	u, err := s.requestUnit(r)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, span := s.tracer.start(r.Context(), "GET /readings/")
+	defer span.finish()
+	span.setAttr("city", city)
+
+	outcomes, warnings := s.mw.collect(ctx, city)
+
+	readings := make([]map[string]interface{}, 0, len(outcomes))
+	for _, o := range outcomes {
+		if o.err != nil {
+			readings = append(readings, s.providerError(o))
+			continue
+		}
+		readings = append(readings, providerDetails([]reading{o.reading}, u, nil, false)[0])
+	}
+
+	resp := map[string]interface{}{
+		"city":     city,
+		"readings": readings,
+	}
+	s.tookFormat.set(resp, begin)
+	if len(warnings) > 0 {
+		resp["warnings"] = warnings
+	}
+	writeJSON(w, r, resp)
+}
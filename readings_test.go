@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHandleReadings(t *testing.T) {
+	slow := newFake("slow", 30)
+	slow.delay = 2 * time.Second
+	s := newTestServer(newFake("good", 10), &fakeProvider{label: "bad", err: errors.New("upstream down")}, newFake("also good", 20), slow)
+	s.defaultUnit = fahrenheit
+
+	w := get(s.handleReadings, "/readings/London")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	body := decode(t, w)
+	readings, _ := body["readings"].([]interface{})
+	if len(readings) != 4 {
+		t.Fatalf("readings %v, want 4", body["readings"])
+	}
+	want := []map[string]interface{}{
+		{"provider": "good", "temp": 50.0},
+		{"provider": "bad", "error": "upstream down"},
+		{"provider": "also good", "temp": 68.0},
+		{"provider": "slow", "error": errTimedOut.Error()},
+	}
+	for i, w := range want {
+		got := readings[i].(map[string]interface{})
+		for k, v := range w {
+			if got[k] != v {
+				t.Errorf("reading %d: %s is %v, want %v", i, k, got[k], v)
+			}
+		}
+		if _, averaged := got["temp"]; averaged != (w["temp"] != nil) {
+			t.Errorf("reading %d: %v", i, got)
+		}
+	}
+	if _, ok := body["temp"]; ok {
+		t.Error("readings were averaged")
+	}
+}
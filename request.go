@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// statusError is returned for upstream responses outside the 2xx range.
+type statusError struct {
+	host   string
+	status int
+}
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("%s: unexpected status %d %s", e.host, e.status, http.StatusText(e.status))
+}
+
+// upstreamClient makes every request to providers and geocoders. main
+// replaces it with one built by newUpstreamClient.
+var upstreamClient = http.DefaultClient
+
+// errorSnippetLen is how many bytes of an upstream error response's body
+// are logged; 0 logs none. main sets it from upstream.errorSnippet.
+var errorSnippetLen int
+
+// defaultMaxRedirects is how many redirects upstream requests follow when
+// the config doesn't say.
+const defaultMaxRedirects = 3
+
+// newUpstreamClient builds the client for upstream requests. Requests go
+// through conf's proxy if one is set, and otherwise through the proxy
+// named by HTTP_PROXY, HTTPS_PROXY and NO_PROXY.
+func newUpstreamClient(conf config) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	if conf.Upstream.Proxy != "" {
+		proxy, err := url.Parse(conf.Upstream.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("upstream proxy: %s", err)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	if dns := conf.Upstream.DNS; dns.Server != "" || dns.Timeout.Duration > 0 {
+		transport.DialContext = resolvingDialer(dns.Server, dns.Timeout.Duration)
+	}
+	tlsConfig, err := upstreamTLS(conf)
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	up := conf.Upstream
+	transport.MaxIdleConnsPerHost = 16
+	if up.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = up.MaxIdleConnsPerHost
+	}
+	if up.MaxIdleConns > 0 {
+		transport.MaxIdleConns = up.MaxIdleConns
+	}
+	if up.IdleConnTimeout.Duration > 0 {
+		transport.IdleConnTimeout = up.IdleConnTimeout.Duration
+	}
+	transport.Protocols = new(http.Protocols)
+	transport.Protocols.SetHTTP1(true)
+	transport.Protocols.SetHTTP2(up.HTTP2 == nil || *up.HTTP2)
+
+	maxRedirects := defaultMaxRedirects
+	if conf.Upstream.MaxRedirects != nil {
+		maxRedirects = *conf.Upstream.MaxRedirects
+	}
+	client := &http.Client{Transport: transport, CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) > maxRedirects {
+			return fmt.Errorf("%s: stopped after %d redirects", via[0].URL.Host, maxRedirects)
+		}
+		return nil
+	}}
+	return client, nil
+}
+
+// upstreamTLS is the TLS policy for upstream requests. Certificates are
+// always verified unless Insecure is set, against CAFile's roots instead
+// of the system's if it names one.
+func upstreamTLS(conf config) (*tls.Config, error) {
+	c := conf.Upstream.TLS
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	switch c.MinVersion {
+	case "", "1.2":
+	case "1.3":
+		tlsConfig.MinVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("upstream tls: unsupported minVersion %q, want 1.2 or 1.3", c.MinVersion)
+	}
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("upstream tls: %s", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("upstream tls: no certificates in %s", c.CAFile)
+		}
+		tlsConfig.RootCAs = roots
+	}
+	if c.Insecure {
+		log.Print("upstream tls: certificate verification is OFF; only use this against local mocks")
+		tlsConfig.InsecureSkipVerify = true
+	}
+	return tlsConfig, nil
+}
+
+// resolvingDialer dials after resolving the host itself, through server if
+// set, so that slow DNS fails after timeout rather than eating into the
+// whole request's time.
+func resolvingDialer(server string, timeout time.Duration) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	resolver := net.DefaultResolver
+	if server != "" {
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		lookupCtx := ctx
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			lookupCtx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		ips, err := resolver.LookupHost(lookupCtx, host)
+		if err != nil {
+			return nil, fmt.Errorf("resolve %s: %w", host, err)
+		}
+		var errs []error
+		for _, ip := range ips {
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+			if err == nil {
+				return conn, nil
+			}
+			errs = append(errs, err)
+		}
+		return nil, errors.Join(errs...)
+	}
+}
+
+// getJSON fetches url and decodes the JSON response body into v.
+func getJSON(ctx context.Context, url string, v interface{}) error {
+	return getJSONWith(ctx, url, nil, nil, v)
+}
+
+// getJSONWith is getJSON with extra request headers and query parameters,
+// such as those a provider's API gateway needs. Query parameters never
+// replace one rawURL already has, which the response's parsing may depend
+// on. Transient failures are retried as upstreamRetry says.
+func getJSONWith(ctx context.Context, rawURL string, header http.Header, query url.Values, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
+	if err != nil {
+		return err
+	}
+	addExtras(req, header, query)
+	return retrying(ctx, req, v)
+}
+
+// postJSON POSTs body, encoded as JSON, to rawURL with extra request
+// headers and query parameters, and decodes the JSON response body into
+// v. Transient failures are retried as getJSONWith's are.
+func postJSON(ctx context.Context, rawURL string, header http.Header, query url.Values, body, v interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", rawURL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	addExtras(req, header, query)
+	req.Header.Set("Content-Type", "application/json")
+	return retrying(ctx, req, v)
+}
+
+// addExtras adds header and query to req, leaving alone any query
+// parameter it already has.
+func addExtras(req *http.Request, header http.Header, query url.Values) {
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	if len(query) > 0 {
+		q := req.URL.Query()
+		for k, vs := range query {
+			if !q.Has(k) {
+				q[k] = vs
+			}
+		}
+		req.URL.RawQuery = q.Encode()
+	}
+}
+
+// retrying makes req, again as upstreamRetry says while it fails
+// transiently, decoding the response body into v.
+func retrying(ctx context.Context, req *http.Request, v interface{}) error {
+	noteUpstream(ctx, req.URL)
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return err
+			}
+			req.Body = body
+		}
+		err := getOnce(req, v)
+		if err == nil || !upstreamRetry.again(ctx, attempt, err) {
+			return err
+		}
+	}
+}
+
+// getOnce makes one attempt at req, decoding the response body into v.
+func getOnce(req *http.Request, v interface{}) error {
+	if err := checkRateLimit(req.URL.Host); err != nil {
+		return err
+	}
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return noteRateLimit(req.URL.Host, resp.Header.Get("Retry-After"))
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		if errorSnippetLen > 0 {
+			slog.Warn("upstream error", "host", req.URL.Host, "status", resp.StatusCode,
+				"body", snippet(resp.Body, errorSnippetLen))
+		}
+		return statusError{host: req.URL.Host, status: resp.StatusCode}
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// snippet reads up to max bytes of body for a log, marking where it was
+// cut short and redacting anything that looks like a credential, since
+// upstreams sometimes echo the request's key back in their errors.
+func snippet(body io.Reader, max int) string {
+	b, _ := io.ReadAll(io.LimitReader(body, int64(max)+1))
+	cut := len(b) > max
+	if cut {
+		b = b[:max]
+		// Don't split a character.
+		for len(b) > 0 && !utf8.Valid(b) {
+			b = b[:len(b)-1]
+		}
+	}
+	s := redact(string(b))
+	if cut {
+		s += "..."
+	}
+	return s
+}
+
+// credentialParam matches a named credential, as in "appid=..." or
+// "api_key": "...", capturing the name and separator.
+var credentialParam = regexp.MustCompile(`(?i)((?:api[_-]?key|appid|key|token|secret|password)["']?\s*[:=]\s*["']?)[^"'&\s,;}]+`)
+
+// credentialLike matches long runs of key characters, which are redacted
+// if they mix letters and digits the way generated keys do.
+var credentialLike = regexp.MustCompile(`[A-Za-z0-9_-]{20,}`)
+
+func redact(s string) string {
+	s = credentialParam.ReplaceAllString(s, "${1}REDACTED")
+	return credentialLike.ReplaceAllStringFunc(s, func(run string) string {
+		if strings.ContainsAny(run, "0123456789") && strings.IndexFunc(run, func(r rune) bool {
+			return r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z'
+		}) >= 0 {
+			return "REDACTED"
+		}
+		return run
+	})
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUpstreamProxy(t *testing.T) {
+	var proxied atomic.Int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A forward proxy is sent the absolute URL.
+		if r.URL.Host != "api.openweathermap.org" || r.URL.Scheme != "http" {
+			http.Error(w, "unexpected "+r.URL.String(), http.StatusBadRequest)
+			return
+		}
+		proxied.Add(1)
+		w.Write([]byte(`{"main":{"temp":10}}`))
+	}))
+	defer proxy.Close()
+
+	var conf config
+	conf.Upstream.Proxy = proxy.URL
+	client, err := newUpstreamClient(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := upstreamClient
+	upstreamClient = client
+	defer func() { upstreamClient = old }()
+
+	r, err := openWeatherMap{}.temperature(context.Background(), "London")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.celsius != 10 || proxied.Load() != 1 {
+		t.Errorf("got %v°C with %d proxied requests, want 10 through the proxy", r.celsius, proxied.Load())
+	}
+}
+
+func TestUpstreamProxyInvalid(t *testing.T) {
+	var conf config
+	conf.Upstream.Proxy = "http://[::1"
+	if _, err := newUpstreamClient(conf); err == nil {
+		t.Error("no error for a malformed proxy URL")
+	}
+}
+
+func TestUpstreamProxyFromEnvironment(t *testing.T) {
+	client, err := newUpstreamClient(config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// http.ProxyFromEnvironment reads the environment once per process,
+	// so this can only check that the transport consults a proxy at all.
+	if client.Transport.(*http.Transport).Proxy == nil {
+		t.Error("transport ignores HTTP_PROXY and friends")
+	}
+}
+
+// fakeDNS answers A queries for every name with 127.0.0.1 over UDP,
+// recording the names asked. With silent set it records and never answers.
+func fakeDNS(t *testing.T, silent bool) (addr string, asked func() []string) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	var mu sync.Mutex
+	var names []string
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			q := buf[:n]
+			// The question's name runs from byte 12 to its zero label,
+			// followed by its type and class.
+			end := 12
+			var labels []string
+			for end < len(q) && q[end] != 0 {
+				labels = append(labels, string(q[end+1:end+1+int(q[end])]))
+				end += 1 + int(q[end])
+			}
+			question := q[12 : end+5]
+			qtype := binary.BigEndian.Uint16(q[end+1:])
+			mu.Lock()
+			names = append(names, strings.Join(labels, "."))
+			mu.Unlock()
+			if silent {
+				continue
+			}
+			resp := append([]byte{q[0], q[1], 0x81, 0x80, 0, 1, 0, 0, 0, 0, 0, 0}, question...)
+			if qtype == 1 {
+				resp[7] = 1
+				resp = append(resp, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 127, 0, 0, 1)
+			}
+			pc.WriteTo(resp, from)
+		}
+	}()
+	return pc.LocalAddr().String(), func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), names...)
+	}
+}
+
+func TestResolvingDialer(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+
+	dns, asked := fakeDNS(t, false)
+	client := &http.Client{Transport: &http.Transport{DialContext: resolvingDialer(dns, time.Second)}}
+	resp, err := client.Get("http://weather.example:" + port + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if names := asked(); len(names) == 0 || names[0] != "weather.example" {
+		t.Errorf("resolver asked %v, want weather.example through the configured server", names)
+	}
+}
+
+func TestResolvingDialerTimeout(t *testing.T) {
+	dns, asked := fakeDNS(t, true)
+	dial := resolvingDialer(dns, 100*time.Millisecond)
+	begin := time.Now()
+	_, err := dial(context.Background(), "tcp", "weather.example:80")
+	if err == nil || !strings.Contains(err.Error(), "resolve weather.example") {
+		t.Errorf("error %v, want the resolution to fail", err)
+	}
+	if took := time.Since(begin); took > 2*time.Second {
+		t.Errorf("resolution took %s, want it bound by the 100ms timeout", took)
+	}
+	if len(asked()) == 0 {
+		t.Error("the configured server was never asked")
+	}
+}
+
+func TestUpstreamRedirectCap(t *testing.T) {
+	// /hop/n redirects to /hop/n-1, and /hop/0 answers.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/hop/"))
+		if n == 0 {
+			w.Write([]byte("ok"))
+			return
+		}
+		http.Redirect(w, r, "/hop/"+strconv.Itoa(n-1), http.StatusFound)
+	}))
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		max  *int
+		hops int
+		ok   bool
+	}{
+		{nil, 3, true},
+		{nil, 4, false},
+		{ptr(0), 0, true},
+		{ptr(0), 1, false},
+		{ptr(5), 5, true},
+	} {
+		var conf config
+		conf.Upstream.MaxRedirects = tt.max
+		client, err := newUpstreamClient(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Get(srv.URL + "/hop/" + strconv.Itoa(tt.hops))
+		if err == nil {
+			resp.Body.Close()
+		}
+		if (err == nil) != tt.ok {
+			t.Errorf("max %v, %d hops: err %v, want ok %t", tt.max, tt.hops, err, tt.ok)
+		}
+		if err != nil && !strings.Contains(err.Error(), "stopped after") {
+			t.Errorf("max %v, %d hops: err %v, want it to name the cap", tt.max, tt.hops, err)
+		}
+	}
+}
+
+func TestUpstreamTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	fetch := func(conf config) error {
+		client, err := newUpstreamClient(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Get(srv.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	// The test server's certificate is self-signed, so it is rejected by
+	// default and accepted only with the insecure opt-in.
+	var conf config
+	if err := fetch(conf); err == nil {
+		t.Error("a self-signed certificate was accepted by default")
+	}
+	conf.Upstream.TLS.Insecure = true
+	if err := fetch(conf); err != nil {
+		t.Errorf("insecure: %s", err)
+	}
+
+	// Pinning to the server's own CA verifies it.
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(path, pemBytes, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	conf = config{}
+	conf.Upstream.TLS.CAFile = path
+	if err := fetch(conf); err != nil {
+		t.Errorf("pinned CA: %s", err)
+	}
+}
+
+func TestUpstreamTLSConfig(t *testing.T) {
+	for version, want := range map[string]uint16{"": tls.VersionTLS12, "1.2": tls.VersionTLS12, "1.3": tls.VersionTLS13} {
+		var conf config
+		conf.Upstream.TLS.MinVersion = version
+		c, err := upstreamTLS(conf)
+		if err != nil || c.MinVersion != want || c.InsecureSkipVerify {
+			t.Errorf("minVersion %q: got %+v, %v", version, c, err)
+		}
+	}
+
+	for name, set := range map[string]func(*config){
+		"old minVersion": func(c *config) { c.Upstream.TLS.MinVersion = "1.0" },
+		"missing caFile": func(c *config) { c.Upstream.TLS.CAFile = filepath.Join(t.TempDir(), "none.pem") },
+		"empty caFile": func(c *config) {
+			path := filepath.Join(t.TempDir(), "empty.pem")
+			os.WriteFile(path, nil, 0o600)
+			c.Upstream.TLS.CAFile = path
+		},
+	} {
+		var conf config
+		set(&conf)
+		if _, err := upstreamTLS(conf); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestUpstreamConnectionReuse(t *testing.T) {
+	for _, tt := range []struct {
+		http2 *bool
+		proto string
+	}{
+		{nil, "HTTP/2.0"},
+		{ptr(false), "HTTP/1.1"},
+	} {
+		var conns atomic.Int32
+		var protos sync.Map
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			protos.Store(r.Proto, true)
+			w.Write([]byte(`{}`))
+		}))
+		srv.EnableHTTP2 = true
+		srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				conns.Add(1)
+			}
+		}
+		srv.StartTLS()
+
+		var conf config
+		conf.Upstream.TLS.Insecure = true
+		conf.Upstream.HTTP2 = tt.http2
+		client, err := newUpstreamClient(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 6; i++ {
+			resp, err := client.Get(srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		srv.Close()
+
+		if n := conns.Load(); n != 1 {
+			t.Errorf("http2 %v: %d connections for 6 sequential requests, want one reused", tt.http2, n)
+		}
+		if _, ok := protos.Load(tt.proto); !ok {
+			t.Errorf("http2 %v: requests weren't %s", tt.http2, tt.proto)
+		}
+	}
+}
+
+func TestUpstreamIdleConfig(t *testing.T) {
+	client, err := newUpstreamClient(config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := client.Transport.(*http.Transport)
+	if tr.MaxIdleConnsPerHost != 16 || tr.MaxIdleConns != 100 || tr.IdleConnTimeout != 90*time.Second {
+		t.Errorf("defaults: %d per host, %d in all, %s idle", tr.MaxIdleConnsPerHost, tr.MaxIdleConns, tr.IdleConnTimeout)
+	}
+
+	var conf config
+	conf.Upstream.MaxIdleConns, conf.Upstream.MaxIdleConnsPerHost = 50, 8
+	conf.Upstream.IdleConnTimeout.Duration = 30 * time.Second
+	if client, err = newUpstreamClient(conf); err != nil {
+		t.Fatal(err)
+	}
+	tr = client.Transport.(*http.Transport)
+	if tr.MaxIdleConnsPerHost != 8 || tr.MaxIdleConns != 50 || tr.IdleConnTimeout != 30*time.Second {
+		t.Errorf("configured: %d per host, %d in all, %s idle", tr.MaxIdleConnsPerHost, tr.MaxIdleConns, tr.IdleConnTimeout)
+	}
+}
+
+func TestSnippetTruncation(t *testing.T) {
+	for _, tt := range []struct {
+		body string
+		max  int
+		want string
+	}{
+		{"city not found", 100, "city not found"},
+		{"city not found", 4, "city..."},
+		{"city not found", 14, "city not found"},
+		// "é" is two bytes; cutting between them drops it whole.
+		{"café closed", 4, "caf..."},
+		{"café closed", 5, "café..."},
+	} {
+		if got := snippet(strings.NewReader(tt.body), tt.max); got != tt.want {
+			t.Errorf("snippet(%q, %d) = %q, want %q", tt.body, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestRedact(t *testing.T) {
+	for _, tt := range []struct{ in, want string }{
+		{`{"cod":401,"message":"Invalid API key. See appid=abc123"}`, `{"cod":401,"message":"Invalid API key. See appid=REDACTED"}`},
+		{`{"api_key": "hunter2", "error": "denied"}`, `{"api_key": "REDACTED", "error": "denied"}`},
+		{"/forecast?token=t0k&units=si", "/forecast?token=REDACTED&units=si"},
+		{"bad key 0a1b2c3d4e5f6a7b8c9d0e1f2a3b4c5d", "bad key REDACTED"},
+		// Long runs without digits are ordinary words.
+		{"internationalization_failure", "internationalization_failure"},
+		{"city not found", "city not found"},
+	} {
+		if got := redact(tt.in); got != tt.want {
+			t.Errorf("redact(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestErrorSnippetLogged(t *testing.T) {
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"message":"Invalid API key appid=s3cr3t, see the documentation for details"}`))
+	}))
+	logs := captureLog(t)
+
+	for _, max := range []int{0, 40} {
+		errorSnippetLen = max
+		err := getJSON(context.Background(), "http://api.example.com/weather?appid=s3cr3t", &struct{}{})
+		if err == nil || strings.Contains(err.Error(), "Invalid") {
+			t.Errorf("error %v, want the status alone", err)
+		}
+	}
+	errorSnippetLen = 0
+
+	out := logs.String()
+	if n := strings.Count(out, `"msg":"upstream error"`); n != 1 {
+		t.Fatalf("%d upstream error lines, want one with a snippet length set: %s", n, out)
+	}
+	if !strings.Contains(out, `"status":401`) || !strings.Contains(out, `"body":"{\"message\":\"Invalid API key appid=REDACTED..."`) || strings.Contains(out, "s3cr3t") {
+		t.Errorf("log %s, want the status and a cut, redacted body", out)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// envelope wraps responses as {"status": "ok", "data": ...} and errors as
+// {"status": "error", "error": {"code": ..., "message": ...}}. main sets it
+// from the config.
+var envelope bool
+
+// always200 answers errors with a 200 and the error in the body, for
+// clients that can't handle other statuses. ?always200= overrides it per
+// request. main sets it from the config.
+var always200 bool
+
+type rawKey struct{}
+
+// withoutEnvelope serves next without wrapping its responses, for shapes
+// that are frozen, such as v1 and the Dark Sky compatibility API.
+func withoutEnvelope(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), rawKey{}, true)))
+	})
+}
+
+func enveloped(r *http.Request) bool {
+	raw, _ := r.Context().Value(rawKey{}).(bool)
+	return envelope && !raw
+}
+
+// errorsAs200 reports whether r's errors are sent with a 200; a ?always200=
+// that doesn't parse is ignored, there being no status left to object with.
+func errorsAs200(r *http.Request) bool {
+	if q := r.URL.Query().Get("always200"); q != "" {
+		if as200, err := strconv.ParseBool(q); err == nil {
+			return as200
+		}
+	}
+	return always200
+}
+
+// writeError responds with an error message and status code, as plain text
+// or, with the envelope on, as JSON. Errors sent with a 200 are always
+// enveloped, so that the body says they failed and with what code.
+func writeError(w http.ResponseWriter, r *http.Request, message string, code int) {
+	as200 := errorsAs200(r)
+	if !enveloped(r) && !as200 {
+		http.Error(w, message, code)
+		return
+	}
+	status := code
+	if as200 {
+		status = http.StatusOK
+	}
+	encodeJSON(w, r, status, map[string]interface{}{
+		"status": "error",
+		"error":  map[string]interface{}{"code": code, "message": message},
+	})
+}
+
+// writeJSON encodes v into a buffer before writing anything, so an encoding
+// failure can still become a 500. ?pretty=true indents the output.
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	writeJSONStatus(w, r, http.StatusOK, v)
+}
+
+// writeJSONStatus is writeJSON with a success status other than 200.
+func writeJSONStatus(w http.ResponseWriter, r *http.Request, code int, v interface{}) {
+	if enveloped(r) {
+		v = map[string]interface{}{"status": "ok", "data": v}
+	}
+	encodeJSON(w, r, code, v)
+}
+
+func encodeJSON(w http.ResponseWriter, r *http.Request, code int, v interface{}) {
+	var body []byte
+	var err error
+	if pretty, _ := strconv.ParseBool(r.URL.Query().Get("pretty")); pretty {
+		body, err = json.MarshalIndent(v, "", "  ")
+	} else {
+		body, err = json.Marshal(v)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	}
+	w.WriteHeader(code)
+	w.Write(append(body, '\n'))
+}
+
+// tookFormat is how responses report the time they took.
+type tookFormat string
+
+const (
+	tookString tookFormat = "string" // "took": "1.234567ms"
+	tookMillis tookFormat = "ms"     // "took_ms": 1
+	tookBoth   tookFormat = "both"
+)
+
+func parseTookFormat(s string) (tookFormat, error) {
+	switch f := tookFormat(s); f {
+	case tookString, tookMillis, tookBoth:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown took format %q, want string, ms or both", s)
+}
+
+// set records in resp the time since begin. The zero format is tookString.
+func (f tookFormat) set(resp map[string]interface{}, begin time.Time) {
+	took := time.Since(begin)
+	if f != tookMillis {
+		resp["took"] = took.String()
+	}
+	if f == tookMillis || f == tookBoth {
+		resp["took_ms"] = took.Milliseconds()
+	}
+}
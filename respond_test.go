@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func write(target string, v interface{}) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	writeJSON(w, httptest.NewRequest("GET", target, nil), v)
+	return w
+}
+
+func TestPrettyJSON(t *testing.T) {
+	v := map[string]interface{}{"city": "London", "temp": 10.5, "warnings": []string{"a skipped"}}
+
+	compact := write("/weather/London", v).Body.String()
+	pretty := write("/weather/London?pretty=true", v).Body.String()
+
+	if want := `{"city":"London","temp":10.5,"warnings":["a skipped"]}` + "\n"; compact != want {
+		t.Errorf("compact %q, want %q", compact, want)
+	}
+	want := "{\n  \"city\": \"London\",\n  \"temp\": 10.5,\n  \"warnings\": [\n    \"a skipped\"\n  ]\n}\n"
+	if pretty != want {
+		t.Errorf("pretty %q, want %q", pretty, want)
+	}
+	var squeezed bytes.Buffer
+	if err := json.Compact(&squeezed, []byte(pretty)); err != nil {
+		t.Fatal(err)
+	}
+	if squeezed.String()+"\n" != compact {
+		t.Errorf("pretty and compact differ beyond whitespace")
+	}
+}
+
+func TestWriteJSONEncodingFailure(t *testing.T) {
+	w := write("/", map[string]float64{"temp": math.NaN()})
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status %d, want 500", w.Code)
+	}
+}
+
+func TestTookFormat(t *testing.T) {
+	begin := time.Now().Add(-1500 * time.Millisecond)
+	for _, tt := range []struct {
+		format      tookFormat
+		str, millis bool
+	}{
+		{"", true, false},
+		{tookString, true, false},
+		{tookMillis, false, true},
+		{tookBoth, true, true},
+	} {
+		resp := make(map[string]interface{})
+		tt.format.set(resp, begin)
+		took, isString := resp["took"].(string)
+		if isString != tt.str {
+			t.Errorf("%q: took %v", tt.format, resp["took"])
+		} else if isString {
+			if d, err := time.ParseDuration(took); err != nil || d < 1500*time.Millisecond {
+				t.Errorf("%q: took %q", tt.format, took)
+			}
+		}
+		ms, isInt := resp["took_ms"].(int64)
+		if isInt != tt.millis || isInt && (ms < 1500 || ms > 60000) {
+			t.Errorf("%q: took_ms %v", tt.format, resp["took_ms"])
+		}
+	}
+
+	if _, err := parseTookFormat("seconds"); err == nil {
+		t.Error("no error for an unknown format")
+	}
+}
+
+func TestTookFormatInResponse(t *testing.T) {
+	s := newTestServer(newFake("a", 10))
+	s.tookFormat = tookMillis
+	body := decode(t, get(s.handleWeather, "/weather/London"))
+	if _, ok := body["took"]; ok {
+		t.Errorf("took reported with format ms: %v", body)
+	}
+	if _, ok := body["took_ms"].(float64); !ok {
+		t.Errorf("took_ms %v, want a number", body["took_ms"])
+	}
+}
+
+func setEnvelope(t *testing.T, on bool) {
+	t.Helper()
+	old := envelope
+	envelope = on
+	t.Cleanup(func() { envelope = old })
+}
+
+func TestEnvelope(t *testing.T) {
+	s := newTestServer(newFake("a", 10))
+
+	// Off by default: the bare shapes.
+	body := decode(t, get(s.handleWeather, "/weather/London"))
+	if _, ok := body["status"]; ok || body["temp"] == nil {
+		t.Errorf("without the envelope: %v", body)
+	}
+	if w := get(s.handleWeather, "/weather/London?units=rankine"); strings.HasPrefix(w.Body.String(), "{") {
+		t.Errorf("without the envelope, error %q is JSON", w.Body)
+	}
+
+	setEnvelope(t, true)
+	body = decode(t, get(s.handleWeather, "/weather/London"))
+	data, _ := body["data"].(map[string]interface{})
+	if body["status"] != "ok" || data == nil || data["temp"] == nil {
+		t.Errorf("success envelope: %v", body)
+	}
+
+	w := get(s.handleWeather, "/weather/London?units=rankine")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("error status %d, want 400", w.Code)
+	}
+	body = decode(t, w)
+	e, _ := body["error"].(map[string]interface{})
+	if body["status"] != "error" || e == nil || e["code"] != 400.0 || !strings.Contains(e["message"].(string), "rankine") {
+		t.Errorf("error envelope: %v", body)
+	}
+}
+
+func TestEnvelopeExempt(t *testing.T) {
+	setEnvelope(t, true)
+	h := withoutEnvelope(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, r, map[string]interface{}{"temp": 10})
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/v1/weather/London", nil))
+	if got := strings.TrimSpace(w.Body.String()); got != `{"temp":10}` {
+		t.Errorf("frozen shape enveloped: %s", got)
+	}
+}
+
+func TestAlways200(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeError(w, httptest.NewRequest("GET", "/weather/London?always200=true", nil), "down", http.StatusBadGateway)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"code":502`) {
+		t.Errorf("status %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestAlways200Combinations(t *testing.T) {
+	for _, tt := range []struct {
+		envelope, always200 bool
+		query               string
+		status              int
+		json                bool
+	}{
+		{false, false, "", http.StatusBadGateway, false},
+		{true, false, "", http.StatusBadGateway, true},
+		{false, true, "", http.StatusOK, true},
+		{true, true, "", http.StatusOK, true},
+		{false, false, "?always200=true", http.StatusOK, true},
+		{false, true, "?always200=false", http.StatusBadGateway, false},
+		{true, true, "?always200=false", http.StatusBadGateway, true},
+		{false, true, "?always200=sometimes", http.StatusOK, true},
+		{false, false, "?always200=sometimes", http.StatusBadGateway, false},
+	} {
+		setEnvelope(t, tt.envelope)
+		old := always200
+		always200 = tt.always200
+		w := httptest.NewRecorder()
+		w.Header().Set("Retry-After", "1")
+		writeError(w, httptest.NewRequest("GET", "/weather/London"+tt.query, nil), "down", http.StatusBadGateway)
+		always200 = old
+
+		name := fmt.Sprintf("envelope %v, always200 %v, %q", tt.envelope, tt.always200, tt.query)
+		if w.Code != tt.status || w.Header().Get("Retry-After") != "1" {
+			t.Errorf("%s: status %d, Retry-After %q; want %d and the header kept", name, w.Code, w.Header().Get("Retry-After"), tt.status)
+		}
+		if !tt.json {
+			if strings.HasPrefix(w.Body.String(), "{") {
+				t.Errorf("%s: error %q is JSON", name, w.Body)
+			}
+			continue
+		}
+		body := decode(t, w)
+		e, _ := body["error"].(map[string]interface{})
+		if body["status"] != "error" || e == nil || e["code"] != 502.0 || e["message"] != "down" {
+			t.Errorf("%s: error body %v", name, body)
+		}
+	}
+}
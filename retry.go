@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// retryPolicy retries upstream requests that fail transiently.
+type retryPolicy struct {
+	attempts int           // retries after the first try; 0 disables
+	backoff  time.Duration // before the first retry, doubling after
+}
+
+// upstreamRetry is the policy for every request to providers and
+// geocoders. main sets it from upstream.retries.
+var upstreamRetry retryPolicy
+
+// again reports whether to retry a request that failed with err after
+// attempt retries, having waited out the backoff. A retry is taken from
+// the budget in ctx, if there is one, and refused once it is spent.
+func (p retryPolicy) again(ctx context.Context, attempt int, err error) bool {
+	if attempt >= p.attempts || !transient(err) || ctx.Err() != nil {
+		return false
+	}
+	if b, _ := ctx.Value(retryBudgetKey{}).(*retryBudget); b != nil && !b.take() {
+		return false
+	}
+	t := time.NewTimer(p.backoff << attempt)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// transient reports whether err might not happen again: a 5xx, a 429
+// without a Retry-After, which is waited out instead, or a network failure
+// other than a certificate the upstream will keep presenting.
+func transient(err error) bool {
+	var rl rateLimitedError
+	if errors.As(err, &rl) && !rl.until.IsZero() {
+		return false
+	}
+	var se statusError
+	if errors.As(err, &se) {
+		return se.status == http.StatusTooManyRequests || se.status >= 500
+	}
+	if errors.As(err, new(*tls.CertificateVerificationError)) {
+		return false
+	}
+	var ne net.Error
+	return errors.As(err, &ne)
+}
+
+// retryBudget caps the retries every provider makes for one lookup
+// together, so a lookup during a wide outage can't multiply into dozens of
+// upstream calls.
+type retryBudget struct {
+	left atomic.Int64
+}
+
+type retryBudgetKey struct{}
+
+// withRetryBudget gives ctx a budget of n retries; 0 leaves it unlimited.
+func withRetryBudget(ctx context.Context, n int) context.Context {
+	if n <= 0 {
+		return ctx
+	}
+	b := &retryBudget{}
+	b.left.Store(int64(n))
+	return context.WithValue(ctx, retryBudgetKey{}, b)
+}
+
+func (b *retryBudget) take() bool {
+	return b.left.Add(-1) >= 0
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// withRetries sets upstreamRetry for the rest of the test.
+func withRetries(t *testing.T, attempts int) {
+	old := upstreamRetry
+	upstreamRetry = retryPolicy{attempts: attempts, backoff: time.Millisecond}
+	t.Cleanup(func() { upstreamRetry = old })
+}
+
+func TestTransient(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"503", statusError{host: "api.example.com", status: 503}, true},
+		{"429", fmt.Errorf("wrapped: %w", statusError{host: "api.example.com", status: 429}), true},
+		{"404", statusError{host: "api.example.com", status: 404}, false},
+		{"429 with a Retry-After", rateLimitedError{host: "api.example.com", until: time.Now().Add(time.Minute)}, false},
+		{"network", &net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{"undecodable", errors.New("invalid character"), false},
+	} {
+		if got := transient(tt.err); got != tt.want {
+			t.Errorf("%s: %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRetryTransientFailures(t *testing.T) {
+	var calls atomic.Int32
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"ok": true}`))
+	}))
+
+	withRetries(t, 1)
+	if err := getJSON(context.Background(), "http://api.example.com/", &struct{}{}); err == nil || calls.Load() != 2 {
+		t.Errorf("%v after %d calls, want the failure after one retry", err, calls.Load())
+	}
+
+	calls.Store(0)
+	withRetries(t, 5)
+	if err := getJSON(context.Background(), "http://api.example.com/", &struct{}{}); err != nil || calls.Load() != 3 {
+		t.Errorf("%v after %d calls, want success on the third", err, calls.Load())
+	}
+}
+
+func TestRetryNotTransient(t *testing.T) {
+	var calls atomic.Int32
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.NotFound(w, r)
+	}))
+	withRetries(t, 5)
+	getJSON(context.Background(), "http://api.example.com/", &struct{}{})
+	if calls.Load() != 1 {
+		t.Errorf("a 404 was tried %d times, want once", calls.Load())
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	var calls atomic.Int32
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+	}))
+	withRetries(t, 5)
+
+	for _, tt := range []struct {
+		budget int
+		want   int32
+	}{
+		// Each request's first try, then the shared retries.
+		{3, 4 + 3},
+		{0, 4 * (1 + 5)},
+	} {
+		calls.Store(0)
+		ctx := withRetryBudget(context.Background(), tt.budget)
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				getJSON(ctx, "http://api.example.com/", &struct{}{})
+			}()
+		}
+		wg.Wait()
+		if calls.Load() != tt.want {
+			t.Errorf("budget %d: %d upstream calls, want %d", tt.budget, calls.Load(), tt.want)
+		}
+	}
+}
+
+// budgetProvider reports the retries left in the budget it is called with.
+type budgetProvider struct {
+	*fakeProvider
+	left atomic.Int64
+}
+
+func (p *budgetProvider) temperature(ctx context.Context, city string) (reading, error) {
+	if b, _ := ctx.Value(retryBudgetKey{}).(*retryBudget); b != nil {
+		p.left.Store(b.left.Load())
+	}
+	return p.fakeProvider.temperature(ctx, city)
+}
+
+func TestRetryBudgetPerLookup(t *testing.T) {
+	p := &budgetProvider{fakeProvider: newFake("fake", 10)}
+	mw := newTestMW(p)
+	mw.retryBudget = 7
+	if _, err := mw.aggregate(context.Background(), "London"); err != nil {
+		t.Fatal(err)
+	}
+	if p.left.Load() != 7 {
+		t.Errorf("provider called with %d retries left, want the lookup's 7", p.left.Load())
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"slices"
+	"sort"
+	"time"
+)
+
+// rotation narrows each lookup to the primaries providers in the best
+// shape: healthy, by health, and with the largest share of their daily
+// quota left. Equals take turns, the order among them shifting every
+// interval, so load spreads across the providers rather than always
+// falling on the first ones configured.
+type rotation struct {
+	primaries int
+	interval  time.Duration
+}
+
+// choose returns the primaries among providers, those with the highest
+// standing, in configuration order, along with any required ones. A nil
+// rotation chooses them all.
+func (rt *rotation) choose(providers []weatherProvider, standing func(provider string) float64, required []string) []weatherProvider {
+	if rt == nil || len(providers) <= rt.primaries {
+		return providers
+	}
+	turn := int(time.Now().UnixNano()/int64(rt.interval)) % len(providers)
+	ranked := append(slices.Clone(providers[turn:]), providers[:turn]...)
+	score := make(map[string]float64, len(providers))
+	for _, p := range providers {
+		score[p.name()] = standing(p.name())
+	}
+	sort.SliceStable(ranked, func(i, j int) bool { return score[ranked[i].name()] > score[ranked[j].name()] })
+	chosen := make(map[string]bool, rt.primaries+len(required))
+	for _, p := range ranked[:rt.primaries] {
+		chosen[p.name()] = true
+	}
+	for _, name := range required {
+		chosen[name] = true
+	}
+	primaries := make([]weatherProvider, 0, len(chosen))
+	for _, p := range providers {
+		if chosen[p.name()] {
+			primaries = append(primaries, p)
+		}
+	}
+	return primaries
+}
+
+// standing rates provider from 0 to 1 for rotation: its health, scaled by
+// the share of its daily quota left.
+func (w multiWeatherProvider) standing(provider string) float64 {
+	return w.health(provider) * w.quota.remaining(provider)
+}
+
+// byQuota orders providers by the share of their daily quota left, most
+// first, keeping configuration order among equals.
+func (w multiWeatherProvider) byQuota(providers []weatherProvider) []weatherProvider {
+	ordered := slices.Clone(providers)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return w.quota.remaining(ordered[i].name()) > w.quota.remaining(ordered[j].name())
+	})
+	return ordered
+}
+
+// health rates provider from 0 to 1 by what the breaker and weights, where
+// configured, have seen of it: 0 while its circuit is open, and less the
+// more it has been failing.
+func (w multiWeatherProvider) health(provider string) float64 {
+	return w.breaker.health(provider) * w.weights.health(provider)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func names(providers []weatherProvider) string {
+	var ns []string
+	for _, p := range providers {
+		ns = append(ns, p.name())
+	}
+	return strings.Join(ns, ",")
+}
+
+func TestRotationFavorsHealthyUnderQuota(t *testing.T) {
+	healthy, open, exhausted, half := newFake("healthy", 10), newFake("open", 20), newFake("exhausted", 30), newFake("half", 40)
+	mw := newTestMW(open, exhausted, half, healthy)
+	mw.breaker = newCircuitBreaker(1, time.Hour)
+	mw.breaker.record("open", errors.New("down"))
+	mw.quota = &quotaTracker{limits: map[string]int{"exhausted": 1, "half": 10}, used: map[string]int{"exhausted": 1, "half": 5}}
+	mw.rotation = &rotation{primaries: 2, interval: time.Hour}
+
+	agg, err := mw.aggregate(context.Background(), "London")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agg.celsius != 25 || len(agg.warnings) != 0 {
+		t.Errorf("mean %v with warnings %q, want healthy's and half's 25 and the rest left out quietly", agg.celsius, agg.warnings)
+	}
+	for _, p := range []*fakeProvider{open, exhausted} {
+		if p.calls.Load() != 0 {
+			t.Errorf("%s called %d times, over healthier providers", p.label, p.calls.Load())
+		}
+	}
+}
+
+func TestRotationRequired(t *testing.T) {
+	a, b, c := newFake("a", 10), newFake("b", 20), newFake("c", 30)
+	rt := &rotation{primaries: 1, interval: time.Hour}
+	health := func(provider string) float64 {
+		if provider == "a" {
+			return 1
+		}
+		return 0.5
+	}
+	// Required providers come on top of the primaries, in configuration
+	// order.
+	if got := names(rt.choose([]weatherProvider{c, b, a}, health, []string{"c"})); got != "c,a" {
+		t.Errorf("chose %s, want c,a", got)
+	}
+
+	var off *rotation
+	if got := names(off.choose([]weatherProvider{a, b, c}, health, nil)); got != "a,b,c" {
+		t.Errorf("a nil rotation chose %s, want every provider", got)
+	}
+	if got := names((&rotation{primaries: 3}).choose([]weatherProvider{a, b, c}, health, nil)); got != "a,b,c" {
+		t.Errorf("three primaries of three chose %s", got)
+	}
+}
+
+func TestRotationTakesTurns(t *testing.T) {
+	providers := []weatherProvider{newFake("a", 10), newFake("b", 20), newFake("c", 30)}
+	// Equals change places every nanosecond here.
+	rt := &rotation{primaries: 1, interval: time.Nanosecond}
+	seen := make(map[string]bool)
+	for i := 0; i < 1000 && len(seen) < 3; i++ {
+		seen[names(rt.choose(providers, func(string) float64 { return 1 }, nil))] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("chose only %v, want equals to take turns", seen)
+	}
+
+	rt.interval = time.Hour
+	first := names(rt.choose(providers, func(string) float64 { return 1 }, nil))
+	if again := names(rt.choose(providers, func(string) float64 { return 1 }, nil)); again != first {
+		t.Errorf("chose %s then %s within one interval", first, again)
+	}
+}
+
+func TestProviderHealthFactors(t *testing.T) {
+	b := newCircuitBreaker(2, time.Hour)
+	if h := b.health("p"); h != 1 {
+		t.Errorf("health %v before any failure, want 1", h)
+	}
+	b.record("p", errors.New("down"))
+	if h := b.health("p"); !near(h, 2.0/3) {
+		t.Errorf("health %v after one failure of two, want 2/3", h)
+	}
+	b.record("p", errors.New("down"))
+	if h := b.health("p"); h != 0 {
+		t.Errorf("health %v with the circuit open, want 0", h)
+	}
+
+	q := &quotaTracker{limits: map[string]int{"p": 4, "none": 0}, used: map[string]int{"p": 1}}
+	for provider, want := range map[string]float64{"p": 0.75, "none": 0, "unlimited": 1} {
+		if got := q.remaining(provider); got != want {
+			t.Errorf("%s: remaining %v, want %v", provider, got, want)
+		}
+	}
+	var none *quotaTracker
+	if none.remaining("p") != 1 || (*providerWeights)(nil).health("p") != 1 || (*circuitBreaker)(nil).health("p") != 1 {
+		t.Error("unconfigured factors don't count a provider as healthy")
+	}
+}
+
+func TestRotationConfig(t *testing.T) {
+	var conf config
+	if err := json.Unmarshal([]byte(`{"rotation": {"primaries": 2}, "quotas": {"openWeatherMap": 100},
+		"providers": [{"type": "openweathermap"}, {"type": "weatherunderground"}, {"type": "forecastio"}]}`), &conf); err != nil {
+		t.Fatal(err)
+	}
+	mw, err := getMultiWeatherProvider(conf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mw.rotation == nil || mw.rotation.primaries != 2 || mw.rotation.interval != time.Minute {
+		t.Errorf("rotation %+v, want 2 primaries every 1m", mw.rotation)
+	}
+	if s := mw.standing("openWeatherMap"); s != 1 {
+		t.Errorf("standing %v with all its quota left, want 1", s)
+	}
+}
+
+func TestByQuota(t *testing.T) {
+	a, b, c, d := newFake("a", 10), newFake("b", 20), newFake("c", 30), newFake("d", 40)
+	mw := newTestMW(a, b, c, d)
+	// c has no quota, so counts as having all of it left.
+	mw.quota = &quotaTracker{limits: map[string]int{"a": 10, "b": 10, "d": 10}, used: map[string]int{"a": 8, "b": 2, "d": 8}}
+	if got := names(mw.byQuota(mw.providers)); got != "c,b,a,d" {
+		t.Errorf("ordered %s, want c,b,a,d: most quota left first, then configuration order", got)
+	}
+	if got := names(mw.providers); got != "a,b,c,d" {
+		t.Errorf("byQuota reordered its argument to %s", got)
+	}
+}
+
+func TestQuotaOrderSequential(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		order   []string
+		running maxCounter
+	)
+	var providers []weatherProvider
+	for i, label := range []string{"a", "b", "c"} {
+		providers = append(providers, orderedProvider{newFake(label, float64(i)), &mu, &order, &running})
+	}
+	mw := newTestMW(providers...)
+	mw.sequential, mw.quotaOrder = true, true
+	mw.quota = &quotaTracker{limits: map[string]int{"a": 10, "b": 10, "c": 10}, used: map[string]int{"a": 9, "b": 5}}
+	if _, err := mw.aggregate(context.Background(), "London"); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(order, ","); got != "c,b,a" {
+		t.Errorf("called %s, want c,b,a by quota left", got)
+	}
+
+	order = nil
+	mw.quotaOrder = false
+	if _, err := mw.aggregate(context.Background(), "London"); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(order, ","); got != "a,b,c" {
+		t.Errorf("called %s without quotaOrder, want configuration order", got)
+	}
+}
+
+func TestQuotaOrderConfig(t *testing.T) {
+	for _, tt := range []struct {
+		conf string
+		want bool
+	}{
+		{`{"quotaOrder": true, "quotas": {"openWeatherMap": 100}, "providers": [{"type": "openweathermap"}]}`, true},
+		// Without quotas there is nothing to order by.
+		{`{"quotaOrder": true, "providers": [{"type": "openweathermap"}]}`, false},
+		{`{"quotas": {"openWeatherMap": 100}, "providers": [{"type": "openweathermap"}]}`, false},
+	} {
+		var conf config
+		if err := json.Unmarshal([]byte(tt.conf), &conf); err != nil {
+			t.Fatal(err)
+		}
+		mw, err := getMultiWeatherProvider(conf, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mw.quotaOrder != tt.want {
+			t.Errorf("%s: quotaOrder %v, want %v", tt.conf, mw.quotaOrder, tt.want)
+		}
+	}
+}
+
+func TestQuotaOrderFirstPriority(t *testing.T) {
+	// Providers first.priority lists still go first; the rest follow by
+	// quota left.
+	scarce, roomy, preferred := newFake("scarce", 10), newFake("roomy", 20), newFake("preferred", 30)
+	preferred.err = errors.New("down")
+	mw := newTestMW(scarce, roomy, preferred)
+	mw.aggregation, mw.priority, mw.stagger = firstAggregation, []string{"preferred"}, 200*time.Millisecond
+	mw.quotaOrder = true
+	mw.quota = &quotaTracker{limits: map[string]int{"scarce": 10, "roomy": 10}, used: map[string]int{"scarce": 9, "roomy": 1}}
+
+	agg, err := mw.aggregate(context.Background(), "London")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agg.readings[0].provider != "roomy" || preferred.calls.Load() != 1 || scarce.calls.Load() != 0 {
+		t.Errorf("%s won, want roomy after preferred failed and before scarce", agg.readings[0].provider)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"hash/fnv"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// requestID is the request's X-Request-Id, or a random one if it has none.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-Id"); id != "" {
+		return id
+	}
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// sampled reports whether the request with id is among the rate, from 0 to
+// 1, of requests logged in full. The same id is always sampled or not, so
+// a request retried with its ID, or traced across services that sample
+// alike, is logged everywhere or nowhere.
+func sampled(id string, rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	return float64(h.Sum64()%1_000_000) < rate*1_000_000
+}
+
+// logIfSampled logs req in full if it is sampled: what each provider
+// answered for it and how long it took.
+func (s *server) logIfSampled(req *http.Request, res *weatherResult) {
+	if s.sampleRate <= 0 {
+		return
+	}
+	id := requestID(req)
+	if !sampled(id, s.sampleRate) {
+		return
+	}
+	providers := make([]any, 0, len(res.agg.readings))
+	for _, r := range res.agg.readings {
+		providers = append(providers, slog.Group(r.provider, "celsius", r.celsius, "took", r.took, "cached", r.cached))
+	}
+	slog.Info("sampled request", "id", id, "city", res.city, "celsius", res.agg.celsius, "took", time.Since(res.begin),
+		"cache_hit", res.cacheHit, "warnings", res.agg.warnings, slog.Group("providers", providers...))
+}
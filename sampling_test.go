@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSampledRate(t *testing.T) {
+	n := 0
+	for i := 0; i < 100_000; i++ {
+		if sampled(fmt.Sprintf("req-%d", i), 0.01) {
+			n++
+		}
+	}
+	if got := float64(n) / 100_000; math.Abs(got-0.01) > 0.002 {
+		t.Errorf("sampled %.3f%% of requests at a rate of 1%%", got*100)
+	}
+	for _, id := range []string{"", "abc", "req-1"} {
+		if sampled(id, 0) || !sampled(id, 1) {
+			t.Errorf("%q: sampled at a rate of 0, or not at 1", id)
+		}
+	}
+}
+
+func TestSampledDeterministic(t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		id := fmt.Sprintf("req-%d", i)
+		if sampled(id, 0.1) != sampled(id, 0.1) {
+			t.Fatalf("%s sampled one time and not the next", id)
+		}
+		// Raising the rate only adds requests to the sample.
+		if sampled(id, 0.1) && !sampled(id, 0.2) {
+			t.Errorf("%s sampled at 10%% but not at 20%%", id)
+		}
+	}
+}
+
+func TestLogIfSampled(t *testing.T) {
+	logs := captureLog(t)
+	s := newTestServer(newFake("a", 10), newFake("b", 12))
+	s.sampleRate = 1
+	r := httptest.NewRequest("GET", "/weather/London", nil)
+	r.Header.Set("X-Request-Id", "abc123")
+	s.handleWeather(httptest.NewRecorder(), r)
+
+	var line struct {
+		Msg       string
+		ID        string
+		City      string
+		Celsius   float64
+		Providers map[string]struct {
+			Celsius float64
+			Cached  bool
+		}
+	}
+	for _, l := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		if json.Unmarshal([]byte(l), &line) == nil && line.Msg == "sampled request" {
+			break
+		}
+	}
+	if line.Msg != "sampled request" {
+		t.Fatalf("no sampled request in %s", logs)
+	}
+	if line.ID != "abc123" || line.City != "London" || line.Celsius != 11 {
+		t.Errorf("logged %+v, want request abc123 for London at 11°C", line)
+	}
+	if len(line.Providers) != 2 || line.Providers["a"].Celsius != 10 || line.Providers["b"].Celsius != 12 {
+		t.Errorf("providers %+v, want a and b's readings", line.Providers)
+	}
+}
+
+func TestLogIfSampledOff(t *testing.T) {
+	logs := captureLog(t)
+	s := newTestServer(newFake("a", 10))
+	get(s.handleWeather, "/weather/London")
+	if strings.Contains(logs.String(), "sampled request") {
+		t.Errorf("logged with no sample rate: %s", logs)
+	}
+}
@@ -0,0 +1,721 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type server struct {
+	mw           multiWeatherProvider
+	metrics      *serverMetrics
+	geocoder     geocoder
+	tracer       *tracer
+	cache        cache
+	cacheTTL     time.Duration
+	cacheJitter  time.Duration
+	errorTTL     time.Duration // how long failed lookups are remembered
+	flights      flightGroup
+	trends       *trendStore
+	staleOnError bool
+	defaultUnit  unit
+	kelvin       bool // add "kelvin" to /weather/ responses unless ?kelvin=false
+	asOf         bool // add "as_of" to /weather/ responses
+	cardinal     bool // add the wind's compass point to /weather/ responses
+	confidence   confidenceScorer
+	// errorCategories adds each failed provider's errorCategory to
+	// /readings/, /diagnose/ and /weather/ warnings and detail.
+	errorCategories bool
+
+	batchMaxSize  int
+	batchPageSize int
+	pool          *workerPool
+	batchTimeout  time.Duration
+	batchLogging  batchLogging
+	maxBodyBytes  int64
+
+	// slowThreshold, if set, logs requests that take longer than it.
+	slowThreshold time.Duration
+	tookFormat    tookFormat
+	// partialContent answers partial results with 206 rather than 200.
+	partialContent bool
+	// minResponseTime pads /weather/ responses to at least this long; it
+	// is only set in debug mode.
+	minResponseTime time.Duration
+
+	streamInterval time.Duration
+	// stopping is closed when the server shuts down, ending streams that
+	// would otherwise hold the shutdown up.
+	stopping chan struct{}
+
+	// readyCity is looked up to check that providers are reachable.
+	readyCity string
+	readiness readiness
+
+	ipLocator      ipLocator
+	trustedProxies trustedProxies
+
+	// climate, if set, answers with a city's climatological average when
+	// the providers fail and the cache has nothing to offer.
+	climate climate
+
+	// requireQualifier rejects /weather/ cities without a region or
+	// country after a comma.
+	requireQualifier bool
+
+	// degradedProvider answers cache misses alone while the server is
+	// near its in-flight limit.
+	degradedProvider weatherProvider
+
+	// outage, if set, fails lookups at once for a while after enough in
+	// a row have had no provider answer.
+	outage *circuitBreaker
+
+	// sampleRate is the fraction of /weather/ requests logged in full.
+	sampleRate float64
+	// cacheOnlyAll answers every lookup from the cache, never calling the
+	// providers; see cacheOnly.
+	cacheOnlyAll bool
+
+	// zones, if set, adds the city's local time to /weather/ responses.
+	zones *zoneResolver
+
+	// method adds how the temperature was computed to detail responses.
+	method bool
+	// provenance adds each reading's provenance to detail responses.
+	provenance bool
+
+	// signalDegraded names any degraded state /weather/ answers in
+	// under in degradedHeader.
+	signalDegraded bool
+}
+
+// weatherResult is the outcome of a /weather/ lookup, before it is shaped
+// into the response of a particular API version.
+type weatherResult struct {
+	city     string
+	agg      aggregate
+	unit     unit
+	zone     *time.Location // ?tz=, for timestamps; nil keeps their own
+	allUnits bool           // ?units=all: temps in every unit, temp in the default
+	kelvin   bool           // add the temperature in Kelvin, whatever unit
+	asOf     bool           // add when agg is as of
+	cardinal bool           // name the wind's compass point
+	stale    bool
+	cacheHit bool
+	fallback bool // a climatological average; see server.climate
+	degraded bool // answered by one provider to shed load
+	detail   bool
+	trend    string // "rising", "falling", "steady" or "" if unknown
+	begin    time.Time
+	took     tookFormat
+	// detailFields, if set, are the per-provider fields to keep, and
+	// native adds each provider's temperature as sent.
+	detailFields map[string]bool
+	native       bool
+	// categories adds each failure's errorCategory to warnings and detail.
+	categories bool
+	// localTime is ?when= in the city's time zone, if it was resolved.
+	localTime time.Time
+	// method, if set, describes how agg was computed; see
+	// multiWeatherProvider.method.
+	method map[string]interface{}
+	// requested is the city as asked for, before hereCity is located,
+	// and provenance adds where each reading came from; see
+	// weatherResult.provenanceChains.
+	requested  string
+	provenance bool
+	// confidence scores agg as of begin.
+	confidence confidenceScorer
+}
+
+// partial reports whether res leaves providers out: some were skipped,
+// excluded or timed out, only the degraded provider was asked, or none
+// answered and it is a climatological average.
+func (res weatherResult) partial() bool {
+	return len(res.agg.warnings) > 0 || res.degraded || res.fallback
+}
+
+// weatherRenderer shapes a weatherResult into a JSON response body.
+type weatherRenderer func(res weatherResult) interface{}
+
+func (s *server) handleWeather(w http.ResponseWriter, r *http.Request) {
+	s.serveWeather(w, r, func(res weatherResult) interface{} { return res.fields() })
+}
+
+func (s *server) serveWeather(w http.ResponseWriter, r *http.Request, render weatherRenderer) {
+	res := weatherResult{begin: time.Now(), took: s.tookFormat, confidence: s.confidence}
+	res.city = strings.SplitN(r.URL.Path, "/", 3)[2]
+	res.requested = res.city
+
+	ctx, span := s.tracer.start(r.Context(), "GET /weather/")
+	defer span.finish()
+	span.setAttr("city", res.city)
+	defer s.logIfSlow(&res)
+	defer s.logIfSampled(r, &res)
+
+	var err error
+	if strings.EqualFold(r.URL.Query().Get("units"), "all") {
+		res.unit, res.allUnits = s.defaultUnit, true
+	} else {
+		res.unit, err = s.requestUnit(r)
+	}
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if tz := r.URL.Query().Get("tz"); tz != "" {
+		if res.zone, err = time.LoadLocation(tz); err != nil {
+			writeError(w, r, "unknown time zone "+tz, http.StatusBadRequest)
+			return
+		}
+	}
+	res.detail, _ = strconv.ParseBool(r.URL.Query().Get("detail"))
+	res.native, _ = strconv.ParseBool(r.URL.Query().Get("native"))
+	res.kelvin, res.asOf, res.cardinal, res.categories = s.kelvin, s.asOf, s.cardinal, s.errorCategories
+	if q := r.URL.Query().Get("kelvin"); q != "" {
+		if res.kelvin, err = strconv.ParseBool(q); err != nil {
+			writeError(w, r, "kelvin must be true or false", http.StatusBadRequest)
+			return
+		}
+	}
+	fields, err := parseFields(r.URL.Query().Get("fields"), weatherFields)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if res.detailFields, err = parseFields(r.URL.Query().Get("detail_fields"), detailFields); err != nil {
+		writeError(w, r, "detail_fields: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	key := cacheKey{aggregation: s.mw.aggregation}
+	if q := r.URL.Query().Get("agg"); q != "" {
+		if key.aggregation, err = parseAggregation(q); err != nil {
+			writeError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if q := r.URL.Query().Get("providers"); q != "" {
+		if key.providers, err = s.mw.selection(q); err != nil {
+			writeError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if q := r.URL.Query().Get("min_tier"); q != "" {
+		if key.minTier, err = s.mw.minTier(q); err != nil {
+			writeError(w, r, "min_tier: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if q := r.URL.Query().Get("cache_only"); q != "" {
+		only, err := strconv.ParseBool(q)
+		if err != nil {
+			writeError(w, r, "cache_only must be true or false", http.StatusBadRequest)
+			return
+		}
+		if only {
+			ctx = withCacheOnly(ctx)
+		}
+	}
+
+	when, err := parseWhen(r.URL.Query().Get("when"))
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if when > whenTolerance || when < -whenTolerance {
+		writeError(w, r, "when="+r.URL.Query().Get("when")+" is too far from now; only the current weather is available", http.StatusBadRequest)
+		return
+	}
+
+	if s.requireQualifier && res.city != hereCity && !strings.Contains(res.city, ",") {
+		writeError(w, r, "qualify "+res.city+" with a region or country, e.g. "+res.city+",US", http.StatusBadRequest)
+		return
+	}
+	if res.city == hereCity && s.ipLocator == nil {
+		writeError(w, r, "IP geolocation is not configured", http.StatusNotFound)
+		return
+	}
+	key.city = res.city
+	var pt point // where res.city is, if located
+	located := res.city == hereCity
+	if located && s.cacheOnly(ctx) {
+		// Located lookups aren't cached.
+		err = errNotCached
+	} else if located {
+		if pt, err = s.locateClient(ctx, r); err == nil {
+			res.city = pt.String()
+			key.city = res.city
+			res.agg, err = s.mw.forKey(key).aggregateAt(ctx, pt)
+		}
+	} else if degraded(r) && s.degradedProvider != nil && !s.cacheOnly(ctx) && s.mw.tierOf(s.degradedProvider.name()) >= key.minTier {
+		res.agg, res.cacheHit, res.degraded, err = s.aggregateDegraded(ctx, key)
+	} else {
+		res.agg, res.cacheHit, err = s.aggregate(ctx, key)
+	}
+	// Cache-only lookups would rather be stale than unanswered.
+	if err != nil && (s.staleOnError || errors.Is(err, errNotCached)) {
+		if e, ok := s.cache.get(key.String()); ok && !e.expires.IsZero() {
+			res.agg, res.stale, err = e.agg, e.expired(time.Now()), nil
+		}
+	}
+	// Refusals to answer, unlike failures, aren't papered over.
+	if err != nil && s.climate != nil && !errors.As(err, new(consensusError)) && !errors.As(err, new(ambiguousError)) {
+		if avg, ok := s.climate.average(res.city, time.Now()); ok {
+			slog.Warn("falling back to the climatological average", "city", res.city, "err", err)
+			res.agg, res.fallback, err = avg, true, nil
+		}
+	}
+	span.setStatus(err)
+	s.pad(ctx, res.begin)
+	if err != nil {
+		code := http.StatusInternalServerError
+		var outage outageError
+		if errors.As(err, new(consensusError)) {
+			code = http.StatusConflict
+		} else if errors.As(err, new(ambiguousError)) {
+			code = http.StatusMultipleChoices
+		} else if errors.As(err, &outage) {
+			code = http.StatusServiceUnavailable
+			w.Header().Set("Retry-After", outage.retryAfterSeconds())
+			if s.signalDegraded {
+				setDegraded(w.Header(), degradedOutage)
+			}
+		} else if errors.Is(err, errNotCached) {
+			code = http.StatusServiceUnavailable
+		}
+		writeError(w, r, err.Error(), code)
+		return
+	}
+	res.trend = s.trends.trend(key.String(), time.Now(), res.agg.celsius)
+	if s.zones != nil {
+		var zone *time.Location
+		if located {
+			zone, err = s.zones.at(ctx, pt)
+		} else {
+			zone, err = s.zones.forCity(ctx, res.city)
+		}
+		if err != nil {
+			slog.Warn("local time unknown", "city", res.city, "err", err)
+		} else {
+			res.localTime = res.begin.Add(when).In(zone)
+		}
+	}
+	res.provenance = s.provenance && res.detail
+	if s.method && res.detail {
+		switch {
+		case res.fallback:
+			res.method = map[string]interface{}{"aggregation": "climatology"}
+		case res.degraded:
+			res.method = s.degradedMW().method()
+		default:
+			res.method = s.mw.forKey(key).method()
+		}
+	}
+
+	code := http.StatusOK
+	if s.partialContent && res.partial() {
+		code = http.StatusPartialContent
+	}
+	w.Header().Add("Vary", "Accept")
+	if s.signalDegraded {
+		setDegraded(w.Header(), res.degradations()...)
+	}
+	if wantsGeoJSON(r) {
+		if !located {
+			if pt, err = s.geocoder.geocode(ctx, res.city); err != nil {
+				writeError(w, r, "can't place "+res.city+" for GeoJSON: "+err.Error(), http.StatusBadGateway)
+				return
+			}
+		}
+		writeGeoJSON(w, r, code, geoJSONFeature(pt, selectFields(render(res), fields)))
+		return
+	}
+	writeJSONStatus(w, r, code, selectFields(render(res), fields))
+}
+
+// pad holds a response back until it has taken at least minResponseTime,
+// or its request ends.
+func (s *server) pad(ctx context.Context, begin time.Time) {
+	wait := s.minResponseTime - time.Since(begin)
+	if wait <= 0 {
+		return
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
+
+// logIfSlow warns about a request that took longer than the slow threshold,
+// with the time each provider took.
+func (s *server) logIfSlow(res *weatherResult) {
+	took := time.Since(res.begin)
+	if s.slowThreshold <= 0 || took <= s.slowThreshold {
+		return
+	}
+	providers := make([]any, 0, len(res.agg.readings))
+	for _, r := range res.agg.readings {
+		providers = append(providers, slog.Duration(r.provider, r.took))
+	}
+	slog.Warn("slow request", "city", res.city, "took", took, slog.Group("providers", providers...))
+}
+
+// fields is the body of the unversioned /weather/ response.
+func (res weatherResult) fields() map[string]interface{} {
+	u, agg := res.unit, res.agg
+	resp := map[string]interface{}{
+		"city": res.city,
+		"temp": u.fromCelsius(agg.celsius),
+	}
+	res.took.set(resp, res.begin)
+	if res.kelvin {
+		resp["kelvin"] = kelvin.fromCelsius(agg.celsius)
+	}
+	if agg.place != "" {
+		resp["place"] = agg.place
+	}
+	if res.asOf && !agg.asOf.IsZero() {
+		resp["as_of"] = timestamp(agg.asOf, res.zone)
+	}
+	if !res.localTime.IsZero() {
+		resp["local_time"] = res.localTime.Format(time.RFC3339)
+		resp["time_zone"] = res.localTime.Location().String()
+	}
+	if res.allUnits {
+		resp["temps"] = map[string]interface{}{
+			"celsius":    celsius.fromCelsius(agg.celsius),
+			"fahrenheit": fahrenheit.fromCelsius(agg.celsius),
+			"kelvin":     kelvin.fromCelsius(agg.celsius),
+		}
+	}
+	if agg.condition != "" {
+		resp["condition"] = agg.condition
+	}
+	if agg.icon != "" {
+		resp["icon"] = agg.icon
+	}
+	if agg.feelsLike != nil {
+		resp["feels_like"] = u.fromCelsius(*agg.feelsLike)
+	}
+	if wind := windFields(agg.windSpeed, agg.windBearing); wind != nil {
+		if res.cardinal && agg.windBearing != nil {
+			wind["cardinal"] = cardinal(*agg.windBearing)
+		}
+		resp["wind"] = wind
+	}
+	if agg.pressure != nil {
+		resp["pressure"] = *agg.pressure
+	}
+	if agg.uvIndex != nil {
+		resp["uv_index"] = *agg.uvIndex
+	}
+	if agg.precipProbability != nil {
+		resp["precip_probability"] = *agg.precipProbability
+	}
+	if agg.cloudCover != nil {
+		resp["cloud_cover"] = *agg.cloudCover
+	}
+	if !agg.sunrise.IsZero() {
+		resp["sunrise"] = timestamp(agg.sunrise, res.zone)
+		resp["sunset"] = timestamp(agg.sunset, res.zone)
+	}
+	resp["confidence"] = res.confidence.score(agg.readings, res.begin)
+	if res.trend != "" {
+		resp["trend"] = res.trend
+	}
+	if res.stale {
+		resp["stale"] = true
+	}
+	if res.degraded {
+		resp["degraded"] = true
+	}
+	if res.fallback {
+		resp["fallback"] = true
+	}
+	if len(agg.warnings) > 0 {
+		resp["warnings"] = agg.warningList(res.categories)
+	}
+	if res.detail {
+		details := selectDetailFields(providerDetails(agg.readings, u, res.zone, res.native), res.detailFields)
+		if res.categories {
+			for _, f := range agg.failures {
+				details = append(details, f.detail())
+			}
+		}
+		resp["providers"] = details
+		if sd := stddev(agg.readings); sd != nil {
+			// A spread scales with the unit but doesn't shift with it.
+			resp["stddev"] = u.fromCelsius(*sd) - u.fromCelsius(0)
+		}
+		if res.cacheHit {
+			resp["cache"] = "hit"
+		} else {
+			resp["cache"] = "miss"
+		}
+		if res.method != nil {
+			resp["method"] = res.method
+		}
+		if res.provenance {
+			resp["provenance"] = res.provenanceChains()
+		}
+	}
+	return resp
+}
+
+// timestamp formats t for a response, in zone if one was asked for.
+// Otherwise sunrise and sunset keep the location's zone, and observation
+// times, which carry none, are given in UTC.
+func timestamp(t time.Time, zone *time.Location) string {
+	if zone != nil {
+		t = t.In(zone)
+	}
+	return t.Format(time.RFC3339)
+}
+
+// providerDetails lists the individual readings behind an aggregate, for
+// ?detail=true, with timestamps in zone if it is set and, if native is,
+// each temperature as the provider sent it.
+func providerDetails(readings []reading, u unit, zone *time.Location, native bool) []map[string]interface{} {
+	details := make([]map[string]interface{}, 0, len(readings))
+	for _, r := range readings {
+		d := map[string]interface{}{
+			"provider": r.provider,
+			"temp":     u.fromCelsius(r.celsius),
+		}
+		if a, ok := attributions[r.provider]; ok {
+			d["attribution"] = a
+		}
+		if native && r.native.unit != "" {
+			d["native"] = map[string]interface{}{"value": r.native.value, "unit": r.native.unit}
+		}
+		if r.place != "" {
+			d["place"] = r.place
+		}
+		if r.condition != "" {
+			d["condition"] = r.condition
+		}
+		if r.icon != "" {
+			d["icon"] = r.icon
+		}
+		if r.cached {
+			d["cached"] = true
+		}
+		if !r.observed.IsZero() {
+			d["observed"] = timestamp(r.observed.UTC(), zone)
+		}
+		if r.feelsLike != nil {
+			d["feels_like"] = u.fromCelsius(*r.feelsLike)
+		}
+		if wind := windFields(r.windSpeed, r.windBearing); wind != nil {
+			d["wind"] = wind
+		}
+		if r.pressure != nil {
+			d["pressure"] = *r.pressure
+		}
+		if r.uvIndex != nil {
+			d["uv_index"] = *r.uvIndex
+		}
+		if r.precipProbability != nil {
+			d["precip_probability"] = *r.precipProbability
+		}
+		if r.cloudCover != nil {
+			d["cloud_cover"] = *r.cloudCover
+		}
+		if r.elevation != nil {
+			d["elevation"] = *r.elevation
+		}
+		if r.altitudeCorrection != nil {
+			// Like stddev, a difference: scaled by the unit, not shifted.
+			d["altitude_correction"] = u.fromCelsius(*r.altitudeCorrection) - u.fromCelsius(0)
+		}
+		if len(r.stations) > 0 {
+			d["stations"] = providerDetails(r.stations, u, zone, native)
+		}
+		details = append(details, d)
+	}
+	return details
+}
+
+// windFields describes wind as {"speed": m/s, "bearing": degrees}, leaving
+// out whichever is unknown; nil if both are.
+func windFields(speed, bearing *float64) map[string]interface{} {
+	if speed == nil && bearing == nil {
+		return nil
+	}
+	wind := make(map[string]interface{})
+	if speed != nil {
+		wind["speed"] = *speed
+	}
+	if bearing != nil {
+		wind["bearing"] = *bearing
+	}
+	return wind
+}
+
+// compassPoints are the 16 points of the compass, clockwise from north.
+var compassPoints = [16]string{"N", "NNE", "NE", "ENE", "E", "ESE", "SE", "SSE", "S", "SSW", "SW", "WSW", "W", "WNW", "NW", "NNW"}
+
+// cardinal names the compass point nearest bearing, in degrees. Each point
+// covers 22.5°, starting half that before it: N is from 348.75° up to, but
+// not including, 11.25°.
+func cardinal(bearing float64) string {
+	i := int(math.Floor(math.Mod(bearing+11.25, 360) / 22.5))
+	if i < 0 {
+		i += 16
+	}
+	return compassPoints[i]
+}
+
+// requestUnit returns the units asked for with ?units=, falling back to the
+// deployment's default.
+func (s *server) requestUnit(r *http.Request) (unit, error) {
+	if q := r.URL.Query().Get("units"); q != "" {
+		return parseUnit(q)
+	}
+	return s.defaultUnit, nil
+}
+
+// aggregate serves k's city from the cache while its entry is fresh and
+// otherwise asks k's providers, combining their readings with its
+// aggregation and caching what they return. hit reports whether the cache
+// answered.
+func (s *server) aggregate(ctx context.Context, k cacheKey) (agg aggregate, hit bool, err error) {
+	if e, ok := s.cache.get(k.String()); ok {
+		now := time.Now()
+		if err := e.failing(now); err != nil {
+			s.metrics.cacheRequests.inc("hit")
+			return aggregate{}, true, err
+		}
+		if !e.expired(now) {
+			s.metrics.cacheRequests.inc("hit")
+			return e.agg, true, nil
+		}
+	}
+	s.metrics.cacheRequests.inc("miss")
+	if s.cacheOnly(ctx) {
+		return aggregate{}, false, errNotCached
+	}
+	agg, err = s.refresh(ctx, k)
+	return agg, false, err
+}
+
+// refreshTimeout bounds a shared lookup. It runs detached from the request
+// that started it, so that request going away doesn't fail the others
+// waiting on the same lookup.
+const refreshTimeout = 10 * time.Second
+
+// refresh asks k's providers for its city, whatever the cache holds, and
+// caches the result. Concurrent refreshes of the same key share one lookup.
+func (s *server) refresh(ctx context.Context, k cacheKey) (aggregate, error) {
+	if err := s.outage.admit(allProviders); err != nil {
+		return aggregate{}, outageError{err: err, retryAfter: s.outage.cooldown}
+	}
+	key := k.String()
+	agg, err, _ := s.flights.do(key, func() (aggregate, error) {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), refreshTimeout)
+		defer cancel()
+		agg, err := s.mw.forKey(k).aggregate(ctx, k.city)
+		switch {
+		case ctx.Err() != nil:
+			s.outage.abandon(allProviders)
+		case err != nil && len(agg.readings) == 0:
+			s.outage.record(allProviders, err)
+		default:
+			// Some provider answered, even if the aggregate failed.
+			s.outage.record(allProviders, nil)
+		}
+		if err == nil {
+			s.cache.set(key, agg, jitter(s.cacheTTL, s.cacheJitter), originOf(ctx))
+			s.trends.record(key, time.Now(), agg.celsius)
+			s.metrics.observeSpread(agg)
+		} else if s.errorTTL > 0 {
+			s.cache.setError(key, err, s.errorTTL)
+		}
+		return agg, err
+	})
+	return agg, err
+}
+
+// aggregateDegraded serves k's city from the cache while its entry is
+// fresh, as aggregate does, but otherwise asks only the degraded provider.
+// Its answer isn't cached, so full aggregates resume once load falls.
+func (s *server) aggregateDegraded(ctx context.Context, k cacheKey) (agg aggregate, hit, degraded bool, err error) {
+	key := k.String()
+	if e, ok := s.cache.get(key); ok && !e.expired(time.Now()) && e.failing(time.Now()) == nil {
+		s.metrics.cacheRequests.inc("hit")
+		return e.agg, true, false, nil
+	}
+	s.metrics.cacheRequests.inc("miss")
+	mw := s.degradedMW()
+	agg, err, _ = s.flights.do("degraded:"+key, func() (aggregate, error) {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), refreshTimeout)
+		defer cancel()
+		return mw.aggregate(ctx, k.city)
+	})
+	return agg, false, true, err
+}
+
+// degradedMW is s.mw narrowed to the degraded provider alone.
+func (s *server) degradedMW() multiWeatherProvider {
+	mw := s.mw
+	mw.providers, mw.overrides, mw.required = []weatherProvider{s.degradedProvider}, nil, nil
+	mw.aggregation, mw.consensusWithin = meanAggregation, 0
+	return mw
+}
+
+// jitter lengthens ttl by a random amount up to window, so entries cached
+// together do not all expire together.
+func jitter(ttl, window time.Duration) time.Duration {
+	if window <= 0 {
+		return ttl
+	}
+	return ttl + time.Duration(rand.Int63n(int64(window)))
+}
+
+type serverMetrics struct {
+	cacheRequests *counterVec
+	// spread is the difference between the highest and lowest readings
+	// behind each fresh aggregate of two or more. Spikes point at a
+	// misbehaving provider.
+	spread *histogram
+	// latency is each provider's response time over its recent calls,
+	// as p50, p95 and p99.
+	latency *summaryVec
+}
+
+// defaultSpreadBuckets bound the spread histogram, in °C, unless the config
+// sets its own.
+var defaultSpreadBuckets = []float64{0.5, 1, 2, 3, 5, 10}
+
+func newServerMetrics(reg *registry, spreadBuckets []float64) *serverMetrics {
+	if len(spreadBuckets) == 0 {
+		spreadBuckets = defaultSpreadBuckets
+	}
+	return &serverMetrics{
+		cacheRequests: reg.counterVec("gollo_cache_requests_total", "Aggregate cache lookups by result.", "result"),
+		spread:        reg.histogram("gollo_provider_spread_celsius", "Spread between the highest and lowest provider readings per aggregate.", spreadBuckets),
+		latency:       reg.summaryVec("gollo_provider_latency_seconds", "Time providers took to answer, over their last 1000 calls.", []float64{0.5, 0.95, 0.99}, 1000, "provider"),
+	}
+}
+
+// observeSpread records how far apart agg's readings are.
+func (m *serverMetrics) observeSpread(agg aggregate) {
+	if len(agg.readings) < 2 {
+		return
+	}
+	lo, hi := agg.readings[0].celsius, agg.readings[0].celsius
+	for _, r := range agg.readings[1:] {
+		lo, hi = math.Min(lo, r.celsius), math.Max(hi, r.celsius)
+	}
+	m.spread.observe(hi - lo)
+}
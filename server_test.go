@@ -0,0 +1,476 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStaleOnError(t *testing.T) {
+	p := &fakeProvider{label: "fake", err: errors.New("upstream down")}
+	s := newTestServer(p)
+	s.staleOnError = true
+	s.cache.set("mean:London", aggregate{celsius: 10, readings: []reading{{provider: "fake", celsius: 10}}}, -time.Minute, cacheOrigin{})
+
+	w := get(s.handleWeather, "/weather/London")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	body := decode(t, w)
+	if body["temp"] != 10.0 || body["stale"] != true {
+		t.Errorf("got %v, want the expired entry flagged stale", body)
+	}
+	if p.calls.Load() != 1 {
+		t.Errorf("provider called %d times, want 1", p.calls.Load())
+	}
+}
+
+func TestStaleOnErrorNothingCached(t *testing.T) {
+	s := newTestServer(&fakeProvider{label: "fake", err: errors.New("upstream down")})
+	s.staleOnError = true
+
+	if w := get(s.handleWeather, "/weather/London"); w.Code != http.StatusInternalServerError {
+		t.Errorf("status %d, want 500: %s", w.Code, w.Body)
+	}
+}
+
+func TestStaleOnErrorOff(t *testing.T) {
+	s := newTestServer(&fakeProvider{label: "fake", err: errors.New("upstream down")})
+	s.cache.set("mean:London", aggregate{celsius: 10}, -time.Minute, cacheOrigin{})
+
+	if w := get(s.handleWeather, "/weather/London"); w.Code != http.StatusInternalServerError {
+		t.Errorf("status %d, want 500: %s", w.Code, w.Body)
+	}
+}
+
+func TestFreshEntryNotStale(t *testing.T) {
+	p := newFake("fake", 20)
+	s := newTestServer(p)
+	s.staleOnError = true
+
+	get(s.handleWeather, "/weather/London")
+	body := decode(t, get(s.handleWeather, "/weather/London"))
+	if body["temp"] != 20.0 || body["stale"] != nil {
+		t.Errorf("got %v, want a fresh 20", body)
+	}
+	if p.calls.Load() != 1 {
+		t.Errorf("provider called %d times, want 1", p.calls.Load())
+	}
+}
+
+func TestDefaultUnits(t *testing.T) {
+	s := newTestServer(newFake("fake", 10))
+	s.defaultUnit = fahrenheit
+
+	for _, tt := range []struct {
+		query string
+		temp  float64
+	}{
+		{"", 50},
+		{"?units=c", 10},
+		{"?units=kelvin", 283.15},
+		{"?units=F", 50},
+	} {
+		w := get(s.handleWeather, "/weather/London"+tt.query)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%q: status %d: %s", tt.query, w.Code, w.Body)
+		}
+		if got := number(t, decode(t, w), "temp"); !near(got, tt.temp) {
+			t.Errorf("%q: temp %v, want %v", tt.query, got, tt.temp)
+		}
+	}
+	if w := get(s.handleWeather, "/weather/London?units=x"); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown units: status %d, want 400", w.Code)
+	}
+}
+
+func TestFeelsLikeUnits(t *testing.T) {
+	p := newFake("fake", 10)
+	p.reading.feelsLike = ptr(5.0)
+	s := newTestServer(p)
+
+	body := decode(t, get(s.handleWeather, "/weather/London?units=f"))
+	if got := number(t, body, "feels_like"); got != 41 {
+		t.Errorf("feels_like %v, want 41°F", got)
+	}
+}
+
+func TestSlowRequestLog(t *testing.T) {
+	fast := newFake("fast", 10)
+	slow := newFake("slow", 12)
+	slow.delay = 60 * time.Millisecond
+
+	for _, tt := range []struct {
+		providers []weatherProvider
+		logged    bool
+	}{
+		{[]weatherProvider{fast}, false},
+		{[]weatherProvider{fast, slow}, true},
+	} {
+		logs := captureLog(t)
+		s := newTestServer(tt.providers...)
+		s.slowThreshold = 30 * time.Millisecond
+		get(s.handleWeather, "/weather/London")
+
+		var line struct {
+			Msg       string
+			Level     string
+			Providers map[string]int64
+		}
+		for _, l := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+			json.Unmarshal([]byte(l), &line)
+			if line.Msg == "slow request" {
+				break
+			}
+		}
+		if got := line.Msg == "slow request"; got != tt.logged {
+			t.Errorf("%d providers: logged %v, want %v: %s", len(tt.providers), got, tt.logged, logs)
+			continue
+		}
+		if !tt.logged {
+			continue
+		}
+		if line.Level != "WARN" {
+			t.Errorf("level %s, want WARN", line.Level)
+		}
+		if took := time.Duration(line.Providers["slow"]); took < slow.delay {
+			t.Errorf("slow provider took %s, want at least %s: %s", took, slow.delay, logs)
+		}
+		if _, ok := line.Providers["fast"]; !ok {
+			t.Errorf("fast provider's time missing: %s", logs)
+		}
+	}
+}
+
+func TestCacheHitAfterMiss(t *testing.T) {
+	reg := newRegistry()
+	p := newFake("fake", 10)
+	s := newTestServer(p)
+	s.metrics = newServerMetrics(reg, nil)
+
+	for i, want := range []string{"miss", "hit", "hit"} {
+		body := decode(t, get(s.handleWeather, "/weather/London?detail=true"))
+		if body["cache"] != want {
+			t.Errorf("request %d: cache %v, want %s", i+1, body["cache"], want)
+		}
+	}
+	if got := decode(t, get(s.handleWeather, "/weather/Paris?detail=true"))["cache"]; got != "miss" {
+		t.Errorf("another city: cache %v, want miss", got)
+	}
+	if p.calls.Load() != 2 {
+		t.Errorf("provider called %d times, want once per city", p.calls.Load())
+	}
+
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{
+		`gollo_cache_requests_total{result="hit"} 2`,
+		`gollo_cache_requests_total{result="miss"} 2`,
+	} {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Errorf("/metrics lacks %s:\n%s", line, w.Body)
+		}
+	}
+}
+
+func TestJitterDistribution(t *testing.T) {
+	const ttl, window, n, buckets = time.Minute, 30 * time.Second, 10000, 10
+	var counts [buckets]int
+	for i := 0; i < n; i++ {
+		d := jitter(ttl, window)
+		if d < ttl || d >= ttl+window {
+			t.Fatalf("jittered TTL %s outside [%s, %s)", d, ttl, ttl+window)
+		}
+		counts[int((d-ttl)*buckets/window)]++
+	}
+	// Each bucket expects n/buckets = 1000, with a standard deviation of
+	// about 30; 200 either way is far outside chance.
+	for i, c := range counts {
+		if c < 800 || c > 1200 {
+			t.Errorf("bucket %d of the window holds %d of %d expirations: %v", i, c, n, counts)
+		}
+	}
+	if d := jitter(ttl, 0); d != ttl {
+		t.Errorf("no window: got %s, want %s", d, ttl)
+	}
+}
+
+func TestCachedExpirationsSpread(t *testing.T) {
+	s := newTestServer(newFake("fake", 10))
+	s.cacheJitter = time.Minute
+	begin := time.Now()
+	for i := 0; i < 200; i++ {
+		get(s.handleWeather, fmt.Sprintf("/weather/City%d", i))
+	}
+	var early, late int
+	for _, e := range s.cache.all() {
+		switch offset := e.expires.Sub(begin) - s.cacheTTL; {
+		case offset < 0 || offset > time.Minute+time.Second:
+			t.Fatalf("entry expires %s past its TTL, outside the jitter window", offset)
+		case offset < 30*time.Second:
+			early++
+		default:
+			late++
+		}
+	}
+	if early < 50 || late < 50 {
+		t.Errorf("%d entries expire in the window's first half and %d in its second; want them spread", early, late)
+	}
+}
+
+func TestProviderSpreadMetric(t *testing.T) {
+	reg := newRegistry()
+	s := newTestServer(newFake("a", 10), newFake("b", 12.5), newFake("c", 14))
+	s.metrics = newServerMetrics(reg, []float64{1, 5, 10})
+
+	get(s.handleWeather, "/weather/London")
+	// A cache hit isn't a new aggregate, so it isn't observed again.
+	get(s.handleWeather, "/weather/London")
+
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{
+		`gollo_provider_spread_celsius_bucket{le="1"} 0`,
+		`gollo_provider_spread_celsius_bucket{le="5"} 1`,
+		`gollo_provider_spread_celsius_bucket{le="+Inf"} 1`,
+		`gollo_provider_spread_celsius_sum 4`,
+		`gollo_provider_spread_celsius_count 1`,
+	} {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Errorf("/metrics lacks %s:\n%s", line, w.Body)
+		}
+	}
+}
+
+func TestProviderSpreadMetricOneReading(t *testing.T) {
+	reg := newRegistry()
+	s := newTestServer(newFake("a", 10))
+	s.metrics = newServerMetrics(reg, nil)
+	get(s.handleWeather, "/weather/London")
+
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(w.Body.String(), "gollo_provider_spread_celsius_count 0\n") {
+		t.Errorf("a single reading has no spread to observe:\n%s", w.Body)
+	}
+}
+
+func TestDegradedMode(t *testing.T) {
+	cheap, other := newFake("cheap", 10), newFake("other", 20)
+	s := newTestServer(cheap, other)
+	s.degradedProvider = cheap
+
+	// /hold keeps a request in flight until released, so the next one
+	// arrives with two in flight, at the threshold.
+	hold, held := make(chan struct{}), make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/weather/", s.handleWeather)
+	mux.HandleFunc("/hold", func(w http.ResponseWriter, r *http.Request) {
+		held <- struct{}{}
+		<-hold
+	})
+	h := withInflightLimit(mux, 10, 2, false)
+	weather := func() map[string]interface{} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/weather/London", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+		return decode(t, w)
+	}
+	done := make(chan struct{})
+	go func() {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/hold", nil))
+		close(done)
+	}()
+	<-held
+
+	body := weather()
+	if body["degraded"] != true || number(t, body, "temp") != 10 {
+		t.Errorf("under load got %v, want cheap's 10 flagged degraded", body)
+	}
+	if other.calls.Load() != 0 {
+		t.Error("the other provider was called under load")
+	}
+
+	close(hold)
+	<-done
+
+	// The degraded answer wasn't cached, so the full aggregate resumes.
+	body = weather()
+	if _, ok := body["degraded"]; ok || number(t, body, "temp") != 15 {
+		t.Errorf("after load fell got %v, want the full mean of 15", body)
+	}
+
+	// Under load again, the fresh full answer is served from the cache.
+	hold = make(chan struct{})
+	done = make(chan struct{})
+	go func() {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/hold", nil))
+		close(done)
+	}()
+	<-held
+	body = weather()
+	close(hold)
+	<-done
+	if _, ok := body["degraded"]; ok || number(t, body, "temp") != 15 {
+		t.Errorf("under load with a fresh entry got %v, want the cached 15", body)
+	}
+}
+
+func TestResponseTimeZone(t *testing.T) {
+	newYork := time.FixedZone("EST", -5*3600)
+	p := newFake("fake", 10)
+	p.reading.sunrise = time.Date(2026, 1, 15, 7, 20, 0, 0, newYork)
+	p.reading.sunset = time.Date(2026, 1, 15, 16, 55, 0, 0, newYork)
+	p.reading.observed = time.Date(2026, 1, 15, 17, 0, 0, 0, time.UTC)
+	s := newTestServer(p)
+
+	for _, tt := range []struct {
+		tz                        string
+		sunrise, sunset, observed string
+	}{
+		// Without tz, sunrise and sunset keep the location's own zone and
+		// observation times are in UTC.
+		{"", "2026-01-15T07:20:00-05:00", "2026-01-15T16:55:00-05:00", "2026-01-15T17:00:00Z"},
+		{"UTC", "2026-01-15T12:20:00Z", "2026-01-15T21:55:00Z", "2026-01-15T17:00:00Z"},
+		{"Asia/Tokyo", "2026-01-15T21:20:00+09:00", "2026-01-16T06:55:00+09:00", "2026-01-16T02:00:00+09:00"},
+		{"Europe/London", "2026-01-15T12:20:00Z", "2026-01-15T21:55:00Z", "2026-01-15T17:00:00Z"},
+	} {
+		s.cache = newMemoryCache(0)
+		body := decode(t, get(s.handleWeather, "/weather/London?detail=true&tz="+tt.tz))
+		if body["sunrise"] != tt.sunrise || body["sunset"] != tt.sunset {
+			t.Errorf("tz %q: sunrise %v, sunset %v, want %s and %s", tt.tz, body["sunrise"], body["sunset"], tt.sunrise, tt.sunset)
+		}
+		detail := body["providers"].([]interface{})[0].(map[string]interface{})
+		if detail["observed"] != tt.observed {
+			t.Errorf("tz %q: observed %v, want %s", tt.tz, detail["observed"], tt.observed)
+		}
+	}
+
+	for _, tz := range []string{"Mars/Olympus_Mons", "not a zone", "../../etc/passwd"} {
+		w := get(s.handleWeather, "/weather/London?tz="+url.QueryEscape(tz))
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "unknown time zone") {
+			t.Errorf("tz %q: status %d %q, want a 400", tz, w.Code, w.Body)
+		}
+	}
+}
+
+func TestMinResponseTime(t *testing.T) {
+	failing := newFake("failing", 0)
+	failing.err = errors.New("down")
+	for _, tt := range []struct {
+		name     string
+		provider weatherProvider
+		pad      time.Duration
+		min, max time.Duration
+	}{
+		{"off", newFake("fake", 10), 0, 0, 100 * time.Millisecond},
+		{"padded", newFake("fake", 10), 200 * time.Millisecond, 200 * time.Millisecond, time.Second},
+		{"failure padded", failing, 200 * time.Millisecond, 200 * time.Millisecond, time.Second},
+	} {
+		s := newTestServer(tt.provider)
+		s.minResponseTime, s.tookFormat = tt.pad, tookMillis
+		begin := time.Now()
+		w := get(s.handleWeather, "/weather/London")
+		if took := time.Since(begin); took < tt.min || took > tt.max {
+			t.Errorf("%s: took %s, want between %s and %s", tt.name, took, tt.min, tt.max)
+		}
+		if w.Code == http.StatusOK && number(t, decode(t, w), "took_ms") < float64(tt.min.Milliseconds()) {
+			t.Errorf("%s: reported took %s, want the padding included", tt.name, w.Body)
+		}
+	}
+
+	// Padding ends with the request.
+	s := newTestServer(newFake("fake", 10))
+	s.minResponseTime = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	begin := time.Now()
+	s.handleWeather(httptest.NewRecorder(), httptest.NewRequest("GET", "/weather/London", nil).WithContext(ctx))
+	if took := time.Since(begin); took > time.Second {
+		t.Errorf("padding outlived its request by %s", took)
+	}
+}
+
+func TestMinResponseTimeDebugOnly(t *testing.T) {
+	var conf config
+	conf.Debug.MinResponseTime.Duration = time.Second
+	if d := conf.minResponseTime(); d != 0 {
+		t.Errorf("%s without debug.enabled, want none", d)
+	}
+	conf.Debug.Enabled = true
+	if d := conf.minResponseTime(); d != time.Second {
+		t.Errorf("%s with debug.enabled, want 1s", d)
+	}
+}
+
+func TestPartialContent(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		providers []weatherProvider
+		partial   bool
+		want      int
+		temp      float64
+	}{
+		{"complete", []weatherProvider{newFake("a", 10), newFake("b", 12)}, true, http.StatusOK, 11},
+		// b's implausible reading is left out with a warning.
+		{"partial", []weatherProvider{newFake("a", 10), newFake("b", 500)}, true, http.StatusPartialContent, 10},
+		{"partial by default", []weatherProvider{newFake("a", 10), newFake("b", 500)}, false, http.StatusOK, 10},
+	} {
+		s := newTestServer(tt.providers...)
+		s.partialContent = tt.partial
+		w := get(s.handleWeather, "/weather/London")
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.want)
+			continue
+		}
+		// The body is the same whatever the status.
+		body := decode(t, w)
+		_, warned := body["warnings"]
+		if number(t, body, "temp") != tt.temp || warned != (tt.temp == 10) {
+			t.Errorf("%s: body %v", tt.name, body)
+		}
+	}
+}
+
+func TestAsOf(t *testing.T) {
+	a, b, c := newFake("a", 10), newFake("b", 12), newFake("c", 14)
+	a.reading.observed = time.Date(2026, 1, 15, 12, 0, 0, 0, time.UTC)
+	b.reading.observed = time.Date(2026, 1, 15, 11, 40, 0, 0, time.UTC)
+	// c reports no observation time; it doesn't hold as_of back.
+	s := newTestServer(a, b, c)
+	s.asOf = true
+
+	body := decode(t, get(s.handleWeather, "/weather/London?tz=UTC"))
+	if body["as_of"] != "2026-01-15T11:40:00Z" {
+		t.Errorf("as_of %v, want b's, the oldest observation", body["as_of"])
+	}
+	// A cached aggregate keeps its as_of.
+	if body = decode(t, get(s.handleWeather, "/weather/London?tz=UTC&fields=as_of")); len(body) != 1 || body["as_of"] != "2026-01-15T11:40:00Z" {
+		t.Errorf("cached: %v", body)
+	}
+
+	s.asOf = false
+	if _, ok := decode(t, get(s.handleWeather, "/weather/London"))["as_of"]; ok {
+		t.Error("as_of reported without the option")
+	}
+}
+
+func TestAsOfFetchTime(t *testing.T) {
+	s := newTestServer(newFake("a", 10), newFake("b", 12))
+	s.asOf = true
+	begin := time.Now().Truncate(time.Second)
+	body := decode(t, get(s.handleWeather, "/weather/London"))
+	asOf, err := time.Parse(time.RFC3339, fmt.Sprint(body["as_of"]))
+	if err != nil || asOf.Before(begin) || asOf.After(time.Now()) {
+		t.Errorf("as_of %v, %v; want when the readings were fetched", body["as_of"], err)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// handleStream serves /stream/<city> as Server-Sent Events, pushing the
+// city's aggregate every stream interval until the client goes away or the
+// server shuts down.
+// Lookups go through the cache, so streams don't add upstream load beyond
+// one request per city per TTL.
+func (s *server) handleStream(w http.ResponseWriter, r *http.Request) {
+	city := strings.SplitN(r.URL.Path, "/", 3)[2]
+	u, err := s.requestUnit(r)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Streams outlive the server's write timeout by design.
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		writeError(w, r, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	ctx := r.Context()
+	ticker := time.NewTicker(s.streamInterval)
+	defer ticker.Stop()
+	for {
+		res := weatherResult{city: city, unit: u, begin: time.Now(), took: s.tookFormat, confidence: s.confidence}
+		key := cacheKey{city: city, aggregation: s.mw.aggregation}
+		res.agg, res.cacheHit, err = s.aggregate(ctx, key)
+		if err != nil {
+			fmt.Fprintf(w, "event: error\ndata: %s\n\n", strings.ReplaceAll(err.Error(), "\n", " "))
+		} else {
+			res.trend = s.trends.trend(key.String(), time.Now(), res.agg.celsius)
+			body, _ := json.Marshal(res.fields())
+			fmt.Fprintf(w, "data: %s\n\n", body)
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.stopping:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStream(t *testing.T) {
+	p := newFake("a", 10)
+	s := newTestServer(p)
+	s.streamInterval = 20 * time.Millisecond
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(done)
+		s.handleStream(w, r)
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/stream/London?units=c", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type %q", ct)
+	}
+
+	events := bufio.NewScanner(resp.Body)
+	for n := 0; n < 2; {
+		if !events.Scan() {
+			t.Fatalf("stream ended after %d events: %v", n, events.Err())
+		}
+		data, ok := strings.CutPrefix(events.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var body map[string]interface{}
+		if err := json.Unmarshal([]byte(data), &body); err != nil {
+			t.Fatalf("event %q: %s", data, err)
+		}
+		if body["city"] != "London" || body["temp"] != 10.0 {
+			t.Errorf("event %v", body)
+		}
+		n++
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler still streaming after the client went away")
+	}
+	// Every event after the first came from the cache.
+	if p.calls.Load() != 1 {
+		t.Errorf("provider called %d times, want once", p.calls.Load())
+	}
+}
+
+func TestStreamError(t *testing.T) {
+	p := newFake("a", 10)
+	p.err = errNoResults
+	s := newTestServer(p)
+	s.streamInterval = time.Hour
+	s.stopping = make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(s.handleStream))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/stream/London")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	r := bufio.NewReader(resp.Body)
+	if line, _ := r.ReadString('\n'); line != "event: error\n" {
+		t.Errorf("first line %q, want an error event", line)
+	}
+	// Shutting the server down ends the stream.
+	close(s.stopping)
+	if _, err := r.ReadString(0); err == nil {
+		t.Error("stream still open after shutdown")
+	}
+}
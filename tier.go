@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// tier is how far a provider's data can be trusted. Requests with
+// ?min_tier= leave out providers below it; providers not given one are
+// standard.
+type tier int
+
+const (
+	noTier tier = iota // no minimum
+	supplementaryTier
+	standardTier
+	authoritativeTier
+)
+
+var tierNames = map[tier]string{
+	supplementaryTier: "supplementary",
+	standardTier:      "standard",
+	authoritativeTier: "authoritative",
+}
+
+func (t tier) String() string { return tierNames[t] }
+
+func parseTier(s string) (tier, error) {
+	for t, name := range tierNames {
+		if strings.EqualFold(s, name) {
+			return t, nil
+		}
+	}
+	return noTier, fmt.Errorf("unknown tier %q, want authoritative, standard or supplementary", s)
+}
+
+// tierOf is provider's configured tier.
+func (w multiWeatherProvider) tierOf(provider string) tier {
+	if t, ok := w.tiers[provider]; ok {
+		return t
+	}
+	return standardTier
+}
+
+// minTier parses a ?min_tier= into the canonical form cache keys hold:
+// noTier for supplementary, which every provider meets. It is an error for
+// no provider to be of that tier or better, or for a required provider to
+// fall below it.
+func (w multiWeatherProvider) minTier(s string) (tier, error) {
+	t, err := parseTier(s)
+	if err != nil || t == supplementaryTier {
+		return noTier, err
+	}
+	for _, name := range w.required {
+		if w.tierOf(name) < t {
+			return noTier, fmt.Errorf("required provider %s is only %s", name, w.tierOf(name))
+		}
+	}
+	for _, p := range w.providers {
+		if w.tierOf(p.name()) >= t {
+			return t, nil
+		}
+	}
+	return noTier, fmt.Errorf("no provider is %s or better", t)
+}
+
+// atLeast narrows w, city overrides included, to the providers of tier t
+// or better.
+func (w multiWeatherProvider) atLeast(t tier) multiWeatherProvider {
+	keep := func(ps []weatherProvider) []weatherProvider {
+		var kept []weatherProvider
+		for _, p := range ps {
+			if w.tierOf(p.name()) >= t {
+				kept = append(kept, p)
+			}
+		}
+		return kept
+	}
+	w.providers = keep(w.providers)
+	if w.overrides != nil {
+		overrides := make(map[string][]weatherProvider, len(w.overrides))
+		for place, ps := range w.overrides {
+			overrides[place] = keep(ps)
+		}
+		w.overrides = overrides
+	}
+	w.tier = t
+	return w
+}
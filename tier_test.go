@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newTierServer serves from an authoritative, a standard, an untagged and
+// a supplementary provider, each reading its own temperature.
+func newTierServer() *server {
+	s := newTestServer(newFake("auth", 10), newFake("std", 20), newFake("untagged", 30), newFake("supp", 40))
+	s.mw.tiers = map[string]tier{"auth": authoritativeTier, "std": standardTier, "supp": supplementaryTier}
+	return s
+}
+
+func TestParseTier(t *testing.T) {
+	for _, tt := range []struct {
+		s    string
+		want tier
+	}{
+		{"authoritative", authoritativeTier},
+		{"Standard", standardTier},
+		{"SUPPLEMENTARY", supplementaryTier},
+	} {
+		if got, err := parseTier(tt.s); err != nil || got != tt.want {
+			t.Errorf("%q: %v, %v; want %v", tt.s, got, err, tt.want)
+		}
+		if got, _ := parseTier(tt.want.String()); got != tt.want {
+			t.Errorf("%v doesn't round-trip", tt.want)
+		}
+	}
+	if _, err := parseTier("gold"); err == nil {
+		t.Error("unknown tier parsed")
+	}
+}
+
+func TestMinTier(t *testing.T) {
+	mw := newTierServer().mw
+	for _, tt := range []struct {
+		s    string
+		want tier
+		err  string
+	}{
+		{"authoritative", authoritativeTier, ""},
+		{"standard", standardTier, ""},
+		// Every provider meets it, so it is no minimum at all.
+		{"supplementary", noTier, ""},
+		{"gold", noTier, "unknown tier"},
+	} {
+		got, err := mw.minTier(tt.s)
+		if got != tt.want || (err == nil) != (tt.err == "") || err != nil && !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%q: %v, %v; want %v, %q", tt.s, got, err, tt.want, tt.err)
+		}
+	}
+
+	mw.required = []string{"std"}
+	if _, err := mw.minTier("authoritative"); err == nil || !strings.Contains(err.Error(), "required provider std is only standard") {
+		t.Errorf("dropping a required provider: error %v", err)
+	}
+	mw.required = nil
+	mw.tiers = nil
+	if _, err := mw.minTier("authoritative"); err == nil || !strings.Contains(err.Error(), "no provider is authoritative") {
+		t.Errorf("no provider of the tier: error %v", err)
+	}
+}
+
+func TestAtLeast(t *testing.T) {
+	mw := newTierServer().mw
+	supp := newFake("supp", 40)
+	mw.overrides = map[string][]weatherProvider{normalizeCity("Reykjavik"): {supp}, "gb": {newFake("auth", 10), supp}}
+	got := mw.atLeast(standardTier)
+	if n := names(got.providers); n != "auth,std,untagged" {
+		t.Errorf("standard or better: %v", n)
+	}
+	if len(got.overrides[normalizeCity("Reykjavik")]) != 0 || len(got.overrides["gb"]) != 1 {
+		t.Errorf("overrides %v, want them narrowed too", got.overrides)
+	}
+	if len(mw.overrides["gb"]) != 2 {
+		t.Error("narrowing changed the original overrides")
+	}
+	if got.tier != standardTier || got.method()["min_tier"] != "standard" {
+		t.Errorf("tier %v, method %v; want standard", got.tier, got.method())
+	}
+	if _, ok := mw.method()["min_tier"]; ok {
+		t.Error("min_tier described without one")
+	}
+	// An override left with no provider of the tier fails as an empty set.
+	if _, err := got.aggregate(context.Background(), "Reykjavik"); err == nil {
+		t.Error("Reykjavik aggregated with no provider of the tier")
+	}
+}
+
+func TestMinTierQuery(t *testing.T) {
+	s := newTierServer()
+	for _, tt := range []struct {
+		query string
+		temp  float64
+	}{
+		{"", 25},
+		{"?min_tier=supplementary", 25},
+		{"?min_tier=standard", 20},
+		{"?min_tier=authoritative", 10},
+		{"?min_tier=standard&providers=std,supp", 20},
+	} {
+		w := get(s.handleWeather, "/weather/London"+tt.query)
+		if w.Code != http.StatusOK {
+			t.Errorf("%q: status %d: %s", tt.query, w.Code, w.Body)
+			continue
+		}
+		if temp := number(t, decode(t, w), "temp"); !near(temp, tt.temp) {
+			t.Errorf("%q: temp %v, want the mean of %v°C", tt.query, temp, tt.temp)
+		}
+	}
+	keys := make(map[string]bool)
+	for k := range s.cache.all() {
+		keys[k] = true
+	}
+	for _, k := range []string{"mean:London", "mean@standard:London", "mean@authoritative:London", "mean@standard[std,supp]:London"} {
+		if !keys[k] {
+			t.Errorf("no cache entry %s in %v", k, keys)
+		}
+	}
+	if len(keys) != 4 {
+		t.Errorf("cache keys %v, want supplementary to share the unfiltered entry", keys)
+	}
+
+	if w := get(s.handleWeather, "/weather/London?min_tier=gold"); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown tier: status %d, want 400", w.Code)
+	}
+	s.mw.required = []string{"untagged"}
+	if w := get(s.handleWeather, "/weather/London?min_tier=authoritative"); w.Code != http.StatusBadRequest {
+		t.Errorf("dropping a required provider: status %d, want 400", w.Code)
+	}
+}
+
+func TestMinTierDegraded(t *testing.T) {
+	s := newTierServer()
+	supp := s.mw.providers[3].(*fakeProvider)
+	s.degradedProvider = supp
+	serve := func(target string) map[string]interface{} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", target, nil)
+		s.handleWeather(w, r.WithContext(context.WithValue(r.Context(), degradedKey{}, true)))
+		return decode(t, w)
+	}
+	if body := serve("/weather/London"); body["degraded"] != true {
+		t.Errorf("under load got %v, want the degraded provider's answer", body)
+	}
+	// Below the request's tier, it isn't asked alone.
+	if body := serve("/weather/London?min_tier=standard"); body["degraded"] != nil {
+		t.Errorf("under load with ?min_tier=standard got %v, want a full answer", body)
+	}
+}
+
+func TestTierConfig(t *testing.T) {
+	conf := config{Providers: []providerConfig{{Type: "openweathermap", Tier: "authoritative"}, {Type: "weatherunderground"}}}
+	mw, err := getMultiWeatherProvider(conf, nil)
+	if err != nil || mw.tierOf("openWeatherMap") != authoritativeTier || mw.tierOf("weatherUnderground") != standardTier {
+		t.Errorf("tiers %v, %v", mw.tiers, err)
+	}
+	conf.Providers[1].Tier = "gold"
+	if _, err := getMultiWeatherProvider(conf, nil); err == nil || !strings.Contains(err.Error(), "weatherUnderground") {
+		t.Errorf("unknown tier: error %v", err)
+	}
+}
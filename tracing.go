@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Spans are recorded with the OpenTelemetry SDK. span and tracer are thin
+// wrappers over it, so handlers and providers need no nil checks when
+// tracing is off.
+
+type spanKey struct{}
+
+type span struct {
+	tracer *tracer
+	otel   trace.Span
+}
+
+func (s *span) setAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.otel.SetAttributes(attributeOf(key, value))
+}
+
+func attributeOf(key string, value interface{}) attribute.KeyValue {
+	switch v := value.(type) {
+	case string:
+		return attribute.String(key, v)
+	case int:
+		return attribute.Int(key, v)
+	case int64:
+		return attribute.Int64(key, v)
+	case float64:
+		return attribute.Float64(key, v)
+	case bool:
+		return attribute.Bool(key, v)
+	}
+	return attribute.String(key, fmt.Sprint(value))
+}
+
+// setStatus records the outcome of the span; a nil error marks it ok.
+func (s *span) setStatus(err error) {
+	if s == nil {
+		return
+	}
+	if err != nil {
+		s.otel.RecordError(err)
+		s.otel.SetStatus(codes.Error, err.Error())
+	} else {
+		s.otel.SetStatus(codes.Ok, "")
+	}
+}
+
+func (s *span) finish() {
+	if s == nil {
+		return
+	}
+	s.otel.End()
+}
+
+// traceID is the span's trace ID in hex, or "" for a nil span.
+func (s *span) traceID() string {
+	if s == nil {
+		return ""
+	}
+	return s.otel.SpanContext().TraceID().String()
+}
+
+type tracer struct {
+	provider *sdktrace.TracerProvider
+	otel     trace.Tracer
+}
+
+func newSDKTracer(opts ...sdktrace.TracerProviderOption) *tracer {
+	opts = append([]sdktrace.TracerProviderOption{
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "gollo"))),
+	}, opts...)
+	tp := sdktrace.NewTracerProvider(opts...)
+	return &tracer{provider: tp, otel: tp.Tracer("gollo")}
+}
+
+// start begins a span, parented to the span already in ctx if there is one.
+func (t *tracer) start(ctx context.Context, name string) (context.Context, *span) {
+	if t == nil {
+		return ctx, nil
+	}
+	ctx, sp := t.otel.Start(ctx, name)
+	s := &span{tracer: t, otel: sp}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// startSpan begins a child of the span in ctx. Without one it is a no-op, so
+// providers can be traced without knowing whether tracing is enabled.
+func startSpan(ctx context.Context, name string) (context.Context, *span) {
+	parent, _ := ctx.Value(spanKey{}).(*span)
+	if parent == nil {
+		return ctx, nil
+	}
+	return parent.tracer.start(ctx, name)
+}
+
+// shutdown exports any spans still batched.
+func (t *tracer) shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	return t.provider.Shutdown(ctx)
+}
+
+func newTracer(exporter, endpoint string) (*tracer, error) {
+	switch exporter {
+	case "":
+		return nil, nil
+	case "log":
+		return newSDKTracer(sdktrace.WithSyncer(logExporter{})), nil
+	case "otlp":
+		if endpoint == "" {
+			return nil, fmt.Errorf("tracing: otlp exporter requires an endpoint")
+		}
+		e := otlpExporter{endpoint: endpoint, client: &http.Client{Timeout: 5 * time.Second}}
+		return newSDKTracer(sdktrace.WithBatcher(e)), nil
+	}
+	return nil, fmt.Errorf("tracing: unknown exporter %q", exporter)
+}
+
+type logExporter struct{}
+
+func (logExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	for _, s := range spans {
+		attrs := make([]string, 0, len(s.Attributes()))
+		for _, a := range s.Attributes() {
+			attrs = append(attrs, string(a.Key)+"="+a.Value.Emit())
+		}
+		log.Printf("span %s trace=%s span=%s parent=%s took %s status=%s attrs=%v",
+			s.Name(), s.SpanContext().TraceID(), s.SpanContext().SpanID(), s.Parent().SpanID(),
+			s.EndTime().Sub(s.StartTime()).String(), s.Status().Code, attrs)
+	}
+	return nil
+}
+
+func (logExporter) Shutdown(ctx context.Context) error { return nil }
+
+// otlpExporter posts batches of finished spans to an OTLP/HTTP collector
+// using the JSON encoding, e.g. http://localhost:4318/v1/traces.
+type otlpExporter struct {
+	endpoint string
+	client   *http.Client
+}
+
+func (e otlpExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	body, err := json.Marshal(otlpPayload(spans))
+	if err != nil {
+		return fmt.Errorf("tracing: %s", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("tracing: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("tracing: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("tracing: %s answered %s", e.endpoint, resp.Status)
+	}
+	return nil
+}
+
+func (otlpExporter) Shutdown(ctx context.Context) error { return nil }
+
+func otlpPayload(spans []sdktrace.ReadOnlySpan) map[string]interface{} {
+	otlpSpans := make([]interface{}, 0, len(spans))
+	for _, s := range spans {
+		attrs := make([]map[string]interface{}, 0, len(s.Attributes()))
+		for _, a := range s.Attributes() {
+			attrs = append(attrs, map[string]interface{}{
+				"key":   string(a.Key),
+				"value": map[string]interface{}{"stringValue": a.Value.Emit()},
+			})
+		}
+		status := map[string]interface{}{"code": 1}
+		if s.Status().Code == codes.Error {
+			status = map[string]interface{}{"code": 2, "message": s.Status().Description}
+		}
+		otlpSpan := map[string]interface{}{
+			"traceId":           s.SpanContext().TraceID().String(),
+			"spanId":            s.SpanContext().SpanID().String(),
+			"name":              s.Name(),
+			"kind":              1,
+			"startTimeUnixNano": strconv.FormatInt(s.StartTime().UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.EndTime().UnixNano(), 10),
+			"attributes":        attrs,
+			"status":            status,
+		}
+		if s.Parent().HasSpanID() {
+			otlpSpan["parentSpanId"] = s.Parent().SpanID().String()
+		}
+		otlpSpans = append(otlpSpans, otlpSpan)
+	}
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []interface{}{map[string]interface{}{
+					"key":   "service.name",
+					"value": map[string]interface{}{"stringValue": "gollo"},
+				}},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "gollo"},
+				"spans": otlpSpans,
+			}},
+		}},
+	}
+}
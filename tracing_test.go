@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestWeatherSpanHierarchy(t *testing.T) {
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Host {
+		case "maps.googleapis.com":
+			w.Write([]byte(`{"status":"OK","results":[{"geometry":{"location":{"lat":51.5,"lng":-0.12}}}]}`))
+		case "api.forecast.io":
+			w.Write([]byte(`{"currently":{"temperature":12}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	sr := tracetest.NewSpanRecorder()
+	s := newTestServer(forecastIo{apiKey: "k", geocoder: googleGeocoder{}}, newFake("fake", 14))
+	s.tracer = newSDKTracer(sdktrace.WithSpanProcessor(sr))
+
+	if w := get(s.handleWeather, "/weather/London"); w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, s := range sr.Ended() {
+		spans[s.Name()] = s
+	}
+	root, ok := spans["GET /weather/"]
+	if !ok {
+		t.Fatalf("no request span among %v", spans)
+	}
+	if root.Parent().IsValid() {
+		t.Errorf("request span has a parent %s", root.Parent().SpanID())
+	}
+	parents := map[string]string{
+		"forecastIo": "GET /weather/",
+		"fake":       "GET /weather/",
+		"geocode":    "forecastIo",
+	}
+	for name, parent := range parents {
+		s, ok := spans[name]
+		if !ok {
+			t.Errorf("no %s span", name)
+			continue
+		}
+		if s.SpanContext().TraceID() != root.SpanContext().TraceID() {
+			t.Errorf("%s span is in trace %s, want %s", name, s.SpanContext().TraceID(), root.SpanContext().TraceID())
+		}
+		if got, want := s.Parent().SpanID(), spans[parent].SpanContext().SpanID(); got != want {
+			t.Errorf("%s span's parent is %s, want %s (%s)", name, got, want, parent)
+		}
+	}
+	if len(sr.Ended()) != len(parents)+1 {
+		t.Errorf("got %d spans, want %d", len(sr.Ended()), len(parents)+1)
+	}
+}
+
+func TestSpanStatus(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	s := newTestServer(&fakeProvider{label: "broken", err: errNoResults})
+	s.tracer = newSDKTracer(sdktrace.WithSpanProcessor(sr))
+
+	get(s.handleWeather, "/weather/Nowhere")
+
+	for _, s := range sr.Ended() {
+		if s.Status().Code.String() != "Error" {
+			t.Errorf("%s span's status is %s, want Error", s.Name(), s.Status().Code)
+		}
+	}
+}
+
+type otlpSpan struct {
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var spans []otlpSpan
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []otlpSpan `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Error(err)
+		}
+		for _, rs := range payload.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}))
+	defer collector.Close()
+	tr := newSDKTracer(sdktrace.WithSyncer(otlpExporter{endpoint: collector.URL, client: collector.Client()}))
+
+	ctx, parent := tr.start(t.Context(), "parent")
+	_, child := startSpan(ctx, "child")
+	child.finish()
+	parent.finish()
+
+	if len(spans) != 2 || spans[0].Name != "child" || spans[1].Name != "parent" {
+		t.Fatalf("unexpected spans %+v", spans)
+	}
+	if spans[1].ParentSpanID != "" {
+		t.Errorf("parent span has a parent %s", spans[1].ParentSpanID)
+	}
+	if spans[0].ParentSpanID != spans[1].SpanID {
+		t.Errorf("child's parent is %s, want %s", spans[0].ParentSpanID, spans[1].SpanID)
+	}
+	for _, s := range spans {
+		if s.TraceID != parent.traceID() {
+			t.Errorf("%s's trace ID is %s, want %s", s.Name, s.TraceID, parent.traceID())
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// trendWindow is how far back a trend looks, and trendSteady the change in
+// Celsius below which the temperature counts as steady. Samples older than
+// trendMaxAge are too old to stand for an hour ago, and are forgotten.
+const (
+	trendWindow = time.Hour
+	trendSteady = 0.5
+	trendMaxAge = 2 * trendWindow
+)
+
+type trendSample struct {
+	at      time.Time
+	celsius float64
+}
+
+// trendStore remembers recent aggregates per city so the current
+// temperature can be compared with the one from an hour ago.
+type trendStore struct {
+	mu      sync.Mutex
+	samples map[string][]trendSample // oldest first
+	swept   time.Time                // when cities were last forgotten
+}
+
+func newTrendStore() *trendStore {
+	return &trendStore{samples: make(map[string][]trendSample)}
+}
+
+// record adds a fresh aggregate for key, forgetting samples that are no
+// longer needed: only the newest one at least trendWindow old is kept.
+// Every trendWindow, it also forgets the cities with no sample newer than
+// trendMaxAge, so that cities asked for once don't stay forever.
+func (t *trendStore) record(key string, at time.Time, celsius float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	samples := append(t.samples[key], trendSample{at, celsius})
+	for len(samples) > 1 && at.Sub(samples[1].at) >= trendWindow {
+		samples = samples[1:]
+	}
+	t.samples[key] = samples
+	if at.Sub(t.swept) >= trendWindow {
+		for k, samples := range t.samples {
+			if at.Sub(samples[len(samples)-1].at) > trendMaxAge {
+				delete(t.samples, k)
+			}
+		}
+		t.swept = at
+	}
+}
+
+// trend compares celsius with the newest sample for key that is at least
+// trendWindow old: "rising", "falling" or "steady". It returns "" until
+// there is such a sample, and if the newest is older than trendMaxAge.
+func (t *trendStore) trend(key string, now time.Time, celsius float64) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var past *trendSample
+	for i, s := range t.samples[key] {
+		if now.Sub(s.at) < trendWindow {
+			break
+		}
+		past = &t.samples[key][i]
+	}
+	switch {
+	case past == nil || now.Sub(past.at) > trendMaxAge:
+		return ""
+	case celsius-past.celsius >= trendSteady:
+		return "rising"
+	case past.celsius-celsius >= trendSteady:
+		return "falling"
+	}
+	return "steady"
+}
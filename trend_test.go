@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTrend(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		past, now float64
+		want      string
+	}{
+		{10, 12, "rising"},
+		{10, 10.5, "rising"},
+		{10, 8, "falling"},
+		{10, 9.5, "falling"},
+		{10, 10.2, "steady"},
+		{10, 9.8, "steady"},
+	} {
+		ts := newTrendStore()
+		ts.record("London", now.Add(-70*time.Minute), tt.past)
+		if got := ts.trend("London", now, tt.now); got != tt.want {
+			t.Errorf("%v then %v: trend %q, want %q", tt.past, tt.now, got, tt.want)
+		}
+	}
+}
+
+func TestTrendNeedsAnHourOfHistory(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	ts := newTrendStore()
+	if got := ts.trend("London", now, 10); got != "" {
+		t.Errorf("no samples: trend %q", got)
+	}
+	ts.record("London", now.Add(-30*time.Minute), 0)
+	if got := ts.trend("London", now, 10); got != "" {
+		t.Errorf("only a recent sample: trend %q", got)
+	}
+	ts.record("London", now.Add(-5*time.Minute), 0)
+	if got := ts.trend("Paris", now, 10); got != "" {
+		t.Errorf("another city's samples: trend %q", got)
+	}
+}
+
+func TestTrendUsesNewestSampleAnHourOld(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	ts := newTrendStore()
+	for i, c := range []float64{0, 5, 10, 10} {
+		ts.record("London", start.Add(time.Duration(i)*30*time.Minute), c)
+	}
+	// At 13:30 the newest sample at least an hour old is 12:30's 5°C;
+	// 12:00's 0°C has been forgotten.
+	if got := ts.trend("London", start.Add(90*time.Minute), 5); got != "steady" {
+		t.Errorf("trend %q, want steady against 12:30", got)
+	}
+	if n := len(ts.samples["London"]); n != 3 {
+		t.Errorf("%d samples kept, want 3", n)
+	}
+}
+
+func TestTrendInResponse(t *testing.T) {
+	s := newTestServer(newFake("a", 20))
+	s.trends.record(cacheKey{city: "London", aggregation: s.mw.aggregation}.String(), time.Now().Add(-90*time.Minute), 15)
+	body := decode(t, get(s.handleWeather, "/weather/London"))
+	if body["trend"] != "rising" {
+		t.Errorf("trend %v, want rising", body["trend"])
+	}
+}
+
+func TestTrendIgnoresStaleSamples(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	ts := newTrendStore()
+	// A day old, it says nothing about an hour ago.
+	ts.record("London", now.Add(-24*time.Hour), 0)
+	if got := ts.trend("London", now, 10); got != "" {
+		t.Errorf("a day-old sample: trend %q, want none", got)
+	}
+	ts.record("Paris", now.Add(-90*time.Minute), 0)
+	if got := ts.trend("Paris", now, 10); got != "rising" {
+		t.Errorf("a sample within the bound: trend %q, want rising", got)
+	}
+}
+
+func TestTrendForgetsIdleCities(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	ts := newTrendStore()
+	ts.record("Atlantis", start, 10)
+	ts.record("London", start, 10)
+	for i := 1; i <= 3; i++ {
+		ts.record("London", start.Add(time.Duration(i)*time.Hour), 10)
+	}
+	if _, ok := ts.samples["Atlantis"]; ok {
+		t.Error("a city not asked for in 3h is still remembered")
+	}
+	if _, ok := ts.samples["London"]; !ok {
+		t.Error("London, still asked for, was forgotten")
+	}
+}
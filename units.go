@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+type unit string
+
+const (
+	kelvin     unit = "k"
+	celsius    unit = "c"
+	fahrenheit unit = "f"
+)
+
+func parseUnit(s string) (unit, error) {
+	switch strings.ToLower(s) {
+	case "k", "kelvin":
+		return kelvin, nil
+	case "c", "celsius", "metric":
+		return celsius, nil
+	case "f", "fahrenheit", "imperial":
+		return fahrenheit, nil
+	}
+	return "", fmt.Errorf("unknown units %q", s)
+}
+
+// Temperatures are held in Celsius, which most providers report natively,
+// so their values come out exactly as received unless another unit is asked
+// for. Holding them in Kelvin instead meant adding and subtracting 273.15,
+// which changes the last bits of most readings.
+
+// fromCelsius converts a temperature in Celsius to u.
+func (u unit) fromCelsius(c float64) float64 {
+	switch u {
+	case kelvin:
+		return c + 273.15
+	case fahrenheit:
+		return c*9/5 + 32
+	}
+	return c
+}
+
+// toCelsius converts a temperature in u to Celsius.
+func (u unit) toCelsius(v float64) float64 {
+	switch u {
+	case kelvin:
+		return v - 273.15
+	case fahrenheit:
+		return (v - 32) * 5 / 9
+	}
+	return v
+}
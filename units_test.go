@@ -0,0 +1,189 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestParseUnit(t *testing.T) {
+	for s, want := range map[string]unit{
+		"k": kelvin, "Kelvin": kelvin,
+		"c": celsius, "celsius": celsius, "metric": celsius,
+		"F": fahrenheit, "fahrenheit": fahrenheit, "imperial": fahrenheit,
+	} {
+		if got, err := parseUnit(s); err != nil || got != want {
+			t.Errorf("parseUnit(%q) = %q, %v; want %q", s, got, err, want)
+		}
+	}
+	if _, err := parseUnit("rankine"); err == nil {
+		t.Error("parseUnit(rankine): no error")
+	}
+}
+
+// oneDecimal is every Celsius reading from -50.0 to 50.0 in steps of 0.1,
+// as providers send them.
+func oneDecimal() []float64 {
+	var cs []float64
+	for i := -500; i <= 500; i++ {
+		c, _ := strconv.ParseFloat(strconv.FormatFloat(float64(i)/10, 'f', 1, 64), 64)
+		cs = append(cs, c)
+	}
+	return cs
+}
+
+// Held in Celsius, a Celsius reading is answered in Celsius exactly as the
+// provider sent it. Held in Kelvin, as temperatures once were, it went
+// through c+273.15-273.15, which changes the last bits of most readings.
+func TestCelsiusRepresentationPrecision(t *testing.T) {
+	viaKelvin := 0
+	for _, c := range oneDecimal() {
+		if got := celsius.fromCelsius(celsius.toCelsius(c)); got != c {
+			t.Errorf("held in Celsius, %v comes back as %v", c, got)
+		}
+		stored := kelvin.fromCelsius(c)
+		if got := kelvin.toCelsius(stored); got != c {
+			viaKelvin++
+			if math.Abs(got-c) > 1e-12 {
+				t.Errorf("held in Kelvin, %v comes back as %v", c, got)
+			}
+		}
+	}
+	if viaKelvin < 500 {
+		t.Errorf("only %d of 1001 readings change held in Kelvin; the Celsius representation is no gain", viaKelvin)
+	}
+}
+
+// Kelvin responses lose nothing by the change: both representations give
+// the same c+273.15.
+func TestKelvinOutputUnchanged(t *testing.T) {
+	for _, c := range oneDecimal() {
+		heldInKelvin := c + 273.15
+		if got := kelvin.fromCelsius(c); got != heldInKelvin {
+			t.Errorf("%v°C: %vK, want %vK", c, got, heldInKelvin)
+		}
+	}
+}
+
+func TestConversionRoundTrips(t *testing.T) {
+	for _, u := range []unit{kelvin, celsius, fahrenheit} {
+		for _, c := range oneDecimal() {
+			if got := u.toCelsius(u.fromCelsius(c)); math.Abs(got-c) > 1e-12 {
+				t.Errorf("%v°C through %s comes back as %v", c, u, got)
+			}
+		}
+	}
+	for c, f := range map[float64]float64{-40: -40, 0: 32, 100: 212, 37: 98.6} {
+		if got := fahrenheit.fromCelsius(c); math.Abs(got-f) > 1e-9 {
+			t.Errorf("%v°C is %v°F, want %v", c, got, f)
+		}
+	}
+}
+
+func TestCelsiusResponseExact(t *testing.T) {
+	s := newTestServer(newFake("fake", 12.3))
+	if got := number(t, decode(t, get(s.handleWeather, "/weather/London?units=c")), "temp"); got != 12.3 {
+		t.Errorf("temp %v, want 12.3 exactly", got)
+	}
+}
+
+func TestAllUnits(t *testing.T) {
+	s := newTestServer(newFake("a", 20), newFake("b", 21))
+	body := decode(t, get(s.handleWeather, "/weather/London?units=ALL"))
+	temps, ok := body["temps"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("temps is %v, want an object", body["temps"])
+	}
+	c, f, k := number(t, temps, "celsius"), number(t, temps, "fahrenheit"), number(t, temps, "kelvin")
+	if !near(c, 20.5) || !near(f, 68.9) || !near(k, 293.65) {
+		t.Errorf("temps %v, want 20.5°C, 68.9°F and 293.65K", temps)
+	}
+	// All three are the same temperature.
+	if !near((f-32)*5/9, c) || !near(k-273.15, c) {
+		t.Errorf("temps %v disagree", temps)
+	}
+	// temp stays in the default unit.
+	if got := number(t, body, "temp"); !near(got, 20.5) {
+		t.Errorf("temp %v, want 20.5 in the default Celsius", got)
+	}
+
+	body = decode(t, get(s.handleWeather, "/weather/London?units=f"))
+	if _, ok := body["temps"]; ok {
+		t.Error("temps reported without units=all")
+	}
+	body = decode(t, get(s.handleWeather, "/weather/London?units=all&fields=temps"))
+	if _, ok := body["temps"]; !ok || len(body) != 1 {
+		t.Errorf("fields=temps gave %v, want temps alone", body)
+	}
+}
+
+func TestKelvinField(t *testing.T) {
+	s := newTestServer(newFake("fake", 20))
+	for _, tt := range []struct {
+		units string
+		temp  float64
+	}{
+		{"c", 20}, {"f", 68}, {"k", 293.15},
+	} {
+		body := decode(t, get(s.handleWeather, "/weather/London?kelvin=true&units="+tt.units))
+		temp, k := number(t, body, "temp"), number(t, body, "kelvin")
+		if !near(temp, tt.temp) || !near(k, 293.15) {
+			t.Errorf("units=%s: temp %v, kelvin %v, want %v and 293.15", tt.units, temp, k, tt.temp)
+		}
+		// Both are the same temperature.
+		if u, _ := parseUnit(tt.units); !near(u.fromCelsius(k-273.15), temp) {
+			t.Errorf("units=%s: temp %v and kelvin %v disagree", tt.units, temp, k)
+		}
+	}
+
+	if _, ok := decode(t, get(s.handleWeather, "/weather/London"))["kelvin"]; ok {
+		t.Error("kelvin reported without the option")
+	}
+	s.kelvin = true
+	if _, ok := decode(t, get(s.handleWeather, "/weather/London"))["kelvin"]; !ok {
+		t.Error("kelvin missing with the option set")
+	}
+	if _, ok := decode(t, get(s.handleWeather, "/weather/London?kelvin=false"))["kelvin"]; ok {
+		t.Error("?kelvin=false didn't override the option")
+	}
+	if body := decode(t, get(s.handleWeather, "/weather/London?fields=kelvin")); len(body) != 1 || !near(number(t, body, "kelvin"), 293.15) {
+		t.Errorf("fields=kelvin gave %v, want kelvin alone", body)
+	}
+	if w := get(s.handleWeather, "/weather/London?kelvin=maybe"); w.Code != http.StatusBadRequest {
+		t.Errorf("?kelvin=maybe: status %d, want 400", w.Code)
+	}
+}
+
+func TestNativeTemperature(t *testing.T) {
+	p := newFake("a", 10)
+	p.reading.native = nativeTemp{50, fahrenheit}
+	s := newTestServer(p)
+
+	body := decode(t, get(s.handleWeather, "/weather/London?detail=true&native=true&units=c"))
+	d := body["providers"].([]interface{})[0].(map[string]interface{})
+	native, _ := d["native"].(map[string]interface{})
+	if native["value"] != 50.0 || native["unit"] != "f" || d["temp"] != 10.0 {
+		t.Errorf("detail %v, want 50°F as sent beside temp 10", d)
+	}
+
+	body = decode(t, get(s.handleWeather, "/weather/London?detail=true"))
+	if d := body["providers"].([]interface{})[0].(map[string]interface{}); d["native"] != nil {
+		t.Errorf("native in %v without ?native=true", d)
+	}
+}
+
+func TestNativeTemperatureStations(t *testing.T) {
+	// An average of stations has no native value of its own; its stations do.
+	r := reading{provider: "owm", celsius: 11, stations: []reading{
+		{provider: "Camden", celsius: 11, native: nativeTemp{11, celsius}},
+	}}
+	d := providerDetails([]reading{r}, celsius, nil, true)[0]
+	if _, ok := d["native"]; ok {
+		t.Errorf("native in the average %v", d)
+	}
+	st := d["stations"].([]map[string]interface{})[0]
+	if native, _ := st["native"].(map[string]interface{}); native["value"] != 11.0 || native["unit"] != celsius {
+		t.Errorf("station %v, want its native 11°C", st)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// weatherVersions are the response shapes served under /<version>/weather/.
+var weatherVersions = map[string]weatherRenderer{
+	"v1": weatherV1,
+	"v2": weatherV2,
+}
+
+// v1 is frozen at the original {city, temp, took} response.
+func weatherV1(res weatherResult) interface{} {
+	return map[string]interface{}{
+		"city": res.city,
+		"temp": res.unit.fromCelsius(res.agg.celsius),
+		"took": time.Since(res.begin).String(),
+	}
+}
+
+// v2 adds the providers that contributed and always includes warnings.
+func weatherV2(res weatherResult) interface{} {
+	resp := res.fields()
+	sources := make([]string, 0, len(res.agg.readings))
+	for _, r := range res.agg.readings {
+		sources = append(sources, r.provider)
+	}
+	resp["sources"] = sources
+	if res.agg.warnings == nil {
+		resp["warnings"] = []string{}
+	}
+	return resp
+}
+
+// handleVersions mounts each version's routes under its path prefix.
+func (s *server) handleVersions(mux *http.ServeMux) {
+	for version, render := range weatherVersions {
+		render := render
+		routes := http.NewServeMux()
+		routes.HandleFunc("/weather/", func(w http.ResponseWriter, r *http.Request) {
+			s.serveWeather(w, r, render)
+		})
+		var h http.Handler = http.StripPrefix("/"+version, routes)
+		if version == "v1" {
+			h = withoutEnvelope(h)
+		}
+		mux.Handle("/"+version+"/", h)
+	}
+}
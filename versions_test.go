@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func serveVersioned(s *server, target string) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	s.handleVersions(mux)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+	return w
+}
+
+func keys(m map[string]interface{}) []string {
+	ks := make([]string, 0, len(m))
+	for k := range m {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	return ks
+}
+
+func TestWeatherV1(t *testing.T) {
+	p := newFake("fake", 10)
+	p.reading.condition = "Rain"
+	s := newTestServer(p)
+
+	w := serveVersioned(s, "/v1/weather/London")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	body := decode(t, w)
+	if got, want := keys(body), []string{"city", "temp", "took"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("v1 keys %v, want %v", got, want)
+	}
+	if body["city"] != "London" || body["temp"] != 10.0 {
+		t.Errorf("got %v", body)
+	}
+}
+
+func TestWeatherV2(t *testing.T) {
+	p := newFake("fake", 10)
+	p.reading.condition = "Rain"
+	s := newTestServer(p)
+
+	body := decode(t, serveVersioned(s, "/v2/weather/London"))
+	if body["condition"] != "rain" || body["temp"] != 10.0 {
+		t.Errorf("got %v", body)
+	}
+	if got := body["sources"]; !reflect.DeepEqual(got, []interface{}{"fake"}) {
+		t.Errorf("sources %v, want [fake]", got)
+	}
+	if got, ok := body["warnings"].([]interface{}); !ok || len(got) != 0 {
+		t.Errorf("warnings %v, want an empty list", body["warnings"])
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+type visualCrossing struct {
+	apiKey string
+	header http.Header
+	query  url.Values
+}
+
+func newVisualCrossing(pc providerConfig, env providerEnv) (weatherProvider, error) {
+	if pc.ApiKey == "" {
+		return nil, errors.New("visualcrossing: apiKey is required")
+	}
+	return visualCrossing{apiKey: pc.ApiKey, header: pc.header(), query: pc.query()}, nil
+}
+
+func (w visualCrossing) name() string { return "visualCrossing" }
+
+func (w visualCrossing) origins() []string { return []string{"https://weather.visualcrossing.com"} }
+
+func (w visualCrossing) temperature(ctx context.Context, city string) (reading, error) {
+	begin := time.Now()
+	r, err := w.fetch(ctx, city)
+	if err != nil {
+		return reading{}, err
+	}
+	logReading(ctx, "visualCrossing: %s: %.2f; took %s", city, r.celsius, time.Since(begin).String())
+	return r, nil
+}
+
+func (w visualCrossing) temperatureAt(ctx context.Context, p point) (reading, error) {
+	return w.fetch(ctx, p.String())
+}
+
+func (w visualCrossing) fetch(ctx context.Context, location string) (reading, error) {
+	var d struct {
+		Current *struct {
+			Celsius       float64  `json:"temp"`
+			FeelsLike     *float64 `json:"feelslike"`
+			Conditions    string   `json:"conditions"`
+			Icon          string   `json:"icon"`
+			DatetimeEpoch int64    `json:"datetimeEpoch"`
+			WindSpeed     *float64 `json:"windspeed"` // km/h
+			WindDir       *float64 `json:"winddir"`
+			Pressure      *float64 `json:"pressure"`
+			UVIndex       *float64 `json:"uvindex"`
+			PrecipProb    *float64 `json:"precipprob"` // percent
+			CloudCover    *float64 `json:"cloudcover"` // percent
+			SunriseEpoch  int64    `json:"sunriseEpoch"`
+			SunsetEpoch   int64    `json:"sunsetEpoch"`
+		} `json:"currentConditions"`
+		TZOffset        float64 `json:"tzoffset"` // hours east of UTC
+		ResolvedAddress string  `json:"resolvedAddress"`
+	}
+
+	if err := getJSONWith(ctx, "https://weather.visualcrossing.com/VisualCrossingWebServices/rest/services/timeline/"+url.PathEscape(location)+"?unitGroup=metric&include=current&contentType=json&key="+w.apiKey, w.header, w.query, &d); err != nil {
+		return reading{}, err
+	}
+	if d.Current == nil {
+		return reading{}, errors.New("visualCrossing: no current conditions for " + location)
+	}
+
+	r := reading{place: d.ResolvedAddress, celsius: d.Current.Celsius, native: nativeTemp{d.Current.Celsius, celsius}, condition: d.Current.Conditions, icon: darkSkyIcon(d.Current.Icon), feelsLike: d.Current.FeelsLike, windBearing: d.Current.WindDir, pressure: d.Current.Pressure, uvIndex: d.Current.UVIndex, cloudCover: d.Current.CloudCover}
+	if kph := d.Current.WindSpeed; kph != nil {
+		speed := *kph / 3.6
+		r.windSpeed = &speed
+	}
+	if p := d.Current.PrecipProb; p != nil {
+		prob := *p / 100
+		r.precipProbability = &prob
+	}
+	if d.Current.SunriseEpoch > 0 && d.Current.SunsetEpoch > 0 {
+		zone := time.FixedZone("", int(d.TZOffset*3600))
+		r.sunrise, r.sunset = time.Unix(d.Current.SunriseEpoch, 0).In(zone), time.Unix(d.Current.SunsetEpoch, 0).In(zone)
+	}
+	if d.Current.DatetimeEpoch > 0 {
+		r.observed = time.Unix(d.Current.DatetimeEpoch, 0)
+	}
+	return r, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestVisualCrossing(t *testing.T) {
+	stubUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host != "weather.visualcrossing.com" || r.URL.Query().Get("key") != "KEY" || r.URL.Query().Get("unitGroup") != "metric" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		switch r.URL.Path {
+		case "/VisualCrossingWebServices/rest/services/timeline/London":
+			w.Write([]byte(`{"resolvedAddress":"London, England, United Kingdom","tzoffset":1,
+				"currentConditions":{"temp":12.5,"feelslike":11,"conditions":"Partially cloudy","icon":"partly-cloudy-day",
+				"datetimeEpoch":1700000000,"windspeed":36,"winddir":270,"precipprob":40,"cloudcover":55,
+				"sunriseEpoch":1699990000,"sunsetEpoch":1700020000}}`))
+		default:
+			w.Write([]byte(`{"resolvedAddress":"Nowhere"}`))
+		}
+	}))
+	p, err := newProvider(providerConfig{Type: "visualcrossing", ApiKey: "KEY"}, providerEnv{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := p.temperature(context.Background(), "London")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.celsius != 12.5 || *r.feelsLike != 11 || r.condition != "Partially cloudy" || r.place != "London, England, United Kingdom" {
+		t.Errorf("got %+v", r)
+	}
+	if !r.observed.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("observed %s", r.observed)
+	}
+	if *r.windSpeed != 10 || *r.windBearing != 270 {
+		t.Errorf("wind %v m/s from %v°, want 10 from 270", *r.windSpeed, *r.windBearing)
+	}
+	if *r.precipProbability != 0.4 || *r.cloudCover != 55 {
+		t.Errorf("precipitation %v, cloud cover %v", *r.precipProbability, *r.cloudCover)
+	}
+	if _, offset := r.sunrise.Zone(); offset != 3600 || r.sunrise.Unix() != 1699990000 {
+		t.Errorf("sunrise %s", r.sunrise)
+	}
+
+	if _, err := p.temperature(context.Background(), "Nowhere"); err == nil {
+		t.Error("no current conditions, but no error")
+	}
+}
+
+func TestVisualCrossingRequiresKey(t *testing.T) {
+	if _, err := newProvider(providerConfig{Type: "visualcrossing"}, providerEnv{}); err == nil {
+		t.Error("no error without an apiKey")
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// warmClient is the worker pool client the cache warmer's lookups count
+// against.
+const warmClient = "cache warmer"
+
+// warm refreshes cities into the cache every interval, so requests for
+// them are answered from the cache. Lookups go through the worker pool
+// like batches do. It returns when ctx is done.
+func (s *server) warm(ctx context.Context, cities []string, interval time.Duration) {
+	if len(cities) == 0 || interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, city := range cities {
+			release, err := s.pool.acquire(ctx, warmClient)
+			if err != nil {
+				return
+			}
+			go func(city string) {
+				defer release()
+				if _, err := s.refresh(ctx, cacheKey{city: city, aggregation: s.mw.aggregation}); err != nil {
+					log.Printf("cache warmer: %s: %s", city, err)
+				}
+			}(city)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
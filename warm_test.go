@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingCache is a memoryCache that counts what is stored in it.
+type recordingCache struct {
+	*memoryCache
+	mu   sync.Mutex
+	sets map[string]int
+}
+
+func (c *recordingCache) set(key string, agg aggregate, ttl time.Duration, origin cacheOrigin) {
+	c.mu.Lock()
+	c.sets[key]++
+	c.mu.Unlock()
+	c.memoryCache.set(key, agg, ttl, origin)
+}
+
+func (c *recordingCache) count(key string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sets[key]
+}
+
+func TestWarm(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		order   []string
+		running maxCounter
+	)
+	p := newFake("a", 10)
+	p.delay = 5 * time.Millisecond
+	s := newTestServer(orderedProvider{p, &mu, &order, &running})
+	c := &recordingCache{memoryCache: newMemoryCache(0), sets: make(map[string]int)}
+	s.cache = c
+	s.pool = newWorkerPool(1, 1)
+
+	cities := []string{"London", "Paris", "Oslo"}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.warm(ctx, cities, 30*time.Millisecond)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for _, city := range cities {
+		key := cacheKey{city: city, aggregation: s.mw.aggregation}.String()
+		for c.count(key) < 2 {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s refreshed %d times, want at least twice", city, c.count(key))
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		if e, ok := c.get(key); !ok || e.agg.celsius != 10 {
+			t.Errorf("%s: cached %+v", city, e)
+		}
+	}
+	if running.max.Load() != 1 {
+		t.Errorf("up to %d refreshes at once, want the pool's cap of 1", running.max.Load())
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("warmer still running after its context ended")
+	}
+}
+
+func TestWarmNothing(t *testing.T) {
+	s := newTestServer(newFake("a", 10))
+	done := make(chan struct{})
+	go func() {
+		s.warm(context.Background(), nil, time.Millisecond)
+		s.warm(context.Background(), []string{"London"}, 0)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("warmer with nothing to do didn't return")
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// freshHalfLife is the age at which freshAggregation counts a reading
+// half as much as one observed now.
+var freshHalfLife = 10 * time.Minute
+
+// providerWeights decides how much each provider's reading counts towards
+// the mean. Each provider has a configured base weight, scaled by a health
+// factor that decays while it keeps failing and recovers as it succeeds, so
+// flaky providers count for less without being cut off.
+type providerWeights struct {
+	base map[string]float64 // by provider name; 1 if absent
+
+	// decay multiplies a provider's factor on each failure and recovery is
+	// added to it on each success, up to 1. The factor never falls below
+	// floor. A zero decay disables adaptation.
+	decay, recovery, floor float64
+	// min and max bound every weight, whatever its base and factor, so no
+	// provider is silenced or dominates. A zero max means no ceiling.
+	min, max float64
+
+	mu     sync.Mutex
+	factor map[string]float64 // 1 if absent
+}
+
+func newProviderWeights(base map[string]float64, decay, recovery, floor, min, max float64) *providerWeights {
+	return &providerWeights{base: base, decay: decay, recovery: recovery, floor: floor, min: min, max: max, factor: make(map[string]float64)}
+}
+
+// weight returns provider's current weight, 1 for every provider if pw is
+// nil.
+func (pw *providerWeights) weight(provider string) float64 {
+	if pw == nil {
+		return 1
+	}
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	return pw.clamp(pw.baseOf(provider) * pw.factorOf(provider))
+}
+
+func (pw *providerWeights) clamp(w float64) float64 {
+	w = math.Max(w, pw.min)
+	if pw.max > 0 {
+		w = math.Min(w, pw.max)
+	}
+	return w
+}
+
+func (pw *providerWeights) baseOf(provider string) float64 {
+	if b, ok := pw.base[provider]; ok {
+		return b
+	}
+	return 1
+}
+
+func (pw *providerWeights) factorOf(provider string) float64 {
+	if f, ok := pw.factor[provider]; ok {
+		return f
+	}
+	return 1
+}
+
+// record adapts provider's factor to the outcome of a call.
+func (pw *providerWeights) record(provider string, err error) {
+	if pw == nil || pw.decay <= 0 {
+		return
+	}
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	f := pw.factorOf(provider)
+	if err != nil {
+		f = math.Max(f*pw.decay, pw.floor)
+	} else {
+		f = math.Min(f+pw.recovery, 1)
+	}
+	// Keep the factor where the clamped weight is still moving, so a
+	// provider pinned at a bound responds at once when its luck turns.
+	if b := pw.baseOf(provider); b > 0 {
+		f = math.Max(f, pw.min/b)
+		if pw.max > 0 {
+			f = math.Min(f, pw.max/b)
+		}
+	}
+	pw.factor[provider] = f
+}
+
+// mean is the weighted mean of the readings' temperatures. With trim, the
+// highest and lowest readings are dropped first if there are at least
+// three.
+func (pw *providerWeights) mean(readings []reading, trim bool) float64 {
+	if trim && len(readings) >= 3 {
+		readings = append([]reading(nil), readings...)
+		sort.Slice(readings, func(i, j int) bool { return readings[i].celsius < readings[j].celsius })
+		readings = readings[1 : len(readings)-1]
+	}
+	var sum, total float64
+	for _, r := range readings {
+		w := pw.weight(r.provider)
+		sum += w * r.celsius
+		total += w
+	}
+	if total == 0 {
+		for _, r := range readings {
+			sum += r.celsius
+		}
+		return sum / float64(len(readings))
+	}
+	return sum / total
+}
+
+// shares is how much each reading counts towards mean's result, in
+// order, together making 1. Readings trim drops count for nothing.
+func (pw *providerWeights) shares(readings []reading, trim bool) []float64 {
+	shares := make([]float64, len(readings))
+	kept := make([]int, len(readings))
+	for i := range kept {
+		kept[i] = i
+	}
+	if trim && len(readings) >= 3 {
+		sort.SliceStable(kept, func(i, j int) bool { return readings[kept[i]].celsius < readings[kept[j]].celsius })
+		kept = kept[1 : len(kept)-1]
+	}
+	var total float64
+	for _, i := range kept {
+		shares[i] = pw.weight(readings[i].provider)
+		total += shares[i]
+	}
+	for _, i := range kept {
+		if total == 0 {
+			shares[i] = 1 / float64(len(kept))
+		} else {
+			shares[i] /= total
+		}
+	}
+	return shares
+}
+
+// freshShares is how much each reading counts towards freshAggregation's
+// mean as of now, in order, together making 1: its weight, halved for
+// every halfLife since it was observed. Readings that don't say when they
+// were observed count as old as the stalest that do, or all as new if
+// none do, so leaving the time out earns no advantage.
+func (pw *providerWeights) freshShares(readings []reading, halfLife time.Duration, now time.Time) []float64 {
+	var stalest time.Duration
+	for _, r := range readings {
+		if !r.observed.IsZero() {
+			stalest = max(stalest, now.Sub(r.observed))
+		}
+	}
+	shares := make([]float64, len(readings))
+	var total float64
+	for i, r := range readings {
+		age := stalest
+		if !r.observed.IsZero() {
+			age = max(now.Sub(r.observed), 0)
+		}
+		shares[i] = pw.weight(r.provider) * math.Pow(0.5, age.Seconds()/halfLife.Seconds())
+		total += shares[i]
+	}
+	for i := range shares {
+		if total == 0 {
+			shares[i] = 1 / float64(len(shares))
+		} else {
+			shares[i] /= total
+		}
+	}
+	return shares
+}
+
+// scheme names how pw weights the mean: "equal" if it is nil,
+// "adaptive" if weights follow providers' failures, and "configured"
+// otherwise.
+func (pw *providerWeights) scheme() string {
+	switch {
+	case pw == nil:
+		return "equal"
+	case pw.decay > 0:
+		return "adaptive"
+	}
+	return "configured"
+}
+
+// health is provider's health factor, from decay and recovery; 1 if pw is
+// nil.
+func (pw *providerWeights) health(provider string) float64 {
+	if pw == nil {
+		return 1
+	}
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	return pw.factorOf(provider)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAdaptiveWeightTrajectory(t *testing.T) {
+	pw := newProviderWeights(nil, 0.5, 0.25, 0.1, 0, 0)
+	failed := errors.New("down")
+	for i, tt := range []struct {
+		err  error
+		want float64
+	}{
+		{failed, 0.5},
+		{failed, 0.25},
+		{failed, 0.125},
+		{failed, 0.1}, // the floor
+		{failed, 0.1},
+		{nil, 0.35},
+		{nil, 0.6},
+		{failed, 0.3},
+		{nil, 0.55},
+		{nil, 0.8},
+		{nil, 1},
+		{nil, 1}, // never above the base
+	} {
+		pw.record("flaky", tt.err)
+		if got := pw.weight("flaky"); !near(got, tt.want) {
+			t.Errorf("step %d: weight %v, want %v", i+1, got, tt.want)
+		}
+	}
+	if got := pw.weight("steady"); got != 1 {
+		t.Errorf("untouched provider: weight %v, want 1", got)
+	}
+}
+
+func TestAdaptiveWeightBounds(t *testing.T) {
+	pw := newProviderWeights(map[string]float64{"heavy": 4}, 0.5, 0.5, 0, 0.5, 3)
+	if got := pw.weight("heavy"); got != 3 {
+		t.Errorf("weight %v, want the max of 3", got)
+	}
+	for i := 0; i < 20; i++ {
+		pw.record("heavy", errors.New("down"))
+	}
+	if got := pw.weight("heavy"); got != 0.5 {
+		t.Errorf("after failing: weight %v, want the min of 0.5", got)
+	}
+	// Pinned at the min, one success lifts it straight away.
+	pw.record("heavy", nil)
+	if got := pw.weight("heavy"); !near(got, 2.5) {
+		t.Errorf("after one success: weight %v, want 2.5", got)
+	}
+}
+
+func TestAdaptiveWeightsDisabled(t *testing.T) {
+	pw := newProviderWeights(map[string]float64{"a": 2}, 0, 0.5, 0, 0, 0)
+	pw.record("a", errors.New("down"))
+	if got := pw.weight("a"); got != 2 {
+		t.Errorf("weight %v, want the base 2 without decay", got)
+	}
+	var none *providerWeights
+	none.record("a", errors.New("down"))
+	if got := none.weight("a"); got != 1 {
+		t.Errorf("nil weights: weight %v, want 1", got)
+	}
+}
+
+func TestAdaptiveWeightsConcurrent(t *testing.T) {
+	pw := newProviderWeights(nil, 0.9, 0.1, 0.1, 0, 0)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				pw.record("a", errors.New("down"))
+				pw.weight("a")
+			}
+		}()
+	}
+	wg.Wait()
+	if got := pw.weight("a"); got != 0.1 {
+		t.Errorf("weight %v after 800 failures, want the floor", got)
+	}
+}
+
+func TestAdaptiveWeightsInMean(t *testing.T) {
+	mw := newTestMW(newFake("a", 10), newFake("b", 20))
+	mw.weights = newProviderWeights(nil, 0.5, 0.1, 0, 0, 0)
+	mw.weights.record("b", errors.New("down"))
+	mw.weights.record("b", errors.New("down"))
+	// b's answer recovers it to 0.35 before the mean is taken.
+	agg, err := mw.aggregate(context.Background(), "London")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (10 + 0.35*20) / 1.35; !near(agg.celsius, want) {
+		t.Errorf("celsius %v, want %v", agg.celsius, want)
+	}
+	if got := mw.weights.weight("b"); !near(got, 0.35) {
+		t.Errorf("b's weight after answering %v, want 0.35", got)
+	}
+}
+
+func TestWeightBoundsSustained(t *testing.T) {
+	base := map[string]float64{"light": 0.2, "normal": 1, "heavy": 5}
+	pw := newProviderWeights(base, 0.5, 0.3, 0, 0.4, 2)
+	check := func(when string) {
+		t.Helper()
+		for name := range base {
+			if w := pw.weight(name); w < 0.4 || w > 2 {
+				t.Errorf("%s: %s's weight %v is outside [0.4, 2]", when, name, w)
+			}
+		}
+	}
+	check("at first")
+	for i := 0; i < 50; i++ {
+		for name := range base {
+			pw.record(name, errors.New("down"))
+		}
+		check("failing")
+	}
+	for name := range base {
+		if w := pw.weight(name); w != 0.4 {
+			t.Errorf("%s after sustained failure: weight %v, want the floor 0.4", name, w)
+		}
+	}
+	for i := 0; i < 50; i++ {
+		for name := range base {
+			pw.record(name, nil)
+		}
+		check("succeeding")
+	}
+	for name, want := range map[string]float64{"light": 0.4, "normal": 1, "heavy": 2} {
+		if w := pw.weight(name); !near(w, want) {
+			t.Errorf("%s after sustained success: weight %v, want %v", name, w, want)
+		}
+	}
+}
+
+func TestWeightBoundsConfig(t *testing.T) {
+	conf := config{Providers: []providerConfig{{Type: "openweathermap"}}}
+	conf.Weighting.MinWeight, conf.Weighting.MaxWeight = 0.5, 3
+	mw, err := getMultiWeatherProvider(conf, nil)
+	if err != nil || mw.weights == nil || mw.weights.min != 0.5 || mw.weights.max != 3 {
+		t.Fatalf("weights %+v, %v", mw.weights, err)
+	}
+	conf.Weighting.MinWeight = 4
+	if _, err := getMultiWeatherProvider(conf, nil); err == nil {
+		t.Error("no error for a minWeight above maxWeight")
+	}
+}
+
+func TestShares(t *testing.T) {
+	readings := []reading{{provider: "a", celsius: 10}, {provider: "heavy", celsius: 20}, {provider: "b", celsius: 40}}
+	pw := newProviderWeights(map[string]float64{"heavy": 2}, 0, 0, 0, 0, 0)
+	for _, tt := range []struct {
+		name string
+		pw   *providerWeights
+		trim bool
+		want []float64
+	}{
+		{"equal", nil, false, []float64{1.0 / 3, 1.0 / 3, 1.0 / 3}},
+		{"configured", pw, false, []float64{0.25, 0.5, 0.25}},
+		{"trimmed", pw, true, []float64{0, 1, 0}},
+	} {
+		got := tt.pw.shares(readings, tt.trim)
+		for i := range got {
+			if !near(got[i], tt.want[i]) {
+				t.Errorf("%s: shares %v, want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+	// Too few readings to trim share the mean.
+	if got := pw.shares(readings[:2], true); !near(got[0], 1.0/3) || !near(got[1], 2.0/3) {
+		t.Errorf("two readings trimmed: shares %v, want neither dropped", got)
+	}
+}
+
+func TestFreshShares(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	ago := func(d time.Duration) reading { return reading{provider: "p", observed: now.Add(-d)} }
+	for _, tt := range []struct {
+		name     string
+		pw       *providerWeights
+		readings []reading
+		want     []float64
+	}{
+		{"halved per half-life", nil, []reading{ago(0), ago(10 * time.Minute), ago(20 * time.Minute)}, []float64{4.0 / 7, 2.0 / 7, 1.0 / 7}},
+		{"untimed as the stalest", nil, []reading{ago(0), ago(10 * time.Minute), {provider: "p"}}, []float64{0.5, 0.25, 0.25}},
+		{"none timed", nil, []reading{{provider: "p"}, {provider: "p"}}, []float64{0.5, 0.5}},
+		{"future as now", nil, []reading{ago(-time.Hour), ago(0)}, []float64{0.5, 0.5}},
+		{"base weights", newProviderWeights(map[string]float64{"heavy": 2}, 0, 0, 0, 0, 0),
+			[]reading{{provider: "heavy", observed: now.Add(-10 * time.Minute)}, ago(0)}, []float64{0.5, 0.5}},
+	} {
+		got := tt.pw.freshShares(tt.readings, 10*time.Minute, now)
+		for i := range got {
+			if !near(got[i], tt.want[i]) {
+				t.Errorf("%s: shares %v, want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+}